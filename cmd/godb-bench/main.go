@@ -0,0 +1,141 @@
+// godb-bench is a load generator for the KV store.
+// it runs one workload against a database file and reports the
+// throughput and the latency percentiles.
+//
+//	godb-bench -workload mixed -ops 10000 -keys 10000 -value 16
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"db/db"
+)
+
+var (
+	path      = flag.String("path", "", "database file, a temporary one if empty")
+	workload  = flag.String("workload", "mixed", "seq, rand, read, scan or mixed")
+	ops       = flag.Int("ops", 10000, "number of operations")
+	keys      = flag.Int("keys", 10000, "number of distinct keys")
+	valueSize = flag.Int("value", 16, "value size in bytes")
+	readRatio = flag.Float64("reads", 0.9, "fraction of reads in the mixed workload")
+	cacheSize = flag.Int("cache", 0, "page cache size in pages")
+	memtable  = flag.Int("memtable", 0, "write buffer size in bytes, 0 commits every update")
+	direct    = flag.Bool("direct", false, "bypass the OS page cache (O_DIRECT)")
+	noMmap    = flag.Bool("nommap", false, "read the pages with pread instead of the mmap")
+	seed      = flag.Int64("seed", 1, "random seed")
+)
+
+func main() {
+	flag.Parse()
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "godb-bench:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	if *ops <= 0 || *keys <= 0 {
+		return fmt.Errorf("-ops and -keys must be positive")
+	}
+	if *path == "" {
+		dir, err := os.MkdirTemp("", "godb-bench")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		*path = filepath.Join(dir, "bench.db")
+	}
+	opts := []db.Option{db.WithCacheSize(*cacheSize), db.WithMemtable(*memtable)}
+	if *direct {
+		opts = append(opts, db.WithDirectIO())
+	}
+	if *noMmap {
+		opts = append(opts, db.WithNoMmap())
+	}
+	kv, err := db.Open(*path, opts...)
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	rng := rand.New(rand.NewSource(*seed))
+	val := make([]byte, *valueSize)
+	rng.Read(val)
+
+	var op func(i int) error
+	switch *workload {
+	case "seq":
+		op = func(i int) error {
+			return kv.Set(key(i%*keys), val)
+		}
+	case "rand":
+		op = func(i int) error {
+			return kv.Set(key(rng.Intn(*keys)), val)
+		}
+	case "read":
+		op = func(i int) error {
+			_, ok, err := kv.Get(key(rng.Intn(*keys)))
+			if err == nil && !ok {
+				err = fmt.Errorf("key not found")
+			}
+			return err
+		}
+	case "scan":
+		op = func(i int) error {
+			return kv.Scan(nil, func(k, v []byte) bool { return true })
+		}
+	case "mixed":
+		op = func(i int) error {
+			k := key(rng.Intn(*keys))
+			if rng.Float64() < *readRatio {
+				_, _, err := kv.Get(k)
+				return err
+			}
+			return kv.Set(k, val)
+		}
+	default:
+		return fmt.Errorf("unknown workload %q", *workload)
+	}
+
+	// the read workloads need data
+	if *workload == "read" || *workload == "scan" || *workload == "mixed" {
+		for i := 0; i < *keys; i++ {
+			if err := kv.Set(key(i), val); err != nil {
+				return err
+			}
+		}
+	}
+
+	latencies := make([]time.Duration, *ops)
+	start := time.Now()
+	for i := range latencies {
+		t := time.Now()
+		if err := op(i); err != nil {
+			return err
+		}
+		latencies[i] = time.Since(t)
+	}
+	report(time.Since(start), latencies)
+	return nil
+}
+
+func key(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+func report(elapsed time.Duration, latencies []time.Duration) {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	pct := func(p float64) time.Duration {
+		return latencies[int(p*float64(len(latencies)-1))]
+	}
+	fmt.Printf("workload=%s ops=%d keys=%d value=%dB\n", *workload, len(latencies), *keys, *valueSize)
+	fmt.Printf("throughput: %.1f ops/s\n", float64(len(latencies))/elapsed.Seconds())
+	fmt.Printf("latency: p50=%v p90=%v p99=%v max=%v\n",
+		pct(0.50), pct(0.90), pct(0.99), latencies[len(latencies)-1])
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+
+	"db/db"
+)
+
+// a reader of bbolt files, to import them without the dependency. only
+// what a read needs: the meta pages, the branch and leaf pages, and the
+// buckets, inline or not. the numbers are little-endian.
+//
+// a page starts with
+// | id | flags | count | overflow |
+// | 8B | 2B    | 2B    | 4B       |
+// followed by count elements, then their keys and values. a leaf element:
+// | flags | pos | ksize | vsize |
+// | 4B    | 4B  | 4B    | 4B    |
+// a branch element:
+// | pos | ksize | pgid |
+// | 4B  | 4B    | 8B   |
+// with pos from the element to its key. a bucket value is its root page
+// and its sequence, the root is 0 for an inline bucket whose page follows.
+const (
+	BOLT_MAGIC       = 0xED0CDAED
+	BOLT_PAGE_HEADER = 16
+	BOLT_ELEMENT     = 16
+	BOLT_BUCKET      = 16
+
+	BOLT_BRANCH = 0x01
+	BOLT_LEAF   = 0x02
+	BOLT_META   = 0x04
+
+	BOLT_BUCKET_LEAF = 0x01 // leaf element flag
+)
+
+type boltFile struct {
+	fp       *os.File
+	pageSize int
+	root     uint64 // of the root bucket
+}
+
+func openBolt(path string) (*boltFile, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	b := &boltFile{fp: fp}
+	if err := b.loadMeta(); err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return b, nil
+}
+
+// the valid meta page with the latest transaction, of the 2 first pages.
+func (b *boltFile) loadMeta() error {
+	var txid uint64
+	found := false
+	// the page size is in the meta, the first one is at 0
+	buf := make([]byte, 4096)
+	n, err := b.fp.ReadAt(buf, 0)
+	if n < BOLT_PAGE_HEADER+64 {
+		return fmt.Errorf("not a bolt file: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		meta := buf[BOLT_PAGE_HEADER:]
+		if binary.LittleEndian.Uint16(buf[8:]) == BOLT_META && boltMetaOK(meta) {
+			if t := binary.LittleEndian.Uint64(meta[48:]); !found || t > txid {
+				txid, found = t, true
+				b.pageSize = int(binary.LittleEndian.Uint32(meta[8:]))
+				b.root = binary.LittleEndian.Uint64(meta[16:])
+			}
+		}
+		if i == 0 {
+			size := int(binary.LittleEndian.Uint32(meta[8:]))
+			if size < BOLT_PAGE_HEADER+64 || size > 1<<20 {
+				size = 4096 // a bad first meta, try the usual size
+			}
+			if _, err := b.fp.ReadAt(buf[:cap(buf)], int64(size)); err != nil && !found {
+				return fmt.Errorf("read meta: %w", err)
+			}
+		}
+	}
+	if !found {
+		return errors.New("not a bolt file or no valid meta page")
+	}
+	return nil
+}
+
+// | magic | version | pageSize | flags | root | sequence | freelist | pgid | txid | checksum |
+// | 4B    | 4B      | 4B       | 4B    | 8B   | 8B       | 8B       | 8B   | 8B   | 8B       |
+// the checksum is the FNV-1a of the fields before it.
+func boltMetaOK(meta []byte) bool {
+	if binary.LittleEndian.Uint32(meta) != BOLT_MAGIC || binary.LittleEndian.Uint32(meta[4:]) != 2 {
+		return false
+	}
+	h := fnv.New64a()
+	h.Write(meta[:56])
+	return h.Sum64() == binary.LittleEndian.Uint64(meta[56:])
+}
+
+// a page with its overflow pages.
+func (b *boltFile) page(pgid uint64) ([]byte, error) {
+	head := make([]byte, BOLT_PAGE_HEADER)
+	if _, err := b.fp.ReadAt(head, int64(pgid)*int64(b.pageSize)); err != nil {
+		return nil, fmt.Errorf("read page %d: %w", pgid, err)
+	}
+	overflow := binary.LittleEndian.Uint32(head[12:])
+	page := make([]byte, (int(overflow)+1)*b.pageSize)
+	if _, err := b.fp.ReadAt(page, int64(pgid)*int64(b.pageSize)); err != nil {
+		return nil, fmt.Errorf("read page %d: %w", pgid, err)
+	}
+	return page, nil
+}
+
+// call fn on the leaf elements of a bucket in key order.
+func (b *boltFile) walk(bucket []byte, fn func(flags uint32, key, val []byte) error) error {
+	if len(bucket) < BOLT_BUCKET {
+		return errors.New("bad bucket value")
+	}
+	root := binary.LittleEndian.Uint64(bucket)
+	if root == 0 {
+		return b.walkPage(bucket[BOLT_BUCKET:], fn)
+	}
+	return b.walkPgid(root, fn)
+}
+
+func (b *boltFile) walkPgid(pgid uint64, fn func(flags uint32, key, val []byte) error) error {
+	page, err := b.page(pgid)
+	if err != nil {
+		return err
+	}
+	return b.walkPage(page, fn)
+}
+
+func (b *boltFile) walkPage(page []byte, fn func(flags uint32, key, val []byte) error) error {
+	if len(page) < BOLT_PAGE_HEADER {
+		return errors.New("bad page")
+	}
+	flags := binary.LittleEndian.Uint16(page[8:])
+	count := int(binary.LittleEndian.Uint16(page[10:]))
+	if BOLT_PAGE_HEADER+count*BOLT_ELEMENT > len(page) {
+		return fmt.Errorf("bad page %d", binary.LittleEndian.Uint64(page))
+	}
+	for i := 0; i < count; i++ {
+		off := BOLT_PAGE_HEADER + i*BOLT_ELEMENT
+		elem := page[off : off+BOLT_ELEMENT]
+		switch flags {
+		case BOLT_BRANCH:
+			if err := b.walkPgid(binary.LittleEndian.Uint64(elem[8:]), fn); err != nil {
+				return err
+			}
+		case BOLT_LEAF:
+			pos := off + int(binary.LittleEndian.Uint32(elem[4:]))
+			ksize := int(binary.LittleEndian.Uint32(elem[8:]))
+			vsize := int(binary.LittleEndian.Uint32(elem[12:]))
+			if pos+ksize+vsize > len(page) {
+				return fmt.Errorf("bad element in page %d", binary.LittleEndian.Uint64(page))
+			}
+			key := page[pos : pos+ksize]
+			val := page[pos+ksize : pos+ksize+vsize]
+			if err := fn(binary.LittleEndian.Uint32(elem), key, val); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("page %d is not a branch or a leaf", binary.LittleEndian.Uint64(page))
+		}
+	}
+	return nil
+}
+
+// the keys of a bucket go to path/key with the default separator, the
+// ones of its nested buckets to path/nested/key.
+func (b *boltFile) load(l *db.Loader, bucket []byte, path []string, sep string) (n int, err error) {
+	err = b.walk(bucket, func(flags uint32, key, val []byte) error {
+		name := append(path[:len(path):len(path)], string(key))
+		if flags&BOLT_BUCKET_LEAF != 0 {
+			m, err := b.load(l, val, name, sep)
+			n += m
+			return err
+		}
+		if len(path) == 0 {
+			return fmt.Errorf("key %q out of a bucket", key)
+		}
+		if err := l.Set([]byte(strings.Join(name, sep)), val); err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(name, sep), err)
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+func runImportBolt(args []string) error {
+	fs := flag.NewFlagSet("import-bolt", flag.ExitOnError)
+	sep := fs.String("sep", "/", "the separator of the bucket names and the keys")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		return fmt.Errorf("usage: godb import-bolt [-sep /] <src.db> <dst>")
+	}
+	src, err := openBolt(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer src.fp.Close()
+	kv, err := openKV(fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	l, err := kv.NewLoader()
+	if err != nil {
+		return err
+	}
+	root := binary.LittleEndian.AppendUint64(nil, src.root)
+	n, err := src.load(l, append(root, make([]byte, 8)...), nil, *sep)
+	if cerr := l.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("keys: %d\n", n)
+	return nil
+}
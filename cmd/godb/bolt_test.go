@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+
+	"db/db"
+)
+
+type boltTestElem struct {
+	flags    uint32
+	key, val string
+	pgid     uint64 // of a branch
+}
+
+// a page in the bbolt format, see bolt.go.
+func boltTestPage(id uint64, flags uint16, elems []boltTestElem) []byte {
+	page := binary.LittleEndian.AppendUint64(nil, id)
+	page = binary.LittleEndian.AppendUint16(page, flags)
+	page = binary.LittleEndian.AppendUint16(page, uint16(len(elems)))
+	page = binary.LittleEndian.AppendUint32(page, 0) // overflow, set below
+	data := BOLT_PAGE_HEADER + len(elems)*BOLT_ELEMENT
+	var tail []byte
+	for i, e := range elems {
+		pos := uint32(data + len(tail) - (BOLT_PAGE_HEADER + i*BOLT_ELEMENT))
+		if flags == BOLT_BRANCH {
+			page = binary.LittleEndian.AppendUint32(page, pos)
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(e.key)))
+			page = binary.LittleEndian.AppendUint64(page, e.pgid)
+		} else {
+			page = binary.LittleEndian.AppendUint32(page, e.flags)
+			page = binary.LittleEndian.AppendUint32(page, pos)
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(e.key)))
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(e.val)))
+		}
+		tail = append(append(tail, e.key...), e.val...)
+	}
+	return append(page, tail...)
+}
+
+func boltTestMeta(id, root, txid uint64, bad bool) []byte {
+	meta := binary.LittleEndian.AppendUint32(nil, BOLT_MAGIC)
+	meta = binary.LittleEndian.AppendUint32(meta, 2)
+	meta = binary.LittleEndian.AppendUint32(meta, 4096)
+	meta = binary.LittleEndian.AppendUint32(meta, 0)
+	for _, v := range []uint64{root, 0, 2, 7, txid} {
+		meta = binary.LittleEndian.AppendUint64(meta, v)
+	}
+	h := fnv.New64a()
+	h.Write(meta)
+	sum := h.Sum64()
+	if bad {
+		sum++
+	}
+	meta = binary.LittleEndian.AppendUint64(meta, sum)
+	page := binary.LittleEndian.AppendUint64(nil, id)
+	page = binary.LittleEndian.AppendUint16(page, BOLT_META)
+	page = append(page, make([]byte, 6)...)
+	return append(page, meta...)
+}
+
+func TestImportBolt(t *testing.T) {
+	// the bucket header of a root page, inline if it's 0
+	bucket := func(root uint64, inline []byte) string {
+		return string(binary.LittleEndian.AppendUint64(make([]byte, 0, BOLT_BUCKET), root)) +
+			string(make([]byte, 8)) + string(inline)
+	}
+	admins := boltTestPage(0, BOLT_LEAF, []boltTestElem{{key: "carol", val: "3"}})
+	users := boltTestPage(0, BOLT_LEAF, []boltTestElem{
+		{flags: BOLT_BUCKET_LEAF, key: "admins", val: bucket(0, admins)},
+		{key: "alice", val: "1"},
+		{key: "bob", val: "2"},
+	})
+	big := strings.Repeat("v", 2500)
+	pages := [][]byte{
+		boltTestMeta(0, 3, 1, false),
+		boltTestMeta(1, 99, 2, true), // the later one is torn
+		nil,                          // the freelist
+		boltTestPage(3, BOLT_LEAF, []boltTestElem{
+			{flags: BOLT_BUCKET_LEAF, key: "logs", val: bucket(4, nil)},
+			{flags: BOLT_BUCKET_LEAF, key: "users", val: bucket(0, users)},
+		}),
+		boltTestPage(4, BOLT_BRANCH, []boltTestElem{{key: "a", pgid: 5}, {key: "b", pgid: 6}}),
+		boltTestPage(5, BOLT_LEAF, []boltTestElem{{key: "a", val: "x"}}),
+		// with an overflow page
+		boltTestPage(6, BOLT_LEAF, []boltTestElem{{key: "b", val: big}, {key: "c", val: big}}),
+	}
+	binary.LittleEndian.PutUint32(pages[6][12:], 1)
+	var file []byte
+	for _, page := range pages {
+		file = append(file, page...)
+		file = append(file, make([]byte, 4096-len(page)%4096)...)
+	}
+	dir := t.TempDir()
+	src := filepath.Join(dir, "bolt.db")
+	testify_assert.NoError(t, os.WriteFile(src, file, 0644))
+
+	dst := filepath.Join(dir, "test.db")
+	testify_assert.NoError(t, runImportBolt([]string{src, dst}))
+	kv, err := db.Open(dst)
+	testify_assert.NoError(t, err)
+	defer kv.Close()
+	got := map[string]string{}
+	testify_assert.NoError(t, kv.Scan(nil, func(key, val []byte) bool {
+		got[string(key)] = string(val)
+		return true
+	}))
+	testify_assert.Equal(t, map[string]string{
+		"logs/a": "x", "logs/b": big, "logs/c": big,
+		"users/admins/carol": "3", "users/alice": "1", "users/bob": "2",
+	}, got)
+
+	testify_assert.ErrorContains(t, runImportBolt([]string{dst, filepath.Join(dir, "x.db")}), "not a bolt file")
+}
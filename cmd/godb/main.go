@@ -0,0 +1,141 @@
+// godb is the command line tool for database files.
+//
+//	godb [flags] <file>                open an interactive shell
+//	godb [flags] inspect [-v] <file>   dump the pages of the tree
+//	godb [flags] check <file>          verify the tree
+//	godb [flags] repair <file> <new>   salvage a damaged file into a new one
+//	godb [flags] memcached [-addr host:port] <file>
+//	                                   serve the memcached text protocol
+//	godb [flags] import-bolt [-sep /] <src.db> <dst>
+//	                                   load the buckets of a bbolt file
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+
+	"db/db"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: godb [flags] <file>")
+	fmt.Fprintln(os.Stderr, "       godb [flags] inspect [-v] <file>")
+	fmt.Fprintln(os.Stderr, "       godb [flags] check <file>")
+	fmt.Fprintln(os.Stderr, "       godb [flags] repair <file> <new>")
+	fmt.Fprintln(os.Stderr, "       godb [flags] memcached [-addr host:port] <file>")
+	fmt.Fprintln(os.Stderr, "       godb [flags] import-bolt [-sep /] <src.db> <dst>")
+	flag.PrintDefaults()
+}
+
+var (
+	cacheSize = flag.Int("cache", 256, "page cache size in pages")
+	key       = flag.String("key", "", "encryption key of the database")
+)
+
+// subcommands take the arguments after their name
+var subcommands = map[string]func(args []string) error{
+	"inspect":     runInspect,
+	"check":       runCheck,
+	"repair":      runRepair,
+	"memcached":   runMemcached,
+	"import-bolt": runImportBolt,
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	var err error
+	switch {
+	case flag.NArg() >= 1 && subcommands[flag.Arg(0)] != nil:
+		err = subcommands[flag.Arg(0)](flag.Args()[1:])
+	case flag.NArg() == 1:
+		err = runShell(flag.Arg(0))
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "godb:", err)
+		os.Exit(1)
+	}
+}
+
+func openKV(path string, opts ...db.Option) (*db.KV, error) {
+	opts = append([]db.Option{db.WithCacheSize(*cacheSize), db.WithEncryptionKey([]byte(*key))}, opts...)
+	return db.Open(path, opts...)
+}
+
+// the file must exist.
+func openReadOnly(path string) (*db.KV, error) {
+	return openKV(path, db.WithReadOnly())
+}
+
+func runInspect(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	verbose := fs.Bool("v", false, "print every key of every node")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: godb inspect [-v] <file>")
+	}
+	kv, err := openReadOnly(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	return kv.Inspect(os.Stdout, *verbose)
+}
+
+func runCheck(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: godb check <file>")
+	}
+	kv, err := openReadOnly(args[0])
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	errs := kv.CheckContext(ctx)
+	for _, err := range errs {
+		fmt.Println(err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%d problems found", len(errs))
+	}
+	fmt.Println("ok")
+	return nil
+}
+
+// the new file is created with the same -key.
+func runRepair(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: godb repair <file> <new>")
+	}
+	if _, err := os.Stat(args[1]); err == nil {
+		return fmt.Errorf("%s already exists", args[1])
+	}
+	dst, err := openKV(args[1])
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	report, err := db.RepairContext(ctx, args[0], []byte(*key), dst)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("pages: %d, bad: %d, leaves salvaged: %d, keys: %d\n",
+		report.Pages, report.BadPages, report.GoodLeaves, report.Keys)
+	if report.MasterLost {
+		fmt.Println("the master page was lost")
+	}
+	if !report.TreeIntact {
+		fmt.Println("the tree was damaged, some values may be stale or deleted ones")
+	}
+	return nil
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"time"
+
+	"db/db"
+)
+
+// the memcached text protocol: get, set, delete and quit, enough for the
+// clients that use it as a cache. an item is stored under its key as
+// | flags | exptime | data |
+// | 4B    | 8B      | ...  |
+// with the expiration in unix seconds, 0 for never. the expired items
+// are misses, they're dropped when they're overwritten or deleted.
+const (
+	MC_HEADER   = 4 + 8
+	MC_MAX_KEY  = 250
+	MC_MAX_DATA = db.BTREE_MAX_VAL_SIZE - MC_HEADER
+	// a larger exptime is a unix time rather than seconds from now
+	MC_MAX_RELATIVE = 30 * 24 * 3600
+)
+
+func runMemcached(args []string) error {
+	fs := flag.NewFlagSet("memcached", flag.ExitOnError)
+	addr := fs.String("addr", "127.0.0.1:11211", "the address to listen on")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: godb memcached [-addr host:port] <file>")
+	}
+	kv, err := openKV(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+	w := kv.StartWriter()
+	defer w.Close()
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+	}()
+	fmt.Fprintln(os.Stderr, "listening on", ln.Addr())
+	err = (&memcached{w: w, now: time.Now}).serve(ln)
+	if ctx.Err() != nil {
+		return nil // interrupted
+	}
+	return err
+}
+
+type memcached struct {
+	w   *db.Writer
+	now func() time.Time
+}
+
+func (mc *memcached) serve(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			_ = mc.handle(conn)
+		}()
+	}
+}
+
+// the commands of a connection. the replies are flushed once the
+// pipelined commands are read.
+func (mc *memcached) handle(conn io.ReadWriter) error {
+	r := bufio.NewReader(conn)
+	out := bufio.NewWriter(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			fmt.Fprint(out, "ERROR\r\n")
+			continue
+		}
+		switch args[0] {
+		case "get":
+			err = mc.get(out, args[1:])
+		case "set":
+			err = mc.set(r, out, args[1:])
+		case "delete":
+			err = mc.delete(out, args[1:])
+		case "quit":
+			return out.Flush()
+		default:
+			fmt.Fprint(out, "ERROR\r\n")
+		}
+		if err != nil {
+			return err
+		}
+		if r.Buffered() == 0 {
+			if err := out.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (mc *memcached) get(out *bufio.Writer, keys []string) error {
+	if len(keys) == 0 {
+		fmt.Fprint(out, "ERROR\r\n")
+		return nil
+	}
+	err := mc.w.View(func(r *db.ReadTx) error {
+		for _, key := range keys {
+			val, ok, err := r.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			if !ok || len(val) < MC_HEADER || mcExpired(mc, val) {
+				continue
+			}
+			flags := binary.BigEndian.Uint32(val)
+			data := val[MC_HEADER:]
+			fmt.Fprintf(out, "VALUE %s %d %d\r\n%s\r\n", key, flags, len(data), data)
+		}
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(out, "SERVER_ERROR %v\r\n", err)
+		return nil
+	}
+	fmt.Fprint(out, "END\r\n")
+	return nil
+}
+
+// set <key> <flags> <exptime> <bytes> [noreply], then the data line.
+func (mc *memcached) set(r *bufio.Reader, out *bufio.Writer, args []string) error {
+	noreply := len(args) == 5 && args[4] == "noreply"
+	if len(args) != 4 && !noreply {
+		fmt.Fprint(out, "ERROR\r\n")
+		return nil
+	}
+	flags, err1 := strconv.ParseUint(args[1], 10, 32)
+	exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+	size, err3 := strconv.Atoi(args[3])
+	if err := errors.Join(err1, err2, err3); err != nil || size < 0 {
+		// the data can't be skipped without its size
+		return mcReply(out, false, "CLIENT_ERROR bad command line format")
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if string(data[size:]) != "\r\n" {
+		if data[size+1] != '\n' {
+			// the rest of a longer data line
+			if _, err := r.ReadString('\n'); err != nil {
+				return err
+			}
+		}
+		return mcReply(out, false, "CLIENT_ERROR bad data chunk")
+	}
+	key := args[0]
+	switch {
+	case !mcKeyOK(key):
+		return mcReply(out, noreply, "CLIENT_ERROR bad key")
+	case size > MC_MAX_DATA:
+		return mcReply(out, noreply, "SERVER_ERROR object too large for cache")
+	}
+	val := binary.BigEndian.AppendUint32(nil, uint32(flags))
+	val = binary.BigEndian.AppendUint64(val, uint64(mcDeadline(mc, exptime)))
+	val = append(val, data[:size]...)
+	err := mc.w.Update(func(tx *db.Tx) error {
+		return tx.Set([]byte(key), val)
+	})
+	if err != nil {
+		return mcReply(out, noreply, "SERVER_ERROR "+err.Error())
+	}
+	return mcReply(out, noreply, "STORED")
+}
+
+// delete <key> [noreply]
+func (mc *memcached) delete(out *bufio.Writer, args []string) error {
+	noreply := len(args) == 2 && args[1] == "noreply"
+	if len(args) != 1 && !noreply {
+		fmt.Fprint(out, "ERROR\r\n")
+		return nil
+	}
+	if !mcKeyOK(args[0]) {
+		return mcReply(out, noreply, "CLIENT_ERROR bad key")
+	}
+	found := false
+	err := mc.w.Update(func(tx *db.Tx) error {
+		key := []byte(args[0])
+		val, ok, err := tx.Get(key)
+		if err != nil || !ok {
+			return err
+		}
+		found = len(val) >= MC_HEADER && !mcExpired(mc, val)
+		_, err = tx.Del(key)
+		return err
+	})
+	switch {
+	case err != nil:
+		return mcReply(out, noreply, "SERVER_ERROR "+err.Error())
+	case !found:
+		return mcReply(out, noreply, "NOT_FOUND")
+	}
+	return mcReply(out, noreply, "DELETED")
+}
+
+func mcReply(out *bufio.Writer, noreply bool, msg string) error {
+	if !noreply {
+		_, err := fmt.Fprintf(out, "%s\r\n", msg)
+		return err
+	}
+	return nil
+}
+
+// up to 250 bytes without spaces or control characters.
+func mcKeyOK(key string) bool {
+	if len(key) == 0 || len(key) > MC_MAX_KEY {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// the unix time an item expires at, 0 for never. a negative exptime
+// expires it at once.
+func mcDeadline(mc *memcached, exptime int64) int64 {
+	switch {
+	case exptime == 0:
+		return 0
+	case exptime < 0:
+		return 1
+	case exptime <= MC_MAX_RELATIVE:
+		return mc.now().Unix() + exptime
+	}
+	return exptime
+}
+
+func mcExpired(mc *memcached, val []byte) bool {
+	deadline := int64(binary.BigEndian.Uint64(val[4:]))
+	return deadline != 0 && mc.now().Unix() >= deadline
+}
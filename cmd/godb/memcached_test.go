@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+
+	"db/db"
+)
+
+func TestMemcached(t *testing.T) {
+	kv := &db.KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	testify_assert.NoError(t, kv.Open())
+	defer kv.Close()
+	w := kv.StartWriter()
+	defer w.Close()
+	now := time.Unix(1_700_000_000, 0)
+	mc := &memcached{w: w, now: func() time.Time { return now }}
+
+	handle := func(input string) (string, error) {
+		out := &bytes.Buffer{}
+		err := mc.handle(struct {
+			io.Reader
+			io.Writer
+		}{strings.NewReader(input), out})
+		return out.String(), err
+	}
+	run := func(input string) string {
+		out, err := handle(input)
+		testify_assert.ErrorIs(t, err, io.EOF)
+		return out
+	}
+	testify_assert.Equal(t, "STORED\r\nSTORED\r\nVALUE a 5 5\r\nhello\r\nVALUE b 0 2\r\n\r\n\r\nEND\r\n",
+		run("set a 5 0 5\r\nhello\r\nset b 0 100 2 noreply\r\n\r\n\r\nset c 0 0 1\r\nx\r\nget a b missing\r\n"))
+	testify_assert.Equal(t, "DELETED\r\nNOT_FOUND\r\nVALUE b 0 2\r\n\r\n\r\nEND\r\n",
+		run("delete c\r\ndelete c\r\nget c b\r\n"))
+
+	// the expired items are misses
+	now = now.Add(100 * time.Second)
+	testify_assert.Equal(t, "END\r\nNOT_FOUND\r\n", run("get b\r\ndelete b\r\n"))
+	testify_assert.Equal(t, "STORED\r\nEND\r\n", run("set a 0 -1 1\r\nx\r\nget a\r\n"))
+	testify_assert.Equal(t, "STORED\r\nVALUE a 0 1\r\ny\r\nEND\r\n",
+		run("set a 0 1700000200 1\r\ny\r\nget a\r\n"))
+
+	// the errors
+	big := strings.Repeat("x", MC_MAX_DATA+1)
+	testify_assert.Equal(t,
+		"ERROR\r\nCLIENT_ERROR bad data chunk\r\nSERVER_ERROR object too large for cache\r\nCLIENT_ERROR bad key\r\n",
+		run("incr a 1\r\nset a 0 0 1\r\nxyz\r\nset a 0 0 "+strconv.Itoa(len(big))+"\r\n"+big+"\r\ndelete "+strings.Repeat("k", 251)+"\r\n"))
+	out, err := handle("quit\r\nget a\r\n")
+	testify_assert.NoError(t, err)
+	testify_assert.Empty(t, out)
+
+	// over TCP
+	var ln net.Listener
+	ln, err = net.Listen("tcp", "127.0.0.1:0")
+	testify_assert.NoError(t, err)
+	go mc.serve(ln)
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	testify_assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("get a\r\nquit\r\n"))
+	testify_assert.NoError(t, err)
+	reply, err := io.ReadAll(conn)
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, "VALUE a 0 1\r\ny\r\nEND\r\n", string(reply))
+}
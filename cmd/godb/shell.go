@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/term"
+
+	"db/db"
+)
+
+type command struct {
+	usage string
+	help  string
+	run   func(sh *shell, args []string) error
+}
+
+var commands = map[string]command{
+	"get":  {"get <key>", "print the value of a key", cmdGet},
+	"set":  {"set <key> <value>", "insert or update a key", cmdSet},
+	"del":  {"del <key>", "delete a key", cmdDel},
+	"scan": {"scan [start] [limit]", "list keys >= start in order, 20 by default", cmdScan},
+	"stat": {"stat", "print the internal counters and page usage", cmdStat},
+	"exit": {"exit", "leave the shell", nil},
+}
+
+func init() {
+	// help lists the commands, so it can't be in the literal
+	commands["help"] = command{"help", "list the commands", cmdHelp}
+}
+
+type shell struct {
+	kv  *db.KV
+	out io.Writer
+}
+
+// the line editor provides the history (up/down) and the tab completion
+// on a terminal. piped input is read line by line.
+func runShell(path string) error {
+	kv, err := openKV(path)
+	if err != nil {
+		return err
+	}
+	defer kv.Close()
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return runLines(&shell{kv: kv, out: os.Stdout}, bufio.NewScanner(os.Stdin))
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "godb> ")
+	t.AutoCompleteCallback = complete
+	sh := &shell{kv: kv, out: t}
+	for {
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sh.exec(line) {
+			return nil
+		}
+	}
+}
+
+func runLines(sh *shell, lines *bufio.Scanner) error {
+	for lines.Scan() {
+		if sh.exec(lines.Text()) {
+			break
+		}
+	}
+	return lines.Err()
+}
+
+// run one line, returns true to leave the shell.
+func (sh *shell) exec(line string) bool {
+	args, err := splitArgs(line)
+	if err != nil {
+		fmt.Fprintln(sh.out, "error:", err)
+		return false
+	}
+	if len(args) == 0 {
+		return false
+	}
+	cmd, ok := commands[args[0]]
+	switch {
+	case !ok:
+		fmt.Fprintf(sh.out, "unknown command %q, try help\n", args[0])
+	case cmd.run == nil:
+		return true
+	default:
+		if err := cmd.run(sh, args[1:]); err != nil {
+			fmt.Fprintln(sh.out, "error:", err)
+		}
+	}
+	return false
+}
+
+// split a line into words, double-quoted words use Go escapes.
+func splitArgs(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			end := strings.IndexAny(line, " \t")
+			if end < 0 {
+				end = len(line)
+			}
+			args = append(args, line[:end])
+			line = line[end:]
+			continue
+		}
+		quoted, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, errors.New("unterminated quote")
+		}
+		arg, _ := strconv.Unquote(quoted)
+		args = append(args, arg)
+		line = line[len(quoted):]
+	}
+}
+
+// complete the command name on tab.
+func complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' || strings.ContainsAny(line[:pos], " \t") {
+		return "", 0, false
+	}
+	var matches []string
+	for name := range commands {
+		if strings.HasPrefix(name, line[:pos]) {
+			matches = append(matches, name)
+		}
+	}
+	if len(matches) != 1 {
+		return "", 0, false
+	}
+	done := matches[0] + " "
+	return done + line[pos:], len(done), true
+}
+
+func wantArgs(args []string, min, max int) error {
+	if len(args) < min || len(args) > max {
+		return errors.New("wrong number of arguments")
+	}
+	return nil
+}
+
+func cmdGet(sh *shell, args []string) error {
+	if err := wantArgs(args, 1, 1); err != nil {
+		return err
+	}
+	val, ok, err := sh.kv.Get([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		fmt.Fprintln(sh.out, "(not found)")
+		return nil
+	}
+	fmt.Fprintf(sh.out, "%q\n", val)
+	return nil
+}
+
+func cmdSet(sh *shell, args []string) error {
+	if err := wantArgs(args, 2, 2); err != nil {
+		return err
+	}
+	return sh.kv.Set([]byte(args[0]), []byte(args[1]))
+}
+
+func cmdDel(sh *shell, args []string) error {
+	if err := wantArgs(args, 1, 1); err != nil {
+		return err
+	}
+	deleted, err := sh.kv.Del([]byte(args[0]))
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		fmt.Fprintln(sh.out, "(not found)")
+	}
+	return nil
+}
+
+func cmdScan(sh *shell, args []string) error {
+	if err := wantArgs(args, 0, 2); err != nil {
+		return err
+	}
+	var start []byte
+	if len(args) > 0 {
+		start = []byte(args[0])
+	}
+	limit := 20
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n <= 0 {
+			return errors.New("bad limit")
+		}
+		limit = n
+	}
+	n := 0
+	return sh.kv.Scan(start, func(key, val []byte) bool {
+		fmt.Fprintf(sh.out, "%q = %q\n", key, val)
+		n++
+		return n < limit
+	})
+}
+
+func cmdStat(sh *shell, args []string) error {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return err
+	}
+	s := sh.kv.Stats()
+	fmt.Fprintf(sh.out, "height %d, pages: %d leaf, %d internal, %d free\n",
+		s.Height, s.LeafPages, s.InternalPages, s.FreePages)
+	fmt.Fprintf(sh.out, "file %d bytes, nodes %d/%d bytes used\n",
+		s.FileBytes, s.UsedBytes, s.AllocBytes)
+	fmt.Fprintf(sh.out, "cache hit ratio %.2f, gets %d, sets %d, dels %d, commits %d, fsyncs %d\n",
+		s.CacheHitRatio, s.Gets, s.Sets, s.Dels, s.Commits, s.Fsyncs)
+	report, err := sh.kv.PageReport()
+	if err != nil {
+		return err
+	}
+	fmt.Fprint(sh.out, report)
+	return nil
+}
+
+func cmdHelp(sh *shell, args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(sh.out, "  %-22s %s\n", commands[name].usage, commands[name].help)
+	}
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+
+	"db/db"
+)
+
+func TestSplitArgs(t *testing.T) {
+	args, err := splitArgs(` set  "a b" "x\ty" plain`)
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, []string{"set", "a b", "x\ty", "plain"}, args)
+	_, err = splitArgs(`get "open`)
+	testify_assert.Error(t, err)
+}
+
+func TestComplete(t *testing.T) {
+	line, pos, ok := complete("sc", 2, '\t')
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "scan ", line)
+	testify_assert.Equal(t, 5, pos)
+	_, _, ok = complete("s", 1, '\t') // set, scan, stat
+	testify_assert.False(t, ok)
+}
+
+func TestShell(t *testing.T) {
+	kv := &db.KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	testify_assert.NoError(t, kv.Open())
+	defer kv.Close()
+
+	out := &bytes.Buffer{}
+	input := "set k1 v1\nset k2 v2\nget k1\ndel k1\nget k1\nscan\nexit\nget k2\n"
+	err := runLines(&shell{kv: kv, out: out}, bufio.NewScanner(strings.NewReader(input)))
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, "\"v1\"\n(not found)\n\"k2\" = \"v2\"\n", out.String())
+}
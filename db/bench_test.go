@@ -0,0 +1,168 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// the data set of every benchmark fits in about this many bytes.
+const benchDataSize = 1 << 20
+
+var benchValueSizes = []int{16, 128, 1024}
+
+func benchKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%08d", i))
+}
+
+// number of distinct keys for a value size
+func benchNumKeys(valSize int) int {
+	n := benchDataSize / (len(benchKey(0)) + valSize + 14) // 14: ptr, offset, klen, vlen
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+func benchOpen(b *testing.B, nkeys int, valSize int) *KV {
+	db := &KV{Path: filepath.Join(b.TempDir(), "bench.db")}
+	if err := db.Open(); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(db.Close)
+	// the loading is not measured, skip the fsyncs
+	db.NoSync = true
+	val := make([]byte, valSize)
+	for i := 0; i < nkeys; i++ {
+		if err := db.Set(benchKey(i), val); err != nil {
+			b.Fatal(err)
+		}
+	}
+	db.NoSync = false
+	return db
+}
+
+// run a benchmark for every value size
+func benchValues(b *testing.B, fn func(b *testing.B, nkeys int, val []byte)) {
+	for _, size := range benchValueSizes {
+		b.Run(fmt.Sprintf("val=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(size))
+			fn(b, benchNumKeys(size), make([]byte, size))
+		})
+	}
+}
+
+func BenchmarkKV_SeqInsert(b *testing.B) {
+	benchValues(b, func(b *testing.B, nkeys int, val []byte) {
+		db := benchOpen(b, 0, 0)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.Set(benchKey(i%nkeys), val); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkKV_RandInsert(b *testing.B) {
+	benchValues(b, func(b *testing.B, nkeys int, val []byte) {
+		db := benchOpen(b, 0, 0)
+		rng := rand.New(rand.NewSource(1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.Set(benchKey(rng.Intn(nkeys)), val); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkKV_Get(b *testing.B) {
+	benchValues(b, func(b *testing.B, nkeys int, val []byte) {
+		db := benchOpen(b, nkeys, len(val))
+		rng := rand.New(rand.NewSource(1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, ok, _ := db.Get(benchKey(rng.Intn(nkeys))); !ok {
+				b.Fatal("key not found")
+			}
+		}
+	})
+}
+
+// Gets from all the cores, sharing the KV behind a mutex or with
+// lock-free reads. run with -cpu 1,2,4,8 to see them scale.
+func BenchmarkKV_ParallelGet(b *testing.B) {
+	benchValues(b, func(b *testing.B, nkeys int, val []byte) {
+		db := benchOpen(b, nkeys, len(val))
+		b.Run("locked", func(b *testing.B) {
+			var mu sync.Mutex
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					mu.Lock()
+					_, ok, _ := db.Get(benchKey(rng.Intn(nkeys)))
+					mu.Unlock()
+					if !ok {
+						b.Error("key not found")
+						return
+					}
+				}
+			})
+		})
+		b.Run("lockfree", func(b *testing.B) {
+			b.RunParallel(func(pb *testing.PB) {
+				rng := rand.New(rand.NewSource(rand.Int63()))
+				for pb.Next() {
+					r := db.BeginRead()
+					_, ok, _ := r.Get(benchKey(rng.Intn(nkeys)))
+					r.Close()
+					if !ok {
+						b.Error("key not found")
+						return
+					}
+				}
+			})
+		})
+	})
+}
+
+func BenchmarkKV_Scan(b *testing.B) {
+	benchValues(b, func(b *testing.B, nkeys int, val []byte) {
+		db := benchOpen(b, nkeys, len(val))
+		b.SetBytes(int64(nkeys * len(val)))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			n := 0
+			db.Scan(nil, func(key, val []byte) bool {
+				n++
+				return true
+			})
+			if n != nkeys {
+				b.Fatalf("scanned %d keys, want %d", n, nkeys)
+			}
+		}
+	})
+}
+
+// 90% reads, 10% updates
+func BenchmarkKV_Mixed(b *testing.B) {
+	benchValues(b, func(b *testing.B, nkeys int, val []byte) {
+		db := benchOpen(b, nkeys, len(val))
+		rng := rand.New(rand.NewSource(1))
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := benchKey(rng.Intn(nkeys))
+			if rng.Intn(10) == 0 {
+				if err := db.Set(key, val); err != nil {
+					b.Fatal(err)
+				}
+			} else {
+				db.Get(key)
+			}
+		}
+	})
+}
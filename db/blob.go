@@ -0,0 +1,214 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// the size of the chunks of a blob, 2 of them fit in a leaf
+const BLOB_CHUNK = 2048
+
+// Blob streams a value larger than BTREE_MAX_VAL_SIZE in chunks, without
+// having it all in memory. it's stored as its size under its key, and
+// its chunks under the key followed by their big-endian uint64 index,
+// so the other keys with the blob key as a prefix must not end with 8
+// more bytes. the chunks never written, past a Seek, read as zeros.
+//
+// the writes are committed chunk by chunk like Tx.CommitNoSync,
+// they're made durable by Close unless the KV was opened with
+// Options.NoSync: a crash in between can leave a part of them, see
+// Tx.CommitNoSync. like the KV, a Blob is not safe for concurrent use.
+type Blob struct {
+	db    *KV
+	key   []byte
+	size  int64
+	off   int64
+	dirty bool // written since the last sync
+}
+
+var _ io.ReadWriteSeeker = (*Blob)(nil)
+
+// OpenBlob opens the blob of a key, it's empty if the key is missing.
+func (db *KV) OpenBlob(key []byte) (*Blob, error) {
+	if err := checkKV(blobChunkKey(key, 0), nil); err != nil {
+		return nil, err
+	}
+	b := &Blob{db: db, key: append([]byte(nil), key...)}
+	val, ok, err := db.Get(b.key)
+	switch {
+	case err != nil:
+		return nil, err
+	case !ok:
+	case len(val) != 8:
+		return nil, fmt.Errorf("blob %q: bad size", key)
+	default:
+		b.size = int64(binary.BigEndian.Uint64(val))
+	}
+	return b, nil
+}
+
+// DeleteBlob deletes the blob of a key with its chunks.
+func (db *KV) DeleteBlob(key []byte) error {
+	if _, err := db.Del(key); err != nil {
+		return err
+	}
+	return db.DeleteRange(blobChunkKey(key, 0), blobChunkKey(key, math.MaxUint64))
+}
+
+func blobChunkKey(key []byte, i uint64) []byte {
+	return binary.BigEndian.AppendUint64(append([]byte(nil), key...), i)
+}
+
+// Size is the length of the blob.
+func (b *Blob) Size() int64 {
+	return b.size
+}
+
+func (b *Blob) Read(p []byte) (int, error) {
+	if b.off >= b.size {
+		return 0, io.EOF
+	}
+	if rest := b.size - b.off; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+	n := 0
+	for n < len(p) {
+		i, at := b.off/BLOB_CHUNK, int(b.off%BLOB_CHUNK)
+		chunk, _, err := b.db.Get(blobChunkKey(b.key, uint64(i)))
+		if err != nil {
+			return n, err
+		}
+		m := blobSpan(len(p)-n, at)
+		got := 0
+		if at < len(chunk) {
+			got = copy(p[n:n+m], chunk[at:])
+		}
+		for j := n + got; j < n+m; j++ {
+			p[j] = 0 // not written
+		}
+		n += m
+		b.off += int64(m)
+	}
+	return n, nil
+}
+
+func (b *Blob) Write(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		i, at := b.off/BLOB_CHUNK, int(b.off%BLOB_CHUNK)
+		m := blobSpan(len(p)-n, at)
+		key := blobChunkKey(b.key, uint64(i))
+		var chunk []byte
+		if at > 0 || m < BLOB_CHUNK {
+			// a part of the chunk, the rest is kept
+			old, _, err := b.db.Get(key)
+			if err != nil {
+				return n, err
+			}
+			chunk = append(chunk, old...)
+		}
+		if len(chunk) < at+m {
+			chunk = append(chunk, make([]byte, at+m-len(chunk))...)
+		}
+		copy(chunk[at:], p[n:n+m])
+		if err := blobSet(b, key, chunk); err != nil {
+			return n, err
+		}
+		n += m
+		b.off += int64(m)
+	}
+	if b.off > b.size {
+		if err := blobResize(b, b.off); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (b *Blob) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += b.off
+	case io.SeekEnd:
+		offset += b.size
+	}
+	if offset < 0 {
+		return b.off, errors.New("blob: negative offset")
+	}
+	b.off = offset
+	return offset, nil
+}
+
+// Truncate changes the size of the blob, the chunks past it are deleted.
+func (b *Blob) Truncate(size int64) error {
+	if size < 0 {
+		return errors.New("blob: negative size")
+	}
+	if size < b.size {
+		// the bytes past the size must read as zeros if it grows again
+		i, at := uint64(size/BLOB_CHUNK), int(size%BLOB_CHUNK)
+		if at > 0 {
+			key := blobChunkKey(b.key, i)
+			chunk, ok, err := b.db.Get(key)
+			if err != nil {
+				return err
+			}
+			if ok && len(chunk) > at {
+				if err := blobSet(b, key, append([]byte(nil), chunk[:at]...)); err != nil {
+					return err
+				}
+			}
+			i++
+		}
+		err := b.db.DeleteRange(blobChunkKey(b.key, i), blobChunkKey(b.key, math.MaxUint64))
+		if err != nil {
+			return err
+		}
+		b.dirty = true
+	}
+	return blobResize(b, size)
+}
+
+// Close makes the writes durable.
+func (b *Blob) Close() error {
+	if !b.dirty {
+		return nil
+	}
+	b.dirty = false
+	if walBuffered(b.db) && syncing(b.db) {
+		b.db.stats.fsyncs++
+		if err := b.db.wal.fp.Sync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+	}
+	return syncLast(b.db)
+}
+
+// the bytes of a chunk from an offset in it, up to n.
+func blobSpan(n, at int) int {
+	if n > BLOB_CHUNK-at {
+		return BLOB_CHUNK - at
+	}
+	return n
+}
+
+func blobResize(b *Blob, size int64) error {
+	if err := blobSet(b, b.key, binary.BigEndian.AppendUint64(nil, uint64(size))); err != nil {
+		return err
+	}
+	b.size = size
+	return nil
+}
+
+// an update like Tx.CommitNoSync, see Close.
+func blobSet(b *Blob, key, val []byte) error {
+	db := b.db
+	saved := db.syncSkip
+	db.syncSkip = true
+	defer func() { db.syncSkip = saved }()
+	b.dirty = true
+	return db.Set(key, val)
+}
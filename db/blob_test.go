@@ -0,0 +1,71 @@
+package db
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestBlob(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.NoError(t, db.Set([]byte("a"), []byte("1")))
+	testify_assert.NoError(t, db.Set([]byte("c"), []byte("3")))
+	data := make([]byte, 3*BLOB_CHUNK+500)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	b, err := db.OpenBlob([]byte("b"))
+	testify_assert.NoError(t, err)
+	testify_assert.Zero(t, b.Size())
+	n, err := io.Copy(b, bytes.NewReader(data))
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, int64(len(data)), n)
+	fsyncs := db.Stats().Fsyncs
+	testify_assert.NoError(t, b.Close())
+	testify_assert.Equal(t, fsyncs+1, db.Stats().Fsyncs)
+
+	readAll := func() []byte {
+		b, err := db.OpenBlob([]byte("b"))
+		testify_assert.NoError(t, err)
+		got, err := io.ReadAll(b)
+		testify_assert.NoError(t, err)
+		return got
+	}
+	testify_assert.Equal(t, data, readAll())
+
+	// an overwrite across chunks, then past the end
+	_, err = b.Seek(BLOB_CHUNK-10, io.SeekStart)
+	testify_assert.NoError(t, err)
+	_, err = b.Write(bytes.Repeat([]byte("x"), 20))
+	testify_assert.NoError(t, err)
+	copy(data[BLOB_CHUNK-10:], bytes.Repeat([]byte("x"), 20))
+	_, err = b.Seek(100, io.SeekEnd)
+	testify_assert.NoError(t, err)
+	_, err = b.Write([]byte("end"))
+	testify_assert.NoError(t, err)
+	data = append(append(data, make([]byte, 100)...), "end"...)
+	testify_assert.Equal(t, data, readAll())
+
+	// the bytes cut off read as zeros if it grows back
+	testify_assert.NoError(t, b.Truncate(BLOB_CHUNK+5))
+	testify_assert.Equal(t, data[:BLOB_CHUNK+5], readAll())
+	testify_assert.NoError(t, b.Truncate(2*BLOB_CHUNK))
+	data = append(data[:BLOB_CHUNK+5], make([]byte, BLOB_CHUNK-5)...)
+	testify_assert.Equal(t, data, readAll())
+	testify_assert.NoError(t, b.Close())
+
+	// the neighbors are left alone
+	testify_assert.NoError(t, db.DeleteBlob([]byte("b")))
+	testify_assert.Empty(t, readAll())
+	var keys []string
+	testify_assert.NoError(t, db.ScanKeys(nil, func(key []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	testify_assert.Equal(t, []string{"a", "c"}, keys)
+
+	_, err = db.OpenBlob(make([]byte, BTREE_MAX_KEY_SIZE-8))
+	testify_assert.ErrorIs(t, err, ErrKeyTooLarge)
+}
@@ -0,0 +1,205 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"os"
+)
+
+// an optional bloom filter over all keys, so a Get on a missing key can
+// usually return without descending the tree.
+// deleted keys stay in the filter until it's rebuilt, which only costs
+// a false positive. it's rebuilt on open if it wasn't saved, at the end
+// of a DefragStep pass and in a CloneTo copy.
+type bloomFilter struct {
+	bits     []uint64
+	k        uint32 // number of hash functions
+	capacity uint64 // number of keys it was sized for
+	count    uint64 // number of keys added, not counting the overwrites
+}
+
+func newBloomFilter(bitsPerKey int, capacity uint64) *bloomFilter {
+	if capacity < 1024 {
+		capacity = 1024
+	}
+	nbits := uint64(bitsPerKey) * capacity
+	k := uint32(math.Round(float64(bitsPerKey) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > 30 {
+		k = 30
+	}
+	return &bloomFilter{
+		bits:     make([]uint64, (nbits+63)/64),
+		k:        k,
+		capacity: capacity,
+	}
+}
+
+// double hashing: the i-th probe is h1 + i*h2.
+func bloomHash(key []byte) (uint64, uint64) {
+	h := fnv.New64a()
+	h.Write(key)
+	h1 := h.Sum64()
+	h2 := h1>>33 | h1<<31
+	return h1, h2 | 1
+}
+
+func (f *bloomFilter) add(key []byte) {
+	h1, h2 := bloomHash(key)
+	nbits := uint64(len(f.bits)) * 64
+	added := false
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % nbits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			f.bits[bit/64] |= 1 << (bit % 64)
+			added = true
+		}
+	}
+	// a key already in the filter sets no new bit
+	if added {
+		f.count++
+	}
+}
+
+// false means the key is definitely absent.
+func (f *bloomFilter) mayContain(key []byte) bool {
+	h1, h2 := bloomHash(key)
+	nbits := uint64(len(f.bits)) * 64
+	for i := uint64(0); i < uint64(f.k); i++ {
+		bit := (h1 + i*h2) % nbits
+		if f.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// the filter is kept next to the DB file and stamped with the master
+// page it was built for. a stale or missing file is rebuilt by a scan.
+// the pages are reused, so the stamp can match a later version: a
+// writable DB removes the file when it's opened and saves it on Close.
+// | sig | btree_root | page_used |  k | capacity | count | nwords | bits |
+// | 8B  |     8B     |     8B    | 4B |    8B    |   8B  |   8B   |  ... |
+const BLOOM_SIG = "GODBBLM1"
+
+func bloomPath(db *KV) string {
+	return db.Path + ".bloom"
+}
+
+func bloomInit(db *KV) error {
+	if db.BloomBitsPerKey > 0 && db.crypt.aead == nil {
+		// the sidecar file would leak key hashes of an encrypted DB
+		f, err := bloomLoad(db)
+		switch {
+		case err == nil && f.count <= f.capacity:
+			db.bloom = f
+		case err != nil && !errors.Is(err, os.ErrNotExist) && err != errBloomStale:
+			return fmt.Errorf("read bloom filter: %w", err)
+		}
+	}
+	if !db.ReadOnly {
+		err := db.vfs().Remove(bloomPath(db))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("remove bloom filter: %w", err)
+		}
+	}
+	if db.BloomBitsPerKey > 0 && db.bloom == nil {
+		db.bloom = bloomBuild(db)
+	}
+	return nil
+}
+
+// scan the whole tree
+func bloomBuild(db *KV) *bloomFilter {
+	nkeys := uint64(0)
+	treeScan(&db.tree, nil, func(key, val []byte) bool {
+		nkeys++
+		return true
+	})
+	f := newBloomFilter(db.BloomBitsPerKey, 2*nkeys)
+	treeScan(&db.tree, nil, func(key, val []byte) bool {
+		f.add(key)
+		return true
+	})
+	return f
+}
+
+// a new filter for the current keys, sized for them.
+func bloomRebuild(db *KV) {
+	f := bloomBuild(db)
+	if db.wal.mem != nil {
+		for n := db.wal.mem.seek(nil); n != nil; n = n.nextNode() {
+			if !n.entry.deleted {
+				f.add(n.entry.key)
+			}
+		}
+	}
+	db.bloom = f
+}
+
+var errBloomStale = errors.New("stale bloom filter")
+
+func bloomLoad(db *KV) (*bloomFilter, error) {
+	data, err := db.vfs().ReadFile(bloomPath(db))
+	if err != nil {
+		return nil, err
+	}
+	const header = 52
+	if len(data) < header || !bytes.Equal(data[:8], []byte(BLOOM_SIG)) {
+		return nil, errBloomStale
+	}
+	root := binary.LittleEndian.Uint64(data[8:])
+	used := binary.LittleEndian.Uint64(data[16:])
+	if root != db.tree.root || used != db.page.flushed {
+		return nil, errBloomStale
+	}
+	f := &bloomFilter{
+		k:        binary.LittleEndian.Uint32(data[24:]),
+		capacity: binary.LittleEndian.Uint64(data[28:]),
+		count:    binary.LittleEndian.Uint64(data[36:]),
+	}
+	nwords := binary.LittleEndian.Uint64(data[44:])
+	if nwords == 0 || uint64(len(data)-header) != 8*nwords {
+		return nil, errBloomStale
+	}
+	f.bits = make([]uint64, nwords)
+	for i := range f.bits {
+		f.bits[i] = binary.LittleEndian.Uint64(data[header+8*i:])
+	}
+	return f, nil
+}
+
+// write the filter for the current master page, called on Close.
+func bloomSave(db *KV) error {
+	if db.bloom == nil || db.crypt.aead != nil {
+		return nil
+	}
+	f := db.bloom
+	data := make([]byte, 52+8*len(f.bits))
+	copy(data, BLOOM_SIG)
+	binary.LittleEndian.PutUint64(data[8:], db.tree.root)
+	binary.LittleEndian.PutUint64(data[16:], db.page.flushed)
+	binary.LittleEndian.PutUint32(data[24:], f.k)
+	binary.LittleEndian.PutUint64(data[28:], f.capacity)
+	binary.LittleEndian.PutUint64(data[36:], f.count)
+	binary.LittleEndian.PutUint64(data[44:], uint64(len(f.bits)))
+	for i, w := range f.bits {
+		binary.LittleEndian.PutUint64(data[52+8*i:], w)
+	}
+
+	// write a new file and rename it over the old one
+	tmp := bloomPath(db) + ".tmp"
+	if err := db.vfs().WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write bloom filter: %w", err)
+	}
+	if err := db.vfs().Rename(tmp, bloomPath(db)); err != nil {
+		return fmt.Errorf("write bloom filter: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestBloomFilter(t *testing.T) {
+	f := newBloomFilter(10, 1000)
+	for i := 0; i < 1000; i++ {
+		f.add([]byte(fmt.Sprintf("key%d", i)))
+	}
+	for i := 0; i < 1000; i++ {
+		testify_assert.True(t, f.mayContain([]byte(fmt.Sprintf("key%d", i))))
+	}
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.mayContain([]byte(fmt.Sprintf("missing%d", i))) {
+			falsePositives++
+		}
+	}
+	testify_assert.Less(t, falsePositives, 300) // ~1% expected
+}
+
+func TestKV_Bloom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Options: Options{BloomBitsPerKey: 10}}
+	testify_assert.NoError(t, db.Open())
+	testify_assert.NoError(t, db.Set([]byte("present"), []byte("1")))
+
+	trace := &Trace{}
+	_, ok, _ := db.GetTraced([]byte("absent"), trace)
+	testify_assert.False(t, ok)
+	testify_assert.True(t, trace.BloomRejected)
+	testify_assert.Empty(t, trace.Steps)
+	db.Close()
+
+	// saved on close, stamped with the master page
+	_, err := os.Stat(path + ".bloom")
+	testify_assert.NoError(t, err)
+	db = &KV{Path: path, Options: Options{BloomBitsPerKey: 10}}
+	testify_assert.NoError(t, db.Open())
+	val, ok, _ := db.Get([]byte("present"))
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "1", string(val))
+
+	// a stale filter is rebuilt rather than trusted
+	testify_assert.NoError(t, db.Set([]byte("later"), []byte("2")))
+	f := db.bloom
+	db.bloom = nil // simulate a crash: no save on close
+	db.Close()
+	testify_assert.True(t, f.mayContain([]byte("later")))
+	db = &KV{Path: path, Options: Options{BloomBitsPerKey: 10}}
+	testify_assert.NoError(t, db.Open())
+	_, ok, _ = db.Get([]byte("later"))
+	testify_assert.True(t, ok)
+	db.Close()
+
+	// updated without the filter, the reused pages can give the same
+	// root and size as the saved filter, so it's gone once opened
+	db = &KV{Path: path}
+	testify_assert.NoError(t, db.Open())
+	_, err = os.Stat(path + ".bloom")
+	testify_assert.ErrorIs(t, err, os.ErrNotExist)
+	testify_assert.NoError(t, db.Set([]byte("unfiltered"), []byte("3")))
+	db.Close()
+	db = &KV{Path: path, Options: Options{BloomBitsPerKey: 10}}
+	testify_assert.NoError(t, db.Open())
+	defer db.Close()
+	_, ok, _ = db.Get([]byte("unfiltered"))
+	testify_assert.True(t, ok)
+}
+
+// overwrites aren't counted, the filter is resized by a defrag pass and
+// in a copy.
+func TestKV_BloomRebuild(t *testing.T) {
+	dir := t.TempDir()
+	db := &KV{Path: filepath.Join(dir, "test.db"), Options: Options{BloomBitsPerKey: 10}}
+	testify_assert.NoError(t, db.Open())
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		testify_assert.NoError(t, db.Set([]byte("k"), []byte(fmt.Sprint(i))))
+	}
+	testify_assert.Equal(t, uint64(1), db.bloom.count)
+
+	for i := 0; i < 3000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v")))
+	}
+	testify_assert.Greater(t, db.bloom.count, db.bloom.capacity)
+
+	copyPath := filepath.Join(dir, "copy.db")
+	testify_assert.NoError(t, db.CloneTo(copyPath))
+	cp := &KV{Path: copyPath, Options: Options{BloomBitsPerKey: 10}}
+	testify_assert.NoError(t, cp.Open())
+	testify_assert.LessOrEqual(t, cp.bloom.count, cp.bloom.capacity)
+	testify_assert.GreaterOrEqual(t, cp.bloom.capacity, uint64(3001))
+	cp.Close()
+
+	for i := 0; i < 3000; i += 2 {
+		_, err := db.Del([]byte(fmt.Sprintf("key%04d", i)))
+		testify_assert.NoError(t, err)
+	}
+	for done := false; !done; {
+		var err error
+		_, done, err = db.DefragStep(16)
+		testify_assert.NoError(t, err)
+	}
+	testify_assert.LessOrEqual(t, db.bloom.count, uint64(1501))
+	testify_assert.GreaterOrEqual(t, db.bloom.capacity, uint64(1501))
+	_, ok, _ := db.Get([]byte("key0001"))
+	testify_assert.True(t, ok)
+}
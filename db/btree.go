@@ -2,7 +2,7 @@ package db
 
 import (
 	"bytes"
-	"fmt"
+	"os"
 	"unsafe"
 )
 
@@ -13,13 +13,39 @@ type BTree struct {
 	get func(uint64) BNode // dereference a pointer
 	new func(BNode) uint64 // allocate a new page
 	del func(uint64)       // deallocate a page
+	// optional, reports structural changes (splits, merges, levels)
+	debug func(msg string, args ...any)
+	// optional, the order of the keys, bytes.Compare if nil
+	cmp func(a, b []byte) int
+	// optional, hints the pages of the next leaves of a scan, readAhead
+	// at a time
+	prefetch  func(ptrs []uint64)
+	readAhead int
+}
+
+func (tree *BTree) keyCmp() func(a, b []byte) int {
+	if tree.cmp == nil {
+		return bytes.Compare
+	}
+	return tree.cmp
+}
+
+func (tree *BTree) logDebug(msg string, args ...any) {
+	if tree.debug != nil {
+		tree.debug(msg, args...)
+	}
+}
+
+// get the value of a key
+func (tree *BTree) Get(key []byte) ([]byte, bool) {
+	return treeGet(tree, key, nil)
 }
 
 // insert a new key or update an existing key
 func (tree *BTree) Insert(key []byte, val []byte) {
 	if tree.root == 0 {
 		// create the first node
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		root := nodeAlloc(BTREE_PAGE_SIZE)
 		root.setHeader(BNODE_LEAF, 2)
 		// a dummy key, this makes the tree cover the whole key space.
 		// thus a lookup can always find a containing node.
@@ -34,7 +60,8 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 	tree.del(tree.root)
 	if nsplit > 1 {
 		// the root was split, add a new level.
-		root := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		tree.logDebug("root split", "nodes", nsplit)
+		root := nodeAlloc(BTREE_PAGE_SIZE)
 		root.setHeader(BNODE_NODE, nsplit)
 		for i, knode := range split[:nsplit] {
 			ptr, key := tree.new(knode), knode.getKey(0)
@@ -50,6 +77,9 @@ func (tree *BTree) Insert(key []byte, val []byte) {
 func (tree *BTree) Delete(key []byte) bool {
 	assert(len(key) != 0)
 	assert(len(key) < BTREE_MAX_KEY_SIZE)
+	if tree.root == 0 {
+		return false
+	}
 
 	updated := treeDelete(tree, tree.get(tree.root), key)
 	if len(updated.data) == 0 {
@@ -60,28 +90,405 @@ func (tree *BTree) Delete(key []byte) bool {
 	// if 1 key in internal node
 	if updated.btype() == BNODE_NODE && updated.nkeys() == 1 {
 		// remove level
+		tree.logDebug("root removed")
 		tree.root = updated.getPtr(0) // assign root to 0 pointer
+		nodeFree(updated)
 	} else {
 		tree.root = tree.new(updated) // assign root to point to updated node
 	}
 	return true
 }
 
+// delete the keys in [lo, hi), a nil hi is the end of the key space.
+// the subtrees that fall entirely in the range are dropped, only their
+// internal nodes are read. returns whether anything was deleted.
+func (tree *BTree) DeleteRange(lo, hi []byte) bool {
+	if tree.root == 0 {
+		return false
+	}
+	// all leaves are at the same depth
+	height := 0
+	for ptr := tree.root; ; {
+		height++
+		node := tree.get(ptr)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		ptr = node.getPtr(0)
+	}
+	updated := treeDeleteRange(tree, tree.get(tree.root), height, lo, hi)
+	if len(updated.data) == 0 {
+		return false
+	}
+	tree.del(tree.root)
+	nsplit, split := nodeSplit3(updated)
+	if nsplit > 1 {
+		// the new first keys of the kids can be longer than the old ones
+		tree.logDebug("root split", "nodes", nsplit)
+		root := nodeAlloc(BTREE_PAGE_SIZE)
+		root.setHeader(BNODE_NODE, nsplit)
+		for i, knode := range split[:nsplit] {
+			nodeAppendKV(root, uint16(i), tree.new(knode), knode.getKey(0), nil)
+		}
+		tree.root = tree.new(root)
+		return true
+	}
+	updated = split[0]
+	if updated.btype() == BNODE_LEAF || updated.nkeys() > 1 {
+		tree.root = tree.new(updated)
+		return true
+	}
+	// the dummy key is never deleted so the root is never empty,
+	// but several levels may be left with a single kid.
+	ptr := updated.getPtr(0)
+	nodeFree(updated)
+	for {
+		node := tree.get(ptr)
+		if node.btype() == BNODE_LEAF || node.nkeys() > 1 {
+			break
+		}
+		next := node.getPtr(0)
+		tree.del(ptr)
+		ptr = next
+	}
+	tree.logDebug("root removed")
+	tree.root = ptr
+	return true
+}
+
+// the node without the keys in [lo, hi), it may be left with no keys.
+// the result is empty (no data) if nothing was deleted.
+// only the 2 kids at the ends of the range are updated, the ones between
+// are dropped. the updated kids have new first keys that may be longer,
+// so the result might be split. underfull kids are not merged, that's
+// left to the later deletes.
+func treeDeleteRange(tree *BTree, node BNode, level int, lo, hi []byte) BNode {
+	cmp := tree.keyCmp()
+	type kv struct {
+		ptr      uint64
+		key, val []byte
+	}
+	var kept []kv
+	changed := false
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			// the dummy key is never in the range
+			if len(key) > 0 && cmp(key, lo) >= 0 && (hi == nil || cmp(key, hi) < 0) {
+				changed = true
+				continue
+			}
+			kept = append(kept, kv{0, key, node.getVal(i)})
+		}
+	case BNODE_NODE:
+		for i := uint16(0); i < node.nkeys(); i++ {
+			ptr, kidLo := node.getPtr(i), node.getKey(i)
+			var kidHi []byte // nil for the last kid
+			if i+1 < node.nkeys() {
+				kidHi = node.getKey(i + 1)
+			}
+			// the kid's keys are in [kidLo, kidHi)
+			before := kidHi != nil && cmp(kidHi, lo) <= 0
+			after := hi != nil && cmp(kidLo, hi) >= 0
+			if before || after {
+				kept = append(kept, kv{ptr, kidLo, nil})
+				continue
+			}
+			covered := len(kidLo) > 0 && cmp(kidLo, lo) >= 0 &&
+				(hi == nil || kidHi != nil && cmp(kidHi, hi) <= 0)
+			if covered {
+				tree.logDebug("subtree dropped", "idx", i)
+				treeDrop(tree, ptr, level-1)
+				changed = true
+				continue
+			}
+			updated := treeDeleteRange(tree, tree.get(ptr), level-1, lo, hi)
+			if len(updated.data) == 0 {
+				kept = append(kept, kv{ptr, kidLo, nil})
+				continue
+			}
+			tree.del(ptr)
+			changed = true
+			if updated.nkeys() == 0 {
+				nodeFree(updated)
+				continue
+			}
+			nsplit, split := nodeSplit3(updated)
+			for _, knode := range split[:nsplit] {
+				kept = append(kept, kv{tree.new(knode), knode.getKey(0), nil})
+			}
+		}
+	default:
+		panic("bad node!")
+	}
+	if !changed {
+		return BNode{}
+	}
+	new := nodeAlloc(2 * BTREE_PAGE_SIZE)
+	new.setHeader(node.btype(), uint16(len(kept)))
+	for i, item := range kept {
+		nodeAppendKV(new, uint16(i), item.ptr, item.key, item.val)
+	}
+	return new
+}
+
+// deallocate a subtree, the leaves (level 1) are not read.
+func treeDrop(tree *BTree, ptr uint64, level int) {
+	if level > 1 {
+		node := tree.get(ptr)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			treeDrop(tree, node.getPtr(i), level-1)
+		}
+	}
+	tree.del(ptr)
+}
+
+// descend from the root to the leaf that may contain the key.
+// every visited node is recorded if a trace is given.
+func treeGet(tree *BTree, key []byte, trace *Trace) ([]byte, bool) {
+	if tree.root == 0 {
+		return nil, false
+	}
+	ptr := tree.root
+	for {
+		node := tree.get(ptr)
+		idx, ncmp := nodeLookup(node, key, tree.keyCmp())
+		trace.visit(ptr, node, idx, ncmp)
+		switch node.btype() {
+		case BNODE_LEAF:
+			if tree.keyCmp()(key, node.getKey(idx)) != 0 {
+				return nil, false
+			}
+			return node.getVal(idx), true
+		case BNODE_NODE:
+			ptr = node.getPtr(idx)
+		default:
+			panic("bad node!")
+		}
+	}
+}
+
+// look up keys sorted in the tree order in a single pass: the keys
+// falling into the same kid share its visit. fn gets the position in
+// keys of every key found.
+func treeGetMany(tree *BTree, keys [][]byte, fn func(i int, val []byte)) {
+	if tree.root != 0 && len(keys) > 0 {
+		nodeGetMany(tree, tree.get(tree.root), keys, 0, fn)
+	}
+}
+
+func nodeGetMany(tree *BTree, node BNode, keys [][]byte, base int, fn func(i int, val []byte)) {
+	cmp := tree.keyCmp()
+	switch node.btype() {
+	case BNODE_LEAF:
+		for i, key := range keys {
+			idx := nodeLookupLE(node, key, cmp)
+			if cmp(key, node.getKey(idx)) == 0 {
+				fn(base+i, node.getVal(idx))
+			}
+		}
+	case BNODE_NODE:
+		for i := 0; i < len(keys); {
+			idx := nodeLookupLE(node, keys[i], cmp)
+			// the following keys before the next kid go to the same kid
+			j := len(keys)
+			if idx+1 < node.nkeys() {
+				next := node.getKey(idx + 1)
+				for j = i + 1; j < len(keys) && cmp(keys[j], next) < 0; j++ {
+				}
+			}
+			nodeGetMany(tree, tree.get(node.getPtr(idx)), keys[i:j], base+i, fn)
+			i = j
+		}
+	default:
+		panic("bad node!")
+	}
+}
+
+// call fn on every node, parents before kids. the root is at depth 0.
+func treeWalk(tree *BTree, fn func(ptr uint64, node BNode, depth int)) {
+	if tree.root != 0 {
+		nodeWalk(tree, tree.root, 0, fn)
+	}
+}
+
+func nodeWalk(tree *BTree, ptr uint64, depth int, fn func(ptr uint64, node BNode, depth int)) {
+	node := tree.get(ptr)
+	fn(ptr, node, depth)
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			nodeWalk(tree, node.getPtr(i), depth+1, fn)
+		}
+	}
+}
+
+// call fn on every KV with key >= start in key order until it returns false.
+// a nil start covers the whole tree, the dummy key is always skipped.
+func treeScan(tree *BTree, start []byte, fn func(key, val []byte) bool) {
+	if tree.root != 0 {
+		nodeScan(tree, tree.get(tree.root), start, fn)
+	}
+}
+
+func nodeScan(tree *BTree, node BNode, start []byte, fn func(key, val []byte) bool) bool {
+	idx := uint16(0)
+	if start != nil {
+		idx = nodeLookupLE(node, start, tree.keyCmp())
+	}
+	ahead := uint16(0) // see treePrefetch
+	for i := idx; i < node.nkeys(); i++ {
+		switch node.btype() {
+		case BNODE_LEAF:
+			key := node.getKey(i)
+			if len(key) == 0 || tree.keyCmp()(key, start) < 0 {
+				continue // the dummy key, or the one before the start
+			}
+			if !fn(key, node.getVal(i)) {
+				return false
+			}
+		case BNODE_NODE:
+			// only the first kid can contain keys before the start
+			kidStart := start
+			if i > idx {
+				kidStart = nil
+			}
+			kid := tree.get(node.getPtr(i))
+			if i > idx && kid.btype() == BNODE_LEAF {
+				treePrefetch(tree, node, i, &ahead)
+			}
+			if !nodeScan(tree, kid, kidStart, fn) {
+				return false
+			}
+		default:
+			panic("bad node!")
+		}
+	}
+	return true
+}
+
+// a cursor over the KVs of a tree, from treeSeek.
+type treeIter struct {
+	tree  *BTree
+	path  []BNode // from the root to a leaf
+	pos   []uint16
+	ahead uint16 // the kids of the leaf's parent before it were prefetched
+}
+
+// a cursor at the first KV with key >= start, the dummy key is skipped.
+func treeSeek(tree *BTree, start []byte) *treeIter {
+	it := &treeIter{tree: tree}
+	if tree.root == 0 {
+		return it
+	}
+	for ptr := tree.root; ; {
+		node := tree.get(ptr)
+		idx := uint16(0)
+		if start != nil {
+			idx = nodeLookupLE(node, start, tree.keyCmp())
+		}
+		it.path = append(it.path, node)
+		it.pos = append(it.pos, idx)
+		if node.btype() != BNODE_NODE {
+			break
+		}
+		ptr = node.getPtr(idx)
+	}
+	// the leaf position is the last key <= start
+	for it.valid() && (len(it.key()) == 0 || tree.keyCmp()(it.key(), start) < 0) {
+		it.next()
+	}
+	return it
+}
+
+func (it *treeIter) valid() bool {
+	last := len(it.path) - 1
+	return last >= 0 && it.pos[last] < it.path[last].nkeys()
+}
+
+func (it *treeIter) key() []byte {
+	last := len(it.path) - 1
+	return it.path[last].getKey(it.pos[last])
+}
+
+func (it *treeIter) val() []byte {
+	last := len(it.path) - 1
+	return it.path[last].getVal(it.pos[last])
+}
+
+func (it *treeIter) next() {
+	// up to the first node with a next kid
+	level := len(it.path) - 1
+	it.pos[level]++
+	for level > 0 && it.pos[level] >= it.path[level].nkeys() {
+		level--
+		it.pos[level]++
+	}
+	if it.pos[level] >= it.path[level].nkeys() {
+		return // the end, the leaf is past its last key
+	}
+	// then down to the first key of the next leaf
+	for ; level+1 < len(it.path); level++ {
+		it.path[level+1] = it.tree.get(it.path[level].getPtr(it.pos[level]))
+		it.pos[level+1] = 0
+	}
+	it.readAhead()
+}
+
+// the scan is sequential past its first leaf, see treePrefetch.
+func (it *treeIter) readAhead() {
+	if len(it.path) < 2 {
+		return
+	}
+	parent, pos := it.path[len(it.path)-2], it.pos[len(it.path)-2]
+	if pos == 0 {
+		it.ahead = 0 // a new parent
+	}
+	treePrefetch(it.tree, parent, pos, &it.ahead)
+}
+
+// a scan at the leaf kid pos of a parent prefetches the next leaves
+// under it, readAhead at a time, once half of the previous ones are
+// read. ahead is the end of the ones already prefetched.
+func treePrefetch(tree *BTree, parent BNode, pos uint16, ahead *uint16) {
+	n := uint16(tree.readAhead)
+	if tree.prefetch == nil || n == 0 || pos+n/2 < *ahead {
+		return
+	}
+	from := pos + 1
+	if from < *ahead {
+		from = *ahead
+	}
+	to := pos + 1 + n
+	if to > parent.nkeys() {
+		to = parent.nkeys()
+	}
+	if from >= to {
+		return
+	}
+	ptrs := make([]uint64, 0, to-from)
+	for i := from; i < to; i++ {
+		ptrs = append(ptrs, parent.getPtr(i))
+	}
+	*ahead = to
+	tree.prefetch(ptrs)
+}
+
 // insert a KV into a node, the result might be split.
 // the caller is responsible for deallocating the input node
 // and splitting and allocating result nodes.
 func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 	// the result node.
 	// it's allowed to be bigger than 1 page and will be split if so
-	new := BNode{data: make([]byte, 2*BTREE_PAGE_SIZE)}
+	new := nodeAlloc(2 * BTREE_PAGE_SIZE)
 
 	// where to insert the key?
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(node, key, tree.keyCmp())
 	// act depending on the node type
 	switch node.btype() {
 	case BNODE_LEAF:
 		// leaf, node.getKey(idx) <= key
-		if bytes.Equal(key, node.getKey(idx)) {
+		if tree.keyCmp()(key, node.getKey(idx)) == 0 {
 			// found the key, update it.
 			leafUpdate(new, node, idx, key, val)
 		} else {
@@ -99,15 +506,15 @@ func treeInsert(tree *BTree, node BNode, key []byte, val []byte) BNode {
 
 func treeDelete(tree *BTree, node BNode, key []byte) BNode {
 	// find index of key to pull key from node
-	idx := nodeLookupLE(node, key)
+	idx := nodeLookupLE(node, key, tree.keyCmp())
 
 	switch node.btype() {
 	case BNODE_LEAF: // if leaf
-		if !bytes.Equal(key, node.getKey(idx)) {
+		if tree.keyCmp()(key, node.getKey(idx)) != 0 {
 			return BNode{} // key not found
 		}
 		// delete the key in the leaf
-		new := BNode{data: make([]byte, BTREE_PAGE_SIZE)} // allocate empty node
+		new := nodeAlloc(BTREE_PAGE_SIZE) // allocate empty node
 		leafDelete(new, node, idx)
 		return new
 	case BNODE_NODE: // if internal
@@ -135,7 +542,7 @@ func NewC() *C {
 				return node
 			},
 			new: func(node BNode) uint64 {
-				assert(node.nbytes() < BTREE_PAGE_SIZE)
+				assert(node.nbytes() <= BNODE_MAX_SIZE)
 
 				key := uint64(uintptr(unsafe.Pointer(&node.data[0])))
 				assert(pages[key].data == nil)
@@ -144,10 +551,11 @@ func NewC() *C {
 				return key
 			},
 			del: func(ptr uint64) {
-				_, ok := pages[ptr]
+				node, ok := pages[ptr]
 				assert(ok)
 
 				delete(pages, ptr)
+				nodeFree(node)
 			},
 		},
 		ref:   map[string]string{},
@@ -165,11 +573,21 @@ func (c *C) Del(key string) bool {
 	return c.tree.Delete([]byte(key))
 }
 
-func (c *C) PrintTree() {
-	// fmt.Printf("Root page: %d\n", c.pages[c.tree.root])
-	fmt.Println("Pages:")
-	for pt, node := range c.pages {
-		fmt.Println("Pointer:", pt)
-		fmt.Println("BNode data:", node.data)
+func (c *C) DelRange(lo, hi string) {
+	for key := range c.ref {
+		if key >= lo && (hi == "" || key < hi) {
+			delete(c.ref, key)
+		}
+	}
+	var hiKey []byte
+	if hi != "" {
+		hiKey = []byte(hi)
 	}
+	c.tree.DeleteRange([]byte(lo), hiKey)
+}
+
+func (c *C) PrintTree() {
+	treeWalk(&c.tree, func(ptr uint64, node BNode, depth int) {
+		dumpNode(os.Stdout, ptr, node, depth, true)
+	})
 }
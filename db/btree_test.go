@@ -1,7 +1,103 @@
 package db
 
-import "testing"
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func cHeight(c *C) int {
+	height := 0
+	for ptr := c.tree.root; ptr != 0; {
+		height++
+		node := c.tree.get(ptr)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		ptr = node.getPtr(0)
+	}
+	return height
+}
+
+// long keys make small fanouts, so a few thousand keys are 3 levels.
+func cBigKey(i int) string {
+	return fmt.Sprintf("key%06d", i) + strings.Repeat("k", 200)
+}
 
 func TestBTree_Insert(t *testing.T) {
+	c := NewC()
+	rng := rand.New(rand.NewSource(1))
+	for _, i := range rng.Perm(2000) {
+		c.Add(cBigKey(i), strings.Repeat("v", rng.Intn(1000)))
+		if i%100 == 0 {
+			cVerify(t, c)
+		}
+	}
+	cVerify(t, c)
+	testify_assert.GreaterOrEqual(t, cHeight(c), 3)
+}
+
+func TestBTree_Delete(t *testing.T) {
+	c := NewC()
+	rng := rand.New(rand.NewSource(2))
+	for i := 0; i < 2000; i++ {
+		c.Add(cBigKey(i), strings.Repeat("v", rng.Intn(1000)))
+	}
+	testify_assert.GreaterOrEqual(t, cHeight(c), 3)
+	for n, i := range rng.Perm(2000) {
+		testify_assert.True(t, c.Del(cBigKey(i)))
+		if n%100 == 0 {
+			cVerify(t, c)
+		}
+	}
+	cVerify(t, c)
+	// merged down to the root leaf with the dummy key
+	testify_assert.Equal(t, 1, cHeight(c))
+	testify_assert.Equal(t, uint16(1), c.tree.get(c.tree.root).nkeys())
+	testify_assert.Len(t, c.pages, 1)
+}
+
+// a big KV in the middle of a full leaf splits it into 3.
+func TestBTree_Split3(t *testing.T) {
+	c := NewC()
+	for i := 0; i < 40; i++ {
+		c.Add(fmt.Sprintf("key%02d", i), strings.Repeat("v", 80))
+	}
+	testify_assert.Equal(t, 1, cHeight(c))
+	big := "key20" + strings.Repeat("x", BTREE_MAX_KEY_SIZE-6)
+	c.Add(big, strings.Repeat("v", BTREE_MAX_VAL_SIZE))
+	cVerify(t, c)
+
+	root := c.tree.get(c.tree.root)
+	testify_assert.Equal(t, BNODE_NODE, root.btype())
+	testify_assert.Equal(t, uint16(3), root.nkeys())
+	middle := c.tree.get(root.getPtr(1))
+	testify_assert.Equal(t, uint16(1), middle.nkeys())
+	testify_assert.Equal(t, big, string(middle.getKey(0)))
+}
 
+func TestBTree_DeleteRange(t *testing.T) {
+	c := NewC()
+	rng := rand.New(rand.NewSource(3))
+	for i := 0; i < 2000; i++ {
+		c.Add(cBigKey(i), strings.Repeat("v", rng.Intn(1000)))
+	}
+	testify_assert.GreaterOrEqual(t, cHeight(c), 3)
+	for _, r := range [][2]int{{10, 20}, {500, 1500}, {1490, 1510}, {0, 5}, {1999, 2000}} {
+		c.DelRange(cBigKey(r[0]), cBigKey(r[1]))
+		cVerify(t, c)
+	}
+	// an empty range
+	c.DelRange(cBigKey(100), cBigKey(100))
+	cVerify(t, c)
+	// to the end, then everything, the dummy key stays
+	c.DelRange(cBigKey(1800), "")
+	cVerify(t, c)
+	c.DelRange("", "")
+	cVerify(t, c)
+	testify_assert.Equal(t, 1, cHeight(c))
+	testify_assert.Equal(t, uint16(1), c.tree.get(c.tree.root).nkeys())
 }
@@ -1,9 +1,150 @@
 package db
 
-import "testing"
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
 
 func TestC_Add(t *testing.T) {
 	c := NewC()
 	c.Add("key1", "val1")
 	c.PrintTree()
 }
+
+// keys cycle through a fixed key space, so after the first round every
+// insert is an update of an existing key.
+func BenchmarkC_Add(b *testing.B) {
+	c := NewC()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		c.tree.Insert([]byte(fmt.Sprintf("key%03d", i%100)), []byte("value"))
+	}
+}
+
+var (
+	cSeed = flag.Int64("c.seed", 1, "seed of TestC_Random, 0 picks one")
+	cOps  = flag.Int("c.ops", 1000000, "number of operations of TestC_Random, a tenth with -short")
+)
+
+// random inserts, updates and deletes checked against the reference map.
+// the path to the updated key is checked after every operation, the
+// whole tree every CHECK_EVERY operations. rerun a failure with -c.seed.
+func TestC_Random(t *testing.T) {
+	const CHECK_EVERY = 1000
+	seed := *cSeed
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	ops := *cOps
+	if testing.Short() {
+		ops /= 10
+	}
+	rng := rand.New(rand.NewSource(seed))
+	t.Cleanup(func() {
+		if t.Failed() {
+			t.Logf("reproduce with -c.seed=%d", seed)
+		}
+	})
+
+	c := NewC()
+	for i := 0; i < ops; i++ {
+		key := fmt.Sprintf("key%04d", rng.Intn(2000))
+		switch rng.Intn(4) {
+		case 0:
+			_, existed := c.ref[key]
+			if c.Del(key) != existed {
+				t.Fatalf("op %d: delete %s", i, key)
+			}
+		default:
+			c.Add(key, fmt.Sprintf("%0*d", rng.Intn(300), i))
+		}
+		if err := cVerifyPath(c, key); err != nil {
+			t.Fatalf("op %d: %s: %v", i, key, err)
+		}
+		// the full check is O(n)
+		if i%CHECK_EVERY == 0 || i == ops-1 {
+			cVerify(t, c)
+		}
+		if _, ok := c.tree.Get([]byte("missing")); ok {
+			t.Fatalf("op %d: found a missing key", i)
+		}
+	}
+}
+
+// check the nodes from the root to the leaf of a key, and its value.
+// the leaves are all at the depth of the first one.
+func cVerifyPath(c *C, key string) error {
+	tree := &c.tree
+	depth := 0
+	for ptr := tree.root; tree.get(ptr).btype() == BNODE_NODE; depth++ {
+		ptr = tree.get(ptr).getPtr(0)
+	}
+	first, end := []byte{}, []byte(nil)
+	ptr := tree.root
+	for d := 0; ; d++ {
+		node := tree.get(ptr)
+		if err := nodeCheck(node, tree.keyCmp()); err != nil {
+			return fmt.Errorf("page %d: %w", ptr, err)
+		}
+		nkeys := node.nkeys()
+		if !bytes.Equal(node.getKey(0), first) {
+			return fmt.Errorf("page %d: first key %q, expected %q", ptr, node.getKey(0), first)
+		}
+		if end != nil && bytes.Compare(node.getKey(nkeys-1), end) >= 0 {
+			return fmt.Errorf("page %d: key %q out of range", ptr, node.getKey(nkeys-1))
+		}
+		i := nodeLookupLE(node, []byte(key), bytes.Compare)
+		if node.btype() == BNODE_LEAF {
+			if d != depth {
+				return fmt.Errorf("page %d: leaf at depth %d, expected %d", ptr, d, depth)
+			}
+			val, ok := c.ref[key]
+			found := bytes.Equal(node.getKey(i), []byte(key))
+			if found != ok || found && string(node.getVal(i)) != val {
+				return fmt.Errorf("found %v, expected %v %q", found, ok, val)
+			}
+			return nil
+		}
+		if i+1 < nkeys {
+			end = node.getKey(i + 1)
+		}
+		first, ptr = node.getKey(i), node.getPtr(i)
+	}
+}
+
+// compare the tree with the reference map and check every node.
+func cVerify(t *testing.T, c *C) {
+	t.Helper()
+	if err := c.tree.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for k := range c.ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var got []string
+	treeScan(&c.tree, nil, func(key, val []byte) bool {
+		if len(key) > 0 { // the dummy key
+			got = append(got, string(key))
+			if c.ref[string(key)] != string(val) {
+				t.Fatalf("key %q has value %q, expected %q", key, val, c.ref[string(key)])
+			}
+		}
+		return true
+	})
+	if fmt.Sprint(got) != fmt.Sprint(keys) {
+		t.Fatalf("keys %v, expected %v", got, keys)
+	}
+	for _, k := range keys {
+		val, ok := c.tree.Get([]byte(k))
+		if !ok || string(val) != c.ref[k] {
+			t.Fatalf("get %q: %q %v, expected %q", k, val, ok, c.ref[k])
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package db
+
+import "container/list"
+
+// a fixed-size page cache with LRU eviction.
+// pages are immutable once written (copy-on-write), so an entry never
+// goes stale; it's only dropped when evicted or when the page is freed.
+type pageCache struct {
+	cap   int                      // max number of pages
+	lru   *list.List               // front is the most recently used
+	items map[uint64]*list.Element // page number -> element
+	stats CacheStats
+}
+
+type cacheEntry struct {
+	ptr  uint64
+	node BNode
+}
+
+// CacheStats counts page cache activity since the DB was opened.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+func newPageCache(capacity int) *pageCache {
+	return &pageCache{
+		cap:   capacity,
+		lru:   list.New(),
+		items: map[uint64]*list.Element{},
+	}
+}
+
+func (c *pageCache) get(ptr uint64) (BNode, bool) {
+	elem, ok := c.items[ptr]
+	if !ok {
+		c.stats.Misses++
+		return BNode{}, false
+	}
+	c.stats.Hits++
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).node, true
+}
+
+func (c *pageCache) put(ptr uint64, node BNode) {
+	if elem, ok := c.items[ptr]; ok {
+		elem.Value.(*cacheEntry).node = node
+		c.lru.MoveToFront(elem)
+		return
+	}
+	c.items[ptr] = c.lru.PushFront(&cacheEntry{ptr: ptr, node: node})
+	c.evict(c.lru.Len() - c.cap)
+}
+
+// drop the n least recently used pages.
+func (c *pageCache) evict(n int) {
+	for ; n > 0 && c.lru.Len() > 0; n-- {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).ptr)
+		c.stats.Evictions++
+	}
+}
+
+// without counting a hit or a miss.
+func (c *pageCache) has(ptr uint64) bool {
+	_, ok := c.items[ptr]
+	return ok
+}
+
+func (c *pageCache) remove(ptr uint64) {
+	if elem, ok := c.items[ptr]; ok {
+		c.lru.Remove(elem)
+		delete(c.items, ptr)
+	}
+}
+
+func (c *pageCache) len() int {
+	return c.lru.Len()
+}
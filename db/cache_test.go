@@ -0,0 +1,44 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestPageCache_LRU(t *testing.T) {
+	c := newPageCache(2)
+	c.put(1, BNode{data: []byte{1}})
+	c.put(2, BNode{data: []byte{2}})
+	_, ok := c.get(1) // 1 is now the most recently used
+	testify_assert.True(t, ok)
+	c.put(3, BNode{data: []byte{3}})
+
+	_, ok = c.get(2)
+	testify_assert.False(t, ok)
+	node, ok := c.get(3)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, []byte{3}, node.data)
+	testify_assert.Equal(t, 2, c.len())
+	testify_assert.Equal(t, CacheStats{Hits: 2, Misses: 1, Evictions: 1}, c.stats)
+
+	c.remove(3)
+	_, ok = c.get(3)
+	testify_assert.False(t, ok)
+}
+
+func TestKV_CacheHits(t *testing.T) {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{CacheSize: 16}}
+	testify_assert.NoError(t, db.Open())
+	defer db.Close()
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+
+	trace := &Trace{}
+	db.GetTraced([]byte("k"), trace)
+	testify_assert.False(t, trace.Steps[0].CacheHit)
+	trace = &Trace{}
+	db.GetTraced([]byte("k"), trace)
+	testify_assert.True(t, trace.Steps[0].CacheHit)
+	testify_assert.Equal(t, uint64(1), db.CacheStats().Hits)
+}
@@ -0,0 +1,154 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoSnapshot     = errors.New("no such snapshot")
+	ErrSnapshotExists = errors.New("snapshot already exists")
+)
+
+// the catalog is a second tree in the file, keyed by the names of the
+// persistent snapshots. the names starting with 0 are reserved for the
+// other entries, see TrainDict. its root is in the master page, after the
+// comparator name. it's in the clear in an encrypted master page, but
+// authenticated with the rest, see masterSeal.
+// | catalog_root |
+// |      8B      |
+const MASTER_CATALOG_OFFSET = MASTER_CMP_OFFSET + 1 + MASTER_CMP_NAME_MAX
+
+// a catalog entry.
+// | root | created (unix ns) |
+// |  8B  |        8B         |
+const CATALOG_VAL_SIZE = 16
+
+// SnapshotInfo describes a persistent snapshot, see KV.CreateSnapshot.
+type SnapshotInfo struct {
+	Name    string
+	Created time.Time
+}
+
+func catalogInit(db *KV, root uint64) {
+	db.catalog = BTree{root: root, get: db.pageGet, new: db.pageNew, del: db.pageDel}
+}
+
+// CreateSnapshot saves the current version of the KV under a name, in
+// the file. unlike Snapshot, it survives Close: its pages are not reused
+// until it's dropped, so the file keeps what it has changed since.
+// the buffered updates are committed first, see Options.MemtableSize.
+func (db *KV) CreateSnapshot(name string) (err error) {
+	defer catchPageError(&err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	if err := checkKV([]byte(name), nil); err != nil {
+		return fmt.Errorf("snapshot name: %w", err)
+	}
+	if catalogReserved([]byte(name)) {
+		return fmt.Errorf("snapshot name %q is reserved", name)
+	}
+	if _, ok := db.catalog.Get([]byte(name)); ok {
+		return fmt.Errorf("%w: %q", ErrSnapshotExists, name)
+	}
+	if walBuffered(db) {
+		if err := db.Flush(); err != nil {
+			return err
+		}
+	}
+	var val [CATALOG_VAL_SIZE]byte
+	binary.LittleEndian.PutUint64(val[0:], db.tree.root)
+	binary.LittleEndian.PutUint64(val[8:], uint64(time.Now().UnixNano()))
+	db.stats.shape.known = false // the catalog pages are not in the shape
+	db.catalog.Insert([]byte(name), val[:])
+	if db.AllocPolicy != ALLOC_APPEND {
+		treePages(&db.tree, db.free.kept.add)
+	}
+	return flushPages(db)
+}
+
+// OpenSnapshot opens a snapshot saved by CreateSnapshot. it must be
+// closed like the ones of Snapshot.
+func (db *KV) OpenSnapshot(name string) (s *Snapshot, err error) {
+	defer catchPageError(&err)
+	if db.closed {
+		return nil, ErrClosed
+	}
+	val, ok := db.catalog.Get([]byte(name))
+	if !ok || catalogReserved([]byte(name)) {
+		return nil, fmt.Errorf("%w: %q", ErrNoSnapshot, name)
+	}
+	s = &Snapshot{db: db, tree: db.tree, version: db.free.version}
+	s.tree.root = binary.LittleEndian.Uint64(val[0:])
+	// the pages stay if the snapshot is dropped while it's open
+	db.pin(s.version)
+	return s, nil
+}
+
+// DropSnapshot deletes a snapshot saved by CreateSnapshot, its pages
+// that are not used by the others are reused after that.
+func (db *KV) DropSnapshot(name string) (err error) {
+	defer catchPageError(&err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	if catalogReserved([]byte(name)) {
+		return fmt.Errorf("%w: %q", ErrNoSnapshot, name)
+	}
+	db.stats.shape.known = false
+	if !db.catalog.Delete([]byte(name)) {
+		return fmt.Errorf("%w: %q", ErrNoSnapshot, name)
+	}
+	if db.AllocPolicy != ALLOC_APPEND {
+		catalogRelease(db)
+	}
+	return flushPages(db)
+}
+
+// free the pages kept for the dropped snapshots alone: not used by the
+// others, by the tree, or already on their way out.
+func catalogRelease(db *KV) {
+	old := db.free.kept
+	db.free.kept = freeMap{}
+	catalogSnapshots(db, func(name []byte, root uint64) {
+		tree := BTree{root: root, get: db.pageGet}
+		treePages(&tree, db.free.kept.add)
+	})
+	inUse := freeMap{}
+	treePages(&db.tree, inUse.add)
+	for _, p := range db.free.pending {
+		inUse.add(p.ptr)
+	}
+	for ptr, ok := old.first(); ok; ptr, ok = old.next(ptr + 1) {
+		if !db.free.kept.has(ptr) && !inUse.has(ptr) {
+			// seen by the open snapshots of the current version
+			db.free.pending = append(db.free.pending, freedPage{ptr, db.free.version})
+		}
+	}
+}
+
+// Snapshots lists the snapshots saved by CreateSnapshot by name.
+func (db *KV) Snapshots() (list []SnapshotInfo, err error) {
+	defer catchPageError(&err)
+	treeScan(&db.catalog, nil, func(key, val []byte) bool {
+		if len(key) > 0 && !catalogReserved(key) { // not the dummy key
+			nanos := binary.LittleEndian.Uint64(val[8:])
+			list = append(list, SnapshotInfo{Name: string(key), Created: time.Unix(0, int64(nanos))})
+		}
+		return true
+	})
+	return list, nil
+}
+
+// call fn on every persistent snapshot.
+func catalogSnapshots(db *KV, fn func(name []byte, root uint64)) {
+	treeScan(&db.catalog, nil, func(key, val []byte) bool {
+		if len(key) > 0 && !catalogReserved(key) {
+			fn(key, binary.LittleEndian.Uint64(val[0:]))
+		}
+		return true
+	})
+}
@@ -0,0 +1,199 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+)
+
+// Check verifies the whole tree and returns every problem found,
+// nil if the database is consistent:
+//   - every node decodes: type, offsets and sizes are in range
+//   - keys are sorted within and across nodes, each kid starts with
+//     the key its parent has for it
+//   - pointers are in the file and no page is referenced twice
+//   - all leaves are at the same depth
+//
+// there is no free list yet, so pages not in the tree are just unused.
+func (db *KV) Check() []error {
+	return db.CheckContext(context.Background())
+}
+
+// same as Check, the error of ctx is the last one if it's done before the end.
+func (db *KV) CheckContext(ctx context.Context) []error {
+	c := checker{ctx: ctx, db: db, seen: map[uint64]bool{}, leafDepth: -1}
+	if db.tree.root != 0 {
+		c.walk(db.tree.root, 0, []byte{}, nil)
+	}
+	if err := ctx.Err(); err != nil {
+		c.errs = append(c.errs, err)
+	}
+	return c.errs
+}
+
+type checker struct {
+	ctx       context.Context
+	db        *KV
+	seen      map[uint64]bool
+	leafDepth int
+	errs      []error
+}
+
+func (c *checker) fail(ptr uint64, format string, args ...any) {
+	c.errs = append(c.errs, fmt.Errorf("page %d: %s", ptr, fmt.Sprintf(format, args...)))
+}
+
+// check the subtree at ptr, whose keys must be in [first, end).
+// a nil end is unbounded.
+func (c *checker) walk(ptr uint64, depth int, first []byte, end []byte) {
+	if c.ctx.Err() != nil {
+		return
+	}
+	if ptr == 0 || ptr >= c.db.page.flushed {
+		c.fail(ptr, "pointer out of the file (%d pages)", c.db.page.flushed)
+		return
+	}
+	if c.seen[ptr] {
+		c.fail(ptr, "referenced twice")
+		return
+	}
+	c.seen[ptr] = true
+
+	node, err := c.read(ptr)
+	if err != nil {
+		c.errs = append(c.errs, err)
+		return
+	}
+	if err := nodeCheck(node, c.db.tree.keyCmp()); err != nil {
+		c.fail(ptr, "%v", err)
+		return
+	}
+	nkeys := node.nkeys()
+	if !bytes.Equal(node.getKey(0), first) {
+		c.fail(ptr, "first key %s, the parent says %s", dumpBytes(node.getKey(0)), dumpBytes(first))
+	}
+	if last := node.getKey(nkeys - 1); end != nil && c.db.tree.keyCmp()(last, end) >= 0 {
+		c.fail(ptr, "key %s is not below the next key of the parent %s", dumpBytes(last), dumpBytes(end))
+	}
+
+	if node.btype() == BNODE_LEAF {
+		if c.leafDepth < 0 {
+			c.leafDepth = depth
+		} else if depth != c.leafDepth {
+			c.fail(ptr, "leaf at depth %d, expected %d", depth, c.leafDepth)
+		}
+		return
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		kidEnd := end
+		if i+1 < nkeys {
+			kidEnd = node.getKey(i + 1)
+		}
+		c.walk(node.getPtr(i), depth+1, node.getKey(i), kidEnd)
+	}
+}
+
+// Verify is a quick structural check of the tree for tests: every node
+// decodes, keys are sorted and within the range of their parent, the
+// leaves are at the same depth and the dummy key is in place.
+// it stops at the first problem, see KV.Check for a full report.
+func (tree *BTree) Verify() error {
+	if tree.root == 0 {
+		return nil
+	}
+	depth := -1
+	return verifyNode(tree, tree.root, 0, &depth, []byte{}, nil)
+}
+
+// Verify runs BTree.Verify on the tree of the database.
+func (db *KV) Verify() (err error) {
+	defer catchPageError(&err)
+	return db.tree.Verify()
+}
+
+func verifyNode(tree *BTree, ptr uint64, depth int, leafDepth *int, first []byte, end []byte) error {
+	node := tree.get(ptr)
+	if err := nodeCheck(node, tree.keyCmp()); err != nil {
+		return fmt.Errorf("page %d: %w", ptr, err)
+	}
+	nkeys := node.nkeys()
+	if !bytes.Equal(node.getKey(0), first) {
+		return fmt.Errorf("page %d: first key %s, expected %s", ptr, dumpBytes(node.getKey(0)), dumpBytes(first))
+	}
+	if end != nil && tree.keyCmp()(node.getKey(nkeys-1), end) >= 0 {
+		return fmt.Errorf("page %d: key %s out of range", ptr, dumpBytes(node.getKey(nkeys-1)))
+	}
+	if node.btype() == BNODE_LEAF {
+		if *leafDepth < 0 {
+			*leafDepth = depth
+		}
+		if depth != *leafDepth {
+			return fmt.Errorf("page %d: leaf at depth %d, expected %d", ptr, depth, *leafDepth)
+		}
+		return nil
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		kidEnd := end
+		if i+1 < nkeys {
+			kidEnd = node.getKey(i + 1)
+		}
+		if err := verifyNode(tree, node.getPtr(i), depth+1, leafDepth, node.getKey(i), kidEnd); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// a page that fails to decrypt or to verify is reported instead of
+// panicking. the error names the page.
+func (c *checker) read(ptr uint64) (node BNode, err error) {
+	defer catchPageError(&err)
+	return c.db.pageRead(ptr), nil
+}
+
+// check that a node decodes and its keys are sorted,
+// without trusting any of its fields.
+func nodeCheck(node BNode, keyCmp func(a, b []byte) int) error {
+	btype := node.btype()
+	if btype != BNODE_NODE && btype != BNODE_LEAF {
+		return fmt.Errorf("bad node type %d", btype)
+	}
+	nkeys := int(node.nkeys())
+	if nkeys == 0 {
+		return fmt.Errorf("empty node")
+	}
+	base := HEADER + 10*nkeys
+	if base > BNODE_MAX_SIZE {
+		return fmt.Errorf("too many keys (%d)", nkeys)
+	}
+	pos := base // start of the current KV
+	for i := 1; i <= nkeys; i++ {
+		if pos+4 > BNODE_MAX_SIZE {
+			return fmt.Errorf("KV %d out of the page", i-1)
+		}
+		klen := int(binary.LittleEndian.Uint16(node.data[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(node.data[pos+2:]))
+		next := pos + 4 + klen + vlen
+		if next > BNODE_MAX_SIZE {
+			return fmt.Errorf("KV %d out of the page", i-1)
+		}
+		if off := int(node.getOffset(uint16(i))); base+off != next {
+			return fmt.Errorf("offset %d is %d, the KV ends at %d", i, off, next-base)
+		}
+		if klen > BTREE_MAX_KEY_SIZE || vlen > BTREE_MAX_VAL_SIZE {
+			return fmt.Errorf("KV %d too large", i-1)
+		}
+		if btype == BNODE_NODE && vlen != 0 {
+			return fmt.Errorf("internal node with a value at %d", i-1)
+		}
+		pos = next
+	}
+	for i := uint16(1); i < uint16(nkeys); i++ {
+		if keyCmp(node.getKey(i-1), node.getKey(i)) >= 0 {
+			return fmt.Errorf("key %d %s is not above key %d %s",
+				i, dumpBytes(node.getKey(i)), i-1, dumpBytes(node.getKey(i-1)))
+		}
+	}
+	return nil
+}
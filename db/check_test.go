@@ -0,0 +1,65 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestNodeCheck(t *testing.T) {
+	node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	node.setHeader(BNODE_LEAF, 2)
+	nodeAppendKV(node, 0, 0, []byte("b"), []byte("1"))
+	nodeAppendKV(node, 1, 0, []byte("c"), []byte("2"))
+	testify_assert.NoError(t, nodeCheck(node, bytes.Compare))
+
+	node.data[HEADER+10*2+4] = 'd' // the first key
+	testify_assert.ErrorContains(t, nodeCheck(node, bytes.Compare), "is not above")
+
+	node.setOffset(2, 4000)
+	testify_assert.ErrorContains(t, nodeCheck(node, bytes.Compare), "offset 2")
+
+	node.setHeader(BNODE_LEAF, 1000)
+	testify_assert.ErrorContains(t, nodeCheck(node, bytes.Compare), "too many keys")
+
+	node.setHeader(7, 1)
+	testify_assert.ErrorContains(t, nodeCheck(node, bytes.Compare), "bad node type")
+}
+
+func TestKV_Check(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.Nil(t, db.Check())
+	testify_assert.NoError(t, db.Set([]byte("k1"), []byte("v1")))
+	testify_assert.NoError(t, db.Set([]byte("k2"), []byte("v2")))
+	testify_assert.Nil(t, db.Check())
+
+	// overwrite the header of the root leaf
+	root := db.tree.root
+	db.Close()
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	testify_assert.NoError(t, err)
+	_, err = fp.WriteAt([]byte{9, 0}, int64(root*BTREE_PAGE_SIZE))
+	testify_assert.NoError(t, err)
+	fp.Close()
+
+	testify_assert.NoError(t, db.Open())
+	errs := db.Check()
+	testify_assert.Len(t, errs, 1)
+	testify_assert.ErrorContains(t, errs[0], "page 2: page checksum mismatch")
+}
+
+func TestBTree_Verify(t *testing.T) {
+	c := NewC()
+	testify_assert.NoError(t, c.tree.Verify())
+	c.Add("k1", "v1")
+	c.Add("k2", "v2")
+	testify_assert.NoError(t, c.tree.Verify())
+
+	// swap the keys in place
+	root := c.tree.get(c.tree.root)
+	copy(root.getKey(1), "k2")
+	copy(root.getKey(2), "k1")
+	testify_assert.ErrorContains(t, c.tree.Verify(), "is not above")
+}
@@ -0,0 +1,43 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+)
+
+// page checksums. a new DB stores the CRC32C of the page number and
+// the node data at the start of the page trailer.
+// | node data | crc32c | unused |
+// |    ...    |   4B   |        |
+// an encrypted page is already authenticated by its GCM tag instead.
+const MASTER_CHECKSUMS uint64 = 1 << 2
+
+const PAGE_CHECKSUM_OFFSET = BNODE_MAX_SIZE
+
+var ErrChecksum = errors.New("page checksum mismatch")
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// called after cryptInit, only a new DB gets checksums.
+func checksumInit(db *KV) {
+	if dbIsNew(db) && db.crypt.aead == nil {
+		db.flags |= MASTER_CHECKSUMS
+	}
+}
+
+func pageChecksum(ptr uint64, page []byte) uint32 {
+	var num [8]byte
+	binary.LittleEndian.PutUint64(num[:], ptr)
+	sum := crc32.Update(0, crc32c, num[:])
+	return crc32.Update(sum, crc32c, page[:BNODE_MAX_SIZE])
+}
+
+// stamp a page written to the file.
+func pageStamp(ptr uint64, page []byte) {
+	binary.LittleEndian.PutUint32(page[PAGE_CHECKSUM_OFFSET:], pageChecksum(ptr, page))
+}
+
+func pageVerify(ptr uint64, page []byte) bool {
+	return binary.LittleEndian.Uint32(page[PAGE_CHECKSUM_OFFSET:]) == pageChecksum(ptr, page)
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// the KVs copied per commit by CloneTo and a Loader
+const CLONE_BATCH = 1000
+
+// CloneTo writes a copy of the last commit of the KV to a new file.
+// the copy is compact: the tree is rebuilt without the free pages and the
+// persistent snapshots. it has the options of the KV changed by opts; the
+// values are recoded if the compression or the encryption key differs.
+//
+// it reads the KV through BeginRead, so it can run in its own goroutine
+// while the KV is updated and read by others. the updates still in the
+// write buffer are not copied, see Flush and Options.MemtableSize.
+func (db *KV) CloneTo(path string, opts ...Option) (err error) {
+	o := db.Options
+	o.ReadOnly, o.MemtableSize = false, 0
+	for _, opt := range opts {
+		opt(&o)
+	}
+	dst := &KV{Path: path, Options: o}
+	fs := dst.vfs()
+	if fp, err := fs.OpenFile(path, os.O_RDONLY, 0); err == nil {
+		_ = fp.Close()
+		return fmt.Errorf("clone: %s: %w", path, os.ErrExist)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("clone: %w", err)
+	}
+	r := db.BeginRead()
+	defer r.Close()
+
+	if err := dst.Open(); err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	defer func() {
+		dst.Close()
+		if err != nil {
+			// the side files are saved by Close
+			for _, name := range []string{path, bloomPath(dst), freePath(dst)} {
+				_ = fs.Remove(name)
+			}
+		}
+	}()
+
+	// the intermediate commits don't need to be durable, see Tx.CommitNoSync
+	dst.syncSkip = true
+	n := 0
+	scanErr := r.Scan(nil, func(key, val []byte) bool {
+		if err = cloneSet(dst, key, val); err != nil {
+			return false
+		}
+		if n++; n%CLONE_BATCH == 0 {
+			err = flushPages(dst)
+		}
+		return err == nil
+	})
+	if err == nil {
+		err = scanErr
+	}
+	if err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	if dst.bloom != nil {
+		bloomRebuild(dst) // sized for the copied keys
+	}
+	dst.syncSkip = false
+	if err = flushPages(dst); err != nil {
+		return fmt.Errorf("clone: %w", err)
+	}
+	return nil
+}
+
+// insert without a commit, see flushPages.
+func cloneSet(dst *KV, key, val []byte) (err error) {
+	defer catchPageError(&err)
+	stored := encodeValue(dst, val)
+	if err := checkKV(key, stored); err != nil {
+		return err
+	}
+	if dst.bloom != nil {
+		dst.bloom.add(key)
+	}
+	dst.tree.Insert(key, stored)
+	return nil
+}
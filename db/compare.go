@@ -0,0 +1,134 @@
+package db
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Comparator orders the keys of a DB. the empty key is reserved and
+// must sort before every other key.
+type Comparator interface {
+	// kept in the master page, the DB can only be reopened with
+	// a comparator of the same name.
+	Name() string
+	Compare(a, b []byte) int
+}
+
+// the raw byte order, the default.
+var Bytewise Comparator = bytewise{}
+
+// ASCII letters compare equal regardless of case, so setting "Key"
+// updates "key".
+var CaseInsensitive Comparator = caseInsensitive{}
+
+// same for all the letters of UTF-8 keys, with the Unicode simple case
+// folding, so "straße" and "STRASSE" differ but "ǅ" and "ǆ" don't. the
+// keys are ordered by the code points of the folded letters.
+var UnicodeCaseInsensitive Comparator = unicodeCaseInsensitive{}
+
+type bytewise struct{}
+
+func (bytewise) Name() string            { return "godb.bytewise" }
+func (bytewise) Compare(a, b []byte) int { return bytes.Compare(a, b) }
+
+type caseInsensitive struct{}
+
+func (caseInsensitive) Name() string { return "godb.case-insensitive" }
+func (caseInsensitive) Compare(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		ca, cb := lower(a[i]), lower(b[i])
+		if ca != cb {
+			if ca < cb {
+				return -1
+			}
+			return +1
+		}
+	}
+	return len(a) - len(b)
+}
+
+type unicodeCaseInsensitive struct{}
+
+func (unicodeCaseInsensitive) Name() string { return "godb.unicode-ci" }
+func (unicodeCaseInsensitive) Compare(a, b []byte) int {
+	for len(a) > 0 && len(b) > 0 {
+		ra, na := foldRune(a)
+		rb, nb := foldRune(b)
+		if ra != rb {
+			if ra < rb {
+				return -1
+			}
+			return +1
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return len(a) - len(b)
+}
+
+// the smallest rune of the case folding orbit of the first rune. a byte
+// that isn't UTF-8 sorts after the runes, by its value.
+func foldRune(key []byte) (rune, int) {
+	r, n := utf8.DecodeRune(key)
+	if r == utf8.RuneError && n == 1 {
+		return unicode.MaxRune + 1 + rune(key[0]), 1
+	}
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min, n
+}
+
+func lower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+// the comparator name in the master page, after the crypt area.
+// an empty name is the bytewise order.
+// | len | name |
+// | 1B  | ...  |
+const (
+	MASTER_CMP_OFFSET   = MASTER_CRYPT_OFFSET + MASTER_CRYPT_SIZE
+	MASTER_CMP_NAME_MAX = 63
+)
+
+// called after masterLoad, which sets db.cmpName.
+func cmpInit(db *KV) error {
+	cmp := db.Comparator
+	if cmp == nil {
+		cmp = Bytewise
+	}
+	name := cmp.Name()
+	if cmp == Bytewise {
+		name = ""
+	}
+	if len(name) > MASTER_CMP_NAME_MAX {
+		return fmt.Errorf("comparator name %q is too long", name)
+	}
+	if dbIsNew(db) {
+		db.cmpName = name
+	}
+	if db.cmpName != name {
+		stored := db.cmpName
+		if stored == "" {
+			stored = Bytewise.Name()
+		}
+		return fmt.Errorf("the database uses the %q comparator, not %q", stored, cmp.Name())
+	}
+	if cmp != Bytewise {
+		// the filter hashes the raw bytes of equal keys differently
+		if db.BloomBitsPerKey > 0 {
+			return errors.New("the bloom filter needs the bytewise comparator")
+		}
+		db.tree.cmp = cmp.Compare
+	}
+	return nil
+}
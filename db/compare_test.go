@@ -0,0 +1,79 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_Comparator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithComparator(CaseInsensitive))
+	testify_assert.NoError(t, err)
+	for _, k := range []string{"b", "A", "C", "a"} {
+		testify_assert.NoError(t, db.Set([]byte(k), []byte(k)))
+	}
+	val, ok, err := db.Get([]byte("B"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "b", string(val))
+	var keys []string
+	testify_assert.NoError(t, db.Scan([]byte("B"), func(key, val []byte) bool {
+		keys = append(keys, string(key)+"="+string(val))
+		return true
+	}))
+	testify_assert.Equal(t, []string{"b=b", "C=C"}, keys)
+	testify_assert.Nil(t, db.Check())
+	testify_assert.NoError(t, db.Verify())
+	db.Close()
+
+	// the name is kept in the master page
+	_, err = Open(path)
+	testify_assert.ErrorContains(t, err, `uses the "godb.case-insensitive" comparator`)
+	_, err = Open(path, WithComparator(CaseInsensitive), WithBloomFilter(10))
+	testify_assert.ErrorContains(t, err, "bytewise")
+	db, err = Open(path, WithComparator(CaseInsensitive))
+	testify_assert.NoError(t, err)
+	db.Close()
+
+	// and the bytewise order is the default
+	path = filepath.Join(t.TempDir(), "bytewise.db")
+	db, err = Open(path)
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	db.Close()
+	_, err = Open(path, WithComparator(CaseInsensitive))
+	testify_assert.ErrorContains(t, err, `uses the "godb.bytewise" comparator`)
+	db, err = Open(path, WithComparator(Bytewise))
+	testify_assert.NoError(t, err)
+	db.Close()
+}
+
+func TestUnicodeCaseInsensitive(t *testing.T) {
+	cmp := UnicodeCaseInsensitive.Compare
+	testify_assert.Zero(t, cmp([]byte("Ärger"), []byte("äRGER")))
+	testify_assert.Zero(t, cmp([]byte("ΣΊΣΥΦΟΣ"), []byte("σίσυφος")))
+	testify_assert.Zero(t, cmp([]byte("K"), []byte("K"))) // the Kelvin sign
+	testify_assert.Negative(t, cmp([]byte("a"), []byte("B")))
+	testify_assert.Negative(t, cmp([]byte("Z"), []byte("é")))
+	testify_assert.Negative(t, cmp([]byte("ab"), []byte("ABC")))
+	testify_assert.Positive(t, cmp([]byte("\xff"), []byte("\xfe\xff")))
+	testify_assert.Negative(t, cmp(nil, []byte("a")))
+
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithComparator(UnicodeCaseInsensitive))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.NoError(t, db.Set([]byte("Éclair"), []byte("1")))
+	testify_assert.NoError(t, db.Set([]byte("éCLAIR"), []byte("2")))
+	val, ok, err := db.Get([]byte("ÉCLAIR"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, []byte("2"), val)
+	n := 0
+	testify_assert.NoError(t, db.ScanKeys(nil, func(key []byte) bool {
+		n++
+		return true
+	}))
+	testify_assert.Equal(t, 1, n)
+}
@@ -0,0 +1,129 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// value codecs. once a DB is created with compression, every value
+// starts with 1 byte saying how the rest of it is encoded.
+// | codec | payload |
+// |  1B   |   ...   |
+const (
+	COMPRESS_NONE   uint8 = 0
+	COMPRESS_SNAPPY uint8 = 1
+	COMPRESS_ZSTD   uint8 = 2
+	// with the shared dictionary of the small values, see KV.TrainDict
+	COMPRESS_ZSTD_DICT uint8 = 3
+)
+
+// values shorter than this are not worth compressing by default
+const COMPRESS_MIN_SIZE = 64
+
+// master page flags
+const (
+	MASTER_TAGGED_VALUES uint64 = 1 << 0 // values carry a codec byte
+)
+
+func compressInit(db *KV) error {
+	switch db.Compression {
+	case COMPRESS_NONE, COMPRESS_SNAPPY, COMPRESS_ZSTD:
+	default:
+		return fmt.Errorf("unknown compression codec %d", db.Compression)
+	}
+	if db.Compression != COMPRESS_NONE {
+		if dbIsNew(db) {
+			db.flags |= MASTER_TAGGED_VALUES // a new DB
+		}
+		if db.flags&MASTER_TAGGED_VALUES == 0 {
+			return errors.New("compression can only be enabled on a new database")
+		}
+	}
+	if db.flags&MASTER_TAGGED_VALUES == 0 {
+		return nil
+	}
+
+	var err error
+	db.codec.zenc, err = zstd.NewWriter(nil)
+	if err != nil {
+		return fmt.Errorf("zstd: %w", err)
+	}
+	db.codec.zdec, err = zstd.NewReader(nil)
+	if err != nil {
+		return fmt.Errorf("zstd: %w", err)
+	}
+	return dictLoad(db)
+}
+
+// the value as stored in the tree.
+func encodeValue(db *KV, val []byte) []byte {
+	if db.flags&MASTER_TAGGED_VALUES == 0 {
+		return val
+	}
+	if db.Compression == COMPRESS_ZSTD && db.codec.denc != nil && len(val) < dictMax(db) {
+		out := db.codec.denc.EncodeAll(val, []byte{COMPRESS_ZSTD_DICT})
+		if len(out) < 1+len(val) {
+			return out
+		}
+		return append([]byte{COMPRESS_NONE}, val...)
+	}
+	min := db.CompressMin
+	if min == 0 {
+		min = COMPRESS_MIN_SIZE
+	}
+	if db.Compression != COMPRESS_NONE && len(val) >= min {
+		var out []byte
+		switch db.Compression {
+		case COMPRESS_SNAPPY:
+			out = append([]byte{0}, snappy.Encode(nil, val)...)
+		case COMPRESS_ZSTD:
+			out = db.codec.zenc.EncodeAll(val, []byte{0})
+		}
+		// keep the raw value if compression doesn't pay off
+		if len(out) < 1+len(val) {
+			out[0] = db.Compression
+			return out
+		}
+	}
+	return append([]byte{COMPRESS_NONE}, val...)
+}
+
+// the value as seen by the user.
+func decodeValue(db *KV, stored []byte) []byte {
+	if db.flags&MASTER_TAGGED_VALUES == 0 {
+		return stored
+	}
+	assert(len(stored) >= 1)
+	payload := stored[1:]
+	switch stored[0] {
+	case COMPRESS_NONE:
+		return payload
+	case COMPRESS_SNAPPY:
+		val, err := snappy.Decode(nil, payload)
+		if err != nil {
+			panic("bad snappy value")
+		}
+		return val
+	case COMPRESS_ZSTD:
+		val, err := db.codec.zdec.DecodeAll(payload, nil)
+		if err != nil {
+			panic("bad zstd value")
+		}
+		return val
+	case COMPRESS_ZSTD_DICT:
+		dec := db.codec.ddec.Load()
+		if dec == nil {
+			panic("no zstd dictionary")
+		}
+		val, err := dec.DecodeAll(payload, nil)
+		if err != nil {
+			panic("bad zstd value")
+		}
+		return val
+	default:
+		panic("bad value codec")
+	}
+}
@@ -0,0 +1,50 @@
+package db
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_Compression(t *testing.T) {
+	for _, codec := range []uint8{COMPRESS_SNAPPY, COMPRESS_ZSTD} {
+		path := filepath.Join(t.TempDir(), "test.db")
+		db := &KV{Path: path, Options: Options{Compression: codec}}
+		testify_assert.NoError(t, db.Open())
+
+		big := bytes.Repeat([]byte("abcd"), 500)
+		testify_assert.NoError(t, db.Set([]byte("big"), big))
+		testify_assert.NoError(t, db.Set([]byte("small"), []byte("x")))
+
+		stored, ok := db.tree.Get([]byte("big"))
+		testify_assert.True(t, ok)
+		testify_assert.Equal(t, codec, stored[0])
+		testify_assert.Less(t, len(stored), len(big))
+		stored, _ = db.tree.Get([]byte("small"))
+		testify_assert.Equal(t, []byte{COMPRESS_NONE, 'x'}, stored)
+		db.Close()
+
+		// the codec is recorded per value, reading needs no options
+		db = &KV{Path: path}
+		testify_assert.NoError(t, db.Open())
+		val, ok, _ := db.Get([]byte("big"))
+		testify_assert.True(t, ok)
+		testify_assert.Equal(t, big, val)
+		val, _, _ = db.Get([]byte("small"))
+		testify_assert.Equal(t, "x", string(val))
+		db.Close()
+	}
+}
+
+func TestKV_CompressionExistingDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	testify_assert.NoError(t, db.Open())
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	db.Close()
+
+	db = &KV{Path: path, Options: Options{Compression: COMPRESS_ZSTD}}
+	testify_assert.Error(t, db.Open())
+}
@@ -0,0 +1,309 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// the crash simulation: the writes and syncs of a commit are recorded,
+// then for every crash point the file is rebuilt as the disk could have
+// it: every write before the last sync, plus each of the later writes
+// either lost, torn or done. unsynced writes may reach the disk in any
+// order, and they never overlap, so trying all the subsets covers all
+// the orders. the rebuilt file must open to the state before or after
+// the commit.
+
+// a write is atomic per sector
+const CRASH_SECTOR = 512
+
+type crashEvent struct {
+	sync bool
+	off  int64
+	data []byte
+}
+
+type recordFS struct {
+	OSFS
+	events []crashEvent
+}
+
+type recordFile struct {
+	*os.File
+	fs *recordFS
+}
+
+func (fs *recordFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fp, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &recordFile{File: fp, fs: fs}, nil
+}
+
+func (f *recordFile) WriteAt(data []byte, off int64) (int, error) {
+	f.fs.events = append(f.fs.events, crashEvent{off: off, data: append([]byte(nil), data...)})
+	return f.File.WriteAt(data, off)
+}
+
+func (f *recordFile) Sync() error {
+	f.fs.events = append(f.fs.events, crashEvent{sync: true})
+	return f.File.Sync()
+}
+
+func crashState(t *testing.T, path string) (string, error) {
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		return "", err
+	}
+	defer db.Close()
+	if errs := db.Check(); errs != nil {
+		return "", fmt.Errorf("check: %v", errs)
+	}
+	state := ""
+	db.Scan(nil, func(key, val []byte) bool {
+		state += fmt.Sprintf("%q=%q ", key, val)
+		return true
+	})
+	return state, nil
+}
+
+// run setup, then simulate a crash at every point of commit.
+func crashTest(t *testing.T, setup func(db *KV), commit func(db *KV) error) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	setup(db)
+	db.Close()
+	pre, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := crashState(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &recordFS{}
+	db = &KV{Path: path, Options: Options{FS: fs}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := commit(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := crashState(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	image := filepath.Join(dir, "crash.db")
+	for point := 0; point <= len(fs.events); point++ {
+		// the file is extended before any write
+		base := make([]byte, fi.Size())
+		copy(base, pre)
+		var unsynced []crashEvent
+		for _, ev := range fs.events[:point] {
+			if !ev.sync {
+				unsynced = append(unsynced, ev)
+				continue
+			}
+			for _, w := range unsynced {
+				copy(base[w.off:], w.data)
+			}
+			unsynced = nil
+		}
+
+		// each unsynced write is lost (0), torn (1) or done (2)
+		ncombo := 1
+		for range unsynced {
+			ncombo *= 3
+		}
+		for combo := 0; combo < ncombo; combo++ {
+			data := append([]byte(nil), base...)
+			desc := ""
+			for i, c := 0, combo; i < len(unsynced); i, c = i+1, c/3 {
+				w := unsynced[i]
+				switch c % 3 {
+				case 1:
+					if len(w.data) <= CRASH_SECTOR {
+						continue // can't be torn
+					}
+					copy(data[w.off:], w.data[:len(w.data)/2/CRASH_SECTOR*CRASH_SECTOR])
+					desc += fmt.Sprintf(" torn@%d", w.off)
+				case 2:
+					copy(data[w.off:], w.data)
+					desc += fmt.Sprintf(" done@%d", w.off)
+				}
+			}
+			if err := os.WriteFile(image, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			state, err := crashState(t, image)
+			if err != nil {
+				t.Fatalf("crash after event %d,%s: %v", point, desc, err)
+			}
+			if state != before && state != after {
+				t.Fatalf("crash after event %d,%s: state %s", point, desc, state)
+			}
+		}
+	}
+}
+
+func TestCrash_Insert(t *testing.T) {
+	crashTest(t, func(db *KV) {
+		db.Set([]byte("k1"), []byte("v1"))
+	}, func(db *KV) error {
+		return db.Set([]byte("k2"), []byte("v2"))
+	})
+}
+
+func TestCrash_Update(t *testing.T) {
+	crashTest(t, func(db *KV) {
+		db.Set([]byte("k1"), []byte("v1"))
+		db.Set([]byte("k2"), []byte("v2"))
+	}, func(db *KV) error {
+		return db.Set([]byte("k1"), []byte("v1b"))
+	})
+}
+
+func TestCrash_Delete(t *testing.T) {
+	crashTest(t, func(db *KV) {
+		db.Set([]byte("k1"), []byte("v1"))
+		db.Set([]byte("k2"), []byte("v2"))
+	}, func(db *KV) error {
+		_, err := db.Del([]byte("k1"))
+		return err
+	})
+}
+
+// the first commit also writes the first master page
+func TestCrash_First(t *testing.T) {
+	crashTest(t, func(db *KV) {}, func(db *KV) error {
+		return db.Set([]byte("k1"), []byte("v1"))
+	})
+}
+
+// a Tx updating a row and its index entry, in 2 ranges of keys on
+// different leaves, is committed as a whole or not at all.
+func TestCrash_Tx(t *testing.T) {
+	val := string(make([]byte, 200))
+	crashTest(t, func(db *KV) {
+		for i := 0; i < 20; i++ {
+			db.Set([]byte(fmt.Sprintf("index/%02d", i)), []byte(val))
+			db.Set([]byte(fmt.Sprintf("row/%02d", i)), []byte(val))
+		}
+	}, func(db *KV) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		tx.Set([]byte("row/05"), []byte("new"))
+		tx.Del([]byte("index/05"))
+		tx.Set([]byte("index/new"), []byte("05"))
+		tx.Set([]byte("row/20"), []byte("v20"))
+		return tx.Commit()
+	})
+}
+
+// the commits with Tx.CommitNoSync don't reuse the pages of the last
+// synced version: the disk may have their pages but not their master
+// page, which must find that version intact.
+func TestCrash_NoSync(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db := &KV{Path: path}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		db.Set([]byte(fmt.Sprintf("key%03d", i)), []byte("old"))
+	}
+	db.Close()
+	pre, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := crashState(t, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fs := &recordFS{}
+	db = &KV{Path: path, Options: Options{FS: fs}}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 3; i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 200; j += 7 {
+			tx.Set([]byte(fmt.Sprintf("key%03d", j)), []byte(fmt.Sprint("new", i)))
+		}
+		if err := tx.CommitNoSync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, fi.Size())
+	copy(data, pre)
+	for _, ev := range fs.events {
+		if !ev.sync && ev.off >= BTREE_PAGE_SIZE {
+			copy(data[ev.off:], ev.data)
+		}
+	}
+	image := filepath.Join(dir, "crash.db")
+	if err := os.WriteFile(image, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	state, err := crashState(t, image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state != before {
+		t.Fatalf("state %s", state)
+	}
+
+	// reused once a commit is synced
+	if err := db.Set([]byte("key000"), []byte("synced")); err != nil {
+		t.Fatal(err)
+	}
+	if db.free.pages.count == 0 {
+		t.Fatal("the freed pages are not reused")
+	}
+}
+
+// a commit with Tx.CommitNoSync isn't synced after its master page, but
+// its pages are before it: the disk can't have the master page alone.
+func TestCrash_CommitNoSync(t *testing.T) {
+	crashTest(t, func(db *KV) {
+		db.Set([]byte("k1"), []byte("v1"))
+		db.Set([]byte("k2"), []byte("v2"))
+	}, func(db *KV) error {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback()
+		tx.Set([]byte("k1"), []byte("v1b"))
+		tx.Set([]byte("k3"), []byte("v3"))
+		return tx.CommitNoSync()
+	})
+}
@@ -0,0 +1,186 @@
+package db
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryption at rest. every page is sealed with AES-256-GCM, the nonce
+// and the auth tag go into the page trailer. the page number is the
+// additional data, so a page can't be moved to another location.
+// | ciphertext | tag | nonce |
+// |  node data | 16B |  12B  |
+//
+// the key is derived from KV.EncryptionKey with scrypt and a random
+// per-file salt kept in the master page.
+const MASTER_ENCRYPTED uint64 = 1 << 1
+
+const (
+	CRYPT_SALT_SIZE  = 16
+	CRYPT_NONCE_SIZE = 12
+	CRYPT_TAG_SIZE   = 16
+)
+
+var ErrDecrypt = errors.New("decryption failed: wrong key or corrupted data")
+
+func init() {
+	assert(CRYPT_TAG_SIZE+CRYPT_NONCE_SIZE <= PAGE_TRAILER)
+}
+
+// derive the page key from the user key and the salt.
+func cryptSetup(db *KV, salt []byte) error {
+	key, err := scrypt.Key(db.EncryptionKey, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return fmt.Errorf("scrypt: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return fmt.Errorf("aes: %w", err)
+	}
+	db.crypt.aead, err = cipher.NewGCM(block)
+	if err != nil {
+		return fmt.Errorf("gcm: %w", err)
+	}
+	db.crypt.salt = salt
+	return nil
+}
+
+// called after masterLoad, an existing encrypted DB is already set up.
+func cryptInit(db *KV) error {
+	if len(db.EncryptionKey) == 0 || db.crypt.aead != nil {
+		return nil
+	}
+	if !dbIsNew(db) {
+		return errors.New("the database is not encrypted")
+	}
+	salt := make([]byte, CRYPT_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return fmt.Errorf("salt: %w", err)
+	}
+	db.flags |= MASTER_ENCRYPTED
+	return cryptSetup(db, salt)
+}
+
+// encrypt a node into a page buffer.
+func pageSeal(db *KV, ptr uint64, dst []byte, node []byte) {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], ptr)
+	nonce := dst[BTREE_PAGE_SIZE-CRYPT_NONCE_SIZE:]
+	_, err := rand.Read(nonce)
+	assert(err == nil)
+	db.crypt.aead.Seal(dst[:0], nonce, node[:BNODE_MAX_SIZE], ad[:])
+}
+
+// decrypt a page read from the file.
+func pageOpen(db *KV, ptr uint64, src []byte) ([]byte, error) {
+	var ad [8]byte
+	binary.LittleEndian.PutUint64(ad[:], ptr)
+	nonce := src[BTREE_PAGE_SIZE-CRYPT_NONCE_SIZE:]
+	sealed := src[:BNODE_MAX_SIZE+CRYPT_TAG_SIZE]
+	node := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := db.crypt.aead.Open(node[:0], nonce, sealed, ad[:]); err != nil {
+		return nil, ErrDecrypt
+	}
+	return node, nil
+}
+
+// the encrypted part of the master page, see masterLoad.
+// | salt | nonce | sealed (btree_root, page_used) |
+// | 16B  |  12B  |          8B + 8B + 16B        |
+const (
+	MASTER_CRYPT_OFFSET = 40
+	MASTER_CRYPT_SIZE   = CRYPT_SALT_SIZE + CRYPT_NONCE_SIZE + 16 + CRYPT_TAG_SIZE
+)
+
+func masterSeal(db *KV, data []byte) {
+	crypt := data[MASTER_CRYPT_OFFSET:]
+	copy(crypt, db.crypt.salt)
+	nonce := crypt[CRYPT_SALT_SIZE : CRYPT_SALT_SIZE+CRYPT_NONCE_SIZE]
+	_, err := rand.Read(nonce)
+	assert(err == nil)
+
+	var plain [16]byte
+	binary.LittleEndian.PutUint64(plain[0:], db.tree.root)
+	binary.LittleEndian.PutUint64(plain[8:], db.page.flushed)
+	db.crypt.aead.Seal(crypt[CRYPT_SALT_SIZE+CRYPT_NONCE_SIZE:][:0], nonce, plain[:], masterAD(data))
+}
+
+// the clear parts are authenticated too: the signature, the flags, the
+// salt, the comparator name, the catalog root, the epoch and the log
+// generation.
+func masterAD(data []byte) []byte {
+	ad := append([]byte(nil), data[:MASTER_CRYPT_OFFSET+CRYPT_SALT_SIZE]...)
+	return append(ad, data[MASTER_CMP_OFFSET:MASTER_LOG_OFFSET+8]...)
+}
+
+func masterUnseal(db *KV, data []byte) (root uint64, used uint64, err error) {
+	if len(db.EncryptionKey) == 0 {
+		return 0, 0, errors.New("the database is encrypted, a key is required")
+	}
+	crypt := data[MASTER_CRYPT_OFFSET:]
+	salt := append([]byte(nil), crypt[:CRYPT_SALT_SIZE]...)
+	if err := cryptSetup(db, salt); err != nil {
+		return 0, 0, err
+	}
+	nonce := crypt[CRYPT_SALT_SIZE : CRYPT_SALT_SIZE+CRYPT_NONCE_SIZE]
+	sealed := crypt[CRYPT_SALT_SIZE+CRYPT_NONCE_SIZE : MASTER_CRYPT_SIZE]
+	plain, err := db.crypt.aead.Open(nil, nonce, sealed, masterAD(data))
+	if err != nil {
+		return 0, 0, ErrDecrypt
+	}
+	root = binary.LittleEndian.Uint64(plain[0:])
+	used = binary.LittleEndian.Uint64(plain[8:])
+	return root, used, nil
+}
+
+// a sealed log record, see walSeal.
+// | nonce | sealed record |
+// |  key  |     value     |
+// the additional data is the log generation and the offset of the record,
+// so records can't be reordered or dropped from the middle, nor replayed
+// from an older log: the generation is in the master page, and each
+// checkpoint that empties the log moves it on.
+func walSeal(db *KV, rec []byte, off int64) []byte {
+	ad := walAD(db.wal.gen, off)
+	nonce := make([]byte, CRYPT_NONCE_SIZE)
+	_, err := rand.Read(nonce)
+	assert(err == nil)
+	sealed := db.crypt.aead.Seal(nil, nonce, rec, ad)
+	return lsmRecord(nil, lsmEntry{key: nonce, val: sealed})
+}
+
+// | gen | off |
+// | 8B  | 8B  |
+func walAD(gen uint64, off int64) []byte {
+	var ad [16]byte
+	binary.LittleEndian.PutUint64(ad[0:], gen)
+	binary.LittleEndian.PutUint64(ad[8:], uint64(off))
+	return ad[:]
+}
+
+// the record sealed in e, read at off in a log of the generation.
+func walOpen(db *KV, e lsmEntry, gen uint64, off int64) (lsmEntry, error) {
+	if len(e.key) != CRYPT_NONCE_SIZE {
+		return lsmEntry{}, ErrDecrypt
+	}
+	rec, err := db.crypt.aead.Open(nil, e.key, e.val, walAD(gen, off))
+	if err != nil {
+		return lsmEntry{}, ErrDecrypt
+	}
+	var out lsmEntry
+	n := 0
+	valid, _ := lsmReadRecords(bytes.NewReader(rec), func(e lsmEntry, off int64) {
+		out, n = e, n+1
+	})
+	if n != 1 || valid != int64(len(rec)) {
+		return lsmEntry{}, ErrDecrypt
+	}
+	return out, nil
+}
@@ -0,0 +1,72 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_Encryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	key := []byte("correct horse battery staple")
+	db := &KV{Path: path, Options: Options{EncryptionKey: key, CacheSize: 8}}
+	testify_assert.NoError(t, db.Open())
+	testify_assert.NoError(t, db.Set([]byte("secret-key"), []byte("secret-value")))
+	testify_assert.NoError(t, db.Set([]byte("other"), []byte("value")))
+	db.Close()
+
+	raw, err := os.ReadFile(path)
+	testify_assert.NoError(t, err)
+	testify_assert.False(t, bytes.Contains(raw, []byte("secret")))
+
+	db = &KV{Path: path, Options: Options{EncryptionKey: key}}
+	testify_assert.NoError(t, db.Open())
+	val, ok, _ := db.Get([]byte("secret-key"))
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "secret-value", string(val))
+	db.Close()
+
+	db = &KV{Path: path, Options: Options{EncryptionKey: []byte("wrong")}}
+	testify_assert.ErrorIs(t, db.Open(), ErrDecrypt)
+	db = &KV{Path: path}
+	testify_assert.Error(t, db.Open())
+}
+
+func TestKV_EncryptionExistingDB(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	testify_assert.NoError(t, db.Open())
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	db.Close()
+
+	db = &KV{Path: path, Options: Options{EncryptionKey: []byte("key")}}
+	testify_assert.Error(t, db.Open())
+}
+
+// the clear parts of the master page can't be changed either.
+func TestKV_EncryptionMaster(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	key := []byte("key")
+	db := &KV{Path: path, Options: Options{EncryptionKey: key}}
+	testify_assert.NoError(t, db.Open())
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	testify_assert.NoError(t, db.CreateSnapshot("s"))
+	db.Close()
+	orig, err := os.ReadFile(path)
+	testify_assert.NoError(t, err)
+
+	for _, off := range []int{MASTER_CMP_OFFSET, MASTER_CMP_OFFSET + 1, MASTER_CATALOG_OFFSET} {
+		data := append([]byte(nil), orig...)
+		data[off] ^= 1
+		testify_assert.NoError(t, os.WriteFile(path, data, 0644))
+		db = &KV{Path: path, Options: Options{EncryptionKey: key}}
+		testify_assert.ErrorIs(t, db.Open(), ErrDecrypt, "offset %d", off)
+	}
+	testify_assert.NoError(t, os.WriteFile(path, orig, 0644))
+	db = &KV{Path: path, Options: Options{EncryptionKey: key}}
+	testify_assert.NoError(t, db.Open())
+	db.Close()
+}
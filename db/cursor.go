@@ -0,0 +1,35 @@
+package db
+
+import "errors"
+
+// KVPair is a key and its value, see ScanPage.
+type KVPair struct {
+	Key []byte
+	Val []byte
+}
+
+// ScanPage returns up to limit KVs with key >= start in key order and
+// the cursor of the next page, nil after the last one. the cursor is
+// the first key of the next page: pass it back as start to resume.
+// nothing is kept between the calls, so the pages reflect the updates
+// made in between.
+func (db *KV) ScanPage(start []byte, limit int) (items []KVPair, next []byte, err error) {
+	if limit <= 0 {
+		return nil, nil, errors.New("ScanPage: limit must be positive")
+	}
+	err = db.Scan(start, func(key, val []byte) bool {
+		if len(items) == limit {
+			next = append([]byte(nil), key...)
+			return false
+		}
+		items = append(items, KVPair{
+			Key: append([]byte(nil), key...),
+			Val: append([]byte(nil), val...),
+		})
+		return true
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return items, next, nil
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// leaves under this fraction of a page are merged with a neighbor
+const DEFRAG_FILL = 0.5
+
+// DefragOptions paces the background defragmentation, see StartDefrag.
+type DefragOptions struct {
+	// guards the KV, held during each step. the KV isn't safe for
+	// concurrent use, so it must be the lock of the other users.
+	Lock sync.Locker
+	// the pause between steps, default 10ms
+	Interval time.Duration
+	// the most pairs of leaves merged by a step, default 16
+	MaxMerges int
+}
+
+// DefragStep merges the sparse adjacent leaves under one parent node and
+// commits, moving on to the next parent on the next call. the pages are
+// copied, so the snapshots still see the old leaves. done is true when
+// it has gone over the whole tree, the next call starts over.
+func (db *KV) DefragStep(maxMerges int) (merged int, done bool, err error) {
+	defer catchPageError(&err)
+	if err := checkWritable(db); err != nil {
+		return 0, false, err
+	}
+	throttle(db, 0)
+	fill := int(DEFRAG_FILL * BNODE_MAX_SIZE)
+	merged, db.defrag.next = treeDefragStep(&db.tree, db.defrag.next, fill, maxMerges)
+	done = db.defrag.next == nil
+	if done && db.bloom != nil {
+		bloomRebuild(db) // without the deleted keys
+	}
+	if merged == 0 {
+		return 0, done, nil
+	}
+	db.stats.shape.known = false
+	db.Logger.Debug("defrag", "merged", merged)
+	return merged, done, flushPages(db)
+}
+
+// StartDefrag runs DefragStep in a goroutine until stop is called, which
+// returns the error that ended it, if any. it's paced by opts so that the
+// foreground updates are only delayed by the lock held for a step.
+func (db *KV) StartDefrag(opts DefragOptions) (stop func() error) {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Millisecond
+	}
+	if opts.MaxMerges <= 0 {
+		opts.MaxMerges = 16
+	}
+	quit, exited := make(chan struct{}), make(chan struct{})
+	var err error
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			opts.Lock.Lock()
+			// the foreground writes go first
+			if !db.closed && !db.Backpressure() {
+				_, _, err = db.DefragStep(opts.MaxMerges)
+			}
+			opts.Lock.Unlock()
+			if err != nil {
+				db.Logger.Warn("defrag", "err", err)
+				return
+			}
+		}
+	}()
+	return func() error {
+		select {
+		case <-exited:
+		default:
+			close(quit)
+			<-exited
+		}
+		return err
+	}
+}
+
+// merge the sparse adjacent leaves under the parent of the leaf with the
+// start key. returns the number of merges and the start of the next
+// parent, nil after the last one.
+func treeDefragStep(tree *BTree, start []byte, fill int, maxMerges int) (int, []byte) {
+	if tree.root == 0 {
+		return 0, nil
+	}
+	// the internal nodes from the root to the parent of the leaves
+	cmp := tree.keyCmp()
+	var path []BNode
+	var pos []uint16 // of the kid in each node
+	node := tree.get(tree.root)
+	if node.btype() == BNODE_LEAF {
+		return 0, nil
+	}
+	for {
+		idx := nodeLookupLE(node, start, cmp)
+		path, pos = append(path, node), append(pos, idx)
+		kid := tree.get(node.getPtr(idx))
+		if kid.btype() == BNODE_LEAF {
+			break
+		}
+		node = kid
+	}
+	// the next parent is right of the lowest path that can go right
+	var next []byte
+	for l := len(path) - 2; l >= 0; l-- {
+		if pos[l]+1 < path[l].nkeys() {
+			next = append([]byte(nil), path[l].getKey(pos[l]+1)...)
+			break
+		}
+	}
+
+	// merge the leaves, greedily from left to right
+	parent := path[len(path)-1]
+	type kid struct {
+		ptr uint64
+		key []byte
+	}
+	kids := make([]kid, parent.nkeys())
+	for i := range kids {
+		kids[i] = kid{parent.getPtr(uint16(i)), parent.getKey(uint16(i))}
+	}
+	merged := 0
+	for i := 0; i+1 < len(kids) && merged < maxMerges; {
+		left, right := tree.get(kids[i].ptr), tree.get(kids[i+1].ptr)
+		sparse := int(left.nbytes()) < fill || int(right.nbytes()) < fill
+		if !sparse || int(left.nbytes()+right.nbytes())-HEADER > BNODE_MAX_SIZE {
+			i++
+			continue
+		}
+		leaf := nodeAlloc(BTREE_PAGE_SIZE)
+		nodeMerge(leaf, left, right)
+		tree.del(kids[i].ptr)
+		tree.del(kids[i+1].ptr)
+		// the merged leaf keeps the key of the left one
+		kids[i].ptr = tree.new(leaf)
+		kids = append(kids[:i+1], kids[i+2:]...)
+		merged++
+	}
+	if merged == 0 {
+		return 0, next
+	}
+	tree.logDebug("leaves merged", "merges", merged)
+
+	// copy the path with the new parent
+	updated := nodeAlloc(BTREE_PAGE_SIZE)
+	updated.setHeader(BNODE_NODE, uint16(len(kids)))
+	for i, k := range kids {
+		nodeAppendKV(updated, uint16(i), k.ptr, k.key, nil)
+	}
+	for l := len(path) - 2; l >= 0; l-- {
+		tree.del(path[l].getPtr(pos[l]))
+		new := nodeAlloc(BTREE_PAGE_SIZE)
+		nodeReplaceKidN(tree, new, path[l], pos[l], updated)
+		updated = new
+	}
+	tree.del(tree.root)
+	if updated.nkeys() == 1 {
+		// the root had only the leaves that became one
+		tree.logDebug("root removed")
+		tree.root = updated.getPtr(0)
+		nodeFree(updated)
+	} else {
+		tree.root = tree.new(updated)
+	}
+	return merged, next
+}
@@ -0,0 +1,90 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+// leaves left sparse by DeleteRange, which doesn't merge them.
+// the long keys make 3+ levels.
+func sparseKV(t *testing.T) (*KV, map[string]bool) {
+	db := openTestKV(t)
+	db.NoSync = true
+	ref := map[string]bool{}
+	for i := 0; i < 3000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(cBigKey(i)), []byte("v")))
+		if i%10 == 0 {
+			ref[cBigKey(i)] = true
+		}
+	}
+	for i := 0; i < 3000; i += 10 {
+		testify_assert.NoError(t, db.DeleteRange([]byte(cBigKey(i+1)), []byte(cBigKey(i+10))))
+	}
+	testify_assert.GreaterOrEqual(t, db.Stats().Height, 3)
+	return db, ref
+}
+
+func checkSparseKV(t *testing.T, db *KV, ref map[string]bool) {
+	testify_assert.NoError(t, db.Verify())
+	n := 0
+	testify_assert.NoError(t, db.ScanKeys(nil, func(key []byte) bool {
+		testify_assert.True(t, ref[string(key)], "key %q", key)
+		n++
+		return true
+	}))
+	testify_assert.Equal(t, len(ref), n)
+}
+
+func TestKV_DefragStep(t *testing.T) {
+	db, ref := sparseKV(t)
+	before := db.Stats().LeafPages
+
+	// a snapshot keeps the old leaves
+	snap, err := db.Snapshot()
+	testify_assert.NoError(t, err)
+	defer snap.Close()
+
+	total, steps := 0, 0
+	for done := false; !done; steps++ {
+		var merged int
+		merged, done, err = db.DefragStep(4)
+		testify_assert.NoError(t, err)
+		testify_assert.LessOrEqual(t, merged, 4)
+		total += merged
+	}
+	testify_assert.Greater(t, steps, 1)
+	testify_assert.Greater(t, total, 0)
+	testify_assert.Equal(t, before-uint64(total), db.Stats().LeafPages)
+	checkSparseKV(t, db, ref)
+
+	n := 0
+	testify_assert.NoError(t, snap.Scan(nil, func(key, val []byte) bool {
+		n++
+		return true
+	}))
+	testify_assert.Equal(t, len(ref), n)
+}
+
+func TestKV_StartDefrag(t *testing.T) {
+	db, ref := sparseKV(t)
+	before := db.Stats().LeafPages
+
+	var mu sync.Mutex
+	stop := db.StartDefrag(DefragOptions{Lock: &mu, Interval: time.Millisecond})
+	for i := 0; i < 1000; i++ {
+		mu.Lock()
+		leaves := db.Stats().LeafPages
+		mu.Unlock()
+		if leaves < before/2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	testify_assert.NoError(t, stop())
+	testify_assert.NoError(t, stop())
+	testify_assert.Less(t, db.Stats().LeafPages, before/2)
+	checkSparseKV(t, db, ref)
+}
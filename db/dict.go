@@ -0,0 +1,173 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// shared dictionaries for the small values, which compress poorly alone.
+// KV.TrainDict samples the values into a raw zstd dictionary, which is
+// kept in the catalog under a reserved name, in chunks:
+// | 0x00 | "dict" | id | chunk |
+// | 1B   |  4B    | 4B | 4B    |
+// the values shorter than CompressDictMax are then compressed with the
+// newest one. the zstd frame names its dictionary, so the older ones are
+// kept to read the values compressed before.
+const (
+	COMPRESS_DICT_MAX = 1024 // default Options.CompressDictMax
+	DICT_MAX_SIZE     = 64 << 10
+	DICT_CHUNK        = 2048
+)
+
+var catalogDictPrefix = []byte("\x00dict")
+
+// the names of the catalog that are not snapshots start with 0.
+func catalogReserved(name []byte) bool {
+	return len(name) > 0 && name[0] == 0
+}
+
+// TrainDict builds a dictionary of about size bytes from a sample of the
+// small values, and compresses the new small values with it. it needs a
+// DB with COMPRESS_ZSTD. the values already stored are not recompressed,
+// it can be called again once they have changed.
+func (db *KV) TrainDict(size int) (err error) {
+	defer catchPageError(&err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	if db.Compression != COMPRESS_ZSTD {
+		return errors.New("a dictionary needs the zstd compression")
+	}
+	if size < 64 || size > DICT_MAX_SIZE {
+		return fmt.Errorf("dictionary size %d out of [64, %d]", size, DICT_MAX_SIZE)
+	}
+	if walBuffered(db) {
+		if err := db.Flush(); err != nil {
+			return err
+		}
+	}
+	hist := dictSample(db, size)
+	if len(hist) < 64 {
+		return errors.New("not enough small values for a dictionary")
+	}
+
+	id := db.codec.dictID + 1
+	db.stats.shape.known = false // the catalog pages are not in the shape
+	for i := 0; len(hist) > 0; i++ {
+		n := len(hist)
+		if n > DICT_CHUNK {
+			n = DICT_CHUNK
+		}
+		db.catalog.Insert(dictKey(id, uint32(i)), hist[:n])
+		hist = hist[n:]
+	}
+	if err := flushPages(db); err != nil {
+		return err
+	}
+	return dictLoad(db)
+}
+
+// the small values spread over the keys, the last size bytes of them.
+// zstd finds the recent history first, so the end of the dictionary
+// matters more.
+func dictSample(db *KV, size int) []byte {
+	max := dictMax(db)
+	total := 0
+	treeScan(&db.tree, nil, func(key, stored []byte) bool {
+		if val := decodeValue(db, stored); len(val) < max {
+			total += len(val)
+		}
+		return true
+	})
+	stride := total / size // take 1 value out of stride+1 bytes
+	var hist []byte
+	skipped := 0
+	treeScan(&db.tree, nil, func(key, stored []byte) bool {
+		val := decodeValue(db, stored)
+		if len(val) >= max {
+			return true
+		}
+		if skipped < stride {
+			skipped += len(val)
+			return true
+		}
+		skipped = 0
+		hist = append(hist, val...)
+		return true
+	})
+	if len(hist) > size {
+		hist = hist[len(hist)-size:]
+	}
+	return hist
+}
+
+func dictMax(db *KV) int {
+	if db.CompressDictMax > 0 {
+		return db.CompressDictMax
+	}
+	return COMPRESS_DICT_MAX
+}
+
+func dictKey(id, chunk uint32) []byte {
+	key := append([]byte(nil), catalogDictPrefix...)
+	key = binary.BigEndian.AppendUint32(key, id)
+	return binary.BigEndian.AppendUint32(key, chunk)
+}
+
+// read the dictionaries of the catalog, called on open and after a new
+// one. the readers of a ReadTx keep the decoder they have loaded.
+func dictLoad(db *KV) (err error) {
+	defer catchPageError(&err)
+	dicts := map[uint32][]byte{}
+	newest := uint32(0)
+	treeScan(&db.catalog, catalogDictPrefix, func(key, val []byte) bool {
+		if !bytes.HasPrefix(key, catalogDictPrefix) {
+			return false
+		}
+		id := binary.BigEndian.Uint32(key[len(catalogDictPrefix):])
+		dicts[id] = append(dicts[id], val...)
+		if id > newest {
+			newest = id
+		}
+		return true
+	})
+	if newest == 0 {
+		return nil
+	}
+	opts := []zstd.DOption{}
+	for id, content := range dicts {
+		opts = append(opts, zstd.WithDecoderDictRaw(id, content))
+	}
+	dec, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return fmt.Errorf("zstd: %w", err)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDictRaw(newest, dicts[newest]))
+	if err != nil {
+		dec.Close()
+		return fmt.Errorf("zstd: %w", err)
+	}
+	if db.codec.denc != nil {
+		_ = db.codec.denc.Close()
+	}
+	db.codec.dictID = newest
+	db.codec.denc = enc
+	db.codec.ddec.Store(dec)
+	db.codec.ddecs = append(db.codec.ddecs, dec)
+	return nil
+}
+
+func dictClose(db *KV) {
+	if db.codec.denc != nil {
+		_ = db.codec.denc.Close()
+		db.codec.denc = nil
+	}
+	for _, dec := range db.codec.ddecs {
+		dec.Close()
+	}
+	db.codec.ddecs = nil
+}
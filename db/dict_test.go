@@ -0,0 +1,77 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_TrainDict(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithCompression(COMPRESS_ZSTD))
+	testify_assert.NoError(t, err)
+	row := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"id":%d,"name":"user%d","email":"user%d@example.com","active":true}`, i, i, i))
+	}
+	for i := 0; i < 500; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("row%04d", i)), row(i)))
+	}
+	stored := func(key string) []byte {
+		val, ok := db.tree.Get([]byte(key))
+		testify_assert.True(t, ok)
+		return val
+	}
+	before := len(stored("row0001"))
+	testify_assert.ErrorContains(t, db.TrainDict(10), "out of")
+
+	testify_assert.NoError(t, db.TrainDict(4096))
+	testify_assert.NoError(t, db.Set([]byte("row0001"), row(1)))
+	after := stored("row0001")
+	testify_assert.Equal(t, COMPRESS_ZSTD_DICT, after[0])
+	testify_assert.Less(t, len(after), before*2/3)
+	testify_assert.NoError(t, db.CreateSnapshot("s1"))
+	db.Close()
+
+	// kept in the file, with the older ones
+	db, err = Open(path, WithCompression(COMPRESS_ZSTD))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.NoError(t, db.TrainDict(2048))
+	testify_assert.Equal(t, uint32(2), db.codec.dictID)
+	testify_assert.NoError(t, db.Set([]byte("row0002"), row(2)))
+	testify_assert.Equal(t, COMPRESS_ZSTD_DICT, stored("row0002")[0])
+	for i := 0; i < 3; i++ {
+		val, _, err := db.Get([]byte(fmt.Sprintf("row%04d", i)))
+		testify_assert.NoError(t, err)
+		testify_assert.Equal(t, row(i), val)
+	}
+	r := db.BeginRead()
+	val, _, err := r.Get([]byte("row0001"))
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, row(1), val)
+	r.Close()
+
+	// the dictionaries are not snapshots
+	list, err := db.Snapshots()
+	testify_assert.NoError(t, err)
+	testify_assert.Len(t, list, 1)
+	testify_assert.ErrorContains(t, db.CreateSnapshot("\x00dict"), "reserved")
+	_, err = db.OpenSnapshot(string(dictKey(1, 0)))
+	testify_assert.ErrorIs(t, err, ErrNoSnapshot)
+	testify_assert.Nil(t, db.Check())
+
+	// and read by a repair
+	dst := openTestKV(t)
+	_, err = Repair(path, nil, dst)
+	testify_assert.NoError(t, err)
+	val, _, err = dst.Get([]byte("row0002"))
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, row(2), val)
+}
+
+func TestKV_TrainDict_NeedsZstd(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.ErrorContains(t, db.TrainDict(4096), "zstd")
+}
@@ -0,0 +1,6 @@
+package db
+
+import "syscall"
+
+// the open flag of Options.DirectIO
+const directFlag = syscall.O_DIRECT
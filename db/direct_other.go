@@ -0,0 +1,6 @@
+//go:build !linux
+
+package db
+
+// TODO: F_NOCACHE on darwin, FILE_FLAG_NO_BUFFERING on windows
+const directFlag = 0
@@ -3,12 +3,16 @@ package db
 import (
 	"errors"
 	"fmt"
-	"os"
-	"syscall"
+	"unsafe"
 )
 
+// pages are read through a mmap where it's supported, with pread
+// otherwise. tests turn it off to cover the fallback.
+var mmapEnabled = mmapSupported
+
 // create the initial mmap that covers the whole file.
-func mmapInit(fp *os.File) (int, []byte, error) {
+// the mmap is nil if it's disabled.
+func mmapInit(fp File, enabled bool) (int, []byte, error) {
 	fi, err := fp.Stat()
 	if err != nil {
 		return 0, nil, fmt.Errorf("stat: %w", err)
@@ -16,32 +20,56 @@ func mmapInit(fp *os.File) (int, []byte, error) {
 	if fi.Size()%BTREE_PAGE_SIZE != 0 {
 		return 0, nil, errors.New("file size is not a multiple of page size")
 	}
+	if !enabled {
+		return int(fi.Size()), nil, nil
+	}
 	mmapSize := 64 << 20
-	assert(mmapSize%BTREE_PAGE_SIZE != 0)
+	assert(mmapSize%BTREE_PAGE_SIZE == 0)
 	for mmapSize < int(fi.Size()) {
 		mmapSize *= 2
 	}
-	// mmapSize can be larger than the file
-	chunk, err := syscall.Mmap(
-		int(fp.Fd()), 0, mmapSize, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
+	// mmapSize can be larger than the file.
+	// it's only for reading, writes go through the file.
+	chunk, err := mmapFile(fp, 0, mmapSize)
 	if err != nil {
 		return 0, nil, fmt.Errorf("mmap: %w", err)
 	}
 	return int(fi.Size()), chunk, nil
 }
 
+// extend the file to at least `npages`.
+func extendFile(db *KV, npages int) error {
+	filePages := db.mmap.file / BTREE_PAGE_SIZE
+	if filePages >= npages {
+		return nil
+	}
+
+	for filePages < npages {
+		// the file size is increased exponentially,
+		// so that we don't have to extend the file for every update.
+		inc := filePages / 8
+		if inc < 1 {
+			inc = 1
+		}
+		filePages += inc
+	}
+
+	fileSize := filePages * BTREE_PAGE_SIZE
+	if err := db.fp.Truncate(int64(fileSize)); err != nil {
+		return fmt.Errorf("truncate: %w", err)
+	}
+	db.mmap.file = fileSize
+	return nil
+}
+
 // extend the mmap by adding new mappings.
 func extendMmap(db *KV, npages int) error {
-	if db.mmap.total >= npages*BTREE_PAGE_SIZE {
+	if db.mmap.chunks == nil || db.mmap.total >= npages*BTREE_PAGE_SIZE {
 		return nil
 	}
 
 	// double the address space
-	chunk, err := syscall.Mmap(
-		int(db.fp.Fd()), int64(db.mmap.total), db.mmap.total,
-		syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED,
-	)
+	chunk, err := mmapFile(db.fp, int64(db.mmap.total), db.mmap.total)
 	if err != nil {
 		return fmt.Errorf("mmap: %w", err)
 	}
@@ -50,3 +78,16 @@ func extendMmap(db *KV, npages int) error {
 	db.mmap.chunks = append(db.mmap.chunks, chunk)
 	return nil
 }
+
+// a buffer for reading or writing a page, aligned for direct I/O.
+func (db *KV) pageBuf() []byte {
+	if !db.DirectIO {
+		return make([]byte, BTREE_PAGE_SIZE)
+	}
+	buf := make([]byte, 2*BTREE_PAGE_SIZE)
+	off := int(uintptr(unsafe.Pointer(&buf[0])) % BTREE_PAGE_SIZE)
+	if off > 0 {
+		off = BTREE_PAGE_SIZE - off
+	}
+	return buf[off : off+BTREE_PAGE_SIZE : off+BTREE_PAGE_SIZE]
+}
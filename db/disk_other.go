@@ -0,0 +1,44 @@
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd || windows)
+
+package db
+
+import (
+	"errors"
+	"os"
+)
+
+// the portable fallback: pread instead of mmap and no locking.
+const (
+	mmapSupported = false
+	lockSupported = false
+)
+
+func mmapFile(fp File, offset int64, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported")
+}
+
+func munmapFile(chunk []byte) error {
+	return nil
+}
+
+func mmapWillNeed(b []byte) error {
+	return nil
+}
+
+// TODO: fcntl locks
+func lockFile(fp File, exclusive bool) error {
+	return nil
+}
+
+func renameFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func syncDir(path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	return fp.Sync()
+}
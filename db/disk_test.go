@@ -0,0 +1,103 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+// the pread fallback of the platforms without mmap.
+func TestKV_Pread(t *testing.T) {
+	mmapEnabled = false
+	defer func() { mmapEnabled = mmapSupported }()
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path)
+	testify_assert.NoError(t, err)
+	testify_assert.Nil(t, db.mmap.chunks)
+	for i := 0; i < 20; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i))))
+	}
+	db.Close()
+
+	db, err = Open(path)
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	val, ok, err := db.Get([]byte("k07"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "7", string(val))
+	testify_assert.Empty(t, db.Check())
+}
+
+func TestKV_NoMmap(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithNoMmap())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.Nil(t, db.mmap.chunks)
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte(fmt.Sprint(i))))
+	}
+	testify_assert.Nil(t, db.mmap.chunks) // not when the file grows either
+	val, ok, err := db.Get([]byte("k007"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "7", string(val))
+	testify_assert.Empty(t, db.Check())
+}
+
+func TestKV_Lock(t *testing.T) {
+	if !lockSupported {
+		t.Skip("no locking on this platform")
+	}
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path)
+	testify_assert.NoError(t, err)
+	_, err = Open(path)
+	testify_assert.ErrorIs(t, err, ErrLocked)
+	_, err = Open(path, WithReadOnly())
+	testify_assert.ErrorIs(t, err, ErrLocked)
+	db.Close()
+
+	// many readers
+	r1, err := Open(path, WithReadOnly())
+	testify_assert.NoError(t, err)
+	defer r1.Close()
+	r2, err := Open(path, WithReadOnly())
+	testify_assert.NoError(t, err)
+	defer r2.Close()
+	_, err = Open(path)
+	testify_assert.ErrorIs(t, err, ErrLocked)
+}
+
+func TestKV_DirectIO(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithDirectIO())
+	if directFlag == 0 {
+		testify_assert.Error(t, err)
+		return
+	}
+	if errors.Is(err, syscall.EINVAL) {
+		t.Skip("no O_DIRECT on this filesystem")
+	}
+	testify_assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i))))
+	}
+	db.Close()
+
+	db, err = Open(path, WithDirectIO())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.Nil(t, db.mmap.chunks)
+	val, ok, err := db.Get([]byte("k07"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "7", string(val))
+	testify_assert.Empty(t, db.Check())
+}
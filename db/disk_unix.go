@@ -0,0 +1,63 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	mmapSupported = true
+	lockSupported = true
+)
+
+// a read-only shared mapping of the file.
+func mmapFile(fp File, offset int64, size int) ([]byte, error) {
+	return syscall.Mmap(int(fp.Fd()), offset, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(chunk []byte) error {
+	return syscall.Munmap(chunk)
+}
+
+// start reading a part of the mapping in the background.
+func mmapWillNeed(b []byte) error {
+	return unix.Madvise(b, unix.MADV_WILLNEED)
+}
+
+// an advisory lock on the whole file, shared for readers.
+// it's released when the file is closed.
+func lockFile(fp File, exclusive bool) error {
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err := syscall.Flock(int(fp.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return err
+}
+
+// renames replace the target atomically, but they are only durable
+// once the directory is synced, see syncDir.
+func renameFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+// make the renames and the new files in a directory durable.
+func syncDir(path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
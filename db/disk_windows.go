@@ -0,0 +1,67 @@
+//go:build windows
+
+package db
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// a mapped file can't be truncated, so it couldn't grow.
+// pages are read with pread instead.
+const (
+	mmapSupported = false
+	lockSupported = true
+)
+
+func mmapFile(fp File, offset int64, size int) ([]byte, error) {
+	return nil, errors.New("mmap is not supported")
+}
+
+func munmapFile(chunk []byte) error {
+	return nil
+}
+
+func mmapWillNeed(b []byte) error {
+	return nil
+}
+
+// the lock is on a byte past any data, since locked ranges can't be
+// read by other handles. it's released when the file is closed.
+func lockFile(fp File, exclusive bool) error {
+	flags := uint32(windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if exclusive {
+		flags |= windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	ol := &windows.Overlapped{Offset: ^uint32(0), OffsetHigh: ^uint32(0)}
+	err := windows.LockFileEx(windows.Handle(fp.Fd()), flags, 0, 1, 0, ol)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+	return err
+}
+
+// replace the target atomically and durably.
+func renameFile(oldpath, newpath string) error {
+	from, err := windows.UTF16PtrFromString(oldpath)
+	if err != nil {
+		return err
+	}
+	to, err := windows.UTF16PtrFromString(newpath)
+	if err != nil {
+		return err
+	}
+	err = windows.MoveFileEx(from, to, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: err}
+	}
+	return nil
+}
+
+// directories can't be synced, renames are made durable by
+// MOVEFILE_WRITE_THROUGH and the NTFS journal.
+func syncDir(path string) error {
+	return nil
+}
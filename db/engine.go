@@ -0,0 +1,85 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Engine is the interface of the storage engines.
+// TODO: Begin, once LSM and Hash have transactions like KV.
+type Engine interface {
+	Get(key []byte) ([]byte, bool, error)
+	Set(key []byte, val []byte) error
+	Del(key []byte) (bool, error)
+	Scan(start []byte, fn func(key, val []byte) bool) error
+	Close()
+}
+
+var (
+	_ Engine = (*KV)(nil)
+	_ Engine = (*LSM)(nil)
+	_ Engine = (*Hash)(nil)
+)
+
+const (
+	ENGINE_BTREE uint8 = 0 // KV, a single file
+	ENGINE_LSM   uint8 = 1 // LSM, a directory
+	ENGINE_HASH  uint8 = 2 // Hash, a single file, no ordered scans
+)
+
+// OpenEngine opens the database at path with the engine it was created
+// with, a new one is created with Options.Engine.
+func OpenEngine(path string, opts ...Option) (Engine, error) {
+	engine := applyOptions(opts).Engine
+	fi, err := os.Stat(path)
+	switch {
+	case err == nil && fi.IsDir():
+		engine = ENGINE_LSM
+	case err == nil:
+		engine, err = fileEngine(path)
+		if err != nil {
+			return nil, err
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return nil, err
+	}
+	// no typed nils in the interface
+	switch engine {
+	case ENGINE_BTREE:
+		db, err := Open(path, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case ENGINE_LSM:
+		db, err := OpenLSM(path, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case ENGINE_HASH:
+		db, err := OpenHash(path, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unknown engine %d", engine)
+	}
+}
+
+// the engine of a database file, by its signature.
+func fileEngine(path string) (uint8, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer fp.Close()
+	sig := make([]byte, len(HASH_SIG))
+	if _, err := io.ReadFull(fp, sig); err == nil && string(sig) == HASH_SIG {
+		return ENGINE_HASH, nil
+	}
+	return ENGINE_BTREE, nil
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrEmptyKey      = errors.New("empty key")
+	ErrKeyTooLarge   = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+	ErrPageNotFound  = errors.New("page not found")
+	ErrLocked        = errors.New("database is in use")
+	ErrNoMerge       = errors.New("no merge operator")
+	ErrReadOnly      = errors.New("read-only database")
+)
+
+// a page that can't be read: out of the file, corrupted or failing to
+// decrypt. the tree code can't return errors, so it's raised as a panic
+// and turned back into an error by the public methods.
+type pageError struct {
+	ptr uint64
+	err error
+}
+
+func (e *pageError) Error() string {
+	return fmt.Sprintf("page %d: %v", e.ptr, e.err)
+}
+
+func (e *pageError) Unwrap() error {
+	return e.err
+}
+
+// deferred by the public methods. other panics are bugs and go on.
+func catchPageError(err *error) {
+	if r := recover(); r != nil {
+		perr, ok := r.(*pageError)
+		if !ok {
+			panic(r)
+		}
+		*err = perr
+	}
+}
+
+// the size limits of the tree
+func checkKV(key []byte, val []byte) error {
+	if len(key) == 0 {
+		return ErrEmptyKey
+	}
+	if len(key) >= BTREE_MAX_KEY_SIZE {
+		return ErrKeyTooLarge
+	}
+	if len(val) > BTREE_MAX_VAL_SIZE {
+		return ErrValueTooLarge
+	}
+	return nil
+}
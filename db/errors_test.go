@@ -0,0 +1,38 @@
+package db
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_Errors(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.ErrorIs(t, db.Set(nil, []byte("v")), ErrEmptyKey)
+	testify_assert.ErrorIs(t, db.Set(make([]byte, BTREE_MAX_KEY_SIZE), nil), ErrKeyTooLarge)
+	testify_assert.ErrorIs(t, db.Set([]byte("k"), make([]byte, BTREE_MAX_VAL_SIZE+1)), ErrValueTooLarge)
+	_, err := db.Del(make([]byte, BTREE_MAX_KEY_SIZE))
+	testify_assert.ErrorIs(t, err, ErrKeyTooLarge)
+	testify_assert.NoError(t, db.Set([]byte("k"), make([]byte, BTREE_MAX_VAL_SIZE)))
+
+	// a bad pointer
+	root := db.tree.root
+	db.tree.root = 1000
+	_, _, err = db.Get([]byte("k"))
+	testify_assert.ErrorIs(t, err, ErrPageNotFound)
+	db.tree.root = root
+
+	// a corrupted page
+	db.Close()
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	testify_assert.NoError(t, err)
+	_, err = fp.WriteAt(bytes.Repeat([]byte{0xff}, 8), int64(root*BTREE_PAGE_SIZE+100))
+	testify_assert.NoError(t, err)
+	fp.Close()
+	testify_assert.NoError(t, db.Open())
+	_, _, err = db.Get([]byte("k"))
+	testify_assert.ErrorIs(t, err, ErrChecksum)
+	testify_assert.ErrorIs(t, db.Scan(nil, func(key, val []byte) bool { return true }), ErrChecksum)
+}
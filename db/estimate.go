@@ -0,0 +1,110 @@
+package db
+
+// EstimateSize returns the approximate number of keys in [lo, hi) and
+// their size in bytes as stored (a nil hi means to the end). only the
+// pages on the 2 paths to the ends of the range are read: the subtrees
+// in between are counted as the average of the subtrees that were read
+// at the same level. the buffered updates are counted as new keys.
+func (db *KV) EstimateSize(lo, hi []byte) (keys uint64, bytes uint64, err error) {
+	defer catchPageError(&err)
+	cmp := db.tree.keyCmp()
+	if hi != nil && cmp(lo, hi) >= 0 {
+		return 0, 0, nil
+	}
+	var in sizeEstimate
+	if db.tree.root != 0 {
+		in, _ = nodeEstimate(&db.tree, db.tree.get(db.tree.root), lo, hi)
+	}
+	if db.wal.mem != nil {
+		for n := db.wal.mem.seek(lo); n != nil; n = n.nextNode() {
+			if hi != nil && cmp(n.entry.key, hi) >= 0 {
+				break
+			}
+			if !n.entry.deleted {
+				in.keys++
+				in.bytes += float64(len(n.entry.key) + len(n.entry.val))
+			}
+		}
+	}
+	return uint64(in.keys + 0.5), uint64(in.bytes + 0.5), nil
+}
+
+type sizeEstimate struct {
+	keys  float64
+	bytes float64
+}
+
+// the estimated size of the keys of a subtree in [lo, hi) and of the
+// whole subtree. the kids partially in the range are read, the ones
+// entirely in it are extrapolated from them.
+func nodeEstimate(tree *BTree, node BNode, lo, hi []byte) (in, total sizeEstimate) {
+	cmp := tree.keyCmp()
+	inRange := func(key []byte) bool {
+		return len(key) > 0 && cmp(key, lo) >= 0 && (hi == nil || cmp(key, hi) < 0)
+	}
+	if node.btype() == BNODE_LEAF {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if len(key) == 0 {
+				continue // the dummy key
+			}
+			size := float64(len(key) + len(node.getVal(i)))
+			total.keys++
+			total.bytes += size
+			if inRange(key) {
+				in.keys++
+				in.bytes += size
+			}
+		}
+		return in, total
+	}
+
+	// the kids read so far, to extrapolate the others
+	var sampled sizeEstimate
+	nsampled := 0
+	var covered []uint16
+	for i := uint16(0); i < node.nkeys(); i++ {
+		kidLo := node.getKey(i)
+		var kidHi []byte // nil for the last kid
+		if i+1 < node.nkeys() {
+			kidHi = node.getKey(i + 1)
+		}
+		// the kid's keys are in [kidLo, kidHi)
+		if kidHi != nil && cmp(kidHi, lo) <= 0 || hi != nil && cmp(kidLo, hi) >= 0 {
+			continue
+		}
+		if cmp(kidLo, lo) >= 0 && (hi == nil || kidHi != nil && cmp(kidHi, hi) <= 0) {
+			covered = append(covered, i)
+			continue
+		}
+		kidIn, kidTotal := nodeEstimate(tree, tree.get(node.getPtr(i)), lo, hi)
+		in.keys += kidIn.keys
+		in.bytes += kidIn.bytes
+		sampled.keys += kidTotal.keys
+		sampled.bytes += kidTotal.bytes
+		nsampled++
+	}
+	if nsampled == 0 {
+		// the range covers whole kids only, read the first and the last
+		// of them, the kids made by appending keys are not all alike.
+		if len(covered) == 0 {
+			return in, total
+		}
+		samples := []uint16{covered[0]}
+		if len(covered) > 1 {
+			samples = append(samples, covered[len(covered)-1])
+		}
+		for _, i := range samples {
+			_, kidTotal := nodeEstimate(tree, tree.get(node.getPtr(i)), nil, nil)
+			sampled.keys += kidTotal.keys
+			sampled.bytes += kidTotal.bytes
+			nsampled++
+		}
+	}
+	avg := sizeEstimate{sampled.keys / float64(nsampled), sampled.bytes / float64(nsampled)}
+	in.keys += float64(len(covered)) * avg.keys
+	in.bytes += float64(len(covered)) * avg.bytes
+	total.keys = float64(node.nkeys()) * avg.keys
+	total.bytes = float64(node.nkeys()) * avg.bytes
+	return in, total
+}
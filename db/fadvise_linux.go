@@ -0,0 +1,8 @@
+package db
+
+import "golang.org/x/sys/unix"
+
+// start reading a part of the file into the OS page cache.
+func fileWillNeed(fp File, offset, size int64) error {
+	return unix.Fadvise(int(fp.Fd()), offset, size, unix.FADV_WILLNEED)
+}
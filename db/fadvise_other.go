@@ -0,0 +1,8 @@
+//go:build !linux
+
+package db
+
+// TODO: F_RDADVISE on darwin, posix_fadvise on the BSDs
+func fileWillNeed(fp File, offset, size int64) error {
+	return nil
+}
@@ -0,0 +1,401 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math/bits"
+	"os"
+)
+
+// how the free pages are reused, see Options.AllocPolicy
+const (
+	// the lowest free page, which keeps the file compact
+	ALLOC_FIRST uint8 = 0
+	// the first free page after the page of the node being replaced, so
+	// the nodes stay near their old copies and their neighbors, which
+	// helps the scans and the readahead
+	ALLOC_NEAR uint8 = 1
+	// never reuse, the file only grows. the old versions of the tree
+	// stay in the file, for Repair to salvage.
+	ALLOC_APPEND uint8 = 2
+)
+
+func allocPolicyName(policy uint8) string {
+	switch policy {
+	case ALLOC_FIRST:
+		return "first"
+	case ALLOC_NEAR:
+		return "near"
+	case ALLOC_APPEND:
+		return "append"
+	}
+	return fmt.Sprintf("unknown(%d)", policy)
+}
+
+// the free-space map: the pages of the file that can be reused.
+// a bitmap with a bit per page, and summary levels above it with a bit
+// per nonzero word of the level below, up to a single word. finding the
+// first free page or updating one is O(log n), a level per 64x pages.
+type freeMap struct {
+	levels [][]uint64 // levels[0] has the pages, the last one is 1 word
+	count  uint64
+}
+
+// make room for the page in every level.
+func (m *freeMap) grow(ptr uint64) {
+	need := ptr/64 + 1 // words at this level
+	for l := 0; ; l++ {
+		if l == len(m.levels) {
+			top := make([]uint64, 0, 1)
+			if l > 0 {
+				// a new level over the last one, which outgrew 1 word
+				below := m.levels[l-1]
+				top = make([]uint64, (len(below)+63)/64)
+				for i, w := range below {
+					if w != 0 {
+						top[i/64] |= 1 << (i % 64)
+					}
+				}
+			}
+			m.levels = append(m.levels, top)
+		}
+		for uint64(len(m.levels[l])) < need {
+			m.levels[l] = append(m.levels[l], 0)
+		}
+		if len(m.levels[l]) == 1 {
+			return
+		}
+		need = (uint64(len(m.levels[l])) + 63) / 64
+	}
+}
+
+func (m *freeMap) has(ptr uint64) bool {
+	return len(m.levels) > 0 && ptr/64 < uint64(len(m.levels[0])) &&
+		m.levels[0][ptr/64]&(1<<(ptr%64)) != 0
+}
+
+func (m *freeMap) add(ptr uint64) {
+	if m.has(ptr) {
+		return
+	}
+	m.grow(ptr)
+	m.count++
+	for _, level := range m.levels {
+		w := level[ptr/64]
+		level[ptr/64] = w | 1<<(ptr%64)
+		if w != 0 {
+			break // the levels above already have it
+		}
+		ptr /= 64
+	}
+}
+
+func (m *freeMap) remove(ptr uint64) {
+	if !m.has(ptr) {
+		return
+	}
+	m.count--
+	for _, level := range m.levels {
+		level[ptr/64] &^= 1 << (ptr % 64)
+		if level[ptr/64] != 0 {
+			break // the levels above still have it
+		}
+		ptr /= 64
+	}
+}
+
+// the lowest free page, so the file stays compact.
+func (m *freeMap) first() (uint64, bool) {
+	if m.count == 0 {
+		return 0, false
+	}
+	idx := uint64(0)
+	for l := len(m.levels) - 1; l >= 0; l-- {
+		idx = idx*64 + uint64(bits.TrailingZeros64(m.levels[l][idx]))
+	}
+	return idx, true
+}
+
+// the first free page >= ptr.
+func (m *freeMap) next(ptr uint64) (uint64, bool) {
+	// go up while the rest of the word is empty
+	l := 0
+	for ; l < len(m.levels); l++ {
+		level := m.levels[l]
+		if ptr/64 < uint64(len(level)) {
+			w := level[ptr/64] & (^uint64(0) << (ptr % 64))
+			if w != 0 {
+				ptr = ptr/64*64 + uint64(bits.TrailingZeros64(w))
+				break
+			}
+		}
+		ptr = ptr/64 + 1 // the next word, a bit of the level above
+	}
+	if l == len(m.levels) {
+		return 0, false
+	}
+	// then down to the first page under it
+	for ; l > 0; l-- {
+		ptr = ptr*64 + uint64(bits.TrailingZeros64(m.levels[l-1][ptr]))
+	}
+	return ptr, true
+}
+
+// a page deallocated while the version was the last durable one.
+// the version and the older ones still use it.
+type freedPage struct {
+	ptr     uint64
+	version uint64
+}
+
+// find the free pages: the pages of the file not reachable from the root,
+// the catalog or the persistent snapshots. they're read from the map
+// saved on Close if it's for the master page, else the trees are read,
+// so a crash never leaks pages. a tree that can't be read is left alone:
+// no page is reused.
+func freeInit(db *KV) error {
+	switch db.AllocPolicy {
+	case ALLOC_FIRST, ALLOC_NEAR:
+	case ALLOC_APPEND:
+		return nil
+	default:
+		return fmt.Errorf("unknown allocation policy %d", db.AllocPolicy)
+	}
+	if db.ReadOnly {
+		return nil
+	}
+	err := freeLoad(db)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		db.Logger.Debug("the free pages are found again", "err", err)
+	}
+	db.free.pages, db.free.kept = freeMap{}, freeMap{}
+	used := freeMap{}
+	used.add(0) // the master page
+	err = freeMark(db, &used)
+	if err != nil {
+		db.Logger.Warn("the free pages are not reused", "err", err)
+		db.free.kept = freeMap{}
+		return nil
+	}
+	for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+		if !used.has(ptr) {
+			db.free.pages.add(ptr)
+		}
+	}
+	return nil
+}
+
+// a free page to reuse by the policy, if any.
+func freeAlloc(db *KV) (uint64, bool) {
+	if db.AllocPolicy == ALLOC_NEAR {
+		if ptr, ok := db.free.pages.next(db.free.hint); ok {
+			return ptr, true
+		}
+	}
+	return db.free.pages.first()
+}
+
+func freeMark(db *KV, used *freeMap) (err error) {
+	defer catchPageError(&err)
+	mark := func(ptr uint64) {
+		if ptr >= db.page.flushed {
+			panic(&pageError{ptr, ErrPageNotFound})
+		}
+		used.add(ptr)
+	}
+	treePages(&db.tree, mark)
+	treePages(&db.catalog, mark)
+	catalogSnapshots(db, func(name []byte, root uint64) {
+		tree := BTree{root: root, get: db.pageGet}
+		treePages(&tree, func(ptr uint64) {
+			mark(ptr)
+			db.free.kept.add(ptr)
+		})
+	})
+	return nil
+}
+
+// call fn on every page of the tree. only the internal nodes are read,
+// the leaves are known from their parents.
+func treePages(tree *BTree, fn func(ptr uint64)) {
+	if tree.root == 0 {
+		return
+	}
+	// all leaves are at the same depth
+	height := 0
+	for ptr := tree.root; ; {
+		height++
+		node := tree.get(ptr)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		ptr = node.getPtr(0)
+	}
+	var visit func(ptr uint64, level int)
+	visit = func(ptr uint64, level int) {
+		fn(ptr)
+		if level == 1 {
+			return // a leaf
+		}
+		node := tree.get(ptr)
+		for i := uint16(0); i < node.nkeys(); i++ {
+			visit(node.getPtr(i), level-1)
+		}
+	}
+	visit(tree.root, height)
+}
+
+// move the deallocated pages that no version in use can see to the map:
+// those freed before the last commit and before every pinned version,
+// and before the last synced one, which a crash goes back to.
+func freeRelease(db *KV) {
+	limit := db.free.version
+	if db.free.durable < limit {
+		limit = db.free.durable
+	}
+	for version := range db.pins {
+		if version < limit {
+			limit = version
+		}
+	}
+	for _, v := range db.views {
+		if v.readers.Load() > 0 && v.version < limit {
+			limit = v.version
+		}
+	}
+	n := 0
+	for n < len(db.free.pending) && db.free.pending[n].version < limit {
+		// still in a persistent snapshot, see catalogRelease
+		if ptr := db.free.pending[n].ptr; !db.free.kept.has(ptr) {
+			db.free.pages.add(ptr)
+		}
+		n++
+	}
+	db.free.pending = db.free.pending[n:]
+}
+
+// the free-space map is saved next to the DB file on Close, so that the
+// next Open doesn't read every internal node of the trees to find the
+// free pages. it's stamped with the master page: the epoch, the number
+// of commits of the file, changes with every commit, so the map is only
+// used for the commit it was saved for. one left by a crash is stale,
+// and not written at all for an encrypted DB: a checksum can't tell a
+// forged map, which could reuse the pages of the tree.
+// | sig | epoch | root | used | catalog | npages | nkept | pages | kept | crc32c |
+// | 8B  |  8B   |  8B  |  8B  |   8B    |   8B   |  8B   |  ...  |  ... |   4B   |
+// the pages and the kept pages of the snapshots are the words of the
+// bitmaps, see freeMap.
+const FREE_SIG = "GODBFRE1"
+
+// after the catalog root in the master page, see freeSave.
+// | epoch |
+// |  8B   |
+const MASTER_EPOCH_OFFSET = MASTER_CATALOG_OFFSET + 8
+
+const freeHeader = 56
+
+var errFreeStale = errors.New("stale free-space map")
+
+func freePath(db *KV) string {
+	return db.Path + ".free"
+}
+
+// write the map for the current master page, called on Close.
+func freeSave(db *KV) error {
+	if db.crypt.aead != nil || db.AllocPolicy == ALLOC_APPEND {
+		return nil
+	}
+	// nothing reads the pages still pending after Close
+	pages := freeMap{}
+	for ptr, ok := db.free.pages.first(); ok; ptr, ok = db.free.pages.next(ptr + 1) {
+		pages.add(ptr)
+	}
+	for _, p := range db.free.pending {
+		if !db.free.kept.has(p.ptr) {
+			pages.add(p.ptr)
+		}
+	}
+	words := func(m *freeMap) []uint64 {
+		if len(m.levels) == 0 {
+			return nil
+		}
+		return m.levels[0]
+	}
+	pw, kw := words(&pages), words(&db.free.kept)
+	data := make([]byte, freeHeader, freeHeader+8*(len(pw)+len(kw))+4)
+	copy(data, FREE_SIG)
+	binary.LittleEndian.PutUint64(data[8:], db.free.epoch)
+	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
+	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	binary.LittleEndian.PutUint64(data[32:], db.catalog.root)
+	binary.LittleEndian.PutUint64(data[40:], uint64(len(pw)))
+	binary.LittleEndian.PutUint64(data[48:], uint64(len(kw)))
+	for _, w := range append(append([]uint64(nil), pw...), kw...) {
+		data = binary.LittleEndian.AppendUint64(data, w)
+	}
+	data = binary.LittleEndian.AppendUint32(data, crc32.Checksum(data, crc32c))
+
+	// write a new file and rename it over the old one
+	tmp := freePath(db) + ".tmp"
+	if err := db.vfs().WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write free-space map: %w", err)
+	}
+	if err := db.vfs().Rename(tmp, freePath(db)); err != nil {
+		return fmt.Errorf("write free-space map: %w", err)
+	}
+	return nil
+}
+
+// read the map saved for the master page.
+func freeLoad(db *KV) error {
+	if db.crypt.aead != nil {
+		return errFreeStale
+	}
+	data, err := db.vfs().ReadFile(freePath(db))
+	if err != nil {
+		return err
+	}
+	if len(data) < freeHeader+4 || !bytes.Equal(data[:8], []byte(FREE_SIG)) {
+		return errFreeStale
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crc32c) != sum {
+		return errFreeStale
+	}
+	stamp := []uint64{db.free.epoch, db.tree.root, db.page.flushed, db.catalog.root}
+	for i, v := range stamp {
+		if binary.LittleEndian.Uint64(data[8+8*i:]) != v {
+			return errFreeStale
+		}
+	}
+	np := binary.LittleEndian.Uint64(data[40:])
+	nk := binary.LittleEndian.Uint64(data[48:])
+	if np > uint64(len(body)) || nk > uint64(len(body)) ||
+		uint64(len(body)-freeHeader) != 8*(np+nk) {
+		return errFreeStale
+	}
+	read := func(m *freeMap, off uint64, n uint64) error {
+		for i := uint64(0); i < n; i++ {
+			w := binary.LittleEndian.Uint64(body[freeHeader+8*(off+i):])
+			for w != 0 {
+				ptr := 64*i + uint64(bits.TrailingZeros64(w))
+				if ptr == 0 || ptr >= db.page.flushed {
+					return errFreeStale
+				}
+				m.add(ptr)
+				w &= w - 1
+			}
+		}
+		return nil
+	}
+	if err := read(&db.free.pages, 0, np); err != nil {
+		return err
+	}
+	return read(&db.free.kept, np, nk)
+}
@@ -0,0 +1,245 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestFreeMap(t *testing.T) {
+	m := freeMap{}
+	_, ok := m.first()
+	testify_assert.False(t, ok)
+
+	// 3 levels
+	ref := map[uint64]bool{}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		ptr := uint64(rng.Intn(64 * 64 * 4))
+		if rng.Intn(3) == 0 {
+			m.remove(ptr)
+			delete(ref, ptr)
+		} else {
+			m.add(ptr)
+			ref[ptr] = true
+		}
+	}
+	testify_assert.Len(t, m.levels, 3)
+	testify_assert.Equal(t, uint64(len(ref)), m.count)
+	// the next ones from anywhere
+	for i := 0; i < 1000; i++ {
+		from := uint64(rng.Intn(64 * 64 * 5))
+		want, found := uint64(0), false
+		for ptr := range ref {
+			if ptr >= from && (!found || ptr < want) {
+				want, found = ptr, true
+			}
+		}
+		got, ok := m.next(from)
+		testify_assert.Equal(t, found, ok)
+		testify_assert.Equal(t, want, got, "from %d", from)
+	}
+	// taken in order
+	prev := int64(-1)
+	for len(ref) > 0 {
+		ptr, ok := m.first()
+		testify_assert.True(t, ok)
+		testify_assert.True(t, ref[ptr])
+		testify_assert.Greater(t, int64(ptr), prev)
+		m.remove(ptr)
+		delete(ref, ptr)
+		prev = int64(ptr)
+	}
+	_, ok = m.first()
+	testify_assert.False(t, ok)
+}
+
+func TestKV_ReusePages(t *testing.T) {
+	for _, policy := range []uint8{ALLOC_FIRST, ALLOC_NEAR} {
+		db := openTestKV(t)
+		db.NoSync = true
+		db.AllocPolicy = policy
+		for i := 0; i < 200; i++ {
+			testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), make([]byte, 100)))
+		}
+		// the updates only use the pages freed by the previous ones
+		size := db.page.flushed
+		for i := 0; i < 1000; i++ {
+			testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i%200)), make([]byte, 100)))
+		}
+		testify_assert.LessOrEqual(t, db.page.flushed, size+2)
+		testify_assert.NoError(t, db.Verify())
+	}
+}
+
+func TestKV_ReusePinned(t *testing.T) {
+	db := openTestKV(t)
+	db.NoSync = true
+	for i := 0; i < 200; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("old")))
+	}
+	snap, err := db.Snapshot()
+	testify_assert.NoError(t, err)
+	it := snap.Iter(nil)
+	snap.Close() // the iterator keeps the version
+
+	// the pages of the snapshot are not reused
+	size := db.page.flushed
+	for i := 0; i < 200; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("new")))
+	}
+	testify_assert.Greater(t, db.page.flushed, size+10)
+	n := 0
+	for ; it.Valid(); it.Next() {
+		testify_assert.Equal(t, "old", string(it.Val()))
+		n++
+	}
+	testify_assert.NoError(t, it.Err())
+	testify_assert.Equal(t, 200, n)
+
+	// until it's closed
+	testify_assert.Zero(t, db.free.pages.count)
+	it.Close()
+	testify_assert.NotZero(t, db.free.pages.count)
+}
+
+func TestKV_FreeOnOpen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 100)))
+	}
+	testify_assert.NoError(t, db.DeleteRange([]byte("k0100"), nil))
+	free := db.free.pages.count
+	db.Close()
+
+	// the pages not in the tree are found again
+	db, err = Open(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	s := db.Stats()
+	testify_assert.Equal(t, s.FreePages, db.free.pages.count)
+	testify_assert.Equal(t, free, db.free.pages.count)
+	size := db.page.flushed
+	for i := 100; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 100)))
+	}
+	testify_assert.Equal(t, size, db.page.flushed)
+	testify_assert.NoError(t, db.Verify())
+}
+
+func TestKV_AllocPolicy(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.Equal(t, "first", db.Stats().AllocPolicy)
+	for _, ptr := range []uint64{5, 50, 100} {
+		db.free.pages.add(ptr)
+	}
+	db.free.hint = 60
+	ptr, _ := freeAlloc(db)
+	testify_assert.Equal(t, uint64(5), ptr)
+	db.AllocPolicy = ALLOC_NEAR
+	ptr, _ = freeAlloc(db)
+	testify_assert.Equal(t, uint64(100), ptr)
+	db.free.hint = 101 // none after it
+	ptr, _ = freeAlloc(db)
+	testify_assert.Equal(t, uint64(5), ptr)
+
+	path := filepath.Join(t.TempDir(), "test.db")
+	_, err := Open(path, WithAllocPolicy(9))
+	testify_assert.ErrorContains(t, err, "unknown allocation policy")
+
+	// the file grows by every update
+	db, err = Open(path, WithAllocPolicy(ALLOC_APPEND), WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.Equal(t, "append", db.Stats().AllocPolicy)
+	for i := 0; i < 100; i++ {
+		testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	}
+	testify_assert.Equal(t, uint64(101), db.page.flushed)
+	testify_assert.Zero(t, db.Stats().ReusablePages)
+}
+
+// the map saved on Close is used by the next Open, unless a commit made
+// it stale.
+func TestKV_FreeSaved(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := Open(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 100)))
+	}
+	testify_assert.NoError(t, db.DeleteRange([]byte("k0500"), nil))
+	testify_assert.NoError(t, db.CreateSnapshot("s"))
+	testify_assert.NoError(t, db.DeleteRange([]byte("k0100"), nil))
+	db.Close()
+	saved, err := os.ReadFile(freePath(db))
+	testify_assert.NoError(t, err)
+
+	// the same maps as those found from the trees
+	walked := func(db *KV) (freeMap, freeMap) {
+		used := freeMap{}
+		used.add(0)
+		kept := db.free.kept
+		db.free.kept = freeMap{}
+		testify_assert.NoError(t, freeMark(db, &used))
+		free := freeMap{}
+		for ptr := uint64(1); ptr < db.page.flushed; ptr++ {
+			if !used.has(ptr) {
+				free.add(ptr)
+			}
+		}
+		walkedKept := db.free.kept
+		db.free.kept = kept
+		return free, walkedKept
+	}
+	// a KV with the master page of db, to load the map into
+	stamped := func(db *KV) *KV {
+		k := &KV{Path: db.Path, tree: db.tree, catalog: db.catalog, page: db.page}
+		k.free.epoch = db.free.epoch
+		return k
+	}
+	db, err = Open(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, freeLoad(stamped(db)))
+	free, kept := walked(db)
+	testify_assert.NotZero(t, free.count)
+	testify_assert.NotZero(t, kept.count)
+	testify_assert.Equal(t, free.count, db.free.pages.count)
+	testify_assert.Equal(t, kept.count, db.free.kept.count)
+	for ptr, ok := free.first(); ok; ptr, ok = free.next(ptr + 1) {
+		testify_assert.True(t, db.free.pages.has(ptr))
+	}
+
+	// a commit after the save, then a crash
+	testify_assert.NoError(t, db.Set([]byte("k0000"), []byte("new")))
+	data, err := os.ReadFile(path)
+	testify_assert.NoError(t, err)
+	db.Close()
+	testify_assert.NoError(t, os.WriteFile(path, data, 0644))
+	testify_assert.NoError(t, os.WriteFile(freePath(db), saved, 0644))
+	db, err = Open(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	testify_assert.ErrorIs(t, freeLoad(stamped(db)), errFreeStale)
+	free, _ = walked(db)
+	testify_assert.Equal(t, free.count, db.free.pages.count)
+	db.Close()
+
+	// a damaged map
+	saved, err = os.ReadFile(freePath(db))
+	testify_assert.NoError(t, err)
+	saved[len(saved)/2] ^= 1
+	testify_assert.NoError(t, os.WriteFile(freePath(db), saved, 0644))
+	db, err = Open(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	free, _ = walked(db)
+	testify_assert.Equal(t, free.count, db.free.pages.count)
+	testify_assert.Nil(t, db.Check())
+}
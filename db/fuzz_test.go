@@ -0,0 +1,67 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// any page that passes nodeCheck can be read without going out of bounds.
+func FuzzNode(f *testing.F) {
+	leaf := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	leaf.setHeader(BNODE_LEAF, 2)
+	nodeAppendKV(leaf, 0, 0, nil, nil)
+	nodeAppendKV(leaf, 1, 0, []byte("key"), []byte("val"))
+	f.Add(leaf.data[:leaf.nbytes()])
+	internal := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	internal.setHeader(BNODE_NODE, 2)
+	nodeAppendKV(internal, 0, 7, nil, nil)
+	nodeAppendKV(internal, 1, 9, []byte("m"), nil)
+	f.Add(internal.data[:internal.nbytes()])
+	f.Add([]byte{2, 0, 255, 255})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		node := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		copy(node.data[:BNODE_MAX_SIZE], data)
+		if nodeCheck(node, bytes.Compare) != nil {
+			return
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			node.getVal(i)
+			if node.btype() == BNODE_NODE {
+				node.getPtr(i)
+			}
+			if idx := nodeLookupLE(node, key, bytes.Compare); idx != i {
+				t.Fatalf("lookup of key %d found %d", i, idx)
+			}
+		}
+		if int(node.nbytes()) > BNODE_MAX_SIZE {
+			t.Fatalf("node of %d bytes", node.nbytes())
+		}
+	})
+}
+
+// every 2 bytes are an operation on one of 256 keys, the tree must
+// match the reference map after each of them.
+func FuzzTree(f *testing.F) {
+	f.Add([]byte{0, 1, 0, 2, 1, 1, 0, 0x33})
+	f.Add([]byte{0, 0xf0, 0, 0xf1, 0, 0xf2, 2, 0xf1, 1, 0xf0})
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		c := NewC()
+		for i := 0; i+1 < len(ops); i += 2 {
+			key := fmt.Sprintf("k%03d", ops[i+1])
+			if ops[i]%3 == 2 {
+				_, existed := c.ref[key]
+				if c.Del(key) != existed {
+					t.Fatalf("op %d: delete %s", i/2, key)
+				}
+			} else {
+				val := bytes.Repeat([]byte{'v'}, int(ops[i]>>2)*16)
+				c.Add(key, string(val))
+			}
+			cVerify(t, c)
+		}
+	})
+}
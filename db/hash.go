@@ -0,0 +1,547 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+)
+
+// a hash index engine for point lookups, by linear hashing. keys are not
+// ordered, so a Scan reads and sorts every key.
+//
+// the file is made of pages, copy-on-write like the KV:
+//   - the master page (0), the root of the directory and the table state
+//   - the directory root, the pointers to the directory pages
+//   - the directory pages, the first page of every bucket, 0 if empty
+//   - the bucket pages, a bucket that doesn't fit in a page is a chain
+//
+// an update writes its pages copy-on-write too, to the free pages or the
+// end of the file. the pages it replaces are free once its master page
+// is synced, the free pages are found again on open.
+//
+// the table grows by one bucket at a time: bucket `split` is rehashed
+// into itself and bucket `split + 2^level` whenever the buckets are
+// HASH_FILL full on average.
+const (
+	HASH_SIG    = "GODBHASH"
+	HASH_FILL   = 0.75
+	HASH_FANOUT = BNODE_MAX_SIZE / 8 // pointers per directory page
+	// HASH_FANOUT directory pages of HASH_FANOUT buckets, the chains
+	// just grow longer past that.
+	HASH_MAX_BUCKETS = HASH_FANOUT * HASH_FANOUT
+)
+
+// the master page.
+// | sig | dir_root | page_used | level | split | count | bytes |
+// | 8B  |    8B    |     8B    |   8B  |   8B  |   8B  |   8B  |
+const HASH_MASTER_SIZE = 56
+
+// a bucket page, every page has a checksum in the trailer.
+// | nkeys | next | klen | vlen | key | val | ... |
+// |  2B   |  8B  |  2B  |  2B  | ... | ... |
+const HASH_BUCKET_HEADER = 10
+
+type hashKV struct {
+	key []byte
+	val []byte
+}
+
+type Hash struct {
+	Path     string
+	noSync   bool
+	readOnly bool
+	fp       File
+	// the master page
+	root  uint64
+	used  uint64 // number of pages
+	level uint64 // 2^level <= number of buckets < 2^(level+1)
+	split uint64 // the next bucket to split
+	count uint64 // number of keys
+	bytes uint64 // size of the KVs
+	// the directory, kept in memory
+	buckets  []uint64 // first page of each bucket
+	dirPages []uint64
+	dirty    map[int]bool // directory pages to rewrite
+	// the pages of the ongoing update, and those it replaces
+	pending map[uint64][]byte
+	freed   []uint64
+	free    freeMap // reusable now
+}
+
+// OpenHash opens or creates a hash database at path.
+// of the options, only FS, ReadOnly and NoSync apply.
+func OpenHash(path string, opts ...Option) (*Hash, error) {
+	o := applyOptions(opts)
+	if len(o.EncryptionKey) > 0 || o.Compression != COMPRESS_NONE {
+		return nil, errors.New("OpenHash: encryption and compression are not supported")
+	}
+	if o.Comparator != nil && o.Comparator != Bytewise {
+		return nil, errors.New("OpenHash: keys are not ordered, a comparator can't apply")
+	}
+	db := &Hash{
+		Path: path, noSync: o.NoSync, readOnly: o.ReadOnly,
+		dirty: map[int]bool{}, pending: map[uint64][]byte{},
+	}
+	fs := o.FS
+	if fs == nil {
+		fs = OSFS{}
+	}
+	mode := os.O_RDWR | os.O_CREATE
+	if o.ReadOnly {
+		mode = os.O_RDONLY
+	}
+	fp, err := fs.OpenFile(path, mode, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("OpenHash: %w", err)
+	}
+	db.fp = fp
+	if err := lockFile(fp, !o.ReadOnly); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("OpenHash: %w", err)
+	}
+	if err := db.load(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("OpenHash: %w", err)
+	}
+	return db, nil
+}
+
+func (db *Hash) load() error {
+	var data [HASH_MASTER_SIZE]byte
+	n, err := db.fp.ReadAt(data[:], 0)
+	if n == 0 || isZero(data[:]) {
+		// a new file, one empty bucket
+		db.used = 1
+		db.buckets = []uint64{0}
+		return nil
+	}
+	if n < len(data) {
+		return fmt.Errorf("read master page: %w", err)
+	}
+	if !bytes.Equal(data[:8], []byte(HASH_SIG)) {
+		return errors.New("Bad signature.")
+	}
+	db.root = binary.LittleEndian.Uint64(data[8:])
+	db.used = binary.LittleEndian.Uint64(data[16:])
+	db.level = binary.LittleEndian.Uint64(data[24:])
+	db.split = binary.LittleEndian.Uint64(data[32:])
+	db.count = binary.LittleEndian.Uint64(data[40:])
+	db.bytes = binary.LittleEndian.Uint64(data[48:])
+	nbuckets := uint64(1)<<db.level + db.split
+	if db.level > 32 || db.split >= 1<<db.level || nbuckets > HASH_MAX_BUCKETS ||
+		db.root == 0 || db.root >= db.used {
+		return errors.New("Bad master page.")
+	}
+
+	// the directory
+	page, err := db.pageRead(db.root)
+	if err != nil {
+		return err
+	}
+	ndir := (nbuckets + HASH_FANOUT - 1) / HASH_FANOUT
+	for i := uint64(0); i < ndir; i++ {
+		db.dirPages = append(db.dirPages, binary.LittleEndian.Uint64(page[8*i:]))
+	}
+	for _, ptr := range db.dirPages {
+		page, err := db.pageRead(ptr)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < HASH_FANOUT && uint64(len(db.buckets)) < nbuckets; i++ {
+			db.buckets = append(db.buckets, binary.LittleEndian.Uint64(page[8*i:]))
+		}
+	}
+	if db.readOnly {
+		return nil
+	}
+	return db.freeInit()
+}
+
+// the free pages: those not reachable from the master page.
+func (db *Hash) freeInit() error {
+	used := freeMap{}
+	used.add(0)
+	used.add(db.root)
+	for _, ptr := range db.dirPages {
+		used.add(ptr)
+	}
+	for b := range db.buckets {
+		ptrs, err := db.chain(uint64(b))
+		if err != nil {
+			return err
+		}
+		for _, ptr := range ptrs {
+			used.add(ptr)
+		}
+	}
+	for ptr := uint64(1); ptr < db.used; ptr++ {
+		if !used.has(ptr) {
+			db.free.add(ptr)
+		}
+	}
+	return nil
+}
+
+// a page for the ongoing update, a free one or at the end of the file.
+func (db *Hash) pageNew(page []byte) uint64 {
+	ptr, ok := db.free.first()
+	if ok {
+		db.free.remove(ptr)
+	} else {
+		ptr = db.used
+		db.used++
+	}
+	db.pending[ptr] = page
+	return ptr
+}
+
+// a page replaced by the ongoing update. it's reused after the commit,
+// unless the update wrote it, then no master page has it.
+func (db *Hash) pageDel(ptr uint64) {
+	if _, ok := db.pending[ptr]; ok {
+		delete(db.pending, ptr)
+		db.free.add(ptr)
+		return
+	}
+	db.freed = append(db.freed, ptr)
+}
+
+func (db *Hash) Close() {
+	if db.fp != nil {
+		_ = db.fp.Close()
+	}
+}
+
+func hashKey(key []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(key)
+	return h.Sum64()
+}
+
+// the bucket of a key.
+func (db *Hash) bucket(key []byte) uint64 {
+	h := hashKey(key)
+	b := h & (1<<db.level - 1)
+	if b < db.split {
+		b = h & (1<<(db.level+1) - 1) // already split
+	}
+	return b
+}
+
+func (db *Hash) Get(key []byte) ([]byte, bool, error) {
+	kvs, err := db.readBucket(db.bucket(key))
+	if err != nil {
+		return nil, false, err
+	}
+	for _, kv := range kvs {
+		if bytes.Equal(kv.key, key) {
+			return kv.val, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (db *Hash) Set(key []byte, val []byte) error {
+	if err := db.checkWritable(); err != nil {
+		return err
+	}
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	b := db.bucket(key)
+	kvs, err := db.readBucket(b)
+	if err != nil {
+		return err
+	}
+	kv := hashKV{key: key, val: val}
+	i := hashFind(kvs, key)
+	if i < len(kvs) {
+		db.bytes -= uint64(len(kvs[i].key) + len(kvs[i].val))
+		kvs[i] = kv
+	} else {
+		kvs = append(kvs, kv)
+		db.count++
+	}
+	db.bytes += uint64(len(key) + len(val))
+	if err := db.writeBucket(b, kvs); err != nil {
+		return err
+	}
+	if float64(db.bytes) > HASH_FILL*float64(len(db.buckets)*BNODE_MAX_SIZE) &&
+		len(db.buckets) < HASH_MAX_BUCKETS {
+		if err := db.splitBucket(); err != nil {
+			return err
+		}
+	}
+	return db.commit()
+}
+
+func (db *Hash) Del(key []byte) (bool, error) {
+	if err := db.checkWritable(); err != nil {
+		return false, err
+	}
+	if err := checkKV(key, nil); err != nil {
+		return false, err
+	}
+	b := db.bucket(key)
+	kvs, err := db.readBucket(b)
+	if err != nil {
+		return false, err
+	}
+	i := hashFind(kvs, key)
+	if i == len(kvs) {
+		return false, nil
+	}
+	db.bytes -= uint64(len(kvs[i].key) + len(kvs[i].val))
+	db.count--
+	kvs = append(kvs[:i], kvs[i+1:]...)
+	if err := db.writeBucket(b, kvs); err != nil {
+		return false, err
+	}
+	return true, db.commit()
+}
+
+// call fn on every KV with key >= start in key order until it returns false.
+// the keys are unordered in the file, so all of them are read and sorted.
+func (db *Hash) Scan(start []byte, fn func(key, val []byte) bool) error {
+	var all []hashKV
+	for b := range db.buckets {
+		kvs, err := db.readBucket(uint64(b))
+		if err != nil {
+			return err
+		}
+		for _, kv := range kvs {
+			if bytes.Compare(kv.key, start) >= 0 {
+				all = append(all, kv)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(all[i].key, all[j].key) < 0
+	})
+	for _, kv := range all {
+		if !fn(kv.key, kv.val) {
+			break
+		}
+	}
+	return nil
+}
+
+func (db *Hash) checkWritable() error {
+	if db.readOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, db.Path)
+	}
+	return nil
+}
+
+func hashFind(kvs []hashKV, key []byte) int {
+	for i, kv := range kvs {
+		if bytes.Equal(kv.key, key) {
+			return i
+		}
+	}
+	return len(kvs)
+}
+
+// add bucket `split + 2^level` by rehashing bucket `split`.
+func (db *Hash) splitBucket() error {
+	old := db.split
+	kvs, err := db.readBucket(old)
+	if err != nil {
+		return err
+	}
+	db.split++
+	if db.split == 1<<db.level {
+		db.level++
+		db.split = 0
+	}
+	db.buckets = append(db.buckets, 0)
+	var keep, move []hashKV
+	for _, kv := range kvs {
+		if db.bucket(kv.key) == old {
+			keep = append(keep, kv)
+		} else {
+			move = append(move, kv)
+		}
+	}
+	if err := db.writeBucket(old, keep); err != nil {
+		return err
+	}
+	return db.writeBucket(uint64(len(db.buckets)-1), move)
+}
+
+// the pages of a bucket.
+func (db *Hash) chain(b uint64) ([]uint64, error) {
+	var ptrs []uint64
+	for ptr := db.buckets[b]; ptr != 0; {
+		page, err := db.pageRead(ptr)
+		if err != nil {
+			return nil, err
+		}
+		ptrs = append(ptrs, ptr)
+		ptr = binary.LittleEndian.Uint64(page[2:])
+	}
+	return ptrs, nil
+}
+
+// read the KVs of a bucket, following the chain.
+func (db *Hash) readBucket(b uint64) ([]hashKV, error) {
+	var kvs []hashKV
+	for ptr := db.buckets[b]; ptr != 0; {
+		page, err := db.pageRead(ptr)
+		if err != nil {
+			return nil, err
+		}
+		nkeys := int(binary.LittleEndian.Uint16(page))
+		ptr = binary.LittleEndian.Uint64(page[2:])
+		pos := HASH_BUCKET_HEADER
+		for i := 0; i < nkeys; i++ {
+			if pos+4 > BNODE_MAX_SIZE {
+				return nil, fmt.Errorf("bucket %d: bad page", b)
+			}
+			klen := int(binary.LittleEndian.Uint16(page[pos:]))
+			vlen := int(binary.LittleEndian.Uint16(page[pos+2:]))
+			pos += 4
+			if pos+klen+vlen > BNODE_MAX_SIZE {
+				return nil, fmt.Errorf("bucket %d: bad page", b)
+			}
+			kvs = append(kvs, hashKV{
+				key: page[pos : pos+klen],
+				val: page[pos+klen : pos+klen+vlen],
+			})
+			pos += klen + vlen
+		}
+	}
+	return kvs, nil
+}
+
+// write the KVs of a bucket as a new chain of pages, in place of the old one.
+func (db *Hash) writeBucket(b uint64, kvs []hashKV) error {
+	old, err := db.chain(b)
+	if err != nil {
+		return err
+	}
+	// the KVs may be in the old pages, which are reused once freed
+	for _, ptr := range old {
+		db.pageDel(ptr)
+	}
+	var pages [][]byte
+	var page []byte
+	for _, kv := range kvs {
+		size := 4 + len(kv.key) + len(kv.val)
+		if page == nil || len(page)+size > BNODE_MAX_SIZE {
+			page = make([]byte, HASH_BUCKET_HEADER, BTREE_PAGE_SIZE)
+			pages = append(pages, page)
+		}
+		i := len(pages) - 1
+		binary.LittleEndian.PutUint16(page, binary.LittleEndian.Uint16(page)+1)
+		page = binary.LittleEndian.AppendUint16(page, uint16(len(kv.key)))
+		page = binary.LittleEndian.AppendUint16(page, uint16(len(kv.val)))
+		page = append(page, kv.key...)
+		page = append(page, kv.val...)
+		pages[i] = page
+	}
+	// linked from the last one
+	next := uint64(0)
+	for i := len(pages) - 1; i >= 0; i-- {
+		binary.LittleEndian.PutUint64(pages[i][2:], next)
+		next = db.pageNew(pages[i][:BTREE_PAGE_SIZE])
+	}
+	db.buckets[b] = next
+	db.dirty[int(b/HASH_FANOUT)] = true
+	return nil
+}
+
+// write the new pages and the directory, then switch the master page.
+func (db *Hash) commit() error {
+	if len(db.dirty) > 0 {
+		for len(db.dirPages) < (len(db.buckets)+HASH_FANOUT-1)/HASH_FANOUT {
+			db.dirPages = append(db.dirPages, 0)
+		}
+		for i := range db.dirty {
+			page := make([]byte, BTREE_PAGE_SIZE)
+			end := (i + 1) * HASH_FANOUT
+			if end > len(db.buckets) {
+				end = len(db.buckets)
+			}
+			for j, ptr := range db.buckets[i*HASH_FANOUT : end] {
+				binary.LittleEndian.PutUint64(page[8*j:], ptr)
+			}
+			if db.dirPages[i] != 0 {
+				db.pageDel(db.dirPages[i])
+			}
+			db.dirPages[i] = db.pageNew(page)
+		}
+		page := make([]byte, BTREE_PAGE_SIZE)
+		for i, ptr := range db.dirPages {
+			binary.LittleEndian.PutUint64(page[8*i:], ptr)
+		}
+		if db.root != 0 {
+			db.pageDel(db.root)
+		}
+		db.root = db.pageNew(page)
+		db.dirty = map[int]bool{}
+	}
+
+	for ptr, page := range db.pending {
+		pageStamp(ptr, page)
+		if _, err := db.fp.WriteAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+			return fmt.Errorf("write page: %w", err)
+		}
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	db.pending = map[uint64][]byte{}
+
+	var data [HASH_MASTER_SIZE]byte
+	copy(data[:8], HASH_SIG)
+	binary.LittleEndian.PutUint64(data[8:], db.root)
+	binary.LittleEndian.PutUint64(data[16:], db.used)
+	binary.LittleEndian.PutUint64(data[24:], db.level)
+	binary.LittleEndian.PutUint64(data[32:], db.split)
+	binary.LittleEndian.PutUint64(data[40:], db.count)
+	binary.LittleEndian.PutUint64(data[48:], db.bytes)
+	if _, err := db.fp.WriteAt(data[:], 0); err != nil {
+		return fmt.Errorf("write master page: %w", err)
+	}
+	if err := db.sync(); err != nil {
+		return err
+	}
+	// no longer in the file
+	for _, ptr := range db.freed {
+		db.free.add(ptr)
+	}
+	db.freed = db.freed[:0]
+	return nil
+}
+
+func (db *Hash) sync() error {
+	if db.noSync {
+		return nil
+	}
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+func (db *Hash) pageRead(ptr uint64) ([]byte, error) {
+	if page, ok := db.pending[ptr]; ok {
+		return page, nil // written by the ongoing update
+	}
+	if ptr == 0 || ptr >= db.used {
+		return nil, &pageError{ptr, ErrPageNotFound}
+	}
+	page := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := db.fp.ReadAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+		return nil, &pageError{ptr, err}
+	}
+	if !pageVerify(ptr, page) {
+		return nil, &pageError{ptr, ErrChecksum}
+	}
+	return page, nil
+}
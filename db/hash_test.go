@@ -0,0 +1,97 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+// enough keys for many splits and some overflow chains.
+func TestHash_Random(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hash.db")
+	db, err := OpenHash(path, WithNoSync())
+	testify_assert.NoError(t, err)
+
+	rng := rand.New(rand.NewSource(1))
+	ref := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("key%04d", rng.Intn(2000))
+		if rng.Intn(4) == 0 {
+			_, existed := ref[key]
+			deleted, err := db.Del([]byte(key))
+			testify_assert.NoError(t, err)
+			testify_assert.Equal(t, existed, deleted)
+			delete(ref, key)
+		} else {
+			val := fmt.Sprintf("%d-%s", i, make([]byte, rng.Intn(100)))
+			testify_assert.NoError(t, db.Set([]byte(key), []byte(val)))
+			ref[key] = val
+		}
+		if i%1000 == 999 {
+			db.Close()
+			db, err = OpenHash(path, WithNoSync())
+			testify_assert.NoError(t, err)
+		}
+	}
+	defer db.Close()
+	testify_assert.Greater(t, len(db.buckets), 16)
+	testify_assert.Equal(t, uint64(len(ref)), db.count)
+	testify_assert.Equal(t, ref, engineDump(t, db))
+	for key, val := range ref {
+		got, ok, err := db.Get([]byte(key))
+		testify_assert.NoError(t, err)
+		testify_assert.True(t, ok)
+		testify_assert.Equal(t, val, string(got))
+	}
+	_, ok, err := db.Get([]byte("missing"))
+	testify_assert.NoError(t, err)
+	testify_assert.False(t, ok)
+}
+
+func TestHash_ReadOnly(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hash.db")
+	db, err := OpenHash(path)
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, db.Set([]byte("k"), make([]byte, BTREE_MAX_VAL_SIZE)))
+	db.Close()
+
+	db, err = OpenHash(path, WithReadOnly())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.ErrorIs(t, db.Set([]byte("k"), nil), ErrReadOnly)
+	val, ok, err := db.Get([]byte("k"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Len(t, val, BTREE_MAX_VAL_SIZE)
+}
+
+// the pages of the old bucket chains and directory are reused.
+func TestHash_Overwrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hash.db")
+	db, err := OpenHash(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		if i == 500 {
+			db.Close() // the free pages are found again
+			db, err = OpenHash(path, WithNoSync())
+			testify_assert.NoError(t, err)
+		}
+		val := make([]byte, BTREE_MAX_VAL_SIZE)
+		val[0] = byte(i)
+		testify_assert.NoError(t, db.Set([]byte("k"), val))
+		testify_assert.NoError(t, db.Set([]byte("small"), []byte(fmt.Sprint(i))))
+	}
+	defer db.Close()
+	testify_assert.LessOrEqual(t, db.used, uint64(16))
+	fi, err := os.Stat(path)
+	testify_assert.NoError(t, err)
+	testify_assert.LessOrEqual(t, fi.Size(), int64(16*BTREE_PAGE_SIZE))
+	val, ok, err := db.Get([]byte("small"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "999", string(val))
+}
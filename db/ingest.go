@@ -0,0 +1,136 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// RunWriter writes a sorted run of KVs and deletions to a file, in the
+// format of the runs of the LSM engine, to be loaded by KV.Ingest. the
+// files can be prepared offline, the keys must be added in increasing
+// bytewise order.
+type RunWriter struct {
+	fp   *os.File
+	w    *bufio.Writer
+	last []byte // nil before the first key
+	n    int
+}
+
+// CreateRun creates a run file, or truncates it.
+func CreateRun(path string) (*RunWriter, error) {
+	fp, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("create run: %w", err)
+	}
+	return &RunWriter{fp: fp, w: bufio.NewWriter(fp)}, nil
+}
+
+func (w *RunWriter) Set(key, val []byte) error {
+	if err := checkKV(key, val); err != nil {
+		return err
+	}
+	return w.add(lsmEntry{key: key, val: val})
+}
+
+// Del adds a deletion, the key is deleted by Ingest if it exists.
+func (w *RunWriter) Del(key []byte) error {
+	if err := checkKV(key, nil); err != nil {
+		return err
+	}
+	return w.add(lsmEntry{key: key, deleted: true})
+}
+
+func (w *RunWriter) add(e lsmEntry) error {
+	if w.last != nil && bytes.Compare(w.last, e.key) >= 0 {
+		return fmt.Errorf("run: key %q is not after %q", e.key, w.last)
+	}
+	w.last = append(w.last[:0], e.key...)
+	w.n++
+	if _, err := w.w.Write(lsmRecord(nil, e)); err != nil {
+		return fmt.Errorf("write run: %w", err)
+	}
+	return nil
+}
+
+// Close flushes the file to the disk.
+func (w *RunWriter) Close() error {
+	err := w.w.Flush()
+	if err == nil {
+		err = w.fp.Sync()
+	}
+	if cerr := w.fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("write run: %w", err)
+	}
+	return nil
+}
+
+// Ingest loads a run file written by a RunWriter with a Loader, in
+// batched commits: the KVs are set and the deletions applied, and the
+// load is durable once it returns. the file is checked before, so a torn
+// or unsorted one is refused without changing the KV. the number of
+// records is returned.
+func (db *KV) Ingest(path string) (n int, err error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return 0, fmt.Errorf("ingest: %w", err)
+	}
+	defer fp.Close()
+	if err := ingestCheck(fp); err != nil {
+		return 0, fmt.Errorf("ingest: %s: %w", path, err)
+	}
+
+	l, err := db.NewLoader()
+	if err != nil {
+		return 0, err
+	}
+	_, err = lsmReadRecords(fp, func(e lsmEntry, off int64) {
+		if err != nil {
+			return
+		}
+		if e.deleted {
+			err = l.Del(e.key)
+		} else {
+			err = l.Set(e.key, e.val)
+		}
+		n++
+	})
+	if cerr := l.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, fmt.Errorf("ingest: %w", err)
+	}
+	return n, nil
+}
+
+// the records must fill the file in increasing key order.
+func ingestCheck(fp *os.File) error {
+	var last []byte
+	sorted := true
+	valid, err := lsmReadRecords(fp, func(e lsmEntry, off int64) {
+		if last != nil && bytes.Compare(last, e.key) >= 0 {
+			sorted = false
+		}
+		last = e.key
+	})
+	if err != nil {
+		return err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		return err
+	}
+	switch {
+	case fi.Size() != valid:
+		return fmt.Errorf("bad record at %d", valid)
+	case !sorted:
+		return errors.New("the keys are not sorted")
+	}
+	return nil
+}
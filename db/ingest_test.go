@@ -0,0 +1,61 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_Ingest(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.NoError(t, db.Set([]byte("k0001"), []byte("old")))
+	testify_assert.NoError(t, db.Set([]byte("k0003"), []byte("old")))
+	testify_assert.NoError(t, db.Set([]byte("x"), []byte("kept")))
+
+	path := filepath.Join(t.TempDir(), "data.run")
+	w, err := CreateRun(path)
+	testify_assert.NoError(t, err)
+	n := CLONE_BATCH + 10
+	for i := 0; i < n; i++ {
+		key := []byte(fmt.Sprintf("k%04d", i))
+		if i == 3 {
+			testify_assert.NoError(t, w.Del(key))
+		} else {
+			testify_assert.NoError(t, w.Set(key, []byte(fmt.Sprint(i))))
+		}
+	}
+	testify_assert.ErrorContains(t, w.Set([]byte("k0000"), nil), "is not after")
+	testify_assert.NoError(t, w.Close())
+
+	got, err := db.Ingest(path)
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, n, got)
+	val, _, _ := db.Get([]byte("k0001"))
+	testify_assert.Equal(t, []byte("1"), val)
+	_, ok, _ := db.Get([]byte("k0003"))
+	testify_assert.False(t, ok)
+	val, _, _ = db.Get([]byte("x"))
+	testify_assert.Equal(t, []byte("kept"), val)
+	testify_assert.Nil(t, db.Check())
+
+	// a torn file changes nothing
+	data, err := os.ReadFile(path)
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, os.WriteFile(path, data[:len(data)-1], 0644))
+	testify_assert.NoError(t, db.Set([]byte("k0001"), []byte("new")))
+	_, err = db.Ingest(path)
+	testify_assert.ErrorContains(t, err, "bad record")
+	val, _, _ = db.Get([]byte("k0001"))
+	testify_assert.Equal(t, []byte("new"), val)
+
+	// and so does an unsorted one
+	unsorted := lsmRecord(lsmRecord(nil, lsmEntry{key: []byte("b")}), lsmEntry{key: []byte("a")})
+	testify_assert.NoError(t, os.WriteFile(path, unsorted, 0644))
+	_, err = db.Ingest(path)
+	testify_assert.ErrorContains(t, err, "not sorted")
+	_, ok, _ = db.Get([]byte("b"))
+	testify_assert.False(t, ok)
+}
@@ -0,0 +1,42 @@
+package db
+
+import "os"
+
+// the path of a database in memory, opened like a file:
+//
+//	db, err := Open(MEMORY_PATH)
+//
+// nothing is written to the disk and it's gone once closed, for the tests
+// and the caches. the whole API works as with a file: Txs, snapshots,
+// iterators, the write buffer... each Open is a new empty database, and
+// there is nothing to sync: Options.NoSync is set.
+const MEMORY_PATH = ":memory:"
+
+// the VFS of MEMORY_PATH. the KV mmaps its file, so the files are in
+// memory but with a descriptor, see memFile. the side files that are
+// only written and read back on the next open, like the bloom filter,
+// are dropped.
+type memFS struct{}
+
+func (memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	if flag&os.O_CREATE == 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return memFile(name)
+}
+func (memFS) ReadFile(name string) ([]byte, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+}
+func (memFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return nil
+}
+func (memFS) Rename(oldpath, newpath string) error {
+	return nil
+}
+func (memFS) Remove(name string) error {
+	return nil
+}
+
+func inMemory(db *KV) bool {
+	return db.Path == MEMORY_PATH && db.FS == nil
+}
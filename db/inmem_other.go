@@ -0,0 +1,16 @@
+//go:build !(linux || windows)
+
+package db
+
+import "os"
+
+// a temporary file removed at once, see MEMORY_PATH. it's only in the
+// OS page cache until it's big enough to be written back.
+func memFile(name string) (*os.File, error) {
+	fp, err := os.CreateTemp("", "godb-memory-*")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(fp.Name())
+	return fp, nil
+}
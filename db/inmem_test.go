@@ -0,0 +1,48 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestOpen_Memory(t *testing.T) {
+	db, err := Open(MEMORY_PATH, WithMemtable(1<<10), WithBloomFilter(10))
+	testify_assert.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprint(i))))
+	}
+	val, ok, err := db.Get([]byte("key0042"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, []byte("42"), val)
+
+	tx, err := db.Begin()
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, tx.Set([]byte("key0042"), []byte("tx")))
+	testify_assert.NoError(t, tx.Commit())
+	snap, err := db.Snapshot()
+	testify_assert.NoError(t, err)
+	it := snap.Iter([]byte("key0042"))
+	testify_assert.True(t, it.Valid())
+	testify_assert.Equal(t, []byte("tx"), it.Val())
+	it.Close()
+	snap.Close()
+	testify_assert.Nil(t, db.Check())
+
+	// another one is apart
+	other, err := Open(MEMORY_PATH)
+	testify_assert.NoError(t, err)
+	_, ok, _ = other.Get([]byte("key0042"))
+	testify_assert.False(t, ok)
+	other.Close()
+	db.Close()
+
+	// and nothing is left
+	_, err = os.Stat(MEMORY_PATH)
+	testify_assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = Open(MEMORY_PATH, WithReadOnly())
+	testify_assert.ErrorIs(t, err, os.ErrNotExist)
+}
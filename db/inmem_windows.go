@@ -0,0 +1,38 @@
+//go:build windows
+
+package db
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/windows"
+)
+
+// a temporary file deleted by the OS once closed, see MEMORY_PATH. an
+// open file can't be removed on windows, so it's named until then, but
+// not left behind. it's kept in the OS page cache if there is room.
+func memFile(name string) (*os.File, error) {
+	fp, err := os.CreateTemp("", "godb-memory-*")
+	if err != nil {
+		return nil, err
+	}
+	path := fp.Name()
+	_ = fp.Close()
+	wpath, err := windows.UTF16PtrFromString(filepath.Clean(path))
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	h, err := windows.CreateFile(wpath,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil, windows.TRUNCATE_EXISTING,
+		windows.FILE_ATTRIBUTE_TEMPORARY|windows.FILE_FLAG_DELETE_ON_CLOSE, 0)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, fmt.Errorf("CreateFile: %w", err)
+	}
+	return os.NewFile(uintptr(h), path), nil
+}
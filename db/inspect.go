@@ -0,0 +1,106 @@
+package db
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// keys and values are cut to this length in dumps
+const DUMP_MAX_BYTES = 32
+
+func dumpBytes(b []byte) string {
+	if len(b) > DUMP_MAX_BYTES {
+		return fmt.Sprintf("%q...", b[:DUMP_MAX_BYTES])
+	}
+	return fmt.Sprintf("%q", b)
+}
+
+// print the header of a node, and every key if verbose.
+func dumpNode(w io.Writer, ptr uint64, node BNode, depth int, verbose bool) {
+	indent := strings.Repeat("  ", depth)
+	nkeys := node.nkeys()
+	kind := "bad"
+	switch node.btype() {
+	case BNODE_LEAF:
+		kind = "leaf"
+	case BNODE_NODE:
+		kind = "node"
+	}
+	fmt.Fprintf(w, "%spage %d: %s, %d keys, %d bytes", indent, ptr, kind, nkeys, node.nbytes())
+	if nkeys > 0 {
+		fmt.Fprintf(w, ", keys %s .. %s", dumpBytes(node.getKey(0)), dumpBytes(node.getKey(nkeys-1)))
+	}
+	fmt.Fprintln(w)
+	if !verbose {
+		return
+	}
+	for i := uint16(0); i < nkeys; i++ {
+		if node.btype() == BNODE_NODE {
+			fmt.Fprintf(w, "%s  [%d] %s -> %d\n", indent, i, dumpBytes(node.getKey(i)), node.getPtr(i))
+		} else {
+			fmt.Fprintf(w, "%s  [%d] %s = %s\n", indent, i, dumpBytes(node.getKey(i)), dumpBytes(node.getVal(i)))
+		}
+	}
+}
+
+// Inspect prints the master page, every node of the tree
+// (with its keys if verbose) and the pages not used by the tree,
+// the catalog or the persistent snapshots.
+func (db *KV) Inspect(w io.Writer, verbose bool) (err error) {
+	defer catchPageError(&err)
+	fmt.Fprintf(w, "master: sig %q, root %d, pages used %d, flags %#x",
+		DB_SIG, db.tree.root, db.page.flushed, db.flags)
+	if db.flags&MASTER_TAGGED_VALUES != 0 {
+		fmt.Fprint(w, " (tagged values)")
+	}
+	if db.flags&MASTER_ENCRYPTED != 0 {
+		fmt.Fprint(w, " (encrypted)")
+	}
+	if db.flags&MASTER_CHECKSUMS != 0 {
+		fmt.Fprint(w, " (checksums)")
+	}
+	if db.cmpName != "" {
+		fmt.Fprintf(w, " (comparator %q)", db.cmpName)
+	}
+	fmt.Fprintln(w)
+
+	used := make([]bool, db.page.flushed)
+	used[0] = true // the master page
+	treeWalk(&db.tree, func(ptr uint64, node BNode, depth int) {
+		used[ptr] = true
+		dumpNode(w, ptr, node, depth, verbose)
+	})
+
+	// the catalog and the persistent snapshots are not printed
+	mark := func(ptr uint64) {
+		if ptr < uint64(len(used)) {
+			used[ptr] = true
+		}
+	}
+	treePages(&db.catalog, mark)
+	catalogSnapshots(db, func(name []byte, root uint64) {
+		tree := BTree{root: root, get: db.pageGet}
+		treePages(&tree, mark)
+	})
+
+	// unreferenced pages are free, reused by the next updates
+	var free []string
+	for start := uint64(0); start < uint64(len(used)); start++ {
+		if used[start] {
+			continue
+		}
+		end := start
+		for end+1 < uint64(len(used)) && !used[end+1] {
+			end++
+		}
+		if start == end {
+			free = append(free, fmt.Sprint(start))
+		} else {
+			free = append(free, fmt.Sprintf("%d-%d", start, end))
+		}
+		start = end
+	}
+	_, err = fmt.Fprintf(w, "unreferenced pages: %s\n", strings.Join(free, ", "))
+	return err
+}
@@ -0,0 +1,235 @@
+// Package inspect decodes the pages of a database file into Go values,
+// read-only, for the debuggers and the visualizers: the master page, the
+// nodes of the tree with their keys and pointers, and the walk of the
+// tree. it reads the format of db.DB_SIG, and a file that isn't being
+// written, e.g. a copy or one of a closed KV.
+//
+// the pages of an encrypted file can't be decoded without the key, and
+// the values are as stored: with a codec byte when
+// Master.TaggedValues, see db.Options.Compression.
+package inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+
+	"db/db"
+)
+
+var (
+	ErrVersion   = errors.New("unsupported file format")
+	ErrEncrypted = errors.New("the pages are encrypted")
+)
+
+// Master is the master page, the first page of the file.
+type Master struct {
+	Signature string
+	// of the tree, 0 for an empty one. they're sealed in an encrypted
+	// file, and 0 here.
+	Root         uint64
+	Pages        uint64 // used by the file
+	Catalog      uint64 // the root of the named snapshots and dictionaries, 0 for none
+	Flags        uint64
+	Comparator   string // empty for the bytewise order
+	TaggedValues bool
+	Encrypted    bool
+	Checksums    bool
+}
+
+// Node is a page of the tree, or of the catalog and the snapshots which
+// are trees too.
+type Node struct {
+	Ptr     uint64
+	Leaf    bool
+	Entries []Entry
+	Bytes   int // used by the node
+}
+
+// Entry is a key with its value in a leaf, or with its kid in an internal
+// node, where the key is the first one of the kid.
+type Entry struct {
+	Key []byte
+	Val []byte
+	Ptr uint64
+}
+
+// File is a database file opened for reading.
+type File struct {
+	fp     *os.File
+	Master Master
+}
+
+func Open(path string) (*File, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	page := make([]byte, db.BTREE_PAGE_SIZE)
+	if _, err := io.ReadFull(fp, page); err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("%s: read the master page: %w", path, err)
+	}
+	m, err := DecodeMaster(page)
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return &File{fp: fp, Master: m}, nil
+}
+
+func (f *File) Close() error {
+	return f.fp.Close()
+}
+
+// the master page format, see the db package.
+// | sig | btree_root | page_used | flags | crypt | cmp name | catalog |
+// | 16B |     8B     |     8B    |   8B  |  ...  |  1B+63B  |   8B    |
+func DecodeMaster(page []byte) (Master, error) {
+	if len(page) < db.MASTER_CATALOG_OFFSET+8 {
+		return Master{}, errors.New("short master page")
+	}
+	m := Master{
+		Signature: string(page[:16]),
+		Root:      binary.LittleEndian.Uint64(page[16:]),
+		Pages:     binary.LittleEndian.Uint64(page[24:]),
+		Flags:     binary.LittleEndian.Uint64(page[32:]),
+		Catalog:   binary.LittleEndian.Uint64(page[db.MASTER_CATALOG_OFFSET:]),
+	}
+	if m.Signature != db.DB_SIG {
+		return m, fmt.Errorf("%w: %q", ErrVersion, m.Signature)
+	}
+	m.TaggedValues = m.Flags&db.MASTER_TAGGED_VALUES != 0
+	m.Encrypted = m.Flags&db.MASTER_ENCRYPTED != 0
+	m.Checksums = m.Flags&db.MASTER_CHECKSUMS != 0
+	n := int(page[db.MASTER_CMP_OFFSET])
+	if n > db.MASTER_CMP_NAME_MAX {
+		return m, errors.New("bad comparator name")
+	}
+	m.Comparator = string(page[db.MASTER_CMP_OFFSET+1:][:n])
+	return m, nil
+}
+
+// Page reads a page, the checksum is verified if the file has them.
+func (f *File) Page(ptr uint64) ([]byte, error) {
+	if f.Master.Encrypted {
+		return nil, ErrEncrypted
+	}
+	if ptr == 0 || ptr >= f.Master.Pages {
+		return nil, fmt.Errorf("page %d: out of the %d pages", ptr, f.Master.Pages)
+	}
+	page := make([]byte, db.BTREE_PAGE_SIZE)
+	if _, err := f.fp.ReadAt(page, int64(ptr)*db.BTREE_PAGE_SIZE); err != nil {
+		return nil, fmt.Errorf("page %d: %w", ptr, err)
+	}
+	if f.Master.Checksums && !ChecksumOK(ptr, page) {
+		return nil, fmt.Errorf("page %d: %w", ptr, db.ErrChecksum)
+	}
+	return page, nil
+}
+
+// ChecksumOK verifies the CRC32C of the page number and the node data,
+// stored at the start of the page trailer.
+func ChecksumOK(ptr uint64, page []byte) bool {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	sum := crc32.Update(0, table, binary.LittleEndian.AppendUint64(nil, ptr))
+	sum = crc32.Update(sum, table, page[:db.BNODE_MAX_SIZE])
+	return binary.LittleEndian.Uint32(page[db.PAGE_CHECKSUM_OFFSET:]) == sum
+}
+
+// Node reads and decodes a node.
+func (f *File) Node(ptr uint64) (Node, error) {
+	page, err := f.Page(ptr)
+	if err != nil {
+		return Node{}, err
+	}
+	node, err := DecodeNode(page)
+	if err != nil {
+		return node, fmt.Errorf("page %d: %w", ptr, err)
+	}
+	node.Ptr = ptr
+	return node, nil
+}
+
+// the node format, see the db package.
+// | type | nkeys |  pointers  |   offsets  | key-values | unused |
+// |  2B  |   2B  | nkeys * 8B | nkeys * 2B |     ...    |        |
+// | klen | vlen | key | val |
+// |  2B  |  2B  | ... | ... |
+// the keys and the values are copied out of the page.
+func DecodeNode(page []byte) (Node, error) {
+	if len(page) < db.HEADER {
+		return Node{}, errors.New("short node")
+	}
+	btype := binary.LittleEndian.Uint16(page)
+	nkeys := int(binary.LittleEndian.Uint16(page[2:]))
+	node := Node{Leaf: btype == db.BNODE_LEAF}
+	if btype != db.BNODE_LEAF && btype != db.BNODE_NODE {
+		return node, fmt.Errorf("bad node type %d", btype)
+	}
+	kvs := db.HEADER + 10*nkeys
+	if kvs > len(page) {
+		return node, fmt.Errorf("bad key count %d", nkeys)
+	}
+	for i := 0; i < nkeys; i++ {
+		pos := kvs
+		if i > 0 {
+			pos += int(binary.LittleEndian.Uint16(page[db.HEADER+8*nkeys+2*(i-1):]))
+		}
+		if pos+4 > len(page) {
+			return node, fmt.Errorf("bad offset of key %d", i)
+		}
+		klen := int(binary.LittleEndian.Uint16(page[pos:]))
+		vlen := int(binary.LittleEndian.Uint16(page[pos+2:]))
+		if pos+4+klen+vlen > len(page) {
+			return node, fmt.Errorf("bad size of key %d", i)
+		}
+		e := Entry{Key: bytes.Clone(page[pos+4 : pos+4+klen])}
+		if node.Leaf {
+			e.Val = bytes.Clone(page[pos+4+klen : pos+4+klen+vlen])
+		} else {
+			e.Ptr = binary.LittleEndian.Uint64(page[db.HEADER+8*i:])
+		}
+		node.Entries = append(node.Entries, e)
+		node.Bytes = pos + 4 + klen + vlen
+	}
+	if nkeys == 0 {
+		node.Bytes = kvs
+	}
+	return node, nil
+}
+
+// Walk calls fn on the nodes of the tree from the root, depth first
+// with the kids in key order. it stops at the first error.
+func (f *File) Walk(fn func(node Node, depth int) error) error {
+	if f.Master.Encrypted {
+		return ErrEncrypted
+	}
+	if f.Master.Root == 0 {
+		return nil
+	}
+	return f.walk(f.Master.Root, 0, fn)
+}
+
+func (f *File) walk(ptr uint64, depth int, fn func(node Node, depth int) error) error {
+	node, err := f.Node(ptr)
+	if err != nil {
+		return err
+	}
+	if err := fn(node, depth); err != nil {
+		return err
+	}
+	if node.Leaf {
+		return nil
+	}
+	for _, e := range node.Entries {
+		if err := f.walk(e.Ptr, depth+1, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package inspect
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+
+	"db/db"
+)
+
+func TestInspect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	kv, err := db.Open(path, db.WithComparator(db.CaseInsensitive))
+	testify_assert.NoError(t, err)
+	for i := 0; i < 200; i++ {
+		testify_assert.NoError(t, kv.Set([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprintf("val%d", i))))
+	}
+	kv.Close()
+
+	f, err := Open(path)
+	testify_assert.NoError(t, err)
+	defer f.Close()
+	testify_assert.Equal(t, db.DB_SIG, f.Master.Signature)
+	testify_assert.True(t, f.Master.Checksums)
+	testify_assert.False(t, f.Master.Encrypted)
+	testify_assert.Equal(t, "godb.case-insensitive", f.Master.Comparator)
+
+	var keys []string
+	leaves, depth := 0, 0
+	err = f.Walk(func(node Node, d int) error {
+		if !node.Leaf {
+			for _, e := range node.Entries {
+				kid, err := f.Node(e.Ptr)
+				testify_assert.NoError(t, err)
+				if len(e.Key) > 0 {
+					testify_assert.Equal(t, e.Key, kid.Entries[0].Key)
+				}
+			}
+			return nil
+		}
+		leaves++
+		depth = d
+		for _, e := range node.Entries {
+			if len(e.Key) > 0 { // the sentinel
+				keys = append(keys, string(e.Key)+"="+string(e.Val))
+			}
+		}
+		testify_assert.LessOrEqual(t, node.Bytes, db.BNODE_MAX_SIZE)
+		return nil
+	})
+	testify_assert.NoError(t, err)
+	testify_assert.Len(t, keys, 200)
+	testify_assert.Equal(t, "key000=val0", keys[0])
+	testify_assert.Greater(t, leaves, 1)
+	testify_assert.Positive(t, depth)
+
+	// a damaged page
+	fp, err := os.OpenFile(path, os.O_RDWR, 0)
+	testify_assert.NoError(t, err)
+	_, err = fp.WriteAt([]byte{0xff}, int64(f.Master.Root)*db.BTREE_PAGE_SIZE+100)
+	testify_assert.NoError(t, err)
+	fp.Close()
+	testify_assert.ErrorIs(t, f.Walk(func(Node, int) error { return nil }), db.ErrChecksum)
+	_, err = f.Page(f.Master.Pages)
+	testify_assert.ErrorContains(t, err, "out of the")
+	_, err = DecodeNode(make([]byte, db.BTREE_PAGE_SIZE))
+	testify_assert.ErrorContains(t, err, "bad node type")
+}
+
+func TestInspect_Unreadable(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "crypt.db")
+	kv, err := db.Open(path, db.WithEncryptionKey([]byte("secret")))
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, kv.Set([]byte("k"), []byte("v")))
+	kv.Close()
+	f, err := Open(path)
+	testify_assert.NoError(t, err)
+	defer f.Close()
+	testify_assert.True(t, f.Master.Encrypted)
+	testify_assert.ErrorIs(t, f.Walk(func(Node, int) error { return nil }), ErrEncrypted)
+
+	other := filepath.Join(dir, "other")
+	testify_assert.NoError(t, os.WriteFile(other, make([]byte, db.BTREE_PAGE_SIZE), 0644))
+	_, err = Open(other)
+	testify_assert.ErrorIs(t, err, ErrVersion)
+}
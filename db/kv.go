@@ -2,36 +2,687 @@ package db
 
 import (
 	"bytes"
+	"context"
+	"crypto/cipher"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
+// KV is not safe for concurrent use, see StartWriter to share it.
 type KV struct {
 	Path string
+	Options
 	// internals
-	fp   *os.File
-	tree BTree
+	fp      File
+	tree    BTree
+	catalog BTree // the persistent snapshots, see CreateSnapshot
+	cache   *pageCache
+	bloom   *bloomFilter
+	flags   uint64 // MASTER_* flags
+	cmpName string // see cmpInit
+	codec   struct {
+		zenc *zstd.Encoder
+		zdec *zstd.Decoder
+		// the shared dictionaries, see TrainDict
+		dictID uint32 // the newest one, 0 for none
+		denc   *zstd.Encoder
+		ddec   atomic.Pointer[zstd.Decoder] // swapped for the lock-free readers
+		ddecs  []*zstd.Decoder
+	}
+	crypt struct {
+		aead cipher.AEAD // nil if not encrypted
+		salt []byte
+	}
 	mmap struct {
 		file   int      // file size, can be larger than the database size
 		total  int      // mmap size, can be larger than the file size
-		chunks [][]byte // multiple mmaps, can be non-continuous
+		chunks [][]byte // multiple mmaps, can be non-continuous. nil without mmap
 	}
 	page struct {
-		flushed uint64   // database size in number of pages
-		temp    [][]byte // newly allocated pages
+		flushed uint64            // database size in number of pages
+		temp    [][]byte          // newly allocated pages
+		updates map[uint64][]byte // free pages reused, written in place
+	}
+	free struct {
+		pages   freeMap     // reusable now
+		pending []freedPage // still used by the last commit or a snapshot
+		kept    freeMap     // the pages of the persistent snapshots
+		version uint64      // the number of commits since Open
+		epoch   uint64      // the number of commits of the file, see freeSave
+		durable uint64      // the version of the last synced master page
+		hint    uint64      // the last page deallocated, see ALLOC_NEAR
+	}
+	wal struct {
+		fp         File // nil if not buffered
+		size       int64
+		mem        *memtable
+		checkpoint time.Time // the last merge of the memtable
+		gen        uint64    // the checkpoints of the file, see walSeal
+		background bool      // merged by StartFlush
+	}
+	throttle struct {
+		ops, bytes tokenBucket // see Options.WriteRate
+	}
+	pins map[uint64]int // versions of the open snapshots and iterators
+	occ  struct {
+		seq    uint64         // the number of updates, while a Tx is open
+		active map[uint64]int // the open Txs by the seq they began at
+		writes []occWrite     // the updates since the oldest one began
+	}
+	locks  *lockManager // of the Txs, see Tx.Lock
+	view   atomic.Value // *readView of the last commit, see BeginRead
+	views  []*readView  // the older ones still read
+	defrag struct {
+		next []byte // where the next DefragStep starts
+	}
+	mem struct {
+		iters int64 // bytes held by the open Iters, see MemoryStats
+		txs   int64 // of the updates of the open Txs
+	}
+	scrub struct {
+		next uint64          // the page the next ScrubStep starts at
+		bad  map[uint64]bool // see CorruptPages
+	}
+	// the commits are not synced for now, see Tx.CommitNoSync
+	syncSkip bool
+	closed   bool
+	temp     bool // removed on Close, see OpenTemp
+	stats    kvStats
+}
+
+func (db *KV) Open() error {
+	// open or create the DB file
+	mode := os.O_RDWR | os.O_CREATE
+	if db.ReadOnly {
+		mode = os.O_RDONLY
+	}
+	if db.DirectIO {
+		if directFlag == 0 {
+			return errors.New("KV.Open: direct I/O is not supported on this platform")
+		}
+		mode |= directFlag
+	}
+	if inMemory(db) {
+		db.NoSync = true
+	}
+	fp, err := db.vfs().OpenFile(db.Path, mode, 0644)
+	if err != nil {
+		return fmt.Errorf("OpenFile: %w", err)
+	}
+	// one writer or many readers
+	if err := lockFile(fp, !db.ReadOnly); err != nil {
+		_ = fp.Close()
+		return fmt.Errorf("KV.Open: %w", err)
+	}
+	db.fp = fp
+
+	// create the initial mmap
+	sz, chunk, err := mmapInit(db.fp, mmapEnabled && !db.DirectIO && !db.NoMmap)
+	if err != nil {
+		goto fail
+	}
+	db.mmap.file = sz
+	if chunk != nil {
+		db.mmap.total = len(chunk)
+		db.mmap.chunks = [][]byte{chunk}
+	}
+
+	if db.CacheSize > 0 {
+		db.cache = newPageCache(db.CacheSize)
+	}
+
+	logInit(db)
+
+	// btree callbacks
+	db.tree.get = db.pageGet
+	db.tree.new = db.pageNew
+	db.tree.del = db.pageDel
+	if db.ReadAhead > 0 && !db.DirectIO {
+		db.tree.prefetch = db.pagePrefetch
+		db.tree.readAhead = db.ReadAhead
+	}
+	catalogInit(db, 0)
+
+	// read the master page
+	err = masterLoad(db)
+	if err != nil {
+		goto fail
+	}
+	err = cryptInit(db)
+	if err != nil {
+		goto fail
+	}
+	err = cmpInit(db)
+	if err != nil {
+		goto fail
+	}
+	checksumInit(db)
+	err = compressInit(db)
+	if err != nil {
+		goto fail
+	}
+	err = bloomInit(db)
+	if err != nil {
+		goto fail
+	}
+	err = freeInit(db)
+	if err != nil {
+		goto fail
+	}
+	err = walInit(db)
+	if err != nil {
+		goto fail
+	}
+	viewPublish(db)
+	return nil
+
+fail:
+	db.Close()
+	return fmt.Errorf("KV.Open: %w", err)
+}
+
+// cleanups
+func (db *KV) Close() {
+	if len(db.pins) > 0 {
+		db.Logger.Warn("closing with open snapshots", "versions", len(db.pins))
+	}
+	db.closed = true
+	if walBuffered(db) {
+		_ = db.Flush() // replayed on the next open if this fails
+	}
+	walClose(db)
+	if db.bloom != nil && !db.ReadOnly && !db.temp {
+		_ = bloomSave(db) // it's rebuilt on the next open if this fails
+		db.bloom = nil
+	}
+	if db.view.Load() != nil && !db.ReadOnly && !db.temp {
+		_ = freeSave(db) // found again on the next open if this fails
+	}
+	for _, chunk := range db.mmap.chunks {
+		err := munmapFile(chunk)
+		assert(err == nil)
+	}
+	db.mmap.chunks = nil
+	if db.codec.zenc != nil {
+		_ = db.codec.zenc.Close()
+		db.codec.zdec.Close()
+	}
+	dictClose(db)
+	_ = db.fp.Close()
+	if db.temp {
+		tempRemove(db)
+	}
+}
+
+// read the db
+func (db *KV) Get(key []byte) (val []byte, ok bool, err error) {
+	defer slowOp(db, "get", key, time.Now())
+	defer catchPageError(&err)
+	db.stats.gets++
+	if db.bloom != nil && !db.bloom.mayContain(key) {
+		db.stats.bloomRejects++
+		return nil, false, nil
+	}
+	if e, ok := walGet(db, key); ok {
+		if e.deleted {
+			return nil, false, nil
+		}
+		return decodeValue(db, e.val), true, nil
+	}
+	val, ok = db.tree.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return decodeValue(db, val), true, nil
+}
+
+// GetMany looks up many keys at once. the values are in the order of
+// the keys, nil for the missing ones; a found empty value is not nil.
+// the keys are sorted and the tree is walked once, so the pages shared
+// by nearby keys are read once instead of once per key.
+func (db *KV) GetMany(keys [][]byte) (vals [][]byte, err error) {
+	defer catchPageError(&err)
+	db.stats.gets += uint64(len(keys))
+	vals = make([][]byte, len(keys))
+	found := func(i int, val []byte) {
+		vals[i] = decodeValue(db, val)
+		if vals[i] == nil {
+			vals[i] = []byte{}
+		}
+	}
+	var order []int // of the keys left for the tree
+	for i, key := range keys {
+		if len(key) == 0 {
+			continue
+		}
+		if db.bloom != nil && !db.bloom.mayContain(key) {
+			db.stats.bloomRejects++
+			continue
+		}
+		if e, ok := walGet(db, key); ok {
+			if !e.deleted {
+				found(i, e.val)
+			}
+			continue
+		}
+		order = append(order, i)
+	}
+	cmp := db.tree.keyCmp()
+	sort.Slice(order, func(a, b int) bool {
+		return cmp(keys[order[a]], keys[order[b]]) < 0
+	})
+	sorted := make([][]byte, len(order))
+	for j, i := range order {
+		sorted[j] = keys[i]
+	}
+	treeGetMany(&db.tree, sorted, func(j int, val []byte) {
+		found(order[j], val)
+	})
+	return vals, nil
+}
+
+// same as Get, but records the descent path into the trace.
+// the trace is a parameter rather than a value of a context.Context:
+// it's an output the caller reads back, not a request-scoped input, and
+// the contexts here are only for cancelling, see ScanContext. Get passes
+// a nil trace down the same path, which costs a nil check per node
+// instead of a context lookup.
+func (db *KV) GetTraced(key []byte, trace *Trace) (val []byte, ok bool, err error) {
+	defer catchPageError(&err)
+	start := time.Now()
+	trace.Key = key
+	db.stats.gets++
+	if db.bloom != nil && !db.bloom.mayContain(key) {
+		db.stats.bloomRejects++
+		trace.BloomRejected = true
+		trace.Elapsed = time.Since(start)
+		return nil, false, nil
+	}
+	if e, ok := walGet(db, key); ok {
+		// not in the tree yet
+		trace.Found = !e.deleted
+		trace.Elapsed = time.Since(start)
+		if e.deleted {
+			return nil, false, nil
+		}
+		return decodeValue(db, e.val), true, nil
+	}
+	// use a private copy of the tree to learn about cache hits
+	tree := db.tree
+	tree.get = func(ptr uint64) BNode {
+		node, hit := db.pageLookup(ptr)
+		trace.cacheHit = hit
+		return node
+	}
+	val, ok = treeGet(&tree, key, trace)
+	if ok {
+		val = decodeValue(db, val)
+	}
+	trace.Found = ok
+	trace.Elapsed = time.Since(start)
+	return val, ok, nil
+}
+
+// call fn on every KV with key >= start in key order until it returns false.
+// the slices passed to fn are only valid during the call.
+func (db *KV) Scan(start []byte, fn func(key, val []byte) bool) error {
+	return db.ScanContext(context.Background(), start, fn)
+}
+
+// same as Scan, but stops with the error of ctx once it's done.
+func (db *KV) ScanContext(ctx context.Context, start []byte, fn func(key, val []byte) bool) (err error) {
+	defer slowOp(db, "scan", start, time.Now())
+	defer catchPageError(&err)
+	walScan(db, start, func(key, val []byte) bool {
+		if err = ctx.Err(); err != nil {
+			return false
+		}
+		return fn(key, decodeValue(db, val))
+	})
+	return err
+}
+
+// call fn on every key >= start in key order until it returns false.
+// the values are neither decoded nor passed, which is cheaper than a
+// Scan when only the keys are needed.
+func (db *KV) ScanKeys(start []byte, fn func(key []byte) bool) (err error) {
+	defer slowOp(db, "scan", start, time.Now())
+	defer catchPageError(&err)
+	walScan(db, start, func(key, val []byte) bool {
+		return fn(key)
+	})
+	return nil
+}
+
+// update the db
+func (db *KV) Set(key []byte, val []byte) (err error) {
+	defer slowOp(db, "set", key, time.Now())
+	defer catchPageError(&err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	stored := encodeValue(db, val)
+	if err := checkKV(key, stored); err != nil {
+		return err
+	}
+	throttle(db, len(key)+len(val))
+	db.stats.sets++
+	db.stats.keySizes.observe(len(key))
+	db.stats.valSizes.observe(len(val))
+	if db.bloom != nil {
+		db.bloom.add(key)
+	}
+	occRecord(db, keySpan{lo: key, point: true})
+	if walBuffered(db) {
+		return walUpdate(db, lsmEntry{key: key, val: stored})
+	}
+	db.tree.Insert(key, stored)
+	return flushPages(db)
+}
+
+func (db *KV) Del(key []byte) (deleted bool, err error) {
+	defer slowOp(db, "del", key, time.Now())
+	defer catchPageError(&err)
+	if err := checkWritable(db); err != nil {
+		return false, err
+	}
+	if err := checkKV(key, nil); err != nil {
+		return false, err
+	}
+	throttle(db, len(key))
+	db.stats.dels++
+	if walBuffered(db) {
+		if e, ok := walGet(db, key); ok {
+			deleted = !e.deleted
+		} else {
+			_, deleted = db.tree.Get(key)
+		}
+		if !deleted {
+			return false, nil
+		}
+		occRecord(db, keySpan{lo: key, point: true})
+		return true, walUpdate(db, lsmEntry{key: key, deleted: true})
+	}
+	deleted = db.tree.Delete(key)
+	if deleted {
+		occRecord(db, keySpan{lo: key, point: true})
+	}
+	return deleted, flushPages(db)
+}
+
+// DeleteRange deletes the keys in [lo, hi), a nil hi means to the end.
+// the subtrees entirely in the range are dropped without being read,
+// which is much cheaper than scanning and deleting the keys one by one.
+// the buffered updates are merged first, see Options.MemtableSize.
+func (db *KV) DeleteRange(lo, hi []byte) (err error) {
+	defer slowOp(db, "delrange", lo, time.Now())
+	defer catchPageError(&err)
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	if hi != nil && db.tree.keyCmp()(lo, hi) >= 0 {
+		return nil
 	}
+	throttle(db, len(lo)+len(hi))
+	if walBuffered(db) {
+		if err := db.Flush(); err != nil {
+			return err
+		}
+	}
+	// the dropped leaves are not read to count them
+	db.stats.shape.known = false
+	if !db.tree.DeleteRange(lo, hi) {
+		return nil
+	}
+	occRecord(db, keySpan{lo: lo, hi: hi})
+	return flushPages(db)
+}
+
+// persist the newly allocated pages after updates
+func flushPages(db *KV) error {
+	start := time.Now()
+	if err := writePages(db); err != nil {
+		return err
+	}
+	npages := len(db.page.temp) + len(db.page.updates)
+	if err := syncPages(db); err != nil {
+		return err
+	}
+	elapsed := time.Since(start)
+	db.stats.commitLatency.observe(elapsed)
+	db.Logger.Debug("commit", "pages", npages, "root", db.tree.root, "elapsed", elapsed)
+	return nil
+}
+
+func writePages(db *KV) error {
+	// extend the file & mmap if needed
+	npages := int(db.page.flushed) + len(db.page.temp)
+	if err := extendFile(db, npages); err != nil {
+		return err
+	}
+	if err := extendMmap(db, npages); err != nil {
+		return err
+	}
+
+	// write data to the file, the mmap is only for reading. the writes
+	// are done with the buffer, so it's reused for every page.
+	buf := db.pageBuf()
+	for i, page := range db.page.temp {
+		if err := writePage(db, db.page.flushed+uint64(i), page, buf); err != nil {
+			return err
+		}
+	}
+	for ptr, page := range db.page.updates {
+		if err := writePage(db, ptr, page, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write a page through buf, a page from pageBuf.
+func writePage(db *KV, ptr uint64, page []byte, buf []byte) error {
+	if db.crypt.aead != nil {
+		pageSeal(db, ptr, buf, page)
+	} else {
+		n := copy(buf, page)
+		for i := range buf[n:] {
+			buf[n+i] = 0 // left by the previous page
+		}
+		if db.flags&MASTER_CHECKSUMS != 0 {
+			pageStamp(ptr, buf)
+		}
+	}
+	if _, err := db.fp.WriteAt(buf, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+		return fmt.Errorf("write page: %w", err)
+	}
+	return nil
+}
+
+func syncPages(db *KV) error {
+	// flush data to the disk. must be done before updating the master page,
+	// also for a commit that isn't synced, or the disk could have the master
+	// page without the pages it points to.
+	if err := fsyncBarrier(db); err != nil {
+		return err
+	}
+	db.page.flushed += uint64(len(db.page.temp))
+	for _, page := range db.page.temp {
+		nodeFree(BNode{page}) // written out, the buffer can be reused
+	}
+	db.page.temp = db.page.temp[:0]
+	for ptr, page := range db.page.updates {
+		nodeFree(BNode{page})
+		delete(db.page.updates, ptr)
+	}
+
+	// update & flush the master page
+	db.free.epoch++
+	if err := masterStore(db); err != nil {
+		return err
+	}
+	if err := fsync(db); err != nil {
+		return err
+	}
+	db.stats.commits++
+	// the pages freed by this commit are no longer used by the file,
+	// unless a crash can go back to a version before it
+	db.free.version++
+	if !db.syncSkip {
+		db.free.durable = db.free.version
+	}
+	viewPublish(db)
+	freeRelease(db)
+	return nil
+}
+
+// make the commits since the last synced one durable, see Tx.CommitNoSync.
+func syncLast(db *KV) error {
+	if err := fsync(db); err != nil {
+		return err
+	}
+	db.free.durable = db.free.version
+	freeRelease(db)
+	return nil
+}
+
+// are the writes synced? not with Options.NoSync, which accepts the
+// corruption of a crash, nor for now, see Tx.CommitNoSync.
+func syncing(db *KV) bool {
+	return !db.NoSync && !db.syncSkip
+}
+
+func fsync(db *KV) error {
+	if !syncing(db) {
+		return nil
+	}
+	return fsyncBarrier(db)
+}
+
+// the sync before a master page, see syncPages.
+func fsyncBarrier(db *KV) error {
+	if db.NoSync {
+		return nil
+	}
+	db.stats.fsyncs++
+	if err := db.fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
 }
 
 // callback for BTree, dereference a pointer.
 func (db *KV) pageGet(ptr uint64) BNode {
+	node, _ := db.pageLookup(ptr)
+	return node
+}
+
+// callback for BTree, ask the OS to read the pages ahead of a scan.
+// there's nothing to do for the pages in memory, and with DirectIO the
+// OS has no cache to read them into.
+func (db *KV) pagePrefetch(ptrs []uint64) {
+	for _, ptr := range ptrs {
+		if _, ok := db.page.updates[ptr]; ok || ptr == 0 || ptr >= db.page.flushed {
+			continue
+		}
+		if db.cache != nil && db.cache.has(ptr) {
+			continue
+		}
+		var err error
+		if db.mmap.chunks != nil {
+			var page []byte
+			if page, err = db.rawPage(ptr); err == nil {
+				err = mmapWillNeed(page)
+			}
+		} else {
+			err = fileWillNeed(db.fp, int64(ptr*BTREE_PAGE_SIZE), BTREE_PAGE_SIZE)
+		}
+		if err != nil {
+			db.Logger.Debug("prefetch", "page", ptr, "err", err)
+			return // only a hint
+		}
+		db.stats.prefetches++
+	}
+}
+
+// dereference a pointer via the page cache, reports whether it was a hit.
+func (db *KV) pageLookup(ptr uint64) (BNode, bool) {
+	if page, ok := db.page.updates[ptr]; ok {
+		return BNode{page}, false
+	}
+	if ptr >= db.page.flushed && ptr-db.page.flushed < uint64(len(db.page.temp)) {
+		// written by an earlier update of the same commit, not cached
+		// since the buffer is recycled after the commit.
+		return BNode{db.page.temp[ptr-db.page.flushed]}, false
+	}
+	if db.cache == nil {
+		return db.pageRead(ptr), false
+	}
+	if node, ok := db.cache.get(ptr); ok {
+		return node, true
+	}
+	node := db.pageRead(ptr)
+	db.cache.put(ptr, node)
+	memEnforce(db)
+	return node, false
+}
+
+// read a page from the file, decrypting it if needed.
+// panics with a pageError if it can't be read.
+func (db *KV) pageRead(ptr uint64) BNode {
+	return pageReadIn(db, db.mmap.chunks, db.page.flushed, ptr)
+}
+
+// read a page from a version of the file: its mmap and its size in
+// pages, which can be older than those of the KV, see readView.
+func pageReadIn(db *KV, chunks [][]byte, flushed uint64, ptr uint64) BNode {
+	if ptr == 0 || ptr >= flushed {
+		panic(&pageError{ptr, ErrPageNotFound})
+	}
+	page, err := rawPageIn(db, chunks, ptr)
+	if err != nil {
+		panic(&pageError{ptr, err})
+	}
+	if db.crypt.aead == nil {
+		if db.flags&MASTER_CHECKSUMS != 0 && !pageVerify(ptr, page) {
+			panic(&pageError{ptr, ErrChecksum})
+		}
+		return BNode{page}
+	}
+	node, err := pageOpen(db, ptr, page)
+	if err != nil {
+		panic(&pageError{ptr, err})
+	}
+	return BNode{node}
+}
+
+// the raw page in the mmap, or read from the file without mmap.
+func (db *KV) rawPage(ptr uint64) ([]byte, error) {
+	return rawPageIn(db, db.mmap.chunks, ptr)
+}
+
+func rawPageIn(db *KV, chunks [][]byte, ptr uint64) ([]byte, error) {
+	if chunks == nil {
+		page := db.pageBuf()
+		if _, err := db.fp.ReadAt(page, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+			return nil, fmt.Errorf("read page: %w", err)
+		}
+		return page, nil
+	}
 	start := uint64(0)
-	for _, chunk := range db.mmap.chunks {
+	for _, chunk := range chunks {
 		end := start + uint64(len(chunk))/BTREE_PAGE_SIZE
 		if ptr < end {
 			offset := BTREE_PAGE_SIZE * (ptr - start)
-			return BNode{chunk[offset : offset+BTREE_PAGE_SIZE]}
+			// cap the slice so it's never mistaken for a pooled buffer
+			return chunk[offset : offset+BTREE_PAGE_SIZE : offset+BTREE_PAGE_SIZE], nil
 		}
 		start = end
 	}
@@ -42,43 +693,92 @@ const DB_SIG = "BuildYourOwnDB06"
 
 // the master page format.
 // it contains the pointer to the root and other important bits.
-// | sig | btree_root | page_used |
-// | 16B |     8B     |     8B    |
+// | sig | btree_root | page_used | flags |
+// | 16B |     8B     |     8B    |   8B  |
+// if the DB is encrypted, btree_root and page_used are zero and
+// the real ones are sealed after the flags, see masterSeal.
 func masterLoad(db *KV) error {
+	// an empty file, or a first commit that crashed before writing
+	// the master page. it will be created on the first write.
 	if db.mmap.file == 0 {
-		// empty file, the master page will be created on the first write.
 		db.page.flushed = 1 // reserved for the master page
 		return nil
 	}
+	data, err := db.rawPage(0)
+	if err != nil {
+		return err
+	}
+	if isZero(data[:MASTER_CRYPT_OFFSET+MASTER_CRYPT_SIZE]) {
+		db.page.flushed = 1
+		return nil
+	}
 
-	data := db.mmap.chunks[0]
 	root := binary.LittleEndian.Uint64(data[16:])
 	used := binary.LittleEndian.Uint64(data[24:])
+	flags := binary.LittleEndian.Uint64(data[32:])
 
 	// verify the page
 	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
 		return errors.New("Bad signature.")
 	}
+	if flags&MASTER_ENCRYPTED != 0 {
+		root, used, err = masterUnseal(db, data)
+		if err != nil {
+			return err
+		}
+	}
 	bad := !(1 <= used && used <= uint64(db.mmap.file/BTREE_PAGE_SIZE))
 	bad = bad || !(0 <= root && root < used)
+	catalog := binary.LittleEndian.Uint64(data[MASTER_CATALOG_OFFSET:])
+	bad = bad || catalog >= used
 	if bad {
 		return errors.New("Bad master page.")
 	}
 
 	db.tree.root = root
+	db.catalog.root = catalog
 	db.page.flushed = used
+	db.flags = flags
+	db.free.epoch = binary.LittleEndian.Uint64(data[MASTER_EPOCH_OFFSET:])
+	db.wal.gen = binary.LittleEndian.Uint64(data[MASTER_LOG_OFFSET:])
+	nameLen := int(data[MASTER_CMP_OFFSET])
+	if nameLen > MASTER_CMP_NAME_MAX {
+		return errors.New("Bad master page.")
+	}
+	db.cmpName = string(data[MASTER_CMP_OFFSET+1:][:nameLen])
 	return nil
 }
 
+// nothing is written yet, so the format can still be chosen.
+func dbIsNew(db *KV) bool {
+	return db.page.flushed == 1
+}
+
 // update the master page. it must be atomic.
 func masterStore(db *KV) error {
-	var data [32]byte
+	var data [MASTER_LOG_OFFSET + 8]byte
 	copy(data[:16], []byte(DB_SIG))
-	binary.LittleEndian.PutUint64(data[16:], db.tree.root)
-	binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	data[MASTER_CMP_OFFSET] = byte(len(db.cmpName))
+	copy(data[MASTER_CMP_OFFSET+1:], db.cmpName)
+	binary.LittleEndian.PutUint64(data[MASTER_CATALOG_OFFSET:], db.catalog.root)
+	binary.LittleEndian.PutUint64(data[MASTER_EPOCH_OFFSET:], db.free.epoch)
+	binary.LittleEndian.PutUint64(data[MASTER_LOG_OFFSET:], db.wal.gen)
+	binary.LittleEndian.PutUint64(data[32:], db.flags)
+	if db.crypt.aead != nil {
+		masterSeal(db, data[:])
+	} else {
+		binary.LittleEndian.PutUint64(data[16:], db.tree.root)
+		binary.LittleEndian.PutUint64(data[24:], db.page.flushed)
+	}
 	// NOTE: Updating the page via mmap is not atomic.
 	//       Use the `pwrite()` syscall instead.
-	_, err := db.fp.WriteAt(data[:], 0)
+	buf := data[:]
+	if db.DirectIO {
+		// whole aligned pages only, the rest of the page is unused
+		buf = db.pageBuf()
+		copy(buf, data[:])
+	}
+	_, err := db.fp.WriteAt(buf, 0)
 	if err != nil {
 		return fmt.Errorf("write master page: %w", err)
 	}
@@ -87,14 +787,51 @@ func masterStore(db *KV) error {
 
 // callback for BTree, allocate a new page.
 func (db *KV) pageNew(node BNode) uint64 {
-	// TODO: reuse deallocated pages
 	assert(len(node.data) <= BTREE_PAGE_SIZE)
-	ptr := db.page.flushed + uint64(len(db.page.temp))
-	db.page.temp = append(db.page.temp, node.data)
+	ptr, ok := freeAlloc(db)
+	if ok {
+		db.free.pages.remove(ptr)
+		if db.page.updates == nil {
+			db.page.updates = map[uint64][]byte{}
+		}
+		db.page.updates[ptr] = node.data
+	} else {
+		// append to the file
+		ptr = db.page.flushed + uint64(len(db.page.temp))
+		db.page.temp = append(db.page.temp, node.data)
+	}
+	if db.stats.shape.known {
+		statsAddNode(db, node, +1)
+	}
 	return ptr
 }
 
-// callback for BTree, deallocate a page.
-func (db *KV) pageDel(uint64) {
-	// TODO: implement this
+// callback for BTree, deallocate a page. it's reused once neither the
+// last commit nor a snapshot can see it, see freeRelease.
+func (db *KV) pageDel(ptr uint64) {
+	_, updated := db.page.updates[ptr]
+	switch {
+	case db.AllocPolicy == ALLOC_APPEND:
+	case updated || ptr >= db.page.flushed:
+		// not committed yet, no version can see it
+		db.free.pages.add(ptr)
+	default:
+		db.free.pending = append(db.free.pending, freedPage{ptr, db.free.version})
+	}
+	// the node is usually replaced by a new copy right after
+	db.free.hint = ptr
+	if db.stats.shape.known {
+		statsAddNode(db, db.pageGet(ptr), -1)
+	}
+	if db.cache != nil {
+		db.cache.remove(ptr)
+	}
+}
+
+// page cache counters, zero if the cache is disabled.
+func (db *KV) CacheStats() CacheStats {
+	if db.cache == nil {
+		return CacheStats{}
+	}
+	return db.cache.stats
 }
@@ -0,0 +1,419 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func openTestKV(t *testing.T) *KV {
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db")}
+	if err := db.Open(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(db.Close)
+	return db
+}
+
+func TestKV_SetGetDel(t *testing.T) {
+	db := openTestKV(t)
+
+	for i := 0; i < 20; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	testify_assert.NoError(t, db.Set([]byte("k05"), []byte("updated")))
+
+	val, ok, _ := db.Get([]byte("k05"))
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "updated", string(val))
+
+	deleted, err := db.Del([]byte("k07"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, deleted)
+	_, ok, _ = db.Get([]byte("k07"))
+	testify_assert.False(t, ok)
+
+	deleted, err = db.Del([]byte("missing"))
+	testify_assert.NoError(t, err)
+	testify_assert.False(t, deleted)
+}
+
+func TestKV_Reopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path}
+	testify_assert.NoError(t, db.Open())
+	testify_assert.NoError(t, db.Set([]byte("hello"), []byte("world")))
+	db.Close()
+
+	db = &KV{Path: path}
+	testify_assert.NoError(t, db.Open())
+	defer db.Close()
+	val, ok, _ := db.Get([]byte("hello"))
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "world", string(val))
+}
+
+func TestKV_GetTraced(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.NoError(t, db.Set([]byte("a"), []byte("1")))
+	testify_assert.NoError(t, db.Set([]byte("b"), []byte("2")))
+
+	trace := &Trace{}
+	val, ok, _ := db.GetTraced([]byte("b"), trace)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "2", string(val))
+	testify_assert.True(t, trace.Found)
+	testify_assert.Len(t, trace.Steps, 1)
+	testify_assert.Equal(t, BNODE_LEAF, trace.Steps[0].Type)
+	testify_assert.Equal(t, uint16(2), trace.Steps[0].Idx)
+	testify_assert.Contains(t, trace.String(), "leaf")
+}
+
+func BenchmarkKV_Set(b *testing.B) {
+	db := &KV{Path: filepath.Join(b.TempDir(), "bench.db")}
+	if err := db.Open(); err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := db.Set([]byte(fmt.Sprintf("key%03d", i%100)), []byte("value")); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestKV_Scan(t *testing.T) {
+	db := openTestKV(t)
+	for _, k := range []string{"c", "a", "e", "b", "d"} {
+		testify_assert.NoError(t, db.Set([]byte(k), []byte("v"+k)))
+	}
+
+	var got []string
+	db.Scan([]byte("bb"), func(key, val []byte) bool {
+		got = append(got, string(key)+"="+string(val))
+		return len(got) < 2
+	})
+	testify_assert.Equal(t, []string{"c=vc", "d=vd"}, got)
+
+	got = nil
+	db.Scan(nil, func(key, val []byte) bool {
+		got = append(got, string(key))
+		return true
+	})
+	testify_assert.Equal(t, []string{"a", "b", "c", "d", "e"}, got)
+}
+
+// the scans hint the leaves ahead of them, each one once.
+func TestKV_ReadAhead(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"),
+		WithNoSync(), WithCacheSize(0), WithReadAhead(4))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	val := bytes.Repeat([]byte("v"), 200)
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), val))
+	}
+	hinted := map[uint64]int{}
+	prefetch := db.tree.prefetch
+	db.tree.prefetch = func(ptrs []uint64) {
+		for _, ptr := range ptrs {
+			hinted[ptr]++
+		}
+		prefetch(ptrs)
+	}
+	leaves := db.Stats().LeafPages
+
+	testify_assert.NoError(t, db.Scan(nil, func(key, val []byte) bool { return true }))
+	testify_assert.Greater(t, uint64(len(hinted)), leaves/2)
+	for _, n := range hinted {
+		testify_assert.Equal(t, 1, n)
+	}
+	testify_assert.Equal(t, uint64(len(hinted)), db.Stats().Prefetches)
+
+	hinted = map[uint64]int{}
+	snap, err := db.Snapshot()
+	testify_assert.NoError(t, err)
+	defer snap.Close()
+	testify_assert.NoError(t, snap.Scan([]byte("k0500"), func(key, val []byte) bool { return true }))
+	testify_assert.Greater(t, uint64(len(hinted)), leaves/4)
+	for _, n := range hinted {
+		testify_assert.Equal(t, 1, n)
+	}
+}
+
+func TestKV_Inspect(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.NoError(t, db.Set([]byte("k1"), []byte("v1")))
+	testify_assert.NoError(t, db.Set([]byte("k2"), []byte("v2")))
+
+	out := &bytes.Buffer{}
+	testify_assert.NoError(t, db.Inspect(out, true))
+	testify_assert.Equal(t, `master: sig "BuildYourOwnDB06", root 2, pages used 3, flags 0x4 (checksums)
+page 2: leaf, 3 keys, 54 bytes, keys "" .. "k2"
+  [0] "" = ""
+  [1] "k1" = "v1"
+  [2] "k2" = "v2"
+unreferenced pages: 1
+`, out.String())
+}
+
+func TestKV_ScanContext(t *testing.T) {
+	db := openTestKV(t)
+	for _, k := range []string{"a", "b", "c"} {
+		testify_assert.NoError(t, db.Set([]byte(k), []byte("v")))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var keys []string
+	err := db.ScanContext(ctx, []byte("a"), func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		cancel()
+		return true
+	})
+	testify_assert.ErrorIs(t, err, context.Canceled)
+	testify_assert.Equal(t, []string{"a"}, keys)
+
+	errs := db.CheckContext(ctx)
+	testify_assert.Len(t, errs, 1)
+	testify_assert.ErrorIs(t, errs[0], context.Canceled)
+}
+
+func TestKV_ScanPage(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 25; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i))))
+	}
+	var keys []string
+	var cursor []byte
+	pages := 0
+	for {
+		items, next, err := db.ScanPage(cursor, 10)
+		testify_assert.NoError(t, err)
+		pages++
+		for _, item := range items {
+			keys = append(keys, string(item.Key))
+		}
+		if next == nil {
+			break
+		}
+		cursor = next
+	}
+	testify_assert.Equal(t, 3, pages)
+	testify_assert.Len(t, keys, 25)
+	testify_assert.Equal(t, "k24", keys[24])
+
+	// exactly one full page
+	items, next, err := db.ScanPage([]byte("k15"), 10)
+	testify_assert.NoError(t, err)
+	testify_assert.Len(t, items, 10)
+	testify_assert.Nil(t, next)
+	_, _, err = db.ScanPage(nil, 0)
+	testify_assert.Error(t, err)
+}
+
+func TestKV_ScanKeys(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 20; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte(fmt.Sprint(i))))
+	}
+	var keys []string
+	testify_assert.NoError(t, db.ScanKeys([]byte("k15"), func(key []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 3
+	}))
+	testify_assert.Equal(t, []string{"k15", "k16", "k17"}, keys)
+}
+
+func TestKV_GetMany(t *testing.T) {
+	db := openTestKV(t)
+	db.NoSync = true
+	for i := 0; i < 1000; i += 2 {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i))))
+	}
+	testify_assert.NoError(t, db.Set([]byte("empty"), nil))
+
+	// unordered, missing, duplicated and empty keys
+	var keys [][]byte
+	for _, i := range rand.New(rand.NewSource(1)).Perm(1000)[:300] {
+		keys = append(keys, []byte(fmt.Sprintf("k%04d", i)))
+	}
+	keys = append(keys, []byte("k0010"), []byte("k0010"), []byte("empty"), nil, []byte("zzz"))
+	vals, err := db.GetMany(keys)
+	testify_assert.NoError(t, err)
+	testify_assert.Len(t, vals, len(keys))
+	for i, key := range keys {
+		val, ok, _ := db.Get(key)
+		if len(key) == 0 {
+			ok = false
+		}
+		testify_assert.Equal(t, ok, vals[i] != nil, "key %q", key)
+		testify_assert.Equal(t, string(val), string(vals[i]))
+	}
+}
+
+func TestKV_DeleteRange(t *testing.T) {
+	db := openTestKV(t)
+	db.NoSync = true
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), make([]byte, 100)))
+	}
+	before := db.Stats().LeafPages
+	testify_assert.NoError(t, db.DeleteRange([]byte("k0100"), []byte("k0900")))
+	testify_assert.NoError(t, db.DeleteRange([]byte("k0950"), nil))
+	testify_assert.NoError(t, db.DeleteRange([]byte("k0020"), []byte("k0010")))
+
+	var keys []string
+	testify_assert.NoError(t, db.ScanKeys(nil, func(key []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	testify_assert.Len(t, keys, 150)
+	testify_assert.Equal(t, "k0099", keys[99])
+	testify_assert.Equal(t, "k0900", keys[100])
+	testify_assert.Equal(t, "k0949", keys[149])
+	testify_assert.Less(t, db.Stats().LeafPages, before)
+	testify_assert.NoError(t, db.Verify())
+}
+
+func TestKV_EstimateSize(t *testing.T) {
+	db := openTestKV(t)
+	db.NoSync = true
+	for i := 0; i < 5000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%05d", i)), make([]byte, 100)))
+	}
+	for _, r := range [][2]int{{0, 5000}, {1000, 4000}, {10, 20}, {2500, 2501}} {
+		lo, hi := []byte(fmt.Sprintf("k%05d", r[0])), []byte(fmt.Sprintf("k%05d", r[1]))
+		keys, bytes, err := db.EstimateSize(lo, hi)
+		testify_assert.NoError(t, err)
+		n := float64(r[1] - r[0])
+		testify_assert.InEpsilon(t, n, float64(keys), 0.25, "range %v", r)
+		testify_assert.InEpsilon(t, n*106, float64(bytes), 0.25, "range %v", r)
+	}
+	keys, _, err := db.EstimateSize([]byte("k1"), []byte("k0"))
+	testify_assert.NoError(t, err)
+	testify_assert.Zero(t, keys)
+	keys, _, err = db.EstimateSize(nil, nil)
+	testify_assert.NoError(t, err)
+	testify_assert.InEpsilon(t, 5000, float64(keys), 0.25)
+}
+
+func TestKV_Merge(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.ErrorIs(t, db.Merge([]byte("k"), []byte("x")), ErrNoMerge)
+
+	// appends the operands, "<nil>" marks a missing key
+	db.MergeOperator = func(key, old, operand []byte) []byte {
+		if old == nil {
+			old = []byte("<nil>")
+		}
+		return append(append(append([]byte{}, old...), ','), operand...)
+	}
+	testify_assert.NoError(t, db.Merge([]byte("k"), []byte("a")))
+	testify_assert.NoError(t, db.Merge([]byte("k"), []byte("b")))
+	testify_assert.NoError(t, db.Set([]byte("e"), nil))
+	testify_assert.NoError(t, db.Merge([]byte("e"), []byte("a")))
+
+	val, _, _ := db.Get([]byte("k"))
+	testify_assert.Equal(t, "<nil>,a,b", string(val))
+	val, _, _ = db.Get([]byte("e"))
+	testify_assert.Equal(t, ",a", string(val))
+}
+
+func TestKV_CloneTo(t *testing.T) {
+	db := openTestKV(t)
+	db.NoSync = true
+	for i := 0; i < 3000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i))))
+	}
+	for i := 0; i < 3000; i += 2 {
+		_, err := db.Del([]byte(fmt.Sprintf("k%04d", i)))
+		testify_assert.NoError(t, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "clone.db")
+	testify_assert.NoError(t, db.CloneTo(path, WithCompression(COMPRESS_ZSTD)))
+	testify_assert.ErrorIs(t, db.CloneTo(path), os.ErrExist)
+
+	clone, err := Open(path, WithCompression(COMPRESS_ZSTD))
+	testify_assert.NoError(t, err)
+	defer clone.Close()
+	testify_assert.NoError(t, clone.Verify())
+	// only the pages of the last version are left
+	s := clone.Stats()
+	testify_assert.LessOrEqual(t, s.FreePages, uint64(2))
+	testify_assert.Less(t, s.FileBytes, db.Stats().FileBytes)
+	n := 0
+	testify_assert.NoError(t, clone.Scan(nil, func(key, val []byte) bool {
+		testify_assert.Equal(t, fmt.Sprintf("k%04d", 2*n+1), string(key))
+		testify_assert.Equal(t, fmt.Sprint(2*n+1), string(val))
+		n++
+		return true
+	}))
+	testify_assert.Equal(t, 1500, n)
+}
+
+// the KV is updated by another goroutine during the copy, which has the
+// last commit from when it began.
+func TestKV_CloneToOnline(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 3000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("old")))
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if err := db.Set([]byte(fmt.Sprintf("k%04d", i%3000)), []byte("new")); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := db.Del([]byte(fmt.Sprintf("k%04d", (i+1500)%3000))); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	path := filepath.Join(t.TempDir(), "clone.db")
+	err := db.CloneTo(path)
+	close(stop)
+	<-done
+	testify_assert.NoError(t, err)
+
+	clone, err := Open(path)
+	testify_assert.NoError(t, err)
+	defer clone.Close()
+	testify_assert.Nil(t, clone.Check())
+	n := 0
+	testify_assert.NoError(t, clone.Scan(nil, func(key, val []byte) bool {
+		n++
+		return true
+	}))
+	testify_assert.Greater(t, n, 0)
+}
+
+// a failed copy leaves no file behind, nor its bloom filter.
+func TestKV_CloneToFailure(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 2*CLONE_BATCH; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("v")))
+	}
+	path := filepath.Join(t.TempDir(), "clone.db")
+	fs := &faultFS{failSync: true}
+	err := db.CloneTo(path, WithFS(fs), WithBloomFilter(10))
+	testify_assert.ErrorContains(t, err, "injected fsync failure")
+	for _, name := range []string{path, path + ".bloom"} {
+		_, err := os.Stat(name)
+		testify_assert.ErrorIs(t, err, os.ErrNotExist)
+	}
+}
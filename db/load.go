@@ -0,0 +1,69 @@
+package db
+
+// Loader inserts many KVs in few commits, to import data: the inserts go
+// straight to the tree, and they're committed by CLONE_BATCH like
+// Tx.CommitNoSync until Close, which makes them durable. a crash
+// before that loses a part of the load, not the keys from before it:
+// the pages freed by the load are only reused after Close, see
+// Tx.CommitNoSync. the KV must not be used by others until Close.
+type Loader struct {
+	db *KV
+	n  int
+}
+
+// NewLoader starts a load, the buffered updates are merged first.
+func (db *KV) NewLoader() (*Loader, error) {
+	if err := checkWritable(db); err != nil {
+		return nil, err
+	}
+	if walBuffered(db) {
+		if err := db.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	db.syncSkip = true
+	return &Loader{db: db}, nil
+}
+
+// Set and Del are throttled and counted like KV.Set and KV.Del.
+func (l *Loader) Set(key, val []byte) error {
+	db := l.db
+	if err := cloneSet(db, key, val); err != nil {
+		return err
+	}
+	throttle(db, len(key)+len(val))
+	db.stats.sets++
+	db.stats.keySizes.observe(len(key))
+	db.stats.valSizes.observe(len(val))
+	occRecord(db, keySpan{lo: key, point: true})
+	return l.next()
+}
+
+func (l *Loader) Del(key []byte) (err error) {
+	defer catchPageError(&err)
+	db := l.db
+	if err := checkKV(key, nil); err != nil {
+		return err
+	}
+	throttle(db, len(key))
+	db.stats.dels++
+	if db.tree.Delete(key) {
+		occRecord(db, keySpan{lo: key, point: true})
+	}
+	return l.next()
+}
+
+// a commit per batch.
+func (l *Loader) next() error {
+	if l.n++; l.n%CLONE_BATCH == 0 {
+		return flushPages(l.db)
+	}
+	return nil
+}
+
+// Close commits the rest of the load, durable unless the KV was opened
+// with Options.NoSync.
+func (l *Loader) Close() error {
+	l.db.syncSkip = false
+	return flushPages(l.db)
+}
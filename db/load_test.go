@@ -0,0 +1,69 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestLoader(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.NoError(t, db.Set([]byte("k0000"), []byte("old")))
+	fsyncs, commits := db.Stats().Fsyncs, db.Stats().Commits
+
+	l, err := db.NewLoader()
+	testify_assert.NoError(t, err)
+	n := 2*CLONE_BATCH + 10
+	for i := 0; i < n; i++ {
+		testify_assert.NoError(t, l.Set([]byte(fmt.Sprintf("k%04d", i)), []byte(fmt.Sprint(i))))
+	}
+	testify_assert.ErrorIs(t, l.Set(nil, nil), ErrEmptyKey)
+	testify_assert.NoError(t, l.Close())
+	// a commit per batch, only the last one is synced after its master page
+	testify_assert.Equal(t, commits+3, db.Stats().Commits)
+	testify_assert.Equal(t, fsyncs+4, db.Stats().Fsyncs)
+	testify_assert.False(t, db.syncSkip)
+	testify_assert.Equal(t, uint64(n+1), db.Stats().KeySizes.Count) // and the Set before
+
+	val, ok, err := db.Get([]byte("k0000"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, []byte("0"), val)
+	count := 0
+	testify_assert.NoError(t, db.ScanKeys(nil, func(key []byte) bool {
+		count++
+		return true
+	}))
+	testify_assert.Equal(t, n, count)
+	testify_assert.Nil(t, db.Check())
+}
+
+// the batches don't write over the pages of the keys from before the
+// load, which a crash goes back to.
+func TestLoader_Crash(t *testing.T) {
+	fs := &recordFS{}
+	db := &KV{Path: filepath.Join(t.TempDir(), "test.db"), Options: Options{FS: fs}}
+	testify_assert.NoError(t, db.Open())
+	defer db.Close()
+	for i := 0; i < 500; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%04d", i)), []byte("old")))
+	}
+	old := map[uint64]bool{0: true}
+	treePages(&db.tree, func(ptr uint64) { old[ptr] = true })
+	fs.events = nil
+
+	l, err := db.NewLoader()
+	testify_assert.NoError(t, err)
+	for i := 0; i < 3*CLONE_BATCH; i++ {
+		testify_assert.NoError(t, l.Set([]byte(fmt.Sprintf("k%04d", i%1000)), []byte(fmt.Sprint(i))))
+	}
+	for _, ev := range fs.events {
+		if !ev.sync && ev.off > 0 {
+			testify_assert.False(t, old[uint64(ev.off)/BTREE_PAGE_SIZE], "page %d", ev.off/BTREE_PAGE_SIZE)
+		}
+	}
+	testify_assert.NoError(t, l.Close())
+	testify_assert.Nil(t, db.Check())
+}
@@ -0,0 +1,139 @@
+package db
+
+import (
+	"errors"
+	"sync"
+)
+
+var ErrDeadlock = errors.New("deadlock, the transaction was aborted")
+
+// the key locks of the transactions, for the workloads that would rather
+// wait than retry on ErrConflict. the locks are held until the end of the
+// Tx (two-phase locking). a Tx that would wait for itself through the
+// others is aborted instead: the waits-for graph is checked for a cycle
+// before each wait.
+//
+// it's safe for concurrent use, unlike the rest of the KV, so the waits
+// must happen outside of the lock guarding the KV.
+type lockManager struct {
+	mu    sync.Mutex
+	wake  *sync.Cond // on every release
+	keys  map[string]*keyLock
+	waits map[*Tx]*keyLock // the lock each waiting Tx waits for
+}
+
+type keyLock struct {
+	owners    map[*Tx]bool
+	exclusive bool
+}
+
+func newLockManager() *lockManager {
+	lm := &lockManager{keys: map[string]*keyLock{}, waits: map[*Tx]*keyLock{}}
+	lm.wake = sync.NewCond(&lm.mu)
+	return lm
+}
+
+// can the Tx take the lock now? a lock of its own can be upgraded.
+func (kl *keyLock) grantable(tx *Tx, exclusive bool) bool {
+	others := len(kl.owners)
+	if kl.owners[tx] {
+		others--
+	}
+	return others == 0 || !exclusive && !kl.exclusive
+}
+
+func (lm *lockManager) acquire(tx *Tx, key []byte, exclusive bool) error {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for {
+		// dropped by a release once it has no owners
+		kl := lm.keys[string(key)]
+		if kl == nil {
+			kl = &keyLock{owners: map[*Tx]bool{}}
+			lm.keys[string(key)] = kl
+		}
+		if kl.grantable(tx, exclusive) {
+			lm.grant(tx, kl, key, exclusive)
+			return nil
+		}
+		lm.waits[tx] = kl
+		if lm.waitsFor(tx, tx, map[*Tx]bool{}) {
+			delete(lm.waits, tx)
+			return ErrDeadlock
+		}
+		lm.wake.Wait()
+	}
+}
+
+func (lm *lockManager) grant(tx *Tx, kl *keyLock, key []byte, exclusive bool) {
+	delete(lm.waits, tx)
+	if !kl.owners[tx] {
+		kl.owners[tx] = true
+		if tx.locked == nil {
+			tx.locked = map[string]bool{}
+		}
+		tx.locked[string(key)] = true
+	}
+	kl.exclusive = kl.exclusive || exclusive
+}
+
+// does the Tx `from` wait, directly or not, for the Tx `target`?
+func (lm *lockManager) waitsFor(from, target *Tx, seen map[*Tx]bool) bool {
+	kl := lm.waits[from]
+	if kl == nil || seen[from] {
+		return false
+	}
+	seen[from] = true
+	for owner := range kl.owners {
+		if owner == from {
+			continue // an upgrade, waiting for the other owners
+		}
+		if owner == target || lm.waitsFor(owner, target, seen) {
+			return true
+		}
+	}
+	return false
+}
+
+// release the locks of a Tx at its end.
+func (lm *lockManager) releaseAll(tx *Tx) {
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	for key := range tx.locked {
+		kl := lm.keys[key]
+		delete(kl.owners, tx)
+		if len(kl.owners) == 0 {
+			delete(lm.keys, key)
+		}
+	}
+	tx.locked = nil
+	lm.wake.Broadcast()
+}
+
+// Lock takes a lock on a key until the end of the Tx, shared or
+// exclusive, waiting for the other Txs holding it. the reads of a locked
+// key see the last commit rather than the version the Tx began with, so
+// they can't conflict, see ErrConflict.
+//
+// if the wait would be a deadlock, the Tx is aborted with ErrDeadlock:
+// its locks are released, and it can only be rolled back. unlike the
+// other methods, Lock must be called without holding the lock of the KV
+// shared with the other Txs, or they couldn't proceed.
+func (tx *Tx) Lock(key []byte, exclusive bool) error {
+	// not tx.usable, the KV is not locked
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.aborted != nil {
+		return tx.aborted
+	}
+	if err := checkKV(key, nil); err != nil {
+		return err
+	}
+	err := tx.lockMgr.acquire(tx, key, exclusive)
+	if err != nil {
+		tx.aborted = err
+		tx.lockMgr.releaseAll(tx)
+	}
+	return err
+}
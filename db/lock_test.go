@@ -0,0 +1,124 @@
+package db
+
+import (
+	"encoding/binary"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+// the increments of the Txs in many goroutines wait for each other
+// instead of conflicting.
+func TestTx_Lock(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	var mu sync.Mutex // the lock of the KV
+	incr := func() error {
+		mu.Lock()
+		tx, err := db.Begin()
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+		defer func() {
+			mu.Lock()
+			tx.Rollback()
+			mu.Unlock()
+		}()
+		if err := tx.Lock([]byte("n"), true); err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		val, _, err := tx.Get([]byte("n"))
+		if err != nil {
+			return err
+		}
+		n := uint64(0)
+		if val != nil {
+			n = binary.LittleEndian.Uint64(val)
+		}
+		if err := tx.Set([]byte("n"), binary.LittleEndian.AppendUint64(nil, n+1)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				testify_assert.NoError(t, incr())
+			}
+		}()
+	}
+	wg.Wait()
+	val, _, _ := db.Get([]byte("n"))
+	testify_assert.Equal(t, uint64(80), binary.LittleEndian.Uint64(val))
+	testify_assert.Empty(t, db.locks.keys)
+}
+
+// 2 Txs locking 2 keys in opposite orders, one of them is aborted.
+func TestTx_Deadlock(t *testing.T) {
+	db := openTestKV(t)
+	t1, err := db.Begin()
+	testify_assert.NoError(t, err)
+	t2, err := db.Begin()
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, t1.Lock([]byte("a"), true))
+	testify_assert.NoError(t, t2.Lock([]byte("b"), false))
+
+	locked := make(chan error)
+	go func() {
+		locked <- t1.Lock([]byte("b"), true) // waits for t2
+	}()
+	// until t1 waits
+	for {
+		db.locks.mu.Lock()
+		waiting := db.locks.waits[t1] != nil
+		db.locks.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	testify_assert.ErrorIs(t, t2.Lock([]byte("a"), false), ErrDeadlock)
+	// t2 is aborted, its locks are released
+	testify_assert.NoError(t, <-locked)
+	testify_assert.ErrorIs(t, t2.Set([]byte("x"), nil), ErrDeadlock)
+	testify_assert.ErrorIs(t, t2.Commit(), ErrDeadlock)
+	t2.Rollback()
+
+	testify_assert.NoError(t, t1.Set([]byte("a"), []byte("1")))
+	testify_assert.NoError(t, t1.Commit())
+	testify_assert.Empty(t, db.locks.keys)
+
+	// shared locks don't wait for each other, an upgrade waits for the others
+	t1, _ = db.Begin()
+	t2, _ = db.Begin()
+	testify_assert.NoError(t, t1.Lock([]byte("a"), false))
+	testify_assert.NoError(t, t2.Lock([]byte("a"), false))
+	go func() {
+		locked <- t1.Lock([]byte("a"), true)
+	}()
+	for {
+		db.locks.mu.Lock()
+		waiting := db.locks.waits[t1] != nil
+		db.locks.mu.Unlock()
+		if waiting {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// both upgrading is a deadlock
+	testify_assert.ErrorIs(t, t2.Lock([]byte("a"), true), ErrDeadlock)
+	testify_assert.NoError(t, <-locked)
+	t2.Rollback()
+	t1.Rollback()
+	testify_assert.Empty(t, db.locks.keys)
+}
@@ -0,0 +1,46 @@
+package db
+
+import "time"
+
+// Logger receives structured records: a message followed by
+// alternating keys and values. *slog.Logger satisfies it.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...any) {}
+func (nopLogger) Info(string, ...any)  {}
+func (nopLogger) Warn(string, ...any)  {}
+
+func logInit(db *KV) {
+	if db.Logger == nil {
+		db.Logger = nopLogger{}
+	}
+	// structural changes of the tree are debug records
+	db.tree.debug = db.Logger.Debug
+}
+
+// keys in log records are cut to this length
+const LOG_MAX_KEY = 64
+
+func logKey(key []byte) string {
+	if len(key) > LOG_MAX_KEY {
+		return string(key[:LOG_MAX_KEY]) + "..."
+	}
+	return string(key)
+}
+
+// log an operation that took longer than KV.SlowOpThreshold.
+// use as `defer slowOp(db, "get", key, time.Now())`.
+func slowOp(db *KV, op string, key []byte, start time.Time) {
+	if db.SlowOpThreshold <= 0 {
+		return
+	}
+	if elapsed := time.Since(start); elapsed >= db.SlowOpThreshold {
+		db.Logger.Warn("slow operation", "op", op, "key", logKey(key), "elapsed", elapsed)
+	}
+}
@@ -0,0 +1,42 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+type recordLogger struct {
+	records []string
+}
+
+func (l *recordLogger) log(level, msg string, args ...any) {
+	l.records = append(l.records, strings.TrimSpace(fmt.Sprintln(append([]any{level, msg}, args...)...)))
+}
+func (l *recordLogger) Debug(msg string, args ...any) { l.log("DEBUG", msg, args...) }
+func (l *recordLogger) Info(msg string, args ...any)  { l.log("INFO", msg, args...) }
+func (l *recordLogger) Warn(msg string, args ...any)  { l.log("WARN", msg, args...) }
+
+func TestKV_Logger(t *testing.T) {
+	logger := &recordLogger{}
+	db := &KV{
+		Path: filepath.Join(t.TempDir(), "test.db"),
+		Options: Options{
+			Logger:          logger,
+			SlowOpThreshold: time.Nanosecond, // everything is slow
+		},
+	}
+	testify_assert.NoError(t, db.Open())
+	defer db.Close()
+
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	db.Get([]byte("k"))
+	testify_assert.Len(t, logger.records, 3)
+	testify_assert.Contains(t, logger.records[0], "DEBUG commit")
+	testify_assert.Contains(t, logger.records[1], "WARN slow operation op set key k")
+	testify_assert.Contains(t, logger.records[2], "WARN slow operation op get key k")
+}
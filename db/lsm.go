@@ -0,0 +1,511 @@
+package db
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// an LSM-tree engine for write-heavy workloads. the database is a
+// directory:
+//   - log: the updates in the memtable, replayed on open
+//   - NNNNNNNN.run: sorted runs of KVs, written when the memtable is full
+//   - MANIFEST: the names of the live runs, newest first
+//
+// a key is looked up in the memtable, then in the runs from the newest.
+// deleted keys are kept as tombstones until all runs are merged into one.
+const (
+	LSM_MEMTABLE_SIZE = 4 << 20 // flush the memtable past this many bytes
+	LSM_MAX_RUNS      = 4       // merge all runs past this count
+)
+
+// a log or run record.
+// | crc32 | klen | vlen | flag | key | val |
+// |  4B   |  4B  |  4B  |  1B  | ... | ... |
+const LSM_RECORD_HEADER = 13
+
+// the largest key or value of a record, a larger length is read as a
+// torn record, so the updates are limited to it.
+const LSM_MAX_KV_SIZE = BTREE_PAGE_SIZE * 1024
+
+const LSM_TOMBSTONE = 1 // the flag of a deleted key
+
+type lsmEntry struct {
+	key     []byte
+	val     []byte
+	deleted bool
+}
+
+// a run file, its keys are kept in memory, values are read on demand.
+type lsmRun struct {
+	name string
+	fp   *os.File
+	keys [][]byte
+	offs []int64 // of the values
+	lens []uint32
+	dels []bool
+}
+
+type LSM struct {
+	Path    string
+	noSync  bool
+	log     *os.File
+	mem     *memtable
+	runs    []*lsmRun // newest first
+	nextRun int
+	// limits, LSM_* by default
+	memtableSize int
+	maxRuns      int
+}
+
+// OpenLSM opens or creates an LSM database in the directory path.
+// of the options, only NoSync applies.
+func OpenLSM(path string, opts ...Option) (*LSM, error) {
+	o := applyOptions(opts)
+	if len(o.EncryptionKey) > 0 || o.Compression != COMPRESS_NONE {
+		return nil, errors.New("OpenLSM: encryption and compression are not supported")
+	}
+	if o.Comparator != nil && o.Comparator != Bytewise {
+		return nil, errors.New("OpenLSM: only the bytewise comparator is supported")
+	}
+	db := &LSM{
+		Path: path, noSync: o.NoSync, mem: newMemtable(bytes.Compare),
+		memtableSize: LSM_MEMTABLE_SIZE, maxRuns: LSM_MAX_RUNS,
+	}
+	if err := db.open(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("OpenLSM: %w", err)
+	}
+	return db, nil
+}
+
+func (db *LSM) open() error {
+	if err := os.MkdirAll(db.Path, 0755); err != nil {
+		return err
+	}
+	names, err := lsmReadManifest(db.Path)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		run, err := lsmOpenRun(filepath.Join(db.Path, name))
+		if err != nil {
+			return err
+		}
+		run.name = name
+		db.runs = append(db.runs, run)
+		var seq int
+		if _, err := fmt.Sscanf(name, "%08d.run", &seq); err == nil && seq >= db.nextRun {
+			db.nextRun = seq + 1
+		}
+	}
+	// replay the log into the memtable
+	db.log, err = os.OpenFile(filepath.Join(db.Path, "log"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	valid, err := lsmReadRecords(db.log, func(e lsmEntry, off int64) {
+		db.mem.put(e)
+	})
+	if err != nil {
+		return err
+	}
+	// drop a torn record at the end
+	if err := db.log.Truncate(valid); err != nil {
+		return err
+	}
+	_, err = db.log.Seek(valid, io.SeekStart)
+	return err
+}
+
+func (db *LSM) Close() {
+	if db.log != nil {
+		_ = db.log.Close()
+	}
+	for _, run := range db.runs {
+		_ = run.fp.Close()
+	}
+	db.runs = nil
+}
+
+func (db *LSM) Get(key []byte) ([]byte, bool, error) {
+	if e, ok := db.mem.get(key); ok {
+		if e.deleted {
+			return nil, false, nil
+		}
+		// the memtable is not the caller's
+		return append([]byte(nil), e.val...), true, nil
+	}
+	for _, run := range db.runs {
+		if i, ok := run.find(key); ok {
+			if run.dels[i] {
+				return nil, false, nil
+			}
+			val, err := run.value(i)
+			return val, err == nil, err
+		}
+	}
+	return nil, false, nil
+}
+
+func (db *LSM) Set(key []byte, val []byte) error {
+	if err := lsmCheck(key, val); err != nil {
+		return err
+	}
+	return db.update(lsmEntry{key: key, val: val})
+}
+
+func (db *LSM) Del(key []byte) (bool, error) {
+	if err := lsmCheck(key, nil); err != nil {
+		return false, err
+	}
+	_, ok, err := db.Get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+	return true, db.update(lsmEntry{key: key, deleted: true})
+}
+
+// the size limits of a record, see LSM_MAX_KV_SIZE.
+func lsmCheck(key, val []byte) error {
+	switch {
+	case len(key) == 0:
+		return ErrEmptyKey
+	case len(key) > LSM_MAX_KV_SIZE:
+		return ErrKeyTooLarge
+	case len(val) > LSM_MAX_KV_SIZE:
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+// call fn on every KV with key >= start in key order until it returns false.
+func (db *LSM) Scan(start []byte, fn func(key, val []byte) bool) error {
+	// the memtable and the runs, newest first
+	iters := []lsmIter{&memIter{db.mem.seek(start)}}
+	for _, run := range db.runs {
+		iters = append(iters, &runIter{run, run.search(start)})
+	}
+	for {
+		// the smallest key, the newest source wins a tie
+		var min lsmIter
+		for _, it := range iters {
+			if it.valid() && (min == nil || bytes.Compare(it.key(), min.key()) < 0) {
+				min = it
+			}
+		}
+		if min == nil {
+			return nil
+		}
+		key := min.key()
+		val, deleted, err := min.entry()
+		if err != nil {
+			return err
+		}
+		for _, it := range iters {
+			if it.valid() && bytes.Equal(it.key(), key) {
+				it.next()
+			}
+		}
+		if !deleted && !fn(key, val) {
+			return nil
+		}
+	}
+}
+
+// a sorted source of entries for Scan.
+type lsmIter interface {
+	valid() bool
+	key() []byte
+	entry() (val []byte, deleted bool, err error)
+	next()
+}
+
+type memIter struct {
+	node *memNode
+}
+
+func (it *memIter) valid() bool { return it.node != nil }
+func (it *memIter) key() []byte { return it.node.entry.key }
+func (it *memIter) next()       { it.node = it.node.nextNode() }
+func (it *memIter) entry() ([]byte, bool, error) {
+	return it.node.entry.val, it.node.entry.deleted, nil
+}
+
+type runIter struct {
+	run *lsmRun
+	pos int
+}
+
+func (it *runIter) valid() bool { return it.pos < len(it.run.keys) }
+func (it *runIter) key() []byte { return it.run.keys[it.pos] }
+func (it *runIter) next()       { it.pos++ }
+func (it *runIter) entry() ([]byte, bool, error) {
+	if it.run.dels[it.pos] {
+		return nil, true, nil
+	}
+	val, err := it.run.value(it.pos)
+	return val, false, err
+}
+
+// log the update, then apply it to the memtable.
+func (db *LSM) update(e lsmEntry) error {
+	if _, err := db.log.Write(lsmRecord(nil, e)); err != nil {
+		return fmt.Errorf("write log: %w", err)
+	}
+	if !db.noSync {
+		if err := db.log.Sync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+	}
+	db.mem.put(lsmEntry{
+		key:     append([]byte(nil), e.key...),
+		val:     append([]byte(nil), e.val...),
+		deleted: e.deleted,
+	})
+	if db.mem.size < db.memtableSize {
+		return nil
+	}
+	if err := db.flush(); err != nil {
+		return err
+	}
+	if len(db.runs) <= db.maxRuns {
+		return nil
+	}
+	return db.compact()
+}
+
+// write the memtable as the newest run and empty the log.
+func (db *LSM) flush() error {
+	if db.mem.count == 0 {
+		return nil
+	}
+	run, err := db.writeRun(func(emit func(e lsmEntry) error) error {
+		for node := db.mem.seek(nil); node != nil; node = node.nextNode() {
+			if err := emit(node.entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := db.setRuns(append([]*lsmRun{run}, db.runs...)); err != nil {
+		return err
+	}
+	db.mem = newMemtable(bytes.Compare)
+	if err := db.log.Truncate(0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	_, err = db.log.Seek(0, io.SeekStart)
+	return err
+}
+
+// merge all runs into one, dropping the tombstones.
+func (db *LSM) compact() error {
+	old := db.runs
+	mem := db.mem
+	db.mem = newMemtable(bytes.Compare) // scan the runs only
+	run, err := db.writeRun(func(emit func(e lsmEntry) error) error {
+		var err error
+		serr := db.Scan(nil, func(key, val []byte) bool {
+			err = emit(lsmEntry{key: key, val: val})
+			return err == nil
+		})
+		if serr != nil {
+			return serr
+		}
+		return err
+	})
+	db.mem = mem
+	if err != nil {
+		return err
+	}
+	if err := db.setRuns([]*lsmRun{run}); err != nil {
+		return err
+	}
+	for _, r := range old {
+		_ = r.fp.Close()
+		_ = os.Remove(filepath.Join(db.Path, r.name))
+	}
+	return nil
+}
+
+// write a new run file from sorted entries.
+func (db *LSM) writeRun(entries func(emit func(e lsmEntry) error) error) (*lsmRun, error) {
+	name := fmt.Sprintf("%08d.run", db.nextRun)
+	db.nextRun++
+	path := filepath.Join(db.Path, name)
+	fp, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(fp)
+	err = entries(func(e lsmEntry) error {
+		_, err := w.Write(lsmRecord(nil, e))
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = fp.Sync()
+	}
+	fp.Close()
+	if err != nil {
+		return nil, fmt.Errorf("write run: %w", err)
+	}
+	run, err := lsmOpenRun(path)
+	if err != nil {
+		return nil, err
+	}
+	run.name = name
+	return run, nil
+}
+
+// switch to a new list of runs by rewriting the manifest.
+func (db *LSM) setRuns(runs []*lsmRun) error {
+	names := make([]string, len(runs))
+	for i, run := range runs {
+		names[i] = run.name
+	}
+	tmp := filepath.Join(db.Path, "MANIFEST.tmp")
+	if err := os.WriteFile(tmp, []byte(strings.Join(names, "\n")), 0644); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := lsmSyncFile(tmp); err != nil {
+		return err
+	}
+	if err := renameFile(tmp, filepath.Join(db.Path, "MANIFEST")); err != nil {
+		return fmt.Errorf("write manifest: %w", err)
+	}
+	if err := syncDir(db.Path); err != nil { // the rename
+		return err
+	}
+	db.runs = runs
+	return nil
+}
+
+func lsmSyncFile(path string) error {
+	fp, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("fsync: %w", err)
+	}
+	return nil
+}
+
+func lsmReadManifest(dir string) ([]string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "MANIFEST"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\n"), nil
+}
+
+func lsmOpenRun(path string) (*lsmRun, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	run := &lsmRun{fp: fp}
+	valid, err := lsmReadRecords(fp, func(e lsmEntry, off int64) {
+		run.keys = append(run.keys, e.key)
+		run.offs = append(run.offs, off+LSM_RECORD_HEADER+int64(len(e.key)))
+		run.lens = append(run.lens, uint32(len(e.val)))
+		run.dels = append(run.dels, e.deleted)
+	})
+	if err == nil {
+		// runs are synced before use, a bad record is a corruption
+		var fi os.FileInfo
+		if fi, err = fp.Stat(); err == nil && fi.Size() != valid {
+			err = fmt.Errorf("bad record at %d", valid)
+		}
+	}
+	if err != nil {
+		fp.Close()
+		return nil, fmt.Errorf("run %s: %w", path, err)
+	}
+	return run, nil
+}
+
+// the first key >= key.
+func (run *lsmRun) search(key []byte) int {
+	return sort.Search(len(run.keys), func(i int) bool {
+		return bytes.Compare(run.keys[i], key) >= 0
+	})
+}
+
+func (run *lsmRun) find(key []byte) (int, bool) {
+	i := run.search(key)
+	return i, i < len(run.keys) && bytes.Equal(run.keys[i], key)
+}
+
+func (run *lsmRun) value(i int) ([]byte, error) {
+	val := make([]byte, run.lens[i])
+	if _, err := run.fp.ReadAt(val, run.offs[i]); err != nil {
+		return nil, fmt.Errorf("read run: %w", err)
+	}
+	return val, nil
+}
+
+func lsmRecord(buf []byte, e lsmEntry) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, LSM_RECORD_HEADER)...)
+	binary.LittleEndian.PutUint32(buf[start+4:], uint32(len(e.key)))
+	binary.LittleEndian.PutUint32(buf[start+8:], uint32(len(e.val)))
+	if e.deleted {
+		buf[start+12] = LSM_TOMBSTONE
+	}
+	buf = append(buf, e.key...)
+	buf = append(buf, e.val...)
+	binary.LittleEndian.PutUint32(buf[start:], crc32.Checksum(buf[start+4:], crc32c))
+	return buf
+}
+
+// call fn on every record from the start of the file,
+// returns the size of the valid records.
+func lsmReadRecords(fp io.ReaderAt, fn func(e lsmEntry, off int64)) (int64, error) {
+	r := bufio.NewReader(io.NewSectionReader(fp, 0, math.MaxInt64))
+	off := int64(0)
+	header := make([]byte, LSM_RECORD_HEADER)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return off, nil // EOF or a torn header
+		}
+		klen := binary.LittleEndian.Uint32(header[4:])
+		vlen := binary.LittleEndian.Uint32(header[8:])
+		if klen > LSM_MAX_KV_SIZE || vlen > LSM_MAX_KV_SIZE {
+			return off, nil
+		}
+		body := make([]byte, klen+vlen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return off, nil
+		}
+		crc := crc32.Update(crc32.Checksum(header[4:], crc32c), crc32c, body)
+		if crc != binary.LittleEndian.Uint32(header) {
+			return off, nil
+		}
+		fn(lsmEntry{key: body[:klen], val: body[klen:], deleted: header[12] == LSM_TOMBSTONE}, off)
+		off += int64(LSM_RECORD_HEADER + len(body))
+	}
+}
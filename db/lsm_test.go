@@ -0,0 +1,139 @@
+package db
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func engineDump(t *testing.T, db Engine) map[string]string {
+	t.Helper()
+	got := map[string]string{}
+	var keys []string
+	testify_assert.NoError(t, db.Scan(nil, func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		got[string(key)] = string(val)
+		return true
+	}))
+	testify_assert.True(t, sort.StringsAreSorted(keys))
+	return got
+}
+
+// random updates with small limits, so that there are many flushes,
+// compactions and reopens.
+func TestLSM_Random(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lsm")
+	db, err := OpenLSM(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	db.memtableSize, db.maxRuns = 256, 3
+
+	rng := rand.New(rand.NewSource(1))
+	ref := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key%03d", rng.Intn(200))
+		if rng.Intn(3) == 0 {
+			_, existed := ref[key]
+			deleted, err := db.Del([]byte(key))
+			testify_assert.NoError(t, err)
+			testify_assert.Equal(t, existed, deleted)
+			delete(ref, key)
+		} else {
+			val := fmt.Sprint(i)
+			testify_assert.NoError(t, db.Set([]byte(key), []byte(val)))
+			ref[key] = val
+		}
+		if i%500 == 499 {
+			db.Close()
+			db, err = OpenLSM(path, WithNoSync())
+			testify_assert.NoError(t, err)
+			db.memtableSize, db.maxRuns = 256, 3
+		}
+	}
+	testify_assert.Equal(t, ref, engineDump(t, db))
+	for key, val := range ref {
+		got, ok, err := db.Get([]byte(key))
+		testify_assert.NoError(t, err)
+		testify_assert.True(t, ok)
+		testify_assert.Equal(t, val, string(got))
+	}
+	testify_assert.LessOrEqual(t, len(db.runs), 3)
+	db.Close()
+}
+
+// a torn record at the end of the log is dropped.
+func TestLSM_TornLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lsm")
+	db, err := OpenLSM(path)
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, db.Set([]byte("k1"), []byte("v1")))
+	testify_assert.NoError(t, db.Set([]byte("k2"), []byte("v2")))
+	db.Close()
+
+	log := filepath.Join(path, "log")
+	fi, err := os.Stat(log)
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, os.Truncate(log, fi.Size()-1))
+
+	db, err = OpenLSM(path)
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.Equal(t, map[string]string{"k1": "v1"}, engineDump(t, db))
+	testify_assert.NoError(t, db.Set([]byte("k3"), []byte("v3")))
+	testify_assert.Equal(t, map[string]string{"k1": "v1", "k3": "v3"}, engineDump(t, db))
+}
+
+// the records the log can read back, and no larger.
+func TestLSM_Limits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "lsm")
+	db, err := OpenLSM(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	big := make([]byte, LSM_MAX_KV_SIZE)
+	testify_assert.ErrorIs(t, db.Set([]byte("k"), append(big, 0)), ErrValueTooLarge)
+	testify_assert.ErrorIs(t, db.Set(append(big, 0), nil), ErrKeyTooLarge)
+	testify_assert.NoError(t, db.Set([]byte("k1"), big))
+	testify_assert.NoError(t, db.Set([]byte("k2"), []byte("v2")))
+
+	// not the memtable
+	val, _, err := db.Get([]byte("k2"))
+	testify_assert.NoError(t, err)
+	val[0] = 'x'
+	val, _, _ = db.Get([]byte("k2"))
+	testify_assert.Equal(t, []byte("v2"), val)
+	db.Close()
+
+	db, err = OpenLSM(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	val, ok, err := db.Get([]byte("k1"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Len(t, val, LSM_MAX_KV_SIZE)
+	val, _, _ = db.Get([]byte("k2"))
+	testify_assert.Equal(t, []byte("v2"), val)
+}
+
+func TestOpenEngine(t *testing.T) {
+	dir := t.TempDir()
+	for _, engine := range []uint8{ENGINE_BTREE, ENGINE_LSM, ENGINE_HASH} {
+		path := filepath.Join(dir, fmt.Sprint(engine))
+		db, err := OpenEngine(path, WithEngine(engine))
+		testify_assert.NoError(t, err)
+		testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+		db.Close()
+
+		// the engine is found from the file
+		db, err = OpenEngine(path)
+		testify_assert.NoError(t, err)
+		_, isLSM := db.(*LSM)
+		testify_assert.Equal(t, engine == ENGINE_LSM, isLSM)
+		_, isHash := db.(*Hash)
+		testify_assert.Equal(t, engine == ENGINE_HASH, isHash)
+		testify_assert.Equal(t, map[string]string{"k": "v"}, engineDump(t, db))
+		db.Close()
+	}
+}
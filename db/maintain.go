@@ -0,0 +1,121 @@
+package db
+
+import (
+	"sync"
+	"time"
+)
+
+// a pass of the maintenance starts below this fraction of the node pages used
+const MAINTAIN_MIN_FILL = 0.4
+
+// MaintainOptions sets when the automatic maintenance runs and how fast,
+// see StartMaintenance.
+type MaintainOptions struct {
+	// guards the KV, held during each check and step. the KV isn't safe
+	// for concurrent use, so it must be the lock of the other users.
+	Lock sync.Locker
+	// the pause between the checks of the thresholds, default 1s
+	Interval time.Duration
+	// a pass starts when the nodes use less than this fraction of their
+	// pages, default MAINTAIN_MIN_FILL
+	MinFill float64
+	// the I/O pacing of a pass: the most pairs of leaves merged per
+	// second, default 100, and by a step, default 16. a step writes about
+	// a page per merge.
+	MergeRate float64
+	MaxMerges int
+	// the least pause between the steps of a pass, default 10ms
+	StepInterval time.Duration
+}
+
+// StartMaintenance runs a goroutine that checks the fragmentation of the
+// tree, see Stats.UsedBytes, and once it's over the threshold defrags the
+// whole tree with DefragStep, paced by opts. the next pass waits for the
+// fill to drop by a tenth. it holds off while the
+// foreground writes are behind, see Backpressure. stop turns it off and
+// returns the error that ended it, if any.
+func (db *KV) StartMaintenance(opts MaintainOptions) (stop func() error) {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+	if opts.MinFill <= 0 {
+		opts.MinFill = MAINTAIN_MIN_FILL
+	}
+	if opts.MergeRate <= 0 {
+		opts.MergeRate = 100
+	}
+	if opts.MaxMerges <= 0 {
+		opts.MaxMerges = 16
+	}
+	if opts.StepInterval <= 0 {
+		opts.StepInterval = 10 * time.Millisecond
+	}
+	quit, exited := make(chan struct{}), make(chan struct{})
+	var err error
+	go func() {
+		defer close(exited)
+		pacing := tokenBucket{rate: opts.MergeRate}
+		running := false // a pass
+		after := 1.0     // the fill after the last pass
+		wait := opts.Interval
+		for {
+			timer := time.NewTimer(wait)
+			select {
+			case <-quit:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			opts.Lock.Lock()
+			wait = opts.Interval
+			if !db.closed && !db.Backpressure() {
+				if !running {
+					// the merges can't always bring the fill over the
+					// threshold, so it must have dropped since the last pass
+					if fill := maintainFill(db); fill < opts.MinFill && fill < after*0.9 {
+						running = true
+						db.Logger.Info("maintenance: defrag", "fill", fill)
+					}
+				}
+				if running {
+					var merged int
+					var done bool
+					merged, done, err = db.DefragStep(opts.MaxMerges)
+					running = !done && err == nil
+					if done {
+						after = maintainFill(db)
+					}
+					if running {
+						wait = pacing.take(time.Now(), float64(merged))
+						if wait < opts.StepInterval {
+							wait = opts.StepInterval
+						}
+					}
+				}
+			}
+			opts.Lock.Unlock()
+			if err != nil {
+				db.Logger.Warn("maintenance", "err", err)
+				return
+			}
+		}
+	}()
+	return func() error {
+		select {
+		case <-exited:
+		default:
+			close(quit)
+			<-exited
+		}
+		return err
+	}
+}
+
+// the fraction of the node pages used, 1 for an empty tree.
+func maintainFill(db *KV) float64 {
+	s := db.Stats()
+	if s.AllocBytes == 0 {
+		return 1
+	}
+	return float64(s.UsedBytes) / float64(s.AllocBytes)
+}
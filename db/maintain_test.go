@@ -0,0 +1,57 @@
+package db
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_StartMaintenance(t *testing.T) {
+	db, ref := sparseKV(t)
+	before := db.Stats().LeafPages
+
+	var mu sync.Mutex
+	stop := db.StartMaintenance(MaintainOptions{
+		Lock: &mu, Interval: time.Millisecond, StepInterval: time.Millisecond, MergeRate: 1e6,
+	})
+	fill := maintainFill(db)
+	for i := 0; i < 5000; i++ {
+		mu.Lock()
+		leaves := db.Stats().LeafPages
+		mu.Unlock()
+		if leaves < before/2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// no pass again once it's done
+	mu.Lock()
+	for db.defrag.next != nil {
+		mu.Unlock()
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+	}
+	commits := db.Stats().Commits
+	mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	testify_assert.NoError(t, stop())
+	testify_assert.NoError(t, stop())
+	testify_assert.Equal(t, commits, db.Stats().Commits)
+	testify_assert.Less(t, db.Stats().LeafPages, before/2)
+	testify_assert.Greater(t, maintainFill(db), fill)
+	checkSparseKV(t, db, ref)
+}
+
+func TestKV_StartMaintenance_Idle(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	commits := db.Stats().Commits
+
+	var mu sync.Mutex
+	stop := db.StartMaintenance(MaintainOptions{Lock: &mu, Interval: time.Millisecond})
+	time.Sleep(20 * time.Millisecond)
+	testify_assert.NoError(t, stop())
+	testify_assert.Equal(t, commits, db.Stats().Commits)
+}
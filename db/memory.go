@@ -0,0 +1,66 @@
+package db
+
+// the memory budget, see Options.MemoryBudget. the bytes counted are
+// those held by:
+//   - the page cache, a page per entry
+//   - the write buffer, see Options.MemtableSize
+//   - the open iterators, the pages of their path. they're copies
+//     without the mmap or with encryption, in the mmap otherwise.
+//   - the pending updates: of the open Txs and the dirty pages of a commit
+//
+// over the budget, the cache is shrunk, down to MEMORY_MIN_CACHE pages,
+// and the write buffer is merged early. the rest can't be given back
+// until the iterators and the Txs end, KV.Backpressure is reported.
+const MEMORY_MIN_CACHE = 16
+
+// MemoryStats is the memory held by a KV in bytes, see Options.MemoryBudget.
+type MemoryStats struct {
+	Budget    uint64 // 0 is unlimited
+	Cache     uint64
+	Memtable  uint64
+	Iterators uint64
+	Pending   uint64
+	Total     uint64
+}
+
+func (db *KV) MemoryStats() MemoryStats {
+	s := MemoryStats{
+		Budget:    uint64(db.MemoryBudget),
+		Iterators: uint64(db.mem.iters),
+		Pending:   uint64(db.mem.txs + writeBacklogPages(db)),
+	}
+	if db.cache != nil {
+		s.Cache = uint64(db.cache.len()) * BTREE_PAGE_SIZE
+	}
+	if db.wal.mem != nil {
+		s.Memtable = uint64(db.wal.mem.size)
+	}
+	s.Total = s.Cache + s.Memtable + s.Iterators + s.Pending
+	return s
+}
+
+// the bytes over the budget, 0 if under it or unlimited.
+func memOver(db *KV) int64 {
+	if db.MemoryBudget <= 0 {
+		return 0
+	}
+	if over := int64(db.MemoryStats().Total) - int64(db.MemoryBudget); over > 0 {
+		return over
+	}
+	return 0
+}
+
+// shrink the cache to fit the budget, called once it has grown.
+func memEnforce(db *KV) {
+	over := memOver(db)
+	if over == 0 || db.cache == nil {
+		return
+	}
+	pages := int((over + BTREE_PAGE_SIZE - 1) / BTREE_PAGE_SIZE)
+	if keep := db.cache.len() - pages; keep < MEMORY_MIN_CACHE {
+		pages = db.cache.len() - MEMORY_MIN_CACHE
+	}
+	if pages > 0 {
+		db.cache.evict(pages)
+	}
+}
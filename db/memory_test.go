@@ -0,0 +1,72 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_MemoryBudget(t *testing.T) {
+	budget := 64 * BTREE_PAGE_SIZE
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"),
+		WithCacheSize(1000), WithMemtable(1<<20), WithMemoryBudget(budget))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+
+	// the write buffer is merged early
+	val := make([]byte, 1000)
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("key%04d", i)), val))
+	}
+	testify_assert.Positive(t, db.Stats().Checkpoints)
+	testify_assert.LessOrEqual(t, db.MemoryStats().Memtable, uint64(budget))
+
+	// and the cache is shrunk to fit
+	testify_assert.NoError(t, db.Flush())
+	for i := 0; i < 1000; i++ {
+		_, ok, err := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		testify_assert.NoError(t, err)
+		testify_assert.True(t, ok)
+	}
+	m := db.Stats().Memory
+	testify_assert.LessOrEqual(t, m.Total, uint64(budget))
+	testify_assert.Equal(t, m.Cache+m.Memtable+m.Iterators+m.Pending, m.Total)
+	testify_assert.False(t, db.Backpressure())
+
+	// the open iterators and Txs count
+	snap, err := db.Snapshot()
+	testify_assert.NoError(t, err)
+	it := snap.Iter(nil)
+	testify_assert.Positive(t, db.MemoryStats().Iterators)
+	tx, err := db.Begin()
+	testify_assert.NoError(t, err)
+	for i := 0; i < 300; i++ {
+		testify_assert.NoError(t, tx.Set([]byte(fmt.Sprintf("tx%04d", i)), val))
+	}
+	testify_assert.Greater(t, db.MemoryStats().Pending, uint64(300*1000))
+	testify_assert.True(t, db.Backpressure())
+	tx.Rollback()
+	it.Close()
+	snap.Close()
+	m = db.MemoryStats()
+	testify_assert.Zero(t, m.Iterators)
+	testify_assert.Zero(t, m.Pending)
+	testify_assert.False(t, db.Backpressure())
+}
+
+func TestKV_MemoryStats_Unlimited(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 100; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("key%04d", i)), []byte("v")))
+	}
+	_, _, err = db.Get([]byte("key0000"))
+	testify_assert.NoError(t, err)
+	m := db.Stats().Memory
+	testify_assert.Zero(t, m.Budget)
+	testify_assert.Positive(t, m.Cache)
+	testify_assert.False(t, db.Backpressure())
+}
@@ -0,0 +1,95 @@
+package db
+
+// a skiplist of the latest updates by key, for the LSM engine and the
+// write buffer of the KV. deleted keys are kept as tombstones.
+const MEMTABLE_MAX_LEVEL = 16
+
+type memNode struct {
+	entry lsmEntry
+	next  []*memNode
+}
+
+type memtable struct {
+	cmp   func(a, b []byte) int
+	head  memNode
+	level int
+	seed  uint64
+	count int
+	size  int // approximate bytes, grows on every put
+}
+
+func newMemtable(cmp func(a, b []byte) int) *memtable {
+	m := &memtable{cmp: cmp, seed: 0x9e3779b97f4a7c15}
+	m.head.next = make([]*memNode, MEMTABLE_MAX_LEVEL)
+	m.level = 1
+	return m
+}
+
+// each level has 1/4 of the nodes of the one below.
+func (m *memtable) randomLevel() int {
+	// xorshift
+	m.seed ^= m.seed << 13
+	m.seed ^= m.seed >> 7
+	m.seed ^= m.seed << 17
+	level := 1
+	for r := m.seed; level < MEMTABLE_MAX_LEVEL && r&3 == 0; r >>= 2 {
+		level++
+	}
+	return level
+}
+
+// the last node < key on every level.
+func (m *memtable) path(key []byte, prev *[MEMTABLE_MAX_LEVEL]*memNode) *memNode {
+	node := &m.head
+	for i := m.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && m.cmp(node.next[i].entry.key, key) < 0 {
+			node = node.next[i]
+		}
+		if prev != nil {
+			prev[i] = node
+		}
+	}
+	return node
+}
+
+// the first node with a key >= key, nil if none. a nil key is the first node.
+func (m *memtable) seek(key []byte) *memNode {
+	if key == nil {
+		return m.head.next[0]
+	}
+	return m.path(key, nil).next[0]
+}
+
+func (m *memtable) get(key []byte) (lsmEntry, bool) {
+	node := m.seek(key)
+	if node != nil && m.cmp(node.entry.key, key) == 0 {
+		return node.entry, true
+	}
+	return lsmEntry{}, false
+}
+
+// add or replace the entry of a key. the entry is kept as it is.
+func (m *memtable) put(e lsmEntry) {
+	m.size += len(e.key) + len(e.val) + LSM_RECORD_HEADER
+	var prev [MEMTABLE_MAX_LEVEL]*memNode
+	node := m.path(e.key, &prev).next[0]
+	if node != nil && m.cmp(node.entry.key, e.key) == 0 {
+		node.entry = e
+		return
+	}
+	level := m.randomLevel()
+	for m.level < level {
+		prev[m.level] = &m.head
+		m.level++
+	}
+	node = &memNode{entry: e, next: make([]*memNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = prev[i].next[i]
+		prev[i].next[i] = node
+	}
+	m.count++
+}
+
+func (n *memNode) nextNode() *memNode {
+	return n.next[0]
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestMemtable(t *testing.T) {
+	m := newMemtable(bytes.Compare)
+	rng := rand.New(rand.NewSource(1))
+	ref := map[string]string{}
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("k%04d", rng.Intn(1000))
+		val := fmt.Sprint(i)
+		m.put(lsmEntry{key: []byte(key), val: []byte(val)})
+		ref[key] = val
+	}
+	testify_assert.Equal(t, len(ref), m.count)
+
+	var keys []string
+	for k := range ref {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	i := 0
+	for node := m.seek(nil); node != nil; node = node.nextNode() {
+		testify_assert.Equal(t, keys[i], string(node.entry.key))
+		testify_assert.Equal(t, ref[keys[i]], string(node.entry.val))
+		i++
+	}
+	testify_assert.Equal(t, len(keys), i)
+
+	e, ok := m.get([]byte(keys[10]))
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, ref[keys[10]], string(e.val))
+	_, ok = m.get([]byte("k"))
+	testify_assert.False(t, ok)
+	testify_assert.Equal(t, keys[0], string(m.seek([]byte("k")).entry.key))
+	testify_assert.Nil(t, m.seek([]byte("z")))
+}
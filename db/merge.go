@@ -0,0 +1,33 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// MergeOperator returns the new value of a key from its current value
+// and an operand given to KV.Merge. old is nil if the key doesn't exist,
+// an existing empty value is not nil. it must not keep old or operand.
+type MergeOperator func(key, old, operand []byte) []byte
+
+// Merge updates a key with the MergeOperator, e.g. adds to a counter or
+// appends to a list, without a Get and a Set by the caller.
+// the operand is merged right away: unlike an LSM, the tree only keeps
+// full values, so there's no chain of operands to fold on reads.
+func (db *KV) Merge(key, operand []byte) (err error) {
+	defer slowOp(db, "merge", key, time.Now())
+	if db.MergeOperator == nil {
+		return fmt.Errorf("merge: %w", ErrNoMerge)
+	}
+	if err := checkWritable(db); err != nil {
+		return err
+	}
+	old, ok, err := db.Get(key)
+	if err != nil {
+		return err
+	}
+	if ok && old == nil {
+		old = []byte{}
+	}
+	return db.Set(key, db.MergeOperator(key, old, operand))
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// WriteMetrics writes the stats in the Prometheus text exposition format.
+func WriteMetrics(w io.Writer, s Stats) error {
+	bw := bufio.NewWriter(w)
+	metric := func(name, typ, help string) {
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	}
+
+	metric("godb_tree_height", "gauge", "Number of levels in the B-tree.")
+	fmt.Fprintf(bw, "godb_tree_height %d\n", s.Height)
+	metric("godb_pages", "gauge", "Number of pages by kind.")
+	fmt.Fprintf(bw, "godb_pages{kind=\"leaf\"} %d\n", s.LeafPages)
+	fmt.Fprintf(bw, "godb_pages{kind=\"internal\"} %d\n", s.InternalPages)
+	fmt.Fprintf(bw, "godb_pages{kind=\"free\"} %d\n", s.FreePages)
+	fmt.Fprintf(bw, "godb_pages{kind=\"reusable\"} %d\n", s.ReusablePages)
+	metric("godb_alloc_policy", "gauge", "The page allocation policy in use.")
+	fmt.Fprintf(bw, "godb_alloc_policy{policy=%q} 1\n", s.AllocPolicy)
+	metric("godb_file_bytes", "gauge", "Size of the database file.")
+	fmt.Fprintf(bw, "godb_file_bytes %d\n", s.FileBytes)
+	metric("godb_alloc_bytes", "gauge", "Bytes of the pages holding tree nodes.")
+	fmt.Fprintf(bw, "godb_alloc_bytes %d\n", s.AllocBytes)
+	metric("godb_used_bytes", "gauge", "Bytes of the pages used by tree nodes.")
+	fmt.Fprintf(bw, "godb_used_bytes %d\n", s.UsedBytes)
+
+	metric("godb_cache_hits_total", "counter", "Page cache hits.")
+	fmt.Fprintf(bw, "godb_cache_hits_total %d\n", s.Cache.Hits)
+	metric("godb_cache_misses_total", "counter", "Page cache misses.")
+	fmt.Fprintf(bw, "godb_cache_misses_total %d\n", s.Cache.Misses)
+	metric("godb_cache_evictions_total", "counter", "Page cache evictions.")
+	fmt.Fprintf(bw, "godb_cache_evictions_total %d\n", s.Cache.Evictions)
+	metric("godb_memory_bytes", "gauge", "Memory held by the caches and the buffers, by kind.")
+	fmt.Fprintf(bw, "godb_memory_bytes{kind=\"cache\"} %d\n", s.Memory.Cache)
+	fmt.Fprintf(bw, "godb_memory_bytes{kind=\"memtable\"} %d\n", s.Memory.Memtable)
+	fmt.Fprintf(bw, "godb_memory_bytes{kind=\"iterators\"} %d\n", s.Memory.Iterators)
+	fmt.Fprintf(bw, "godb_memory_bytes{kind=\"pending\"} %d\n", s.Memory.Pending)
+	metric("godb_memory_budget_bytes", "gauge", "The memory budget, 0 is unlimited.")
+	fmt.Fprintf(bw, "godb_memory_budget_bytes %d\n", s.Memory.Budget)
+	metric("godb_bloom_rejects_total", "counter", "Gets answered by the bloom filter alone.")
+	fmt.Fprintf(bw, "godb_bloom_rejects_total %d\n", s.BloomRejects)
+
+	metric("godb_ops_total", "counter", "Operations by type.")
+	fmt.Fprintf(bw, "godb_ops_total{op=\"get\"} %d\n", s.Gets)
+	fmt.Fprintf(bw, "godb_ops_total{op=\"set\"} %d\n", s.Sets)
+	fmt.Fprintf(bw, "godb_ops_total{op=\"del\"} %d\n", s.Dels)
+	metric("godb_commits_total", "counter", "Committed updates.")
+	fmt.Fprintf(bw, "godb_commits_total %d\n", s.Commits)
+	metric("godb_fsyncs_total", "counter", "fsync calls.")
+	fmt.Fprintf(bw, "godb_fsyncs_total %d\n", s.Fsyncs)
+	metric("godb_throttled_writes_total", "counter", "Writes delayed by the write rate limit.")
+	fmt.Fprintf(bw, "godb_throttled_writes_total %d\n", s.Throttled)
+	metric("godb_throttle_wait_seconds_total", "counter", "Time the writes waited for the write rate limit.")
+	fmt.Fprintf(bw, "godb_throttle_wait_seconds_total %g\n", s.ThrottleWait.Seconds())
+
+	writeHistogram(bw, "godb_commit_duration_seconds", "Time to write and sync a commit.", s.CommitLatency)
+	writeSizeHistogram(bw, "godb_key_size_bytes", "Sizes of the keys written.", s.KeySizes)
+	writeSizeHistogram(bw, "godb_value_size_bytes", "Sizes of the values written.", s.ValueSizes)
+	return bw.Flush()
+}
+
+func writeHistogram(w io.Writer, name, help string, h Histogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	cumulative := uint64(0)
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound.Seconds(), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.Sum.Seconds())
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+func writeSizeHistogram(w io.Writer, name, help string, h SizeHistogram) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	cumulative := uint64(0)
+	for i, bound := range h.Bounds {
+		cumulative += h.Counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%d\"} %d\n", name, bound, cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+	fmt.Fprintf(w, "%s_sum %d\n", name, h.Sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, h.Count)
+}
+
+// MetricsHandler serves the stats to a Prometheus scraper, e.g. on /metrics.
+// stats is called on every scrape. The KV isn't safe for concurrent use,
+// so pass a function that takes whatever lock guards the KV around db.Stats.
+func MetricsHandler(stats func() Stats) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		if err := WriteMetrics(w, stats()); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+}
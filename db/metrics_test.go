@@ -0,0 +1,24 @@
+package db
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	db.Get([]byte("k"))
+
+	rec := httptest.NewRecorder()
+	MetricsHandler(db.Stats).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	testify_assert.Contains(t, body, "# TYPE godb_commits_total counter\ngodb_commits_total 1\n")
+	testify_assert.Contains(t, body, `godb_ops_total{op="get"} 1`)
+	testify_assert.Contains(t, body, `godb_pages{kind="leaf"} 1`)
+	testify_assert.Contains(t, body, `godb_commit_duration_seconds_bucket{le="+Inf"} 1`)
+	testify_assert.Contains(t, body, "godb_commit_duration_seconds_count 1\n")
+	testify_assert.Contains(t, body, `godb_value_size_bytes_bucket{le="16"} 1`)
+}
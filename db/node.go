@@ -1,7 +1,6 @@
 package db
 
 import (
-	"bytes"
 	"encoding/binary"
 )
 
@@ -11,9 +10,15 @@ const BTREE_PAGE_SIZE = 4096
 const BTREE_MAX_KEY_SIZE = 1000
 const BTREE_MAX_VAL_SIZE = 3000
 
+// the end of every page is reserved for a trailer
+// (e.g. the nonce and the auth tag of an encrypted page),
+// so a node must fit in what's left.
+const PAGE_TRAILER = 32
+const BNODE_MAX_SIZE = BTREE_PAGE_SIZE - PAGE_TRAILER
+
 func init() {
 	node1max := HEADER + 8 + 2 + 4 + BTREE_MAX_KEY_SIZE + BTREE_MAX_VAL_SIZE
-	assert(node1max <= BTREE_PAGE_SIZE)
+	assert(node1max <= BNODE_MAX_SIZE)
 }
 
 const (
@@ -109,13 +114,21 @@ func (node BNode) nbytes() uint16 {
 
 // returns the first kid node whose range intersects the key. (kid[i] <= key)
 // TODO: binary search
-func nodeLookupLE(node BNode, key []byte) uint16 {
+func nodeLookupLE(node BNode, key []byte, keyCmp func(a, b []byte) int) uint16 {
+	found, _ := nodeLookup(node, key, keyCmp)
+	return found
+}
+
+// same as nodeLookupLE, also returns the number of key comparisons.
+func nodeLookup(node BNode, key []byte, keyCmp func(a, b []byte) int) (uint16, int) {
 	nkeys := node.nkeys()
 	found := uint16(0)
+	ncmp := 0
 	// the first key is a copy from the parent node,
 	// thus it's always less than or equal to the key.
 	for i := uint16(1); i < nkeys; i++ {
-		cmp := bytes.Compare(node.getKey(i), key)
+		cmp := keyCmp(node.getKey(i), key)
+		ncmp++
 		if cmp <= 0 {
 			found = i
 		}
@@ -123,7 +136,7 @@ func nodeLookupLE(node BNode, key []byte) uint16 {
 			break
 		}
 	}
-	return found
+	return found, ncmp
 }
 
 // add a new key to a leaf node
@@ -143,7 +156,7 @@ func leafUpdate(
 	new BNode, old BNode, idx uint16,
 	key []byte, val []byte,
 ) {
-	//new.setHeader(BNODE_LEAF, old.nkeys())
+	new.setHeader(BNODE_LEAF, old.nkeys())
 	nodeAppendRange(new, old, 0, 0, idx)
 	nodeAppendKV(new, idx, 0, key, val)
 	nodeAppendRange(new, old, idx+1, idx+1, old.nkeys()-idx-1)
@@ -206,31 +219,59 @@ func nodeReplaceKidN(
 	nodeAppendRange(new, old, idx+inc, idx+1, old.nkeys()-(idx+1))
 }
 
-// split a oversized node into 2 so that the 2nd node always fits on a page
+// split a oversized node into 2 so that the 2nd node always fits on a page.
+// the 1st node may still be too big, it's split again by nodeSplit3.
 func nodeSplit2(left BNode, right BNode, old BNode) {
-	// code omitted...
+	assert(old.nkeys() >= 2)
+	// the initial guess
+	nleft := old.nkeys() / 2
+	leftBytes := func() uint16 {
+		return HEADER + 8*nleft + 2*nleft + old.getOffset(nleft)
+	}
+	rightBytes := func() uint16 {
+		return old.nbytes() - leftBytes() + HEADER
+	}
+	// try to fit the left half
+	for nleft > 1 && leftBytes() > BNODE_MAX_SIZE {
+		nleft--
+	}
+	// the right half must fit
+	for rightBytes() > BNODE_MAX_SIZE {
+		nleft++
+	}
+	assert(nleft < old.nkeys())
+	nright := old.nkeys() - nleft
+
+	left.setHeader(old.btype(), nleft)
+	right.setHeader(old.btype(), nright)
+	nodeAppendRange(left, old, 0, 0, nleft)
+	nodeAppendRange(right, old, 0, nleft, nright)
+	assert(right.nbytes() <= BNODE_MAX_SIZE)
 }
 
 // 由于我们施加的大小限制，一个节点至少可以容纳 1 个 KV 对。在最坏的情况下，一个超大节点将被分割成 3 个节点，
 // 中间是一个大的 KV。因此，我们可能需要将其拆分 2 次。
 // split a node if it's too big. the results are 1~3 nodes.
+// the input node is freed if it was split.
 func nodeSplit3(old BNode) (uint16, [3]BNode) {
-	if old.nbytes() <= BTREE_PAGE_SIZE {
+	if old.nbytes() <= BNODE_MAX_SIZE {
 		old.data = old.data[:BTREE_PAGE_SIZE]
 		return 1, [3]BNode{old} // not split
 	}
-	left := BNode{make([]byte, 2*BTREE_PAGE_SIZE)} // might be split later
-	right := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	left := nodeAlloc(2 * BTREE_PAGE_SIZE) // might be split later
+	right := nodeAlloc(BTREE_PAGE_SIZE)
 	nodeSplit2(left, right, old)
-	if left.nbytes() <= BTREE_PAGE_SIZE {
+	nodeFree(old)
+	if left.nbytes() <= BNODE_MAX_SIZE {
 		left.data = left.data[:BTREE_PAGE_SIZE]
 		return 2, [3]BNode{left, right} // 2 nodes
 	}
 	// the left node is still too large
-	leftleft := BNode{make([]byte, BTREE_PAGE_SIZE)}
-	middle := BNode{make([]byte, BTREE_PAGE_SIZE)}
+	leftleft := nodeAlloc(BTREE_PAGE_SIZE)
+	middle := nodeAlloc(BTREE_PAGE_SIZE)
 	nodeSplit2(leftleft, middle, left)
-	assert(leftleft.nbytes() <= BTREE_PAGE_SIZE)
+	nodeFree(left)
+	assert(leftleft.nbytes() <= BNODE_MAX_SIZE)
 	return 3, [3]BNode{leftleft, middle, right} // 3 nodes
 }
 
@@ -244,6 +285,9 @@ func nodeInsert(
 	knode := treeInsert(tree, tree.get(kptr), key, val)
 	// split the result
 	nsplit, split := nodeSplit3(knode)
+	if nsplit > 1 {
+		tree.logDebug("node split", "nodes", nsplit, "key", logKey(split[0].getKey(0)))
+	}
 	// deallocate the kid node
 	tree.del(kptr)
 	// update the kid links
@@ -268,7 +312,10 @@ func nodeMerge(new BNode, left BNode, right BNode) {
 func nodeReplace2Kid(
 	new BNode, old BNode, idx uint16, ptr uint64, key []byte,
 ) {
-
+	new.setHeader(BNODE_NODE, old.nkeys()-1)
+	nodeAppendRange(new, old, 0, 0, idx)
+	nodeAppendKV(new, idx, ptr, key, nil)
+	nodeAppendRange(new, old, idx+1, idx+2, old.nkeys()-(idx+2))
 }
 
 // should the updated kid be merged with a sibling?
@@ -276,21 +323,21 @@ func shouldMerge(
 	tree *BTree, node BNode,
 	idx uint16, updated BNode,
 ) (int, BNode) {
-	if updated.nbytes() > BTREE_PAGE_SIZE/4 {
+	if updated.nbytes() > BNODE_MAX_SIZE/4 {
 		return 0, BNode{}
 	}
 
 	if idx > 0 {
 		sibling := tree.get(node.getPtr(idx - 1))
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if merged <= BNODE_MAX_SIZE {
 			return -1, sibling // left
 		}
 	}
 	if idx+1 < node.nkeys() {
 		sibling := tree.get(node.getPtr(idx + 1))
 		merged := sibling.nbytes() + updated.nbytes() - HEADER
-		if merged <= BTREE_PAGE_SIZE {
+		if merged <= BNODE_MAX_SIZE {
 			return +1, sibling // right
 		}
 	}
@@ -305,23 +352,28 @@ func nodeDelete(tree *BTree, node BNode, idx uint16, key []byte) BNode {
 	}
 	tree.del(kptr)
 
-	new := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+	new := nodeAlloc(BTREE_PAGE_SIZE)
 	// check for merging
 	mergeDir, sibling := shouldMerge(tree, node, idx, updated)
 	switch {
 	case mergeDir < 0: // left
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		tree.logDebug("node merge", "dir", "left", "idx", idx)
+		merged := nodeAlloc(BTREE_PAGE_SIZE)
 		nodeMerge(merged, sibling, updated)
+		nodeFree(updated)
 		tree.del(node.getPtr(idx - 1))
 		nodeReplace2Kid(new, node, idx-1, tree.new(merged), merged.getKey(0))
 	case mergeDir > 0: // right
-		merged := BNode{data: make([]byte, BTREE_PAGE_SIZE)}
+		tree.logDebug("node merge", "dir", "right", "idx", idx)
+		merged := nodeAlloc(BTREE_PAGE_SIZE)
 		nodeMerge(merged, updated, sibling)
+		nodeFree(updated)
 		tree.del(node.getPtr(idx + 1))
 		nodeReplace2Kid(new, node, idx, tree.new(merged), merged.getKey(0))
 	case mergeDir == 0 && updated.nkeys() == 0:
 		assert(node.nkeys() == 1 && idx == 0) // 1 empty child but no sibling
 		new.setHeader(BNODE_NODE, 0)          // the parent becomes empty too
+		nodeFree(updated)
 	case mergeDir == 0 && updated.nkeys() > 0: // no merge
 		nodeReplaceKidN(tree, new, node, idx, updated)
 	}
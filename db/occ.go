@@ -0,0 +1,99 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+)
+
+var ErrConflict = errors.New("transaction conflict")
+
+// the optimistic concurrency control of the transactions. a Tx keeps the
+// keys and the ranges it has read, and the KV keeps the ones updated
+// since the oldest open Tx began. a Tx can only commit if none of its
+// reads were updated meanwhile, so it's as if it ran alone at its commit:
+// the transactions are serializable. nothing is kept without an open Tx.
+
+// a key, or the keys in [lo, hi), a nil hi means to the end.
+type keySpan struct {
+	lo, hi []byte
+	point  bool
+}
+
+func spansOverlap(cmp func(a, b []byte) int, a, b keySpan) bool {
+	switch {
+	case a.point && b.point:
+		return cmp(a.lo, b.lo) == 0
+	case a.point:
+		return cmp(a.lo, b.lo) >= 0 && (b.hi == nil || cmp(a.lo, b.hi) < 0)
+	case b.point:
+		return spansOverlap(cmp, b, a)
+	}
+	return (a.hi == nil || cmp(b.lo, a.hi) < 0) && (b.hi == nil || cmp(a.lo, b.hi) < 0)
+}
+
+// an update, numbered in the order of the updates.
+type occWrite struct {
+	seq  uint64
+	span keySpan
+}
+
+// a Tx begins after the updates up to the returned number.
+func occBegin(db *KV) uint64 {
+	if db.occ.active == nil {
+		db.occ.active = map[uint64]int{}
+	}
+	db.occ.active[db.occ.seq]++
+	return db.occ.seq
+}
+
+// the end of a Tx, the updates no open Tx can conflict with are dropped.
+func occEnd(db *KV, seq uint64) {
+	db.occ.active[seq]--
+	if db.occ.active[seq] > 0 {
+		return
+	}
+	delete(db.occ.active, seq)
+	oldest := db.occ.seq
+	for seq := range db.occ.active {
+		if seq < oldest {
+			oldest = seq
+		}
+	}
+	n := 0
+	for n < len(db.occ.writes) && db.occ.writes[n].seq <= oldest {
+		n++
+	}
+	db.occ.writes = db.occ.writes[n:]
+	if len(db.occ.writes) == 0 {
+		db.occ.writes = nil // not to keep the keys of a large batch
+	}
+}
+
+// keep an update for the open transactions.
+func occRecord(db *KV, span keySpan) {
+	if len(db.occ.active) == 0 {
+		return
+	}
+	span.lo = append([]byte(nil), span.lo...)
+	if span.hi != nil {
+		span.hi = append([]byte(nil), span.hi...)
+	}
+	db.occ.seq++
+	db.occ.writes = append(db.occ.writes, occWrite{db.occ.seq, span})
+}
+
+// the first read of a Tx updated since it began.
+func occCheck(db *KV, since uint64, reads []keySpan) error {
+	cmp := db.tree.keyCmp()
+	for _, w := range db.occ.writes {
+		if w.seq <= since {
+			continue
+		}
+		for _, r := range reads {
+			if spansOverlap(cmp, w.span, r) {
+				return fmt.Errorf("%w: %q was updated", ErrConflict, r.lo)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,196 @@
+package db
+
+import (
+	"fmt"
+	"time"
+)
+
+// Options are the knobs of a KV, set before KV.Open or given to Open.
+// the page size is fixed at BTREE_PAGE_SIZE.
+type Options struct {
+	CacheSize   int   // number of pages kept in the page cache, 0 disables it
+	Compression uint8 // COMPRESS_*, can only be turned on for a new DB
+	CompressMin int   // smallest value to compress, default COMPRESS_MIN_SIZE
+	// the values shorter than this use the shared dictionary once there is
+	// one, default COMPRESS_DICT_MAX. see KV.TrainDict.
+	CompressDictMax int
+	// encrypt every page with a key derived from this,
+	// can only be set for a new DB and is required to reopen it.
+	EncryptionKey []byte
+	// bits per key of the bloom filter, 0 disables it. ~10 gives 1% false positives.
+	BloomBitsPerKey int
+	// optional, gets debug records about splits, merges and commits
+	Logger Logger
+	// operations taking at least this long are logged as warnings, 0 disables it
+	SlowOpThreshold time.Duration
+	// the filesystem, nil for the OS one
+	FS VFS
+	// the file must exist and updates fail with ErrReadOnly
+	ReadOnly bool
+	// skip fsync, a crash can lose or corrupt recent commits
+	NoSync bool
+	// bypass the OS page cache with O_DIRECT, Linux only. pages are read
+	// with pread instead of the mmap, so CacheSize is the only cache.
+	DirectIO bool
+	// read the pages with pread instead of the mmap, through the OS page
+	// cache unlike DirectIO. a failing read is then an error, not a SIGBUS,
+	// and the address space stays small.
+	NoMmap bool
+	// the order of the keys, Bytewise if nil. it's kept in the DB.
+	Comparator Comparator
+	// the engine of a new database for OpenEngine, ENGINE_*
+	Engine uint8
+	// buffer updates in a memtable of about this many bytes, backed by a
+	// log, and merge them into the tree in one commit. 0 commits every update.
+	MemtableSize int
+	// also merge the buffer once the log has this many bytes, or once
+	// this long has passed since the last merge. 0 disables them.
+	WALMaxSize         int
+	CheckpointInterval time.Duration
+	// combines a value with the operands of KV.Merge, not kept in the DB
+	MergeOperator MergeOperator
+	// how the free pages are reused, ALLOC_*
+	AllocPolicy uint8
+	// the leaves prefetched ahead of a scan, 0 disables it. not with DirectIO.
+	ReadAhead int
+	// limit the writes (Set, Del, DeleteRange, DefragStep, Tx commits)
+	// per second, and the bytes of their keys and values, 0 is unlimited.
+	// a write waits for its turn in the call, with the caller's locks.
+	WriteRate      int
+	WriteBytesRate int
+	// the unmerged write buffer and dirty pages, in bytes, from which
+	// KV.Backpressure is reported. 0 disables it.
+	WriteBacklog int
+	// the bytes of the caches and the buffers, see KV.MemoryStats.
+	// 0 is unlimited.
+	MemoryBudget int
+}
+
+// the options used by Open before applying its arguments.
+func DefaultOptions() Options {
+	return Options{CacheSize: 256, ReadAhead: 8}
+}
+
+type Option func(*Options)
+
+func WithCacheSize(pages int) Option {
+	return func(o *Options) { o.CacheSize = pages }
+}
+
+func WithCompression(codec uint8) Option {
+	return func(o *Options) { o.Compression = codec }
+}
+
+func WithCompressMin(size int) Option {
+	return func(o *Options) { o.CompressMin = size }
+}
+
+func WithCompressDictMax(size int) Option {
+	return func(o *Options) { o.CompressDictMax = size }
+}
+
+func WithEncryptionKey(key []byte) Option {
+	return func(o *Options) { o.EncryptionKey = key }
+}
+
+func WithBloomFilter(bitsPerKey int) Option {
+	return func(o *Options) { o.BloomBitsPerKey = bitsPerKey }
+}
+
+func WithLogger(logger Logger) Option {
+	return func(o *Options) { o.Logger = logger }
+}
+
+func WithSlowOpThreshold(d time.Duration) Option {
+	return func(o *Options) { o.SlowOpThreshold = d }
+}
+
+func WithFS(fs VFS) Option {
+	return func(o *Options) { o.FS = fs }
+}
+
+func WithReadOnly() Option {
+	return func(o *Options) { o.ReadOnly = true }
+}
+
+func WithNoSync() Option {
+	return func(o *Options) { o.NoSync = true }
+}
+
+func WithDirectIO() Option {
+	return func(o *Options) { o.DirectIO = true }
+}
+
+func WithNoMmap() Option {
+	return func(o *Options) { o.NoMmap = true }
+}
+
+func WithComparator(cmp Comparator) Option {
+	return func(o *Options) { o.Comparator = cmp }
+}
+
+func WithEngine(engine uint8) Option {
+	return func(o *Options) { o.Engine = engine }
+}
+
+func WithMemtable(size int) Option {
+	return func(o *Options) { o.MemtableSize = size }
+}
+
+func WithWALMaxSize(size int) Option {
+	return func(o *Options) { o.WALMaxSize = size }
+}
+
+func WithCheckpointInterval(d time.Duration) Option {
+	return func(o *Options) { o.CheckpointInterval = d }
+}
+
+func WithMergeOperator(merge MergeOperator) Option {
+	return func(o *Options) { o.MergeOperator = merge }
+}
+
+func WithAllocPolicy(policy uint8) Option {
+	return func(o *Options) { o.AllocPolicy = policy }
+}
+
+func WithReadAhead(leaves int) Option {
+	return func(o *Options) { o.ReadAhead = leaves }
+}
+
+func WithWriteRate(writes, bytes int) Option {
+	return func(o *Options) { o.WriteRate, o.WriteBytesRate = writes, bytes }
+}
+
+func WithWriteBacklog(size int) Option {
+	return func(o *Options) { o.WriteBacklog = size }
+}
+
+func WithMemoryBudget(size int) Option {
+	return func(o *Options) { o.MemoryBudget = size }
+}
+
+func applyOptions(opts []Option) Options {
+	o := DefaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// Open opens or creates the database at path with the DefaultOptions
+// changed by opts.
+func Open(path string, opts ...Option) (*KV, error) {
+	db := &KV{Path: path, Options: applyOptions(opts)}
+	if err := db.Open(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// updates are refused on a read-only DB.
+func checkWritable(db *KV) error {
+	if db.ReadOnly {
+		return fmt.Errorf("%w: %s", ErrReadOnly, db.Path)
+	}
+	return nil
+}
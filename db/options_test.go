@@ -0,0 +1,33 @@
+package db
+
+import (
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestOpen_Options(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	_, err := Open(path, WithReadOnly())
+	testify_assert.Error(t, err) // the file must exist
+
+	db, err := Open(path, WithNoSync(), WithCompression(COMPRESS_SNAPPY))
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, 256, db.CacheSize)
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	testify_assert.Equal(t, uint64(0), db.Stats().Fsyncs)
+	db.Close()
+
+	db, err = Open(path, WithReadOnly(), WithCacheSize(0))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.Equal(t, 0, db.CacheSize)
+	val, ok, err := db.Get([]byte("k"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "v", string(val))
+	testify_assert.ErrorIs(t, db.Set([]byte("k"), []byte("v2")), ErrReadOnly)
+	_, err = db.Del([]byte("k"))
+	testify_assert.ErrorIs(t, err, ErrReadOnly)
+}
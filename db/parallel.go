@@ -0,0 +1,146 @@
+package db
+
+import "sync"
+
+// KeyRange is the keys in [Start, End), a nil End means to the end.
+type KeyRange struct {
+	Start, End []byte
+}
+
+// SplitRange divides [lo, hi) into at most n parts with about as many
+// keys, to scan them in parallel, see ScanParallel. the levels of the
+// tree are read from the root down until one has enough keys in the
+// range to split it: the subtrees of a level have the same height, so
+// they are estimated to hold the same number of keys. the parts are in
+// key order, there are fewer of them for a small range.
+func (db *KV) SplitRange(lo, hi []byte, n int) (parts []KeyRange, err error) {
+	defer catchPageError(&err)
+	if hi != nil && db.tree.keyCmp()(lo, hi) >= 0 {
+		return nil, nil
+	}
+	var bounds [][]byte
+	if n > 1 && db.tree.root != 0 {
+		bounds = treeSplitKeys(&db.tree, lo, hi, n)
+	}
+	start := lo
+	for _, key := range bounds {
+		parts = append(parts, KeyRange{start, key})
+		start = key
+	}
+	return append(parts, KeyRange{start, hi}), nil
+}
+
+// the keys in (lo, hi) of the first level that has at least n-1 of them,
+// or of the leaves, n-1 of them evenly spaced.
+func treeSplitKeys(tree *BTree, lo, hi []byte, n int) [][]byte {
+	cmp := tree.keyCmp()
+	inside := func(key []byte) bool {
+		return len(key) > 0 && cmp(key, lo) > 0 && (hi == nil || cmp(key, hi) < 0)
+	}
+	level := []BNode{tree.get(tree.root)}
+	for {
+		var keys [][]byte
+		for _, node := range level {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				if key := node.getKey(i); inside(key) {
+					keys = append(keys, key)
+				}
+			}
+		}
+		if len(keys) >= n-1 || level[0].btype() == BNODE_LEAF {
+			return splitPick(keys, n)
+		}
+		// down to the kids overlapping the range
+		var next []BNode
+		for _, node := range level {
+			for i := uint16(0); i < node.nkeys(); i++ {
+				// the last kid may end before lo, it's read for nothing
+				if i+1 < node.nkeys() && cmp(node.getKey(i+1), lo) <= 0 {
+					continue
+				}
+				if hi != nil && cmp(node.getKey(i), hi) >= 0 {
+					break
+				}
+				next = append(next, tree.get(node.getPtr(i)))
+			}
+		}
+		level = next
+	}
+}
+
+// n-1 of the keys, evenly spaced, copied out of the pages.
+func splitPick(keys [][]byte, n int) [][]byte {
+	m := len(keys)
+	var picked [][]byte
+	for j := 1; j < n && j <= m; j++ {
+		i := j - 1
+		if m >= n-1 {
+			i = j*(m+1)/n - 1
+		}
+		picked = append(picked, append([]byte(nil), keys[i]...))
+	}
+	return picked
+}
+
+// ScanParallel folds the KVs of [lo, hi) in n goroutines, one per part of
+// SplitRange. each one calls fn on the KVs of its part in key order,
+// starting from the zero T, then the results of the parts are combined
+// in key order with merge. fn is called concurrently.
+//
+// the pages are read without the page cache, the parts don't share
+// anything. the KV must not be used by others until it returns.
+func ScanParallel[T any](db *KV, lo, hi []byte, n int,
+	fn func(acc T, key, val []byte) T, merge func(a, b T) T) (result T, err error) {
+	snap, err := db.Snapshot()
+	if err != nil {
+		return result, err
+	}
+	defer snap.Close()
+	parts, err := db.SplitRange(lo, hi, n)
+	if err != nil {
+		return result, err
+	}
+	results := make([]T, len(parts))
+	errs := make([]error, len(parts))
+	var wg sync.WaitGroup
+	for i := range parts {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = scanPart(snap, parts[i], fn)
+		}(i)
+	}
+	wg.Wait()
+	for i := range parts {
+		if errs[i] != nil {
+			return result, errs[i]
+		}
+		if i == 0 {
+			result = results[i]
+		} else {
+			result = merge(result, results[i])
+		}
+	}
+	return result, nil
+}
+
+// scan a part of a snapshot without the page cache, the pins and the
+// counters of the KV, which are not safe for concurrent use.
+func scanPart[T any](s *Snapshot, part KeyRange, fn func(acc T, key, val []byte) T) (acc T, err error) {
+	defer catchPageError(&err)
+	db := s.db
+	view := &Snapshot{db: db, tree: BTree{root: s.tree.root, get: db.pageRead, cmp: s.tree.cmp}, mem: s.mem}
+	it := &Iter{snap: view, tree: treeSeek(&view.tree, part.Start)}
+	if s.mem != nil {
+		it.mem = s.mem.seek(part.Start)
+	}
+	it.settle()
+	cmp := view.tree.keyCmp()
+	for ; it.Valid(); it.Next() {
+		if part.End != nil && cmp(it.Key(), part.End) >= 0 {
+			break
+		}
+		acc = fn(acc, it.Key(), it.Val())
+	}
+	return acc, it.Err()
+}
@@ -0,0 +1,80 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_SplitRange(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	parts, err := db.SplitRange(nil, nil, 4)
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, []KeyRange{{nil, nil}}, parts)
+
+	for i := 0; i < 5000; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%05d", i)), []byte("value")))
+	}
+	count := func(r KeyRange) int {
+		n := 0
+		db.Scan(r.Start, func(key, val []byte) bool {
+			if r.End != nil && string(key) >= string(r.End) {
+				return false
+			}
+			n++
+			return true
+		})
+		return n
+	}
+	for _, r := range []KeyRange{{nil, nil}, {[]byte("k01000"), []byte("k03000")}} {
+		parts, err = db.SplitRange(r.Start, r.End, 4)
+		testify_assert.NoError(t, err)
+		testify_assert.Len(t, parts, 4)
+		testify_assert.Equal(t, r.Start, parts[0].Start)
+		testify_assert.Equal(t, r.End, parts[3].End)
+		total := count(r)
+		for i, part := range parts {
+			if i > 0 {
+				testify_assert.Equal(t, parts[i-1].End, part.Start)
+			}
+			n := count(part)
+			testify_assert.InDelta(t, total/4, n, float64(total/8), "part %d", i)
+		}
+	}
+
+	// fewer keys than parts
+	parts, err = db.SplitRange([]byte("k00010"), []byte("k00013"), 8)
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, []KeyRange{
+		{[]byte("k00010"), []byte("k00011")},
+		{[]byte("k00011"), []byte("k00012")},
+		{[]byte("k00012"), []byte("k00013")},
+	}, parts)
+}
+
+func TestScanParallel(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithNoSync(), WithCompression(COMPRESS_SNAPPY))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	var want []string
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("k%05d", i)
+		testify_assert.NoError(t, db.Set([]byte(key), []byte("value")))
+		if key >= "k00100" {
+			want = append(want, key)
+		}
+	}
+	keys, err := ScanParallel(db, []byte("k00100"), nil, 4,
+		func(acc []string, key, val []byte) []string {
+			testify_assert.Equal(t, []byte("value"), val)
+			return append(acc, string(key))
+		},
+		func(a, b []string) []string { return append(a, b...) })
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, want, keys)
+	testify_assert.Empty(t, db.pins)
+}
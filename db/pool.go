@@ -0,0 +1,34 @@
+package db
+
+import "sync"
+
+// node buffers are recycled to take the allocations off the write path.
+// every buffer is 2 pages, the size treeInsert needs for an oversized node.
+//
+// ownership rules:
+//   - a node from nodeAlloc belongs to whoever holds it. passing it to
+//     tree.new hands it over to the page store.
+//   - the owner calls nodeFree once nothing can reach the node anymore.
+//   - nodes from tree.get belong to the page store and are never freed here.
+type nodeBuf = [2 * BTREE_PAGE_SIZE]byte
+
+var nodePool = sync.Pool{
+	New: func() any { return new(nodeBuf) },
+}
+
+// get a zeroed node buffer of `size` bytes.
+func nodeAlloc(size int) BNode {
+	assert(size <= 2*BTREE_PAGE_SIZE)
+	buf := nodePool.Get().(*nodeBuf)
+	return BNode{data: buf[:size]}
+}
+
+// return a node buffer to the pool. foreign buffers are ignored.
+func nodeFree(node BNode) {
+	if cap(node.data) != 2*BTREE_PAGE_SIZE {
+		return
+	}
+	buf := (*nodeBuf)(node.data[:2*BTREE_PAGE_SIZE])
+	*buf = nodeBuf{}
+	nodePool.Put(buf)
+}
@@ -0,0 +1,98 @@
+package db
+
+import "sync/atomic"
+
+// the last commit, published for the lock-free readers, see BeginRead.
+// the KV replaces it after each commit, it never changes.
+type readView struct {
+	root    uint64
+	version uint64 // see KV.free
+	flushed uint64
+	chunks  [][]byte // the mmap of the commit, it's only ever extended
+	readers atomic.Int64
+}
+
+// publish the current version, on open and after a commit, before its
+// freed pages are released. the older views are kept while they are read.
+func viewPublish(db *KV) {
+	v := &readView{
+		root: db.tree.root, version: db.free.version,
+		flushed: db.page.flushed, chunks: db.mmap.chunks,
+	}
+	db.view.Store(v)
+	views := db.views[:0]
+	for _, old := range db.views {
+		if old.readers.Load() > 0 {
+			views = append(views, old)
+		}
+	}
+	db.views = append(views, v)
+}
+
+// ReadTx is a read of the last commit that takes no lock, from BeginRead.
+type ReadTx struct {
+	db   *KV
+	view *readView
+	tree BTree
+	done bool
+}
+
+// BeginRead starts a read of the last commit that can run while the KV
+// is being updated by another goroutine, and with the other reads: it
+// shares nothing the updates change. the published root is loaded
+// atomically, and its pages are not reused until the read is closed.
+// the pages are read through the mmap, without the page cache and the
+// bloom filter, and the buffered updates are not seen, see
+// Options.MemtableSize.
+//
+// a ReadTx itself is used by one goroutine at a time. it must be closed,
+// before the KV.
+func (db *KV) BeginRead() *ReadTx {
+	var v *readView
+	for {
+		v = db.view.Load().(*readView)
+		v.readers.Add(1)
+		if db.view.Load() == v {
+			break
+		}
+		// replaced meanwhile, its pages may already be reused
+		v.readers.Add(-1)
+	}
+	r := &ReadTx{db: db, view: v}
+	r.tree = BTree{root: v.root, cmp: db.tree.cmp, get: func(ptr uint64) BNode {
+		return pageReadIn(db, v.chunks, v.flushed, ptr)
+	}}
+	return r
+}
+
+func (r *ReadTx) Get(key []byte) (val []byte, ok bool, err error) {
+	defer catchPageError(&err)
+	if r.done {
+		return nil, false, ErrClosed
+	}
+	val, ok = r.tree.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return decodeValue(r.db, val), true, nil
+}
+
+// call fn on every KV with key >= start in key order until it returns false.
+func (r *ReadTx) Scan(start []byte, fn func(key, val []byte) bool) (err error) {
+	defer catchPageError(&err)
+	if r.done {
+		return ErrClosed
+	}
+	treeScan(&r.tree, start, func(key, val []byte) bool {
+		return fn(key, decodeValue(r.db, val))
+	})
+	return nil
+}
+
+// Close lets the KV reuse the pages of the read.
+func (r *ReadTx) Close() {
+	if !r.done {
+		r.done = true
+		r.view.readers.Add(-1)
+	}
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_BeginRead(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set(snapKey(i), []byte("old")))
+	}
+	r := db.BeginRead()
+	// the pages of the read are not reused by the updates
+	for i := 0; i < 1000; i++ {
+		testify_assert.NoError(t, db.Set(snapKey(i), []byte("new")))
+	}
+	testify_assert.NoError(t, db.DeleteRange(snapKey(500), nil))
+	n := 0
+	testify_assert.NoError(t, r.Scan(nil, func(key, val []byte) bool {
+		testify_assert.Equal(t, "old", string(val))
+		n++
+		return true
+	}))
+	testify_assert.Equal(t, 1000, n)
+	val, ok, err := r.Get(snapKey(999))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, []byte("old"), val)
+	r.Close()
+	_, _, err = r.Get(snapKey(1))
+	testify_assert.ErrorIs(t, err, ErrClosed)
+
+	r = db.BeginRead()
+	defer r.Close()
+	val, _, _ = r.Get(snapKey(1))
+	testify_assert.Equal(t, []byte("new"), val)
+	_, ok, _ = r.Get(snapKey(999))
+	testify_assert.False(t, ok)
+}
+
+// the reads run while the writer commits, each one sees a single commit.
+func TestKV_BeginReadConcurrent(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	w := db.StartWriter()
+	const nkeys = 200
+	write := func(gen int) error {
+		return w.Update(func(tx *Tx) error {
+			for i := 0; i < nkeys; i++ {
+				if err := tx.Set(snapKey(i), []byte(fmt.Sprint(gen))); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	testify_assert.NoError(t, write(0))
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				testify_assert.NoError(t, w.View(func(r *ReadTx) error {
+					var gen string
+					n := 0
+					err := r.Scan(nil, func(key, val []byte) bool {
+						if n == 0 {
+							gen = string(val)
+						}
+						testify_assert.Equal(t, gen, string(val))
+						n++
+						return true
+					})
+					testify_assert.Equal(t, nkeys, n)
+					return err
+				}))
+			}
+		}()
+	}
+	for gen := 1; gen <= 50; gen++ {
+		testify_assert.NoError(t, write(gen))
+	}
+	close(done)
+	wg.Wait()
+	w.Close()
+}
@@ -0,0 +1,244 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+// RepairReport says what Repair found in the damaged file.
+type RepairReport struct {
+	Pages      uint64 // pages in the file
+	BadPages   uint64 // pages failing the checksum, decryption or decoding
+	GoodLeaves uint64 // leaves the KV pairs were salvaged from
+	Keys       uint64 // KV pairs written to the new database
+	TreeIntact bool   // the tree was fully readable, stale pages were ignored
+	MasterLost bool   // the master page was unreadable, see Repair
+}
+
+// Repair salvages the KV pairs of a damaged database file into dst,
+// an opened (usually new) KV using the comparator of src.
+// key is the encryption key of src, if any.
+//
+// the leaves reachable from the root are used first. if any part of the
+// tree is damaged, every other leaf of the file is scanned as well, last
+// page first, for the keys not found in the tree. those pages are older
+// versions of the tree, so the salvaged values may be stale and deleted
+// keys may come back. the free pages are reused, so the last page is only
+// likely to be the newest.
+//
+// if the master page is lost, the file is assumed to have the flags
+// of a new unencrypted DB.
+func Repair(src string, key []byte, dst *KV) (RepairReport, error) {
+	return RepairContext(context.Background(), src, key, dst)
+}
+
+// same as Repair, but stops with the error of ctx once it's done.
+// dst then has part of the salvaged keys.
+func RepairContext(ctx context.Context, src string, key []byte, dst *KV) (RepairReport, error) {
+	report := RepairReport{}
+	fp, err := os.Open(src)
+	if err != nil {
+		return report, fmt.Errorf("repair: %w", err)
+	}
+	defer fp.Close()
+	fi, err := fp.Stat()
+	if err != nil {
+		return report, fmt.Errorf("repair: %w", err)
+	}
+	npages := uint64(fi.Size()) / BTREE_PAGE_SIZE
+
+	// the source is read with a KV that is never opened,
+	// only its flags and codecs are set up.
+	r := &salvager{fp: fp, db: &KV{Options: Options{EncryptionKey: key}}, kvs: map[string][]byte{}}
+	r.db.tree.cmp = dst.tree.cmp
+	root, used, err := r.master()
+	if err != nil {
+		return report, fmt.Errorf("repair: %w", err)
+	}
+	report.MasterLost = r.lost
+	if !r.lost && used <= npages {
+		npages = used // the rest of the file was never written
+	}
+	report.Pages = npages
+	if err := compressInit(r.db); err != nil {
+		return report, fmt.Errorf("repair: %w", err)
+	}
+	defer func() {
+		if r.db.codec.zenc != nil {
+			_ = r.db.codec.zenc.Close()
+			r.db.codec.zdec.Close()
+		}
+		dictClose(r.db)
+	}()
+	if !r.lost && r.catalog < npages {
+		// the values compressed with a lost dictionary are dropped
+		r.db.catalog = BTree{root: r.catalog, get: r.mustRead}
+		_ = dictLoad(r.db)
+	}
+
+	seen := map[uint64]bool{}
+	intact := !r.lost
+	if root != 0 {
+		intact = r.walk(root, npages, seen)
+	}
+	report.TreeIntact = intact
+	for ptr := npages - 1; ptr >= 1 && ptr < npages; ptr-- {
+		if err := ctx.Err(); err != nil {
+			return report, fmt.Errorf("repair: %w", err)
+		}
+		node, ok := r.read(ptr)
+		if !ok {
+			if !isZero(node.data) {
+				report.BadPages++ // zeroed pages were never written
+			}
+			continue
+		}
+		if node.btype() != BNODE_LEAF {
+			continue
+		}
+		if seen[ptr] || !intact {
+			report.GoodLeaves++
+			r.collect(node)
+		}
+	}
+
+	keys := make([]string, 0, len(r.kvs))
+	for k := range r.kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := ctx.Err(); err != nil {
+			return report, fmt.Errorf("repair: %w", err)
+		}
+		if err := dst.Set([]byte(k), r.kvs[k]); err != nil {
+			return report, fmt.Errorf("repair: %w", err)
+		}
+		report.Keys++
+	}
+	return report, nil
+}
+
+type salvager struct {
+	fp      *os.File
+	db      *KV
+	lost    bool   // bad master page
+	catalog uint64 // its root, for the dictionaries
+	kvs     map[string][]byte
+}
+
+// the root and the number of pages from the master page, 0 if it is lost.
+func (r *salvager) master() (uint64, uint64, error) {
+	data := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := r.fp.ReadAt(data, 0); err != nil && err != io.EOF {
+		return 0, 0, err
+	}
+	if !bytes.Equal([]byte(DB_SIG), data[:16]) {
+		r.lost = true
+		r.db.flags = MASTER_CHECKSUMS
+		return 0, 0, nil
+	}
+	r.db.flags = binary.LittleEndian.Uint64(data[32:])
+	r.catalog = binary.LittleEndian.Uint64(data[MASTER_CATALOG_OFFSET:])
+	if r.db.flags&MASTER_ENCRYPTED != 0 {
+		// can't read any page without the salt
+		return masterUnseal(r.db, data)
+	}
+	root := binary.LittleEndian.Uint64(data[16:])
+	used := binary.LittleEndian.Uint64(data[24:])
+	return root, used, nil
+}
+
+// a page of the catalog, for a BTree of the salvager.
+func (r *salvager) mustRead(ptr uint64) BNode {
+	node, ok := r.read(ptr)
+	if !ok {
+		panic(&pageError{ptr: ptr, err: ErrChecksum})
+	}
+	return node
+}
+
+// a page that can be trusted, or false with the raw page.
+func (r *salvager) read(ptr uint64) (BNode, bool) {
+	raw := make([]byte, BTREE_PAGE_SIZE)
+	if _, err := r.fp.ReadAt(raw, int64(ptr*BTREE_PAGE_SIZE)); err != nil {
+		return BNode{raw}, false
+	}
+	page := raw
+	switch {
+	case r.db.crypt.aead != nil:
+		var err error
+		if page, err = pageOpen(r.db, ptr, raw); err != nil {
+			return BNode{raw}, false
+		}
+	case r.db.flags&MASTER_CHECKSUMS != 0:
+		if !pageVerify(ptr, raw) {
+			return BNode{raw}, false
+		}
+	}
+	node := BNode{page}
+	if nodeCheck(node, r.db.tree.keyCmp()) != nil {
+		return BNode{raw}, false
+	}
+	return node, true
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// mark the pages of the tree, reports whether all of them are readable.
+func (r *salvager) walk(ptr uint64, npages uint64, seen map[uint64]bool) bool {
+	if ptr == 0 || ptr >= npages || seen[ptr] {
+		return false
+	}
+	node, ok := r.read(ptr)
+	if !ok {
+		return false
+	}
+	seen[ptr] = true
+	intact := true
+	if node.btype() == BNODE_NODE {
+		for i := uint16(0); i < node.nkeys(); i++ {
+			intact = r.walk(node.getPtr(i), npages, seen) && intact
+		}
+	}
+	return intact
+}
+
+// add the KV pairs of a leaf, keeping the ones already found.
+func (r *salvager) collect(node BNode) {
+	for i := uint16(0); i < node.nkeys(); i++ {
+		key := node.getKey(i)
+		if len(key) == 0 {
+			continue // the dummy key
+		}
+		if _, ok := r.kvs[string(key)]; ok {
+			continue
+		}
+		val, ok := r.decode(node.getVal(i))
+		if ok {
+			r.kvs[string(key)] = val
+		}
+	}
+}
+
+// a value that fails to decompress is dropped.
+func (r *salvager) decode(stored []byte) (val []byte, ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+	return append([]byte(nil), decodeValue(r.db, stored)...), true
+}
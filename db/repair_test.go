@@ -0,0 +1,49 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestRepair(t *testing.T) {
+	src := openTestKV(t)
+	testify_assert.NoError(t, src.Set([]byte("k1"), []byte("v1")))
+	testify_assert.NoError(t, src.Set([]byte("k2"), []byte("v2")))
+	testify_assert.NoError(t, src.Set([]byte("k1"), []byte("v1b")))
+	root := src.tree.root
+	src.Close()
+
+	repair := func() (RepairReport, *KV) {
+		dst := &KV{Path: filepath.Join(t.TempDir(), "repaired.db")}
+		testify_assert.NoError(t, dst.Open())
+		t.Cleanup(dst.Close)
+		report, err := Repair(src.Path, nil, dst)
+		testify_assert.NoError(t, err)
+		return report, dst
+	}
+
+	// intact: only the tree is used
+	// the 1st leaf was freed by the 2nd commit and reused by the 3rd
+	report, dst := repair()
+	testify_assert.Equal(t, RepairReport{Pages: 3, GoodLeaves: 1, Keys: 2, TreeIntact: true}, report)
+	val, _, _ := dst.Get([]byte("k1"))
+	testify_assert.Equal(t, "v1b", string(val))
+
+	// a damaged root: the older leaves are salvaged
+	fp, err := os.OpenFile(src.Path, os.O_RDWR, 0)
+	testify_assert.NoError(t, err)
+	_, err = fp.WriteAt([]byte("garbage"), int64(root*BTREE_PAGE_SIZE+100))
+	testify_assert.NoError(t, err)
+	fp.Close()
+
+	report, dst = repair()
+	testify_assert.Equal(t, RepairReport{Pages: 3, BadPages: 1, GoodLeaves: 1, Keys: 2}, report)
+	val, _, _ = dst.Get([]byte("k1"))
+	testify_assert.Equal(t, "v1", string(val))
+	val, _, _ = dst.Get([]byte("k2"))
+	testify_assert.Equal(t, "v2", string(val))
+	testify_assert.Nil(t, dst.Check())
+}
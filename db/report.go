@@ -0,0 +1,72 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PageReport describes how well the tree uses its pages, see KV.PageReport.
+type PageReport struct {
+	Levels     []LevelReport // the root level first
+	TreePages  uint64
+	FreePages  uint64  // pages in the file not used by the tree
+	FileUsage  float64 // fraction of the file's pages used by the tree
+	FillFactor float64 // bytes used / capacity over all nodes
+}
+
+// one level of the tree
+type LevelReport struct {
+	Level       int // 0 is the root
+	Pages       uint64
+	Keys        uint64
+	UsedBytes   uint64
+	WastedBytes uint64  // unused bytes in those pages
+	FillFactor  float64 // UsedBytes / node capacity
+	AvgKeys     float64 // keys per page
+}
+
+// scan the whole tree, the cost is proportional to the number of pages.
+func (db *KV) PageReport() (r PageReport, err error) {
+	defer catchPageError(&err)
+	treeWalk(&db.tree, func(ptr uint64, node BNode, depth int) {
+		for len(r.Levels) <= depth {
+			r.Levels = append(r.Levels, LevelReport{Level: len(r.Levels)})
+		}
+		level := &r.Levels[depth]
+		level.Pages++
+		level.Keys += uint64(node.nkeys())
+		level.UsedBytes += uint64(node.nbytes())
+	})
+
+	used := uint64(0)
+	for i := range r.Levels {
+		level := &r.Levels[i]
+		capacity := level.Pages * BNODE_MAX_SIZE
+		level.WastedBytes = level.Pages*BTREE_PAGE_SIZE - level.UsedBytes
+		level.FillFactor = float64(level.UsedBytes) / float64(capacity)
+		level.AvgKeys = float64(level.Keys) / float64(level.Pages)
+		r.TreePages += level.Pages
+		used += level.UsedBytes
+	}
+	if r.TreePages > 0 {
+		r.FillFactor = float64(used) / float64(r.TreePages*BNODE_MAX_SIZE)
+	}
+	if filePages := db.page.flushed - 1; filePages > 0 { // 1: the master page
+		r.FreePages = filePages - r.TreePages
+		r.FileUsage = float64(r.TreePages) / float64(filePages)
+	}
+	return r, nil
+}
+
+func (r PageReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%-6s %8s %10s %8s %12s %12s\n",
+		"level", "pages", "keys", "fill", "avg keys", "wasted")
+	for _, l := range r.Levels {
+		fmt.Fprintf(&b, "%-6d %8d %10d %7.1f%% %12.1f %12d\n",
+			l.Level, l.Pages, l.Keys, 100*l.FillFactor, l.AvgKeys, l.WastedBytes)
+	}
+	fmt.Fprintf(&b, "tree pages: %d, free pages: %d, file usage: %.1f%%, fill: %.1f%%\n",
+		r.TreePages, r.FreePages, 100*r.FileUsage, 100*r.FillFactor)
+	return b.String()
+}
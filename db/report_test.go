@@ -0,0 +1,29 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_PageReport(t *testing.T) {
+	db := openTestKV(t)
+	r, err := db.PageReport()
+	testify_assert.NoError(t, err)
+	testify_assert.Empty(t, r.Levels)
+
+	for i := 0; i < 10; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")))
+	}
+	r, err = db.PageReport()
+	testify_assert.NoError(t, err)
+	testify_assert.Len(t, r.Levels, 1)
+	root := db.tree.get(db.tree.root)
+	testify_assert.Equal(t, uint64(1), r.Levels[0].Pages)
+	testify_assert.Equal(t, uint64(11), r.Levels[0].Keys) // with the dummy key
+	testify_assert.Equal(t, uint64(root.nbytes()), r.Levels[0].UsedBytes)
+	testify_assert.Equal(t, uint64(BTREE_PAGE_SIZE-root.nbytes()), r.Levels[0].WastedBytes)
+	testify_assert.Equal(t, db.page.flushed-2, r.FreePages)
+	testify_assert.Contains(t, r.String(), "tree pages: 1")
+}
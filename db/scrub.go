@@ -0,0 +1,127 @@
+package db
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// ScrubOptions paces the background scrubbing, see StartScrub.
+type ScrubOptions struct {
+	// guards the KV, held during each step. the KV isn't safe for
+	// concurrent use, so it must be the lock of the other users.
+	Lock sync.Locker
+	// the pause between steps, default 100ms
+	Interval time.Duration
+	// the most pages read by a step, default 16
+	Pages int
+	// optional, called under the lock for each corrupt page found
+	OnCorrupt func(ptr uint64)
+}
+
+// ScrubStep reads the next pages of the file from the disk, bypassing the
+// cache, and verifies their checksums, or their GCM tags if encrypted.
+// the free pages are skipped. the corrupt pages are logged and kept in
+// CorruptPages until they verify again, e.g. once rewritten. done is true
+// when it has gone over the whole file, the next call starts over.
+func (db *KV) ScrubStep(maxPages int) (bad []uint64, done bool, err error) {
+	if db.closed {
+		return nil, false, ErrClosed
+	}
+	if db.scrub.next == 0 {
+		db.scrub.next = 1 // the master page has no checksum
+	}
+	for n := 0; n < maxPages && db.scrub.next < db.page.flushed; db.scrub.next++ {
+		ptr := db.scrub.next
+		if _, ok := db.page.updates[ptr]; ok || db.free.pages.has(ptr) {
+			continue
+		}
+		n++
+		db.stats.scrubbed++
+		perr := scrubPage(db, ptr)
+		if perr == nil {
+			delete(db.scrub.bad, ptr)
+			continue
+		}
+		if db.scrub.bad == nil {
+			db.scrub.bad = map[uint64]bool{}
+		}
+		db.scrub.bad[ptr] = true
+		db.Logger.Warn("scrub", "page", ptr, "err", perr)
+		bad = append(bad, ptr)
+	}
+	if db.scrub.next >= db.page.flushed {
+		db.scrub.next = 0
+		db.stats.scrubPasses++
+		done = true
+	}
+	return bad, done, nil
+}
+
+// verify a page as read by pageRead, the error names the page.
+func scrubPage(db *KV, ptr uint64) (err error) {
+	defer catchPageError(&err)
+	db.pageRead(ptr)
+	return nil
+}
+
+// CorruptPages returns the pages found corrupt by the scrubbing, sorted.
+func (db *KV) CorruptPages() []uint64 {
+	bad := []uint64{}
+	for ptr := range db.scrub.bad {
+		bad = append(bad, ptr)
+	}
+	sort.Slice(bad, func(i, j int) bool { return bad[i] < bad[j] })
+	return bad
+}
+
+// StartScrub runs ScrubStep in a goroutine until stop is called, going
+// over the file again and again. it's paced by opts so that a pass reads
+// the file slowly and the foreground users are only delayed by the lock
+// held for a step. stop returns the error that ended it, if any.
+func (db *KV) StartScrub(opts ScrubOptions) (stop func() error) {
+	if opts.Interval <= 0 {
+		opts.Interval = 100 * time.Millisecond
+	}
+	if opts.Pages <= 0 {
+		opts.Pages = 16
+	}
+	quit, exited := make(chan struct{}), make(chan struct{})
+	var err error
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			opts.Lock.Lock()
+			if !db.closed {
+				var bad []uint64
+				bad, _, err = db.ScrubStep(opts.Pages)
+				for _, ptr := range bad {
+					if opts.OnCorrupt != nil {
+						opts.OnCorrupt(ptr)
+					}
+				}
+			}
+			opts.Lock.Unlock()
+			if err != nil {
+				db.Logger.Warn("scrub", "err", err)
+				return
+			}
+		}
+	}()
+	return func() error {
+		select {
+		case <-exited:
+		default:
+			close(quit)
+			<-exited
+		}
+		return err
+	}
+}
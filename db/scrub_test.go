@@ -0,0 +1,91 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_ScrubStep(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 500; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100)))
+	}
+	pages := uint64(0)
+	treePages(&db.tree, func(uint64) { pages++ })
+
+	// a clean pass, the free pages are skipped
+	steps := 0
+	for done := false; !done; steps++ {
+		var bad []uint64
+		var err error
+		bad, done, err = db.ScrubStep(4)
+		testify_assert.NoError(t, err)
+		testify_assert.Empty(t, bad)
+	}
+	testify_assert.Greater(t, steps, 1)
+	s := db.Stats()
+	testify_assert.Equal(t, uint64(1), s.ScrubPasses)
+	testify_assert.GreaterOrEqual(t, s.ScrubbedPages, pages)
+	testify_assert.Less(t, s.ScrubbedPages, db.page.flushed-1)
+
+	// a damaged page on the disk, behind the cache
+	leaf := db.tree.get(db.tree.root).getPtr(1)
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	testify_assert.NoError(t, err)
+	defer fp.Close()
+	orig := make([]byte, 7)
+	_, err = fp.ReadAt(orig, int64(leaf*BTREE_PAGE_SIZE+100))
+	testify_assert.NoError(t, err)
+	_, err = fp.WriteAt([]byte("garbage"), int64(leaf*BTREE_PAGE_SIZE+100))
+	testify_assert.NoError(t, err)
+	bad, done, err := db.ScrubStep(int(db.page.flushed))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, done)
+	testify_assert.Equal(t, []uint64{leaf}, bad)
+	testify_assert.Equal(t, []uint64{leaf}, db.CorruptPages())
+	testify_assert.Equal(t, uint64(1), db.Stats().CorruptPages)
+
+	// forgotten once it verifies again
+	_, err = fp.WriteAt(orig, int64(leaf*BTREE_PAGE_SIZE+100))
+	testify_assert.NoError(t, err)
+	_, _, err = db.ScrubStep(int(db.page.flushed))
+	testify_assert.NoError(t, err)
+	testify_assert.Empty(t, db.CorruptPages())
+}
+
+func TestKV_StartScrub(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 500; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("key%04d", i)), make([]byte, 100)))
+	}
+	leaf := db.tree.get(db.tree.root).getPtr(1)
+	fp, err := os.OpenFile(db.Path, os.O_RDWR, 0)
+	testify_assert.NoError(t, err)
+	_, err = fp.WriteAt([]byte("garbage"), int64(leaf*BTREE_PAGE_SIZE+100))
+	testify_assert.NoError(t, err)
+	fp.Close()
+
+	var mu sync.Mutex
+	found := make(chan uint64, 1)
+	stop := db.StartScrub(ScrubOptions{Lock: &mu, Interval: time.Millisecond, Pages: 2,
+		OnCorrupt: func(ptr uint64) {
+			select {
+			case found <- ptr:
+			default: // found again by the next passes
+			}
+		}})
+	select {
+	case ptr := <-found:
+		testify_assert.Equal(t, leaf, ptr)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the corrupt page is not found")
+	}
+	testify_assert.NoError(t, stop())
+	testify_assert.NoError(t, stop())
+	testify_assert.Equal(t, []uint64{leaf}, db.CorruptPages())
+}
@@ -0,0 +1,237 @@
+package db
+
+import "errors"
+
+var ErrClosed = errors.New("use of a closed snapshot, iterator or database")
+
+// Snapshot is a read-only view of the KV as of one commit. it doesn't
+// change while the KV is updated: the pages of the commit are pinned and
+// are not reused until the snapshot and its iterators are closed.
+//
+// like the KV, snapshots are not safe for concurrent use; reads of a
+// snapshot may be interleaved with updates of the KV, but must not run
+// at the same time. they must be closed before the KV, calls after that
+// fail with ErrClosed.
+type Snapshot struct {
+	db      *KV
+	tree    BTree     // a copy with the root of the commit
+	version uint64    // of the commit, see KV.free
+	mem     *memtable // the log of a read-only DB, it never changes
+	closed  bool
+}
+
+// Snapshot pins the current version of the KV. the buffered updates are
+// committed first, see Options.MemtableSize.
+func (db *KV) Snapshot() (*Snapshot, error) {
+	if db.closed {
+		return nil, ErrClosed
+	}
+	if walBuffered(db) {
+		if err := db.Flush(); err != nil {
+			return nil, err
+		}
+	}
+	s := &Snapshot{db: db, tree: db.tree, version: db.free.version}
+	if db.ReadOnly {
+		s.mem = db.wal.mem
+	}
+	db.pin(s.version)
+	return s, nil
+}
+
+// keep the pages of a version of the tree from being reused.
+func (db *KV) pin(version uint64) {
+	if db.pins == nil {
+		db.pins = map[uint64]int{}
+	}
+	db.pins[version]++
+}
+
+func (db *KV) unpin(version uint64) {
+	db.pins[version]--
+	if db.pins[version] == 0 {
+		delete(db.pins, version)
+		freeRelease(db)
+	}
+}
+
+func (s *Snapshot) usable() error {
+	if s.closed || s.db.closed {
+		return ErrClosed
+	}
+	return nil
+}
+
+// Close releases the snapshot, its open iterators keep their pages pinned.
+func (s *Snapshot) Close() {
+	if !s.closed {
+		s.closed = true
+		s.db.unpin(s.version)
+	}
+}
+
+func (s *Snapshot) Get(key []byte) (val []byte, ok bool, err error) {
+	defer catchPageError(&err)
+	if err := s.usable(); err != nil {
+		return nil, false, err
+	}
+	if s.mem != nil {
+		if e, ok := s.mem.get(key); ok {
+			if e.deleted {
+				return nil, false, nil
+			}
+			return decodeValue(s.db, e.val), true, nil
+		}
+	}
+	val, ok = s.tree.Get(key)
+	if !ok {
+		return nil, false, nil
+	}
+	return decodeValue(s.db, val), true, nil
+}
+
+// call fn on every KV with key >= start in key order until it returns false.
+func (s *Snapshot) Scan(start []byte, fn func(key, val []byte) bool) error {
+	it := s.Iter(start)
+	defer it.Close()
+	for ; it.Valid(); it.Next() {
+		if !fn(it.Key(), it.Val()) {
+			break
+		}
+	}
+	return it.Err()
+}
+
+// Iter is a cursor over the KVs of a snapshot in key order.
+//
+//	it := snap.Iter(start)
+//	defer it.Close()
+//	for ; it.Valid(); it.Next() {
+//		use(it.Key(), it.Val())
+//	}
+//	if err := it.Err(); err != nil { ... }
+//
+// it pins the pages of the snapshot until it's closed.
+type Iter struct {
+	snap *Snapshot
+	tree *treeIter
+	mem  *memNode
+	// the current KV and where it's from
+	key, val []byte
+	decoded  bool // val is decoded on the first Val
+	fromTree bool
+	fromMem  bool
+	err      error
+	closed   bool
+	held     int64 // bytes, see MemoryStats
+}
+
+// Iter returns an iterator at the first KV with key >= start.
+// it's invalid with the error of the snapshot if that's closed.
+func (s *Snapshot) Iter(start []byte) *Iter {
+	it := &Iter{snap: s, closed: true}
+	if it.err = s.usable(); it.err != nil {
+		return it
+	}
+	it.closed = false
+	s.db.pin(s.version)
+	defer catchPageError(&it.err)
+	it.tree = treeSeek(&s.tree, start)
+	it.held = int64(len(it.tree.path)) * BTREE_PAGE_SIZE
+	s.db.mem.iters += it.held
+	if s.mem != nil {
+		it.mem = s.mem.seek(start)
+	}
+	it.settle()
+	return it
+}
+
+// the next KV from the tree or the memtable, the memtable wins a tie.
+func (it *Iter) settle() {
+	cmp := it.snap.tree.keyCmp()
+	for {
+		it.key, it.val = nil, nil
+		it.fromTree, it.fromMem = false, false
+		inTree, inMem := it.tree.valid(), it.mem != nil
+		if !inTree && !inMem {
+			return
+		}
+		c := 0
+		switch {
+		case !inMem:
+			c = -1
+		case !inTree:
+			c = +1
+		default:
+			c = cmp(it.tree.key(), it.mem.entry.key)
+		}
+		if c < 0 {
+			it.key, it.val, it.fromTree = it.tree.key(), it.tree.val(), true
+			break
+		}
+		e := it.mem.entry
+		if e.deleted {
+			it.mem = it.mem.nextNode()
+			if c == 0 {
+				it.tree.next()
+			}
+			continue
+		}
+		it.key, it.val = e.key, e.val
+		it.fromMem, it.fromTree = true, c == 0
+		break
+	}
+	it.decoded = false
+}
+
+// Valid reports whether the iterator is at a KV. it's false at the end,
+// on an error and once the iterator, the snapshot or the KV is closed.
+func (it *Iter) Valid() bool {
+	if it.err == nil && it.snap.db.closed {
+		it.err = ErrClosed
+	}
+	return it.err == nil && !it.closed && it.key != nil
+}
+
+// Key and Val are only valid until the next call to Next.
+func (it *Iter) Key() []byte {
+	return it.key
+}
+
+// the value is only decoded if it's asked for, iterating over the keys
+// alone is cheaper.
+func (it *Iter) Val() []byte {
+	if !it.decoded && it.key != nil {
+		it.val = decodeValue(it.snap.db, it.val)
+		it.decoded = true
+	}
+	return it.val
+}
+
+func (it *Iter) Next() {
+	if !it.Valid() {
+		return
+	}
+	defer catchPageError(&it.err)
+	if it.fromTree {
+		it.tree.next()
+	}
+	if it.fromMem {
+		it.mem = it.mem.nextNode()
+	}
+	it.settle()
+}
+
+// Err is the error that stopped the iteration, if any.
+func (it *Iter) Err() error {
+	return it.err
+}
+
+// Close unpins the pages, the iterator is invalid after that.
+func (it *Iter) Close() {
+	if !it.closed {
+		it.closed = true
+		it.snap.db.mem.iters -= it.held
+		it.snap.db.unpin(it.snap.version)
+	}
+}
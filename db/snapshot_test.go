@@ -0,0 +1,149 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func snapKey(i int) []byte {
+	return []byte(fmt.Sprintf("key%04d", i))
+}
+
+// an iterator keeps returning the snapshot while the KV is updated
+// between its steps. there are enough keys to cross many leaves.
+func TestSnapshot_Iter(t *testing.T) {
+	db := openTestKV(t)
+	db.NoSync = true
+	val := strings.Repeat("v", 100)
+	for i := 0; i < 1000; i += 2 {
+		testify_assert.NoError(t, db.Set(snapKey(i), []byte(val)))
+	}
+	snap, err := db.Snapshot()
+	testify_assert.NoError(t, err)
+	defer snap.Close()
+
+	it := snap.Iter(snapKey(101))
+	n := 102
+	for ; it.Valid(); it.Next() {
+		testify_assert.Equal(t, string(snapKey(n)), string(it.Key()))
+		testify_assert.Equal(t, val, string(it.Val()))
+		// new keys, updates and deletes around the position
+		testify_assert.NoError(t, db.Set(snapKey(n-1), []byte("updated")))
+		testify_assert.NoError(t, db.Set(snapKey(n+1), []byte("new")))
+		_, err := db.Del(snapKey(n + 2))
+		testify_assert.NoError(t, err)
+		n += 2
+	}
+	testify_assert.NoError(t, it.Err())
+	testify_assert.Equal(t, 1000, n)
+	it.Close()
+
+	got, ok, err := snap.Get(snapKey(104))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, val, string(got))
+	_, ok, _ = db.Get(snapKey(104))
+	testify_assert.False(t, ok)
+	_, ok, _ = snap.Get(snapKey(103))
+	testify_assert.False(t, ok)
+	got, _, _ = snap.Get(snapKey(102))
+	testify_assert.Equal(t, val, string(got))
+}
+
+func TestSnapshot_Lifetime(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithMemtable(1<<20))
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, db.Set([]byte("k1"), []byte("v1")))
+
+	// the buffered update is committed first
+	snap, err := db.Snapshot()
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, db.Set([]byte("k2"), []byte("v2")))
+	keys := []string{}
+	testify_assert.NoError(t, snap.Scan(nil, func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	testify_assert.Equal(t, []string{"k1"}, keys)
+
+	// the iterator pins the pages after the snapshot is closed
+	it := snap.Iter(nil)
+	snap.Close()
+	testify_assert.Len(t, db.pins, 1)
+	_, _, err = snap.Get([]byte("k1"))
+	testify_assert.ErrorIs(t, err, ErrClosed)
+	testify_assert.ErrorIs(t, snap.Iter(nil).Err(), ErrClosed)
+	testify_assert.True(t, it.Valid())
+	it.Close()
+	testify_assert.False(t, it.Valid())
+	testify_assert.Empty(t, db.pins)
+
+	// everything fails once the KV is closed
+	snap, err = db.Snapshot()
+	testify_assert.NoError(t, err)
+	it = snap.Iter(nil)
+	db.Close()
+	testify_assert.False(t, it.Valid())
+	testify_assert.ErrorIs(t, it.Err(), ErrClosed)
+	_, _, err = snap.Get([]byte("k1"))
+	testify_assert.ErrorIs(t, err, ErrClosed)
+	_, err = db.Snapshot()
+	testify_assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestKV_NamedSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	for i := 0; i < 300; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v1")))
+	}
+	testify_assert.NoError(t, db.CreateSnapshot("v1"))
+	testify_assert.ErrorIs(t, db.CreateSnapshot("v1"), ErrSnapshotExists)
+	for i := 0; i < 300; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v2")))
+	}
+	db.Close()
+
+	// it survives, and its pages are not reused
+	db, err = Open(path, WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 300; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v3")))
+	}
+	list, err := db.Snapshots()
+	testify_assert.NoError(t, err)
+	testify_assert.Len(t, list, 1)
+	testify_assert.Equal(t, "v1", list[0].Name)
+	testify_assert.WithinDuration(t, time.Now(), list[0].Created, time.Minute)
+
+	snap, err := db.OpenSnapshot("v1")
+	testify_assert.NoError(t, err)
+	n := 0
+	testify_assert.NoError(t, snap.Scan(nil, func(key, val []byte) bool {
+		testify_assert.Equal(t, "v1", string(val))
+		n++
+		return true
+	}))
+	testify_assert.Equal(t, 300, n)
+	val, _, _ := db.Get([]byte("k000"))
+	testify_assert.Equal(t, "v3", string(val))
+
+	// dropped while open: the pages are reused once it's closed
+	reusable := db.free.pages.count
+	testify_assert.NoError(t, db.DropSnapshot("v1"))
+	testify_assert.ErrorIs(t, db.DropSnapshot("v1"), ErrNoSnapshot)
+	_, err = db.OpenSnapshot("v1")
+	testify_assert.ErrorIs(t, err, ErrNoSnapshot)
+	val, _, _ = snap.Get([]byte("k299"))
+	testify_assert.Equal(t, "v1", string(val))
+	snap.Close()
+	testify_assert.Greater(t, db.free.pages.count, reusable)
+	testify_assert.NoError(t, db.Verify())
+}
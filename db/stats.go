@@ -0,0 +1,252 @@
+package db
+
+import "time"
+
+// Stats is a snapshot of the internal counters, see KV.Stats.
+type Stats struct {
+	// tree shape
+	Height        int
+	LeafPages     uint64
+	InternalPages uint64
+	FreePages     uint64 // pages in the file no longer used by the tree
+	ReusablePages uint64 // free pages that can be reused now
+	AllocPolicy   string // how they are reused, see ALLOC_*
+	// space
+	FileBytes  uint64 // size of the file
+	AllocBytes uint64 // pages holding tree nodes
+	UsedBytes  uint64 // bytes of those pages actually used by the nodes
+	// caches
+	Cache         CacheStats
+	Memory        MemoryStats
+	CacheHitRatio float64 // 0 if the cache is disabled or unused
+	BloomRejects  uint64  // Gets answered by the bloom filter alone
+	Prefetches    uint64  // pages read ahead of the scans, see Options.ReadAhead
+	// pages verified by the scrubbing, the passes over the whole file,
+	// and the pages found corrupt. see KV.StartScrub
+	ScrubbedPages uint64
+	ScrubPasses   uint64
+	CorruptPages  uint64
+	// activity since Open
+	Gets    uint64
+	Sets    uint64
+	Dels    uint64
+	Commits uint64 // every Set or Del is committed on its own, unless buffered
+	// merges of the write buffer into the tree, and the size of its log
+	Checkpoints uint64
+	WALBytes    uint64
+	Fsyncs      uint64
+	// writes delayed by Options.WriteRate, and the time they waited
+	Throttled    uint64
+	ThrottleWait time.Duration
+	// time spent writing and syncing each commit
+	CommitLatency Histogram
+	// sizes of the keys and the values given to Set since Open, before
+	// compression. see KV.AnalyzeSizes for the whole DB as stored.
+	KeySizes   SizeHistogram
+	ValueSizes SizeHistogram
+}
+
+// upper bounds of the latency histogram buckets
+var latencyBuckets = []time.Duration{
+	100 * time.Microsecond, 250 * time.Microsecond, 500 * time.Microsecond,
+	1 * time.Millisecond, 2500 * time.Microsecond, 5 * time.Millisecond,
+	10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	1 * time.Second,
+}
+
+// Histogram counts durations into latencyBuckets.
+// Counts[i] is the number of observations <= Bounds[i], the last count
+// is for the observations above every bound.
+type Histogram struct {
+	Bounds []time.Duration
+	Counts []uint64
+	Count  uint64
+	Sum    time.Duration
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	if h.Counts == nil {
+		h.Bounds = latencyBuckets
+		h.Counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	i := 0
+	for i < len(h.Bounds) && d > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += d
+}
+
+func (h Histogram) clone() Histogram {
+	if h.Counts == nil {
+		h.Bounds = latencyBuckets
+		h.Counts = make([]uint64, len(latencyBuckets)+1)
+	}
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// upper bounds of the size histogram buckets in bytes,
+// up to the page size as no KV is bigger.
+var sizeBuckets = []int{16, 32, 64, 128, 256, 512, 1024, 2048, BTREE_PAGE_SIZE}
+
+// SizeHistogram counts sizes into sizeBuckets, like Histogram.
+type SizeHistogram struct {
+	Bounds []int
+	Counts []uint64
+	Count  uint64
+	Sum    uint64
+}
+
+func (h *SizeHistogram) observe(size int) {
+	if h.Counts == nil {
+		h.Bounds = sizeBuckets
+		h.Counts = make([]uint64, len(sizeBuckets)+1)
+	}
+	i := 0
+	for i < len(h.Bounds) && size > h.Bounds[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Count++
+	h.Sum += uint64(size)
+}
+
+func (h SizeHistogram) clone() SizeHistogram {
+	if h.Counts == nil {
+		h.Bounds = sizeBuckets
+		h.Counts = make([]uint64, len(sizeBuckets)+1)
+	}
+	h.Counts = append([]uint64(nil), h.Counts...)
+	return h
+}
+
+// AnalyzeSizes reads every leaf and returns the histograms of the key
+// and value sizes as stored, i.e. after compression and encoding.
+// the buffered updates are not included.
+func (db *KV) AnalyzeSizes() (keys, vals SizeHistogram, err error) {
+	defer catchPageError(&err)
+	keys, vals = keys.clone(), vals.clone()
+	treeWalk(&db.tree, func(ptr uint64, node BNode, depth int) {
+		if node.btype() != BNODE_LEAF {
+			return
+		}
+		for i := uint16(0); i < node.nkeys(); i++ {
+			key := node.getKey(i)
+			if len(key) == 0 {
+				continue // the dummy key
+			}
+			keys.observe(len(key))
+			vals.observe(len(node.getVal(i)))
+		}
+	})
+	return keys, vals, nil
+}
+
+// counters maintained by the KV
+type kvStats struct {
+	gets, sets, dels uint64
+	commits, fsyncs  uint64
+	checkpoints      uint64
+	throttled        uint64
+	throttleWait     time.Duration
+	bloomRejects     uint64
+	prefetches       uint64
+	scrubbed         uint64
+	scrubPasses      uint64
+	commitLatency    Histogram
+	keySizes         SizeHistogram
+	valSizes         SizeHistogram
+	// the tree shape is counted by a full walk on the first Stats call,
+	// then kept up to date by the page callbacks.
+	shape struct {
+		known    bool
+		leaf     uint64
+		internal uint64
+		used     uint64 // sum of node sizes
+	}
+}
+
+func (db *KV) Stats() Stats {
+	s := Stats{
+		FileBytes:     uint64(db.mmap.file),
+		ReusablePages: db.free.pages.count,
+		AllocPolicy:   allocPolicyName(db.AllocPolicy),
+		Cache:         db.CacheStats(),
+		Memory:        db.MemoryStats(),
+		BloomRejects:  db.stats.bloomRejects,
+		Prefetches:    db.stats.prefetches,
+		ScrubbedPages: db.stats.scrubbed,
+		ScrubPasses:   db.stats.scrubPasses,
+		CorruptPages:  uint64(len(db.scrub.bad)),
+		Gets:          db.stats.gets,
+		Sets:          db.stats.sets,
+		Dels:          db.stats.dels,
+		Commits:       db.stats.commits,
+		Checkpoints:   db.stats.checkpoints,
+		WALBytes:      uint64(db.wal.size),
+		Fsyncs:        db.stats.fsyncs,
+		Throttled:     db.stats.throttled,
+		ThrottleWait:  db.stats.throttleWait,
+		CommitLatency: db.stats.commitLatency.clone(),
+		KeySizes:      db.stats.keySizes.clone(),
+		ValueSizes:    db.stats.valSizes.clone(),
+	}
+	if err := statsTree(db, &s); err != nil {
+		db.Logger.Warn("stats: bad tree", "err", err)
+	}
+	nodes := s.LeafPages + s.InternalPages
+	s.AllocBytes = nodes * BTREE_PAGE_SIZE
+	if db.page.flushed > 1+nodes {
+		s.FreePages = db.page.flushed - 1 - nodes // 1: the master page
+	}
+	if lookups := s.Cache.Hits + s.Cache.Misses; lookups > 0 {
+		s.CacheHitRatio = float64(s.Cache.Hits) / float64(lookups)
+	}
+	return s
+}
+
+// the parts of Stats read from the tree.
+func statsTree(db *KV, s *Stats) (err error) {
+	defer catchPageError(&err)
+	if !db.stats.shape.known {
+		statsCountShape(db)
+	}
+	s.LeafPages = db.stats.shape.leaf
+	s.InternalPages = db.stats.shape.internal
+	s.UsedBytes = db.stats.shape.used
+	// follow the leftmost path, all leaves are at the same depth
+	for ptr := db.tree.root; ptr != 0; {
+		s.Height++
+		node := db.pageGet(ptr)
+		if node.btype() == BNODE_LEAF {
+			break
+		}
+		ptr = node.getPtr(0)
+	}
+	return nil
+}
+
+func statsCountShape(db *KV) {
+	shape := &db.stats.shape
+	shape.leaf, shape.internal, shape.used = 0, 0, 0
+	treeWalk(&db.tree, func(ptr uint64, node BNode, depth int) {
+		statsAddNode(db, node, +1)
+	})
+	shape.known = true
+}
+
+// account for a node entering (+1) or leaving (-1) the tree.
+func statsAddNode(db *KV, node BNode, sign int) {
+	shape := &db.stats.shape
+	delta := uint64(sign) // wraps around for -1
+	switch node.btype() {
+	case BNODE_LEAF:
+		shape.leaf += delta
+	case BNODE_NODE:
+		shape.internal += delta
+	}
+	shape.used += delta * uint64(node.nbytes())
+}
@@ -0,0 +1,60 @@
+package db
+
+import (
+	"fmt"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestKV_Stats(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.Equal(t, 0, db.Stats().Height)
+
+	for i := 0; i < 10; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%d", i)), []byte("v")))
+	}
+	db.Get([]byte("k1"))
+	_, err := db.Del([]byte("k2"))
+	testify_assert.NoError(t, err)
+
+	s := db.Stats()
+	testify_assert.Equal(t, 1, s.Height)
+	testify_assert.Equal(t, uint64(1), s.LeafPages)
+	testify_assert.Equal(t, uint64(0), s.InternalPages)
+	testify_assert.Equal(t, db.page.flushed-2, s.FreePages)
+	testify_assert.Equal(t, uint64(BTREE_PAGE_SIZE), s.AllocBytes)
+	testify_assert.Equal(t, uint64(db.tree.get(db.tree.root).nbytes()), s.UsedBytes)
+	testify_assert.Equal(t, uint64(1), s.Gets)
+	testify_assert.Equal(t, uint64(10), s.Sets)
+	testify_assert.Equal(t, uint64(1), s.Dels)
+	testify_assert.Equal(t, uint64(11), s.Commits)
+	testify_assert.Equal(t, 2*s.Commits, s.Fsyncs)
+
+	// the shape is maintained incrementally after the first call
+	testify_assert.NoError(t, db.Set([]byte("k99"), []byte("a longer value")))
+	s = db.Stats()
+	used := s.UsedBytes
+	statsCountShape(db)
+	testify_assert.Equal(t, used, db.Stats().UsedBytes)
+	testify_assert.Equal(t, uint64(1), s.LeafPages)
+}
+
+func TestKV_SizeHistograms(t *testing.T) {
+	db := openTestKV(t)
+	for i := 0; i < 10; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%d", i)), make([]byte, 100*i)))
+	}
+	s := db.Stats()
+	testify_assert.Equal(t, uint64(10), s.KeySizes.Count)
+	testify_assert.Equal(t, uint64(10), s.KeySizes.Counts[0]) // <= 16
+	testify_assert.Equal(t, uint64(4500), s.ValueSizes.Sum)
+	testify_assert.Equal(t, uint64(3), s.ValueSizes.Counts[5]) // 300..500 in (256, 512]
+
+	_, err := db.Del([]byte("k0"))
+	testify_assert.NoError(t, err)
+	keys, vals, err := db.AnalyzeSizes()
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, uint64(9), keys.Count)
+	testify_assert.Equal(t, uint64(4500), vals.Sum)
+}
@@ -0,0 +1,242 @@
+package db
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Codec converts values of type T to and from bytes.
+// a codec used for keys must keep their order.
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(data []byte) (T, error)
+}
+
+// CodecFuncs makes a Codec of a pair of functions.
+type CodecFuncs[T any] struct {
+	EncodeFunc func(v T) ([]byte, error)
+	DecodeFunc func(data []byte) (T, error)
+}
+
+func (c CodecFuncs[T]) Encode(v T) ([]byte, error)    { return c.EncodeFunc(v) }
+func (c CodecFuncs[T]) Decode(data []byte) (T, error) { return c.DecodeFunc(data) }
+
+// BinaryCodec uses the encoding.BinaryMarshaler of *T, e.g. BinaryCodec[User, *User].
+type BinaryCodec[T any, PT interface {
+	*T
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+}] struct{}
+
+func (BinaryCodec[T, PT]) Encode(v T) ([]byte, error) {
+	return PT(&v).MarshalBinary()
+}
+func (BinaryCodec[T, PT]) Decode(data []byte) (T, error) {
+	var v T
+	err := PT(&v).UnmarshalBinary(data)
+	return v, err
+}
+
+// JSONCodec stores values in JSON, for the values that must be readable
+// by other tools. it doesn't keep an order for keys.
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) { return json.Marshal(v) }
+func (JSONCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(data, &v)
+	return v, err
+}
+
+// GobCodec stores values with encoding/gob. each value carries the
+// description of its type, it suits the structs that change over time
+// more than the small values.
+type GobCodec[T any] struct{}
+
+func (GobCodec[T]) Encode(v T) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	return buf.Bytes(), err
+}
+func (GobCodec[T]) Decode(data []byte) (T, error) {
+	var v T
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&v)
+	return v, err
+}
+
+// StringCodec stores strings as they are.
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error)    { return []byte(v), nil }
+func (StringCodec) Decode(data []byte) (string, error) { return string(data), nil }
+
+// BytesCodec stores byte slices as they are.
+type BytesCodec struct{}
+
+func (BytesCodec) Encode(v []byte) ([]byte, error)    { return v, nil }
+func (BytesCodec) Decode(data []byte) ([]byte, error) { return append([]byte(nil), data...), nil }
+
+// Uint64Codec stores integers in big-endian, which keeps their order as keys.
+type Uint64Codec struct{}
+
+func (Uint64Codec) Encode(v uint64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, v), nil
+}
+func (Uint64Codec) Decode(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, errors.New("bad uint64")
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+// Int64Codec stores integers in big-endian with the sign bit flipped,
+// which keeps their order as keys, the negative ones first.
+type Int64Codec struct{}
+
+func (Int64Codec) Encode(v int64) ([]byte, error) {
+	return binary.BigEndian.AppendUint64(nil, uint64(v)^1<<63), nil
+}
+func (Int64Codec) Decode(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, errors.New("bad int64")
+	}
+	return int64(binary.BigEndian.Uint64(data) ^ 1<<63), nil
+}
+
+// DurationCodec stores durations like Int64Codec.
+type DurationCodec struct{}
+
+func (DurationCodec) Encode(v time.Duration) ([]byte, error) {
+	return Int64Codec{}.Encode(int64(v))
+}
+func (DurationCodec) Decode(data []byte) (time.Duration, error) {
+	v, err := Int64Codec{}.Decode(data)
+	if err != nil {
+		return 0, errors.New("bad duration")
+	}
+	return time.Duration(v), nil
+}
+
+// TimeCodec stores times as the seconds since the epoch like Int64Codec,
+// followed by the nanoseconds in big-endian: 12 bytes in time order,
+// whatever the year. the location is not kept, they're decoded in UTC.
+type TimeCodec struct{}
+
+func (TimeCodec) Encode(v time.Time) ([]byte, error) {
+	data, _ := Int64Codec{}.Encode(v.Unix())
+	return binary.BigEndian.AppendUint32(data, uint32(v.Nanosecond())), nil
+}
+func (TimeCodec) Decode(data []byte) (time.Time, error) {
+	if len(data) != 12 {
+		return time.Time{}, errors.New("bad time")
+	}
+	sec, _ := Int64Codec{}.Decode(data[:8])
+	return time.Unix(sec, int64(binary.BigEndian.Uint32(data[8:]))).UTC(), nil
+}
+
+// Store is a typed view of a KV, the keys and values are converted
+// by the codecs.
+type Store[K, V any] struct {
+	kv   *KV
+	keys Codec[K]
+	vals Codec[V]
+}
+
+func NewStore[K, V any](kv *KV, keys Codec[K], vals Codec[V]) *Store[K, V] {
+	return &Store[K, V]{kv: kv, keys: keys, vals: vals}
+}
+
+func (s *Store[K, V]) Put(key K, val V) error {
+	k, err := s.keys.Encode(key)
+	if err != nil {
+		return fmt.Errorf("encode key: %w", err)
+	}
+	v, err := s.vals.Encode(val)
+	if err != nil {
+		return fmt.Errorf("encode value: %w", err)
+	}
+	return s.kv.Set(k, v)
+}
+
+func (s *Store[K, V]) Get(key K) (val V, ok bool, err error) {
+	k, err := s.keys.Encode(key)
+	if err != nil {
+		return val, false, fmt.Errorf("encode key: %w", err)
+	}
+	v, ok, err := s.kv.Get(k)
+	if err != nil || !ok {
+		return val, false, err
+	}
+	val, err = s.vals.Decode(v)
+	if err != nil {
+		return val, false, fmt.Errorf("decode value: %w", err)
+	}
+	return val, true, nil
+}
+
+func (s *Store[K, V]) Delete(key K) (bool, error) {
+	k, err := s.keys.Encode(key)
+	if err != nil {
+		return false, fmt.Errorf("encode key: %w", err)
+	}
+	return s.kv.Del(k)
+}
+
+// call fn on every pair in key order until it returns false.
+func (s *Store[K, V]) Scan(fn func(key K, val V) bool) error {
+	return s.scan(nil, nil, fn)
+}
+
+// same as Scan, from the first key >= start.
+func (s *Store[K, V]) ScanFrom(start K, fn func(key K, val V) bool) error {
+	k, err := s.keys.Encode(start)
+	if err != nil {
+		return fmt.Errorf("encode key: %w", err)
+	}
+	return s.scan(k, nil, fn)
+}
+
+// same as Scan, for the keys in [lo, hi), e.g. a time range with TimeCodec.
+func (s *Store[K, V]) ScanRange(lo, hi K, fn func(key K, val V) bool) error {
+	k, err := s.keys.Encode(lo)
+	if err != nil {
+		return fmt.Errorf("encode key: %w", err)
+	}
+	end, err := s.keys.Encode(hi)
+	if err != nil {
+		return fmt.Errorf("encode key: %w", err)
+	}
+	cmp := s.kv.tree.keyCmp()
+	return s.scan(k, func(k []byte) bool { return cmp(k, end) < 0 }, fn)
+}
+
+// the keys from start while in(key), or all of them with a nil in.
+func (s *Store[K, V]) scan(start []byte, in func(k []byte) bool, fn func(key K, val V) bool) error {
+	var derr error
+	err := s.kv.Scan(start, func(k, v []byte) bool {
+		if in != nil && !in(k) {
+			return false
+		}
+		key, err := s.keys.Decode(k)
+		if err != nil {
+			derr = fmt.Errorf("decode key: %w", err)
+			return false
+		}
+		val, err := s.vals.Decode(v)
+		if err != nil {
+			derr = fmt.Errorf("decode value: %w", err)
+			return false
+		}
+		return fn(key, val)
+	})
+	if err != nil {
+		return err
+	}
+	return derr
+}
@@ -0,0 +1,131 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+type testUser struct {
+	Name string
+	Age  uint16
+}
+
+func (u *testUser) MarshalBinary() ([]byte, error) {
+	return append(binary.LittleEndian.AppendUint16(nil, u.Age), u.Name...), nil
+}
+
+func (u *testUser) UnmarshalBinary(data []byte) error {
+	if len(data) < 2 {
+		return errors.New("short user")
+	}
+	u.Age = binary.LittleEndian.Uint16(data)
+	u.Name = string(data[2:])
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	users := NewStore[uint64, testUser](openTestKV(t), Uint64Codec{}, BinaryCodec[testUser, *testUser]{})
+	testify_assert.NoError(t, users.Put(300, testUser{"carol", 41}))
+	testify_assert.NoError(t, users.Put(2, testUser{"bob", 25}))
+	testify_assert.NoError(t, users.Put(1, testUser{"alice", 30}))
+
+	user, ok, err := users.Get(2)
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, testUser{"bob", 25}, user)
+
+	deleted, err := users.Delete(1)
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, deleted)
+	_, ok, err = users.Get(1)
+	testify_assert.NoError(t, err)
+	testify_assert.False(t, ok)
+
+	var ids []uint64
+	testify_assert.NoError(t, users.ScanFrom(2, func(id uint64, user testUser) bool {
+		ids = append(ids, id)
+		return true
+	}))
+	testify_assert.Equal(t, []uint64{2, 300}, ids)
+
+	// a value that doesn't decode
+	names := NewStore[uint64, string](users.kv, Uint64Codec{}, StringCodec{})
+	testify_assert.NoError(t, names.Put(5, "x"))
+	err = users.Scan(func(id uint64, user testUser) bool { return true })
+	testify_assert.ErrorContains(t, err, "decode value: short user")
+}
+
+func TestStore_Time(t *testing.T) {
+	// the encodings keep the order
+	for _, pair := range [][2]int64{{-5, 3}, {-2, -1}, {0, 1}, {1, 1 << 40}} {
+		a, _ := Int64Codec{}.Encode(pair[0])
+		b, _ := Int64Codec{}.Encode(pair[1])
+		testify_assert.Negative(t, bytes.Compare(a, b))
+	}
+	d, err := DurationCodec{}.Decode(mustEncode[time.Duration](t, DurationCodec{}, -time.Second))
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, -time.Second, d)
+
+	base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	events := NewStore[time.Time, string](openTestKV(t), TimeCodec{}, StringCodec{})
+	for _, at := range []time.Time{
+		base.Add(time.Hour),
+		base.Add(-time.Hour),
+		base,
+		base.Add(time.Nanosecond),
+		time.Date(1500, 1, 1, 0, 0, 0, 0, time.UTC), // before UnixNano can go
+	} {
+		testify_assert.NoError(t, events.Put(at, at.String()))
+	}
+	var got []time.Time
+	testify_assert.NoError(t, events.ScanRange(base, base.Add(time.Hour), func(at time.Time, val string) bool {
+		testify_assert.Equal(t, at.String(), val)
+		got = append(got, at)
+		return true
+	}))
+	testify_assert.Equal(t, []time.Time{base, base.Add(time.Nanosecond)}, got)
+	first := time.Time{}
+	testify_assert.NoError(t, events.Scan(func(at time.Time, val string) bool {
+		first = at
+		return false
+	}))
+	testify_assert.Equal(t, 1500, first.Year())
+
+	// in UTC
+	at, err := TimeCodec{}.Decode(mustEncode[time.Time](t, TimeCodec{}, base.In(time.FixedZone("x", 3600))))
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, base, at)
+}
+
+func mustEncode[T any](t *testing.T, c Codec[T], v T) []byte {
+	data, err := c.Encode(v)
+	testify_assert.NoError(t, err)
+	return data
+}
+
+func TestStore_Codecs(t *testing.T) {
+	type event struct {
+		Name string
+		Tags []string
+	}
+	kv := openTestKV(t)
+	for _, codec := range []Codec[event]{JSONCodec[event]{}, GobCodec[event]{}} {
+		events := NewStore[string, event](kv, StringCodec{}, codec)
+		testify_assert.NoError(t, events.Put("e1", event{"deploy", []string{"prod"}}))
+		ev, ok, err := events.Get("e1")
+		testify_assert.NoError(t, err)
+		testify_assert.True(t, ok)
+		testify_assert.Equal(t, event{"deploy", []string{"prod"}}, ev)
+	}
+	val, _, _ := kv.Get([]byte("e1"))
+	_, err := JSONCodec[event]{}.Decode(val)
+	testify_assert.Error(t, err) // gob
+	data, err := JSONCodec[event]{}.Encode(event{Name: "x"})
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, `{"Name":"x","Tags":null}`, string(data))
+}
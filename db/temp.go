@@ -0,0 +1,39 @@
+package db
+
+import (
+	"errors"
+	"os"
+)
+
+// OpenTemp creates a new database with a unique name in dir, or in
+// os.TempDir if dir is empty, for the scratch space and the tests. its
+// files are removed by Close. they're also removed right after the open
+// where the OS allows it, so that nothing is left if the process dies;
+// the KV keeps them open until Close, but Path no longer names them.
+func OpenTemp(dir string, opts ...Option) (*KV, error) {
+	fp, err := os.CreateTemp(dir, "godb-*.db")
+	if err != nil {
+		return nil, err
+	}
+	path := fp.Name()
+	_ = fp.Close()
+	db, err := Open(path, opts...)
+	if err != nil {
+		_ = os.Remove(path)
+		return nil, err
+	}
+	db.temp = true
+	tempRemove(db)
+	return db, nil
+}
+
+// remove the files of a temporary DB. an open file can't be removed on
+// some platforms, Close tries again once they're closed.
+func tempRemove(db *KV) {
+	for _, path := range []string{db.Path, walPath(db), bloomPath(db), freePath(db)} {
+		err := db.vfs().Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			db.Logger.Debug("temp db", "path", path, "err", err)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestOpenTemp(t *testing.T) {
+	dir := t.TempDir()
+	db, err := OpenTemp(dir, WithMemtable(1<<10), WithBloomFilter(10))
+	testify_assert.NoError(t, err)
+	other, err := OpenTemp(dir)
+	testify_assert.NoError(t, err)
+	testify_assert.NotEqual(t, db.Path, other.Path)
+	testify_assert.Equal(t, dir, filepath.Dir(db.Path))
+
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	testify_assert.NoError(t, db.Flush())
+	val, ok, err := db.Get([]byte("k"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, []byte("v"), val)
+	_, ok, _ = other.Get([]byte("k"))
+	testify_assert.False(t, ok)
+
+	names := func() []string {
+		entries, err := os.ReadDir(dir)
+		testify_assert.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+	if runtime.GOOS != "windows" {
+		testify_assert.Empty(t, names()) // already removed
+	}
+	db.Close()
+	other.Close()
+	testify_assert.Empty(t, names())
+}
@@ -0,0 +1,81 @@
+package db
+
+import "time"
+
+// the write throttle, see Options.WriteRate. a token bucket per limit,
+// refilled at the rate and holding at most THROTTLE_BURST of it. a write
+// takes its tokens even if there are not enough, and waits for the debt
+// to be paid back, so large writes pass but delay the next ones.
+const THROTTLE_BURST = 100 * time.Millisecond
+
+type tokenBucket struct {
+	rate   float64 // per second, 0 is unlimited
+	tokens float64 // negative while in debt
+	last   time.Time
+}
+
+// take n tokens, returns how long to wait for them.
+func (b *tokenBucket) take(now time.Time, n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	burst := b.rate * THROTTLE_BURST.Seconds()
+	if b.last.IsZero() {
+		b.tokens = burst
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+	}
+	if b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// are the writes still waiting for their tokens?
+func (b *tokenBucket) behind(now time.Time) bool {
+	return b.rate > 0 && b.tokens+now.Sub(b.last).Seconds()*b.rate < 0
+}
+
+// wait for the turn of a write of n bytes of keys and values.
+func throttle(db *KV, n int) {
+	db.throttle.ops.rate = float64(db.WriteRate)
+	db.throttle.bytes.rate = float64(db.WriteBytesRate)
+	now := time.Now()
+	wait := db.throttle.ops.take(now, 1)
+	if d := db.throttle.bytes.take(now, float64(n)); d > wait {
+		wait = d
+	}
+	if wait <= 0 {
+		return
+	}
+	db.stats.throttled++
+	db.stats.throttleWait += wait
+	time.Sleep(wait)
+}
+
+// Backpressure reports whether the writes are falling behind: the write
+// buffer not yet merged into the tree has reached Options.WriteBacklog,
+// or the writes are being delayed by the throttle, or the memory is over
+// Options.MemoryBudget. the background work,
+// like StartDefrag, holds off while it's true, and so should the
+// callers' bulk loads, to leave room for the foreground.
+func (db *KV) Backpressure() bool {
+	if db.WriteBacklog > 0 && db.wal.size+writeBacklogPages(db) >= int64(db.WriteBacklog) {
+		return true
+	}
+	if memOver(db) > 0 {
+		return true
+	}
+	now := time.Now()
+	return db.throttle.ops.behind(now) || db.throttle.bytes.behind(now)
+}
+
+// the dirty pages of a commit in progress, in bytes.
+func writeBacklogPages(db *KV) int64 {
+	return int64(len(db.page.temp)+len(db.page.updates)) * BTREE_PAGE_SIZE
+}
@@ -0,0 +1,57 @@
+package db
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := tokenBucket{rate: 100}
+	now := time.Now()
+	// a burst of 10, then 1 every 10ms
+	for i := 0; i < 10; i++ {
+		testify_assert.Zero(t, b.take(now, 1))
+	}
+	testify_assert.Equal(t, 10*time.Millisecond, b.take(now, 1))
+	testify_assert.True(t, b.behind(now))
+	testify_assert.False(t, b.behind(now.Add(10*time.Millisecond)))
+	testify_assert.Zero(t, b.take(now.Add(20*time.Millisecond), 1))
+	// a large take passes and delays the next
+	testify_assert.Equal(t, 500*time.Millisecond, b.take(now.Add(20*time.Millisecond), 50))
+
+	unlimited := tokenBucket{}
+	testify_assert.Zero(t, unlimited.take(now, 1e9))
+	testify_assert.False(t, unlimited.behind(now))
+}
+
+func TestKV_Throttle(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithNoSync(), WithWriteRate(1000, 0))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	start := time.Now()
+	for i := 0; i < 150; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("v")))
+	}
+	// about 50 writes after the burst of 100 waited their turn
+	testify_assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+	s := db.Stats()
+	testify_assert.NotZero(t, s.Throttled)
+	testify_assert.NotZero(t, s.ThrottleWait)
+}
+
+func TestKV_WriteBacklog(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"),
+		WithNoSync(), WithMemtable(1<<20), WithWriteBacklog(100))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; !db.Backpressure(); i++ {
+		testify_assert.Less(t, i, 10)
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), []byte("value")))
+	}
+	testify_assert.NoError(t, db.Flush())
+	testify_assert.False(t, db.Backpressure())
+}
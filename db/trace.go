@@ -0,0 +1,57 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Trace records what a single lookup did inside the tree.
+// Pass one to KV.GetTraced to find out why a particular Get was slow.
+type Trace struct {
+	Key   []byte
+	Found bool
+	Steps []TraceStep // root first, leaf last
+	// the bloom filter ruled the key out, the tree wasn't touched
+	BloomRejected bool
+	Elapsed       time.Duration
+
+	cacheHit bool // set by the page callback, consumed by the next visit
+}
+
+// one node visited on the way down
+type TraceStep struct {
+	Ptr      uint64 // page number
+	Type     uint16 // BNODE_NODE or BNODE_LEAF
+	NKeys    uint16
+	Idx      uint16 // the position picked by nodeLookupLE
+	Compares int    // key comparisons made in this node
+	CacheHit bool   // the page came from the page cache
+}
+
+// a nil trace records nothing, so the untraced path stays cheap.
+func (trace *Trace) visit(ptr uint64, node BNode, idx uint16, ncmp int) {
+	if trace == nil {
+		return
+	}
+	trace.Steps = append(trace.Steps, TraceStep{
+		Ptr: ptr, Type: node.btype(), NKeys: node.nkeys(), Idx: idx, Compares: ncmp,
+		CacheHit: trace.cacheHit,
+	})
+	trace.cacheHit = false
+}
+
+func (trace *Trace) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "get %q: found=%v pages=%d bloom_rejected=%v elapsed=%v\n",
+		trace.Key, trace.Found, len(trace.Steps), trace.BloomRejected, trace.Elapsed)
+	for depth, step := range trace.Steps {
+		kind := "node"
+		if step.Type == BNODE_LEAF {
+			kind = "leaf"
+		}
+		fmt.Fprintf(&b, "  %d: page %d %s nkeys=%d idx=%d compares=%d cache_hit=%v\n",
+			depth, step.Ptr, kind, step.NKeys, step.Idx, step.Compares, step.CacheHit)
+	}
+	return b.String()
+}
@@ -0,0 +1,214 @@
+package db
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+
+// Tx groups updates into one atomic commit. it reads the version of the
+// KV it began with, plus its own updates, which are kept in memory until
+// the commit. the updates of the KV since then are not seen: if one of
+// them changed what the Tx has read, the commit fails with ErrConflict
+// and the Tx can be retried. the reads of an Iter are taken to go to
+// the end of the keys.
+//
+// like the KV, a Tx is not safe for concurrent use. its updates must not
+// be made while one of its iterators is in use.
+type Tx struct {
+	snap   *Snapshot // with the pending updates as its memtable
+	writes *memtable
+	bytes  int       // of the keys and values written, see Options.WriteRate
+	seq    uint64    // began after this update, see occBegin
+	reads  []keySpan // not counting its own updates and locked keys
+	// the key locks, see Lock
+	lockMgr *lockManager
+	locked  map[string]bool
+	aborted error
+	done    bool
+}
+
+// Begin starts a transaction, it must end with a commit or a Rollback.
+// the buffered updates are committed first, see Options.MemtableSize.
+func (db *KV) Begin() (*Tx, error) {
+	if err := checkWritable(db); err != nil {
+		return nil, err
+	}
+	snap, err := db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	if db.locks == nil {
+		db.locks = newLockManager()
+	}
+	tx := &Tx{snap: snap, writes: newMemtable(db.tree.keyCmp()), seq: occBegin(db), lockMgr: db.locks}
+	snap.mem = tx.writes
+	return tx, nil
+}
+
+func (tx *Tx) usable() error {
+	if tx.done {
+		return ErrTxDone
+	}
+	if tx.aborted != nil {
+		return tx.aborted
+	}
+	return tx.snap.usable()
+}
+
+func (tx *Tx) Get(key []byte) (val []byte, ok bool, err error) {
+	if err := tx.usable(); err != nil {
+		return nil, false, err
+	}
+	e, written := tx.writes.get(key)
+	switch {
+	case written:
+		if e.deleted {
+			return nil, false, nil
+		}
+		return decodeValue(tx.snap.db, e.val), true, nil
+	case tx.locked[string(key)]:
+		return tx.snap.db.Get(key) // the last commit
+	}
+	tx.reads = append(tx.reads, keySpan{lo: append([]byte(nil), key...), point: true})
+	return tx.snap.Get(key)
+}
+
+func (tx *Tx) Scan(start []byte, fn func(key, val []byte) bool) error {
+	if err := tx.usable(); err != nil {
+		return err
+	}
+	// the keys up to the one it stopped at
+	var last []byte
+	err := tx.snap.Scan(start, func(key, val []byte) bool {
+		if !fn(key, val) {
+			last = append([]byte(nil), key...)
+			return false
+		}
+		return true
+	})
+	span := keySpan{lo: append([]byte(nil), start...), hi: last}
+	tx.reads = append(tx.reads, span)
+	if last != nil {
+		tx.reads = append(tx.reads, keySpan{lo: last, point: true})
+	}
+	return err
+}
+
+// Iter is like Snapshot.Iter, with the pending updates.
+func (tx *Tx) Iter(start []byte) *Iter {
+	if err := tx.usable(); err != nil {
+		return &Iter{snap: tx.snap, err: err, closed: true}
+	}
+	tx.reads = append(tx.reads, keySpan{lo: append([]byte(nil), start...)})
+	return tx.snap.Iter(start)
+}
+
+func (tx *Tx) Set(key []byte, val []byte) error {
+	if err := tx.usable(); err != nil {
+		return err
+	}
+	stored := encodeValue(tx.snap.db, val)
+	if err := checkKV(key, stored); err != nil {
+		return err
+	}
+	db := tx.snap.db
+	db.stats.keySizes.observe(len(key))
+	db.stats.valSizes.observe(len(val))
+	tx.bytes += len(key) + len(val)
+	size := tx.writes.size
+	tx.writes.put(lsmEntry{
+		key: append([]byte(nil), key...),
+		val: append([]byte(nil), stored...),
+	})
+	db.mem.txs += int64(tx.writes.size - size)
+	memEnforce(db)
+	return nil
+}
+
+func (tx *Tx) Del(key []byte) (deleted bool, err error) {
+	if err := checkKV(key, nil); err != nil {
+		return false, err
+	}
+	_, deleted, err = tx.Get(key)
+	if err != nil || !deleted {
+		return false, err
+	}
+	tx.bytes += len(key)
+	size := tx.writes.size
+	tx.writes.put(lsmEntry{key: append([]byte(nil), key...), deleted: true})
+	tx.snap.db.mem.txs += int64(tx.writes.size - size)
+	memEnforce(tx.snap.db)
+	return true, nil
+}
+
+// Commit applies the updates in one commit, durable unless the KV was
+// opened with Options.NoSync.
+func (tx *Tx) Commit() error {
+	return txCommit(tx, false)
+}
+
+// CommitNoSync applies the updates in one commit with a single fsync,
+// of its pages before its master page, instead of two. it's atomic, but
+// it can be lost by a crash, along with the other commits until the next
+// durable one. the pages it frees are only reused after that one, so a
+// crash finds the last durable commit or a later one intact.
+// for bulk and maintenance work that can be redone.
+func (tx *Tx) CommitNoSync() error {
+	return txCommit(tx, true)
+}
+
+// Rollback discards the updates. it does nothing after a commit, so it
+// can be deferred.
+func (tx *Tx) Rollback() {
+	if !tx.done {
+		tx.done = true
+		tx.snap.db.mem.txs -= int64(tx.writes.size)
+		tx.snap.Close()
+		occEnd(tx.snap.db, tx.seq)
+		if tx.locked != nil {
+			tx.lockMgr.releaseAll(tx)
+		}
+	}
+}
+
+func txCommit(tx *Tx, noSync bool) (err error) {
+	defer catchPageError(&err)
+	if err := tx.usable(); err != nil {
+		return err
+	}
+	db := tx.snap.db
+	defer slowOp(db, "commit", nil, time.Now())
+	defer tx.Rollback()
+	if tx.writes.count == 0 {
+		return nil // nothing to serialize
+	}
+	if err := occCheck(db, tx.seq, tx.reads); err != nil {
+		return err
+	}
+	throttle(db, tx.bytes)
+	if walBuffered(db) {
+		// the tx is merged into the tree, after the older updates
+		if err := db.Flush(); err != nil {
+			return err
+		}
+	}
+	for n := tx.writes.seek(nil); n != nil; n = n.nextNode() {
+		occRecord(db, keySpan{lo: n.entry.key, point: true})
+		if n.entry.deleted {
+			db.stats.dels++
+			db.tree.Delete(n.entry.key)
+			continue
+		}
+		db.stats.sets++
+		if db.bloom != nil {
+			db.bloom.add(n.entry.key)
+		}
+		db.tree.Insert(n.entry.key, n.entry.val)
+	}
+	saved := db.syncSkip
+	db.syncSkip = noSync
+	defer func() { db.syncSkip = saved }()
+	return flushPages(db)
+}
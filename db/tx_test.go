@@ -0,0 +1,141 @@
+package db
+
+import (
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func TestTx(t *testing.T) {
+	db := openTestKV(t)
+	testify_assert.NoError(t, db.Set([]byte("a"), []byte("1")))
+	testify_assert.NoError(t, db.Set([]byte("b"), []byte("2")))
+
+	tx, err := db.Begin()
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, tx.Set([]byte("c"), []byte("3")))
+	deleted, err := tx.Del([]byte("a"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, deleted)
+	deleted, err = tx.Del([]byte("x"))
+	testify_assert.NoError(t, err)
+	testify_assert.False(t, deleted)
+
+	// the tx sees its updates, the KV doesn't
+	_, ok, err := tx.Get([]byte("a"))
+	testify_assert.NoError(t, err)
+	testify_assert.False(t, ok)
+	var keys []string
+	testify_assert.NoError(t, tx.Scan(nil, func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return true
+	}))
+	testify_assert.Equal(t, []string{"b", "c"}, keys)
+	_, ok, _ = db.Get([]byte("c"))
+	testify_assert.False(t, ok)
+
+	commits := db.Stats().Commits
+	testify_assert.NoError(t, tx.Commit())
+	testify_assert.Equal(t, commits+1, db.Stats().Commits)
+	_, ok, _ = db.Get([]byte("a"))
+	testify_assert.False(t, ok)
+	val, ok, _ := db.Get([]byte("c"))
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, []byte("3"), val)
+	testify_assert.ErrorIs(t, tx.Commit(), ErrTxDone)
+	testify_assert.ErrorIs(t, tx.Set([]byte("d"), nil), ErrTxDone)
+	tx.Rollback()
+
+	tx, err = db.Begin()
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, tx.Set([]byte("d"), []byte("4")))
+	tx.Rollback()
+	_, ok, _ = db.Get([]byte("d"))
+	testify_assert.False(t, ok)
+	testify_assert.Empty(t, db.pins)
+}
+
+// the durability is chosen by each commit.
+func TestTx_CommitNoSync(t *testing.T) {
+	db := openTestKV(t)
+	fsyncs := db.Stats().Fsyncs
+	tx, err := db.Begin()
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, tx.Set([]byte("k"), []byte("v")))
+	testify_assert.NoError(t, tx.CommitNoSync())
+	testify_assert.Equal(t, fsyncs+1, db.Stats().Fsyncs) // before the master page only
+	testify_assert.False(t, db.NoSync)
+
+	tx, err = db.Begin()
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, tx.Set([]byte("k"), []byte("v2")))
+	testify_assert.NoError(t, tx.Commit())
+	testify_assert.Equal(t, fsyncs+3, db.Stats().Fsyncs)
+	val, _, _ := db.Get([]byte("k"))
+	testify_assert.Equal(t, []byte("v2"), val)
+}
+
+// a commit fails if what the tx has read was updated since it began.
+func TestTx_Conflict(t *testing.T) {
+	db := openTestKV(t)
+	db.NoSync = true
+	for _, k := range []string{"a", "b", "c", "d"} {
+		testify_assert.NoError(t, db.Set([]byte(k), []byte(k)))
+	}
+	begin := func() *Tx {
+		tx, err := db.Begin()
+		testify_assert.NoError(t, err)
+		return tx
+	}
+
+	// 2 read-modify-writes of the same key, the second one is retried
+	t1, t2 := begin(), begin()
+	for _, tx := range []*Tx{t1, t2} {
+		val, _, err := tx.Get([]byte("a"))
+		testify_assert.NoError(t, err)
+		testify_assert.NoError(t, tx.Set([]byte("a"), []byte(string(val)+"+")))
+	}
+	testify_assert.NoError(t, t1.Commit())
+	testify_assert.ErrorIs(t, t2.Commit(), ErrConflict)
+	val, _, _ := db.Get([]byte("a"))
+	testify_assert.Equal(t, []byte("a+"), val)
+
+	// a missing key that was inserted
+	tx := begin()
+	_, ok, _ := tx.Get([]byte("x"))
+	testify_assert.False(t, ok)
+	testify_assert.NoError(t, db.Set([]byte("x"), nil))
+	testify_assert.NoError(t, tx.Set([]byte("y"), nil))
+	testify_assert.ErrorIs(t, tx.Commit(), ErrConflict)
+
+	// a scan sees the keys up to where it stopped
+	scan := func() *Tx {
+		tx := begin()
+		testify_assert.NoError(t, tx.Scan([]byte("b"), func(key, val []byte) bool {
+			return string(key) < "c"
+		}))
+		testify_assert.NoError(t, tx.Set([]byte("y"), nil))
+		return tx
+	}
+	tx = scan()
+	testify_assert.NoError(t, db.Set([]byte("d"), nil)) // after the scan
+	testify_assert.NoError(t, tx.Commit())
+	tx = scan()
+	testify_assert.NoError(t, db.Set([]byte("bb"), nil)) // a phantom
+	testify_assert.ErrorIs(t, tx.Commit(), ErrConflict)
+	tx = scan()
+	testify_assert.NoError(t, db.DeleteRange([]byte("c"), []byte("d")))
+	testify_assert.ErrorIs(t, tx.Commit(), ErrConflict)
+
+	// the updates before it began and the blind writes don't conflict
+	tx = begin()
+	testify_assert.NoError(t, db.Set([]byte("a"), nil))
+	testify_assert.NoError(t, tx.Set([]byte("a"), []byte("tx")))
+	testify_assert.NoError(t, tx.Commit())
+	val, _, _ = db.Get([]byte("a"))
+	testify_assert.Equal(t, []byte("tx"), val)
+
+	// nothing is kept without an open tx
+	testify_assert.Empty(t, db.occ.active)
+	testify_assert.Nil(t, db.occ.writes)
+}
@@ -0,0 +1,58 @@
+package db
+
+import (
+	"io"
+	"os"
+)
+
+// VFS is the filesystem used by the KV, so that tests can replace it
+// with one that injects failures. the database file is mmapped for
+// reads, so it must be a real file with a descriptor; writes and syncs
+// only go through the interface.
+type VFS interface {
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm os.FileMode) error
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// File is the subset of *os.File used by the KV.
+type File interface {
+	io.ReaderAt
+	io.WriterAt
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error
+	Sync() error
+	Fd() uintptr
+}
+
+// OSFS is the VFS of the operating system, the default.
+type OSFS struct{}
+
+func (OSFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+func (OSFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(name)
+}
+func (OSFS) WriteFile(name string, data []byte, perm os.FileMode) error {
+	return os.WriteFile(name, data, perm)
+}
+func (OSFS) Rename(oldpath, newpath string) error {
+	return renameFile(oldpath, newpath)
+}
+func (OSFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (db *KV) vfs() VFS {
+	if inMemory(db) {
+		return memFS{}
+	}
+	if db.FS == nil {
+		return OSFS{}
+	}
+	return db.FS
+}
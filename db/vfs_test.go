@@ -0,0 +1,144 @@
+package db
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+var errCrashed = errors.New("crashed")
+
+// faultFS passes everything through to the OS, except that the writes
+// to an opened file are kept in memory until it's synced, so they can
+// be lost. it can fail a sync, make a write short, or crash at a given
+// write or sync, after which every write and sync fails.
+type faultFS struct {
+	OSFS
+	failSync   bool // the next Sync fails and drops the unsynced writes
+	shortWrite bool // the next WriteAt only writes half of the data
+	crashAt    int  // crash on this write or sync, counting from 1, 0 never
+	ops        int  // writes and syncs so far
+	crashed    bool
+}
+
+type pendingWrite struct {
+	off  int64
+	data []byte
+}
+
+type faultFile struct {
+	*os.File
+	fs      *faultFS
+	pending []pendingWrite
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fp, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return &faultFile{File: fp, fs: fs}, nil
+}
+
+// counts an operation, reports whether the FS is (now) crashed.
+func (fs *faultFS) op() bool {
+	fs.ops++
+	if fs.crashAt == fs.ops {
+		fs.crashed = true
+	}
+	return fs.crashed
+}
+
+func (f *faultFile) WriteAt(data []byte, off int64) (int, error) {
+	if f.fs.op() {
+		f.pending = nil
+		return 0, errCrashed
+	}
+	n, err := len(data), error(nil)
+	if f.fs.shortWrite {
+		f.fs.shortWrite = false
+		n, err = n/2, io.ErrShortWrite
+	}
+	f.pending = append(f.pending, pendingWrite{off, append([]byte(nil), data[:n]...)})
+	return n, err
+}
+
+func (f *faultFile) Sync() error {
+	if f.fs.op() {
+		f.pending = nil
+		return errCrashed
+	}
+	pending := f.pending
+	f.pending = nil
+	if f.fs.failSync {
+		f.fs.failSync = false
+		return errors.New("injected fsync failure")
+	}
+	for _, w := range pending {
+		if _, err := f.File.WriteAt(w.data, w.off); err != nil {
+			return err
+		}
+	}
+	return f.File.Sync()
+}
+
+// unsynced writes are lost, as if the machine crashed afterwards.
+func (f *faultFile) Close() error {
+	f.pending = nil
+	return f.File.Close()
+}
+
+// commit k1, then run a Set of k2 that may fail on the FS.
+// the database must then hold k1 and either nothing or v2 for k2.
+func faultSet(t *testing.T, fs *faultFS, setup func()) error {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db := &KV{Path: path, Options: Options{FS: fs}}
+	testify_assert.NoError(t, db.Open())
+	testify_assert.NoError(t, db.Set([]byte("k1"), []byte("v1")))
+	setup()
+	err := db.Set([]byte("k2"), []byte("v2"))
+	db.Close()
+
+	db = &KV{Path: path}
+	testify_assert.NoError(t, db.Open())
+	defer db.Close()
+	testify_assert.Nil(t, db.Check())
+	val, ok, _ := db.Get([]byte("k1"))
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "v1", string(val))
+	val, ok, _ = db.Get([]byte("k2"))
+	if err != nil {
+		testify_assert.False(t, ok)
+	} else {
+		testify_assert.Equal(t, "v2", string(val))
+	}
+	return err
+}
+
+func TestFaultFS_SyncFailure(t *testing.T) {
+	fs := &faultFS{}
+	err := faultSet(t, fs, func() { fs.failSync = true })
+	testify_assert.ErrorContains(t, err, "injected fsync failure")
+}
+
+func TestFaultFS_ShortWrite(t *testing.T) {
+	fs := &faultFS{}
+	err := faultSet(t, fs, func() { fs.shortWrite = true })
+	testify_assert.ErrorIs(t, err, io.ErrShortWrite)
+}
+
+// crash on every write and sync of the commit in turn.
+func TestFaultFS_Crash(t *testing.T) {
+	for n := 1; ; n++ {
+		fs := &faultFS{}
+		err := faultSet(t, fs, func() { fs.crashAt = fs.ops + n })
+		if err == nil {
+			break // the commit is done before the crash point
+		}
+		testify_assert.ErrorIs(t, err, errCrashed)
+	}
+}
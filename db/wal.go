@@ -0,0 +1,335 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// the write buffer. with Options.MemtableSize, updates are appended to a
+// log next to the DB file and kept in a memtable instead of being
+// committed one by one. the memtable is merged into the tree in a single
+// commit when it's full, on Flush and on Close, then the log is emptied.
+// this checkpoint also happens when the log reaches WALMaxSize or when
+// CheckpointInterval has passed since the last one, which bound the log
+// and the time to replay it. a log left by a crash is replayed on open.
+// with StartFlush, the merges are done in the background instead.
+//
+// the log is in the format of the LSM log, with the stored values.
+// with an EncryptionKey, each record is sealed in the value of an outer
+// record, see walSeal.
+
+// after the epoch in the master page, the generation of the log: the
+// number of checkpoints, see walSeal.
+// | log_gen |
+// |   8B    |
+const MASTER_LOG_OFFSET = MASTER_EPOCH_OFFSET + 8
+
+// with StartFlush, an update only merges the memtable itself once it's
+// this many times over its size, or the log over WALMaxSize.
+const WAL_STALL = 2
+
+// FlushOptions paces the background merges of the memtable, see StartFlush.
+type FlushOptions struct {
+	// guards the KV, held during each merge. the KV isn't safe for
+	// concurrent use, so it must be the lock of the other users.
+	Lock sync.Locker
+	// the pause between the checks, default 10ms
+	Interval time.Duration
+}
+
+func walPath(db *KV) string {
+	return db.Path + ".wal"
+}
+
+func walInit(db *KV) error {
+	if db.MemtableSize > 0 && db.crypt.aead != nil && !db.ReadOnly && dbIsNew(db) {
+		// the log is sealed with the salt of the master page
+		if err := flushPages(db); err != nil {
+			return err
+		}
+	}
+	mode := os.O_RDWR
+	switch {
+	case db.ReadOnly:
+		mode = os.O_RDONLY
+	case db.MemtableSize > 0:
+		mode |= os.O_CREATE
+	}
+	fp, err := db.vfs().OpenFile(walPath(db), mode, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // not buffered and nothing to replay
+	}
+	if err != nil {
+		return fmt.Errorf("open log: %w", err)
+	}
+	db.wal.fp = fp
+	db.wal.mem = newMemtable(db.tree.keyCmp())
+	db.wal.checkpoint = time.Now()
+	var bad error
+	current := false // a record of this generation was read
+	valid, err := lsmReadRecords(fp, func(e lsmEntry, off int64) {
+		if bad != nil {
+			return
+		}
+		if db.crypt.aead != nil {
+			rec, err := walOpen(db, e, db.wal.gen, off)
+			if err != nil && !current && db.wal.gen > 0 {
+				// merged by a checkpoint that failed to empty the log
+				if _, err := walOpen(db, e, db.wal.gen-1, off); err == nil {
+					return
+				}
+			}
+			if bad = err; bad != nil {
+				return
+			}
+			e, current = rec, true
+		}
+		db.wal.mem.put(e)
+		if db.bloom != nil && !e.deleted {
+			db.bloom.add(e.key) // the saved filter may predate the log
+		}
+	})
+	if err == nil {
+		err = bad
+	}
+	if err != nil {
+		return fmt.Errorf("read log: %w", err)
+	}
+	db.wal.size = valid
+	if db.ReadOnly {
+		return nil // read through the memtable
+	}
+	// drop a torn record at the end
+	if err := fp.Truncate(valid); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	if db.MemtableSize > 0 {
+		return nil
+	}
+	// left by a buffered open, merge it now
+	if err := db.Flush(); err != nil {
+		return err
+	}
+	walClose(db)
+	return nil
+}
+
+func walClose(db *KV) {
+	if db.wal.fp != nil {
+		_ = db.wal.fp.Close()
+	}
+	db.wal.fp = nil
+	db.wal.mem = nil
+}
+
+// buffered updates go to the log.
+func walBuffered(db *KV) bool {
+	return db.wal.fp != nil && !db.ReadOnly
+}
+
+// the latest buffered update of a key.
+func walGet(db *KV, key []byte) (lsmEntry, bool) {
+	if db.wal.mem == nil {
+		return lsmEntry{}, false
+	}
+	return db.wal.mem.get(key)
+}
+
+// log an update and add it to the memtable, merge it if it's full.
+func walUpdate(db *KV, e lsmEntry) error {
+	rec := lsmRecord(nil, e)
+	if db.crypt.aead != nil {
+		rec = walSeal(db, rec, db.wal.size)
+	}
+	if _, err := db.wal.fp.WriteAt(rec, db.wal.size); err != nil {
+		return fmt.Errorf("write log: %w", err)
+	}
+	if syncing(db) {
+		db.stats.fsyncs++
+		if err := db.wal.fp.Sync(); err != nil {
+			return fmt.Errorf("fsync: %w", err)
+		}
+	}
+	db.wal.size += int64(len(rec))
+	db.wal.mem.put(lsmEntry{
+		key:     append([]byte(nil), e.key...),
+		val:     append([]byte(nil), e.val...),
+		deleted: e.deleted,
+	})
+	if walDue(db) && (!db.wal.background || walStalled(db)) {
+		return walFlush(db)
+	}
+	return nil
+}
+
+// has the background merge fallen too far behind the updates?
+func walStalled(db *KV) bool {
+	switch {
+	case db.wal.mem.size >= WAL_STALL*db.MemtableSize:
+		return true
+	case db.WALMaxSize > 0 && db.wal.size >= WAL_STALL*int64(db.WALMaxSize):
+		return true
+	case memOver(db) > 0:
+		return true
+	}
+	return false
+}
+
+// is it time for a checkpoint?
+func walDue(db *KV) bool {
+	switch {
+	case db.wal.mem.size >= db.MemtableSize:
+		return true
+	case db.WALMaxSize > 0 && db.wal.size >= int64(db.WALMaxSize):
+		return true
+	case db.CheckpointInterval > 0 && time.Since(db.wal.checkpoint) >= db.CheckpointInterval:
+		return true
+	case memOver(db) > 0:
+		return true
+	}
+	return false
+}
+
+// merge the memtable into the tree in one commit, then empty the log.
+// panics with a pageError like the tree updates.
+func walFlush(db *KV) error {
+	if db.wal.mem == nil || db.wal.mem.count == 0 {
+		return nil
+	}
+	for node := db.wal.mem.seek(nil); node != nil; node = node.nextNode() {
+		e := node.entry
+		if e.deleted {
+			db.tree.Delete(e.key)
+		} else {
+			db.tree.Insert(e.key, e.val)
+		}
+	}
+	n := db.wal.mem.count
+	// the records written from now on are of the next generation
+	db.wal.gen++
+	if err := flushPages(db); err != nil {
+		db.wal.gen--
+		return err
+	}
+	// replaying the log again after a crash here is harmless, and a
+	// sealed log of the previous generation is skipped
+	if err := db.wal.fp.Truncate(0); err != nil {
+		return fmt.Errorf("truncate log: %w", err)
+	}
+	db.wal.size = 0
+	db.wal.mem = newMemtable(db.tree.keyCmp())
+	db.wal.checkpoint = time.Now()
+	db.stats.checkpoints++
+	db.Logger.Debug("merge memtable", "keys", n)
+	return nil
+}
+
+// Flush merges the buffered updates into the tree and empties the log,
+// a checkpoint on demand. see Options.MemtableSize.
+func (db *KV) Flush() (err error) {
+	defer catchPageError(&err)
+	if db.ReadOnly {
+		return nil
+	}
+	return walFlush(db)
+}
+
+// StartFlush merges the memtable into the tree in a goroutine until stop
+// is called, which returns the error that ended it, if any. the updates
+// then only write the log, and leave the merges that are due to it, see
+// WAL_STALL. the merges only hold opts.Lock, the updates wait for it
+// while one is running.
+func (db *KV) StartFlush(opts FlushOptions) (stop func() error) {
+	if opts.Interval <= 0 {
+		opts.Interval = 10 * time.Millisecond
+	}
+	opts.Lock.Lock()
+	db.wal.background = true
+	opts.Lock.Unlock()
+	quit, exited := make(chan struct{}), make(chan struct{})
+	var err error
+	go func() {
+		defer close(exited)
+		ticker := time.NewTicker(opts.Interval)
+		defer ticker.Stop()
+		defer func() {
+			opts.Lock.Lock()
+			db.wal.background = false
+			opts.Lock.Unlock()
+		}()
+		for {
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+			opts.Lock.Lock()
+			// unlike the other background work, not held off by the
+			// backpressure: the merges relieve it
+			if !db.closed && walBuffered(db) && walDue(db) {
+				err = db.Flush()
+			}
+			opts.Lock.Unlock()
+			if err != nil {
+				db.Logger.Warn("flush", "err", err)
+				return
+			}
+		}
+	}()
+	return func() error {
+		select {
+		case <-exited:
+		default:
+			close(quit)
+			<-exited
+		}
+		return err
+	}
+}
+
+// scan the tree with the memtable merged in, the memtable wins a tie.
+func walScan(db *KV, start []byte, fn func(key, val []byte) bool) {
+	if db.wal.mem == nil {
+		treeScan(&db.tree, start, fn)
+		return
+	}
+	cmp := db.tree.keyCmp()
+	node := db.wal.mem.seek(start)
+	// pass the memtable entries < key, or all with a nil key
+	drain := func(key []byte) bool {
+		for node != nil && (key == nil || cmp(node.entry.key, key) < 0) {
+			e := node.entry
+			node = node.nextNode()
+			if !e.deleted && !fn(e.key, e.val) {
+				return false
+			}
+		}
+		return true
+	}
+	stopped := false
+	treeScan(&db.tree, start, func(key, val []byte) bool {
+		if !drain(key) {
+			stopped = true
+			return false
+		}
+		if node != nil && cmp(node.entry.key, key) == 0 {
+			e := node.entry
+			node = node.nextNode()
+			if e.deleted {
+				return true
+			}
+			val = e.val
+		}
+		if !fn(key, val) {
+			stopped = true
+			return false
+		}
+		return true
+	})
+	if !stopped {
+		drain(nil)
+	}
+}
@@ -0,0 +1,285 @@
+package db
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+func walDump(t *testing.T, db *KV) map[string]string {
+	out := map[string]string{}
+	testify_assert.NoError(t, db.Scan(nil, func(key, val []byte) bool {
+		out[string(key)] = string(val)
+		return true
+	}))
+	return out
+}
+
+func TestWAL_Buffered(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	db, err := Open(path, WithMemtable(1<<20))
+	testify_assert.NoError(t, err)
+
+	// some keys in the tree, some in the memtable
+	ref := map[string]string{}
+	for i := 0; i < 20; i++ {
+		key, val := fmt.Sprintf("k%02d", i), fmt.Sprintf("v%d", i)
+		testify_assert.NoError(t, db.Set([]byte(key), []byte(val)))
+		ref[key] = val
+		if i == 9 {
+			testify_assert.NoError(t, db.Flush())
+		}
+	}
+	testify_assert.Equal(t, uint64(1), db.Stats().Commits)
+	testify_assert.NoError(t, db.Set([]byte("k03"), []byte("updated")))
+	ref["k03"] = "updated"
+	for _, key := range []string{"k04", "k15"} {
+		deleted, err := db.Del([]byte(key))
+		testify_assert.NoError(t, err)
+		testify_assert.True(t, deleted)
+		delete(ref, key)
+	}
+	deleted, err := db.Del([]byte("k04"))
+	testify_assert.NoError(t, err)
+	testify_assert.False(t, deleted)
+
+	val, ok, err := db.Get([]byte("k03"))
+	testify_assert.NoError(t, err)
+	testify_assert.True(t, ok)
+	testify_assert.Equal(t, "updated", string(val))
+	_, ok, _ = db.Get([]byte("k04"))
+	testify_assert.False(t, ok)
+	testify_assert.Equal(t, ref, walDump(t, db))
+	testify_assert.Equal(t, uint64(1), db.Stats().Commits)
+
+	// stop early in the memtable and in the tree
+	var keys []string
+	testify_assert.NoError(t, db.Scan([]byte("k02"), func(key, val []byte) bool {
+		keys = append(keys, string(key))
+		return len(keys) < 3
+	}))
+	testify_assert.Equal(t, []string{"k02", "k03", "k05"}, keys)
+
+	db.Close()
+	fi, err := os.Stat(walPath(db))
+	testify_assert.NoError(t, err)
+	testify_assert.Zero(t, fi.Size())
+
+	db, err = Open(path)
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.Equal(t, ref, walDump(t, db))
+}
+
+func TestWAL_Merge(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithMemtable(200))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("value")))
+	}
+	// 200 bytes is about 8 updates
+	testify_assert.Equal(t, uint64(2), db.Stats().Commits)
+	testify_assert.Len(t, walDump(t, db), 20)
+}
+
+func TestWAL_Checkpoint(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"),
+		WithMemtable(1<<20), WithWALMaxSize(200), WithCheckpointInterval(time.Hour))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%02d", i)), []byte("value")))
+		testify_assert.Less(t, db.Stats().WALBytes, uint64(200))
+	}
+	s := db.Stats()
+	testify_assert.NotZero(t, s.Checkpoints)
+	n := s.Checkpoints
+
+	// the next update after the interval
+	db.wal.checkpoint = time.Now().Add(-time.Hour)
+	testify_assert.NoError(t, db.Set([]byte("k"), []byte("v")))
+	s = db.Stats()
+	testify_assert.Equal(t, n+1, s.Checkpoints)
+	testify_assert.Zero(t, s.WALBytes)
+	testify_assert.Len(t, walDump(t, db), 21)
+}
+
+// the log of a crashed process is replayed.
+func TestWAL_Replay(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	db, err := Open(path, WithMemtable(1<<20))
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.NoError(t, db.Set([]byte("a"), []byte("1")))
+	testify_assert.NoError(t, db.Flush())
+	testify_assert.NoError(t, db.Set([]byte("b"), []byte("2")))
+	_, err = db.Del([]byte("a"))
+	testify_assert.NoError(t, err)
+
+	// copy the files as they are, with a torn record at the end
+	copyPath := filepath.Join(dir, "copy.db")
+	data, err := os.ReadFile(path)
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, os.WriteFile(copyPath, data, 0644))
+	data, err = os.ReadFile(walPath(db))
+	testify_assert.NoError(t, err)
+	data = append(data, lsmRecord(nil, lsmEntry{key: []byte("c"), val: []byte("3")})[:10]...)
+	testify_assert.NoError(t, os.WriteFile(copyPath+".wal", data, 0644))
+
+	// read-only, the log is not touched
+	ro, err := Open(copyPath, WithReadOnly())
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, map[string]string{"b": "2"}, walDump(t, ro))
+	ro.Close()
+
+	// not buffered, the log is merged on open
+	cp, err := Open(copyPath)
+	testify_assert.NoError(t, err)
+	defer cp.Close()
+	testify_assert.Equal(t, map[string]string{"b": "2"}, walDump(t, cp))
+	testify_assert.Nil(t, cp.wal.fp)
+	fi, err := os.Stat(copyPath + ".wal")
+	testify_assert.NoError(t, err)
+	testify_assert.Zero(t, fi.Size())
+}
+
+// the log of an encrypted DB is sealed too.
+func TestWAL_Encrypted(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	key := WithEncryptionKey([]byte("key"))
+	db, err := Open(path, WithMemtable(1<<20), key)
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.NoError(t, db.Set([]byte("secret-a"), []byte("secret-1")))
+	testify_assert.NoError(t, db.Set([]byte("secret-b"), []byte("secret-2")))
+	_, err = db.Del([]byte("secret-a"))
+	testify_assert.NoError(t, err)
+
+	// a crash before any checkpoint
+	copyPath := filepath.Join(dir, "copy.db")
+	data, err := os.ReadFile(path)
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, os.WriteFile(copyPath, data, 0644))
+	data, err = os.ReadFile(walPath(db))
+	testify_assert.NoError(t, err)
+	testify_assert.NotContains(t, string(data), "secret")
+	testify_assert.NoError(t, os.WriteFile(copyPath+".wal", data, 0644))
+
+	cp, err := Open(copyPath, key)
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, map[string]string{"secret-b": "secret-2"}, walDump(t, cp))
+	cp.Close()
+
+	// the records are bound to their offsets
+	var offs []int64
+	_, err = lsmReadRecords(bytes.NewReader(data), func(e lsmEntry, off int64) {
+		offs = append(offs, off)
+	})
+	testify_assert.NoError(t, err)
+	testify_assert.Len(t, offs, 3)
+	first, second := data[offs[0]:offs[1]], data[offs[1]:offs[2]]
+	data = append(append(append([]byte(nil), second...), first...), data[offs[2]:]...)
+	testify_assert.NoError(t, os.WriteFile(copyPath+".wal", data, 0644))
+	_, err = Open(copyPath, key)
+	testify_assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+// the sealed records are bound to the generation of the log, so an older
+// log can't be replayed once a checkpoint has emptied it.
+func TestWAL_Generation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	key := WithEncryptionKey([]byte("key"))
+	db, err := Open(path, WithMemtable(1<<20), key)
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	testify_assert.NoError(t, db.Set([]byte("a"), []byte("1")))
+	testify_assert.NoError(t, db.Set([]byte("b"), []byte("2")))
+	old, err := os.ReadFile(walPath(db))
+	testify_assert.NoError(t, err)
+	testify_assert.NoError(t, db.Flush())
+	testify_assert.NoError(t, db.Set([]byte("a"), []byte("3")))
+
+	copyPath := filepath.Join(dir, "copy.db")
+	crash := func(log []byte) (map[string]string, error) {
+		data, err := os.ReadFile(path)
+		testify_assert.NoError(t, err)
+		testify_assert.NoError(t, os.WriteFile(copyPath, data, 0644))
+		testify_assert.NoError(t, os.WriteFile(copyPath+".wal", log, 0644))
+		cp, err := Open(copyPath, key)
+		if err != nil {
+			return nil, err
+		}
+		defer cp.Close()
+		return walDump(t, cp), nil
+	}
+	cur, err := os.ReadFile(walPath(db))
+	testify_assert.NoError(t, err)
+	state, err := crash(cur)
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, map[string]string{"a": "3", "b": "2"}, state)
+
+	// the checkpoint crashed before emptying the log: it's skipped
+	state, err = crash(old)
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, map[string]string{"a": "1", "b": "2"}, state)
+
+	// a log from before the last checkpoint
+	testify_assert.NoError(t, db.Flush())
+	_, err = crash(old)
+	testify_assert.ErrorIs(t, err, ErrDecrypt)
+}
+
+// the updates leave the merges to the background, until they're too far
+// ahead of it.
+func TestWAL_StartFlush(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithMemtable(1000), WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	var mu sync.Mutex
+	stop := db.StartFlush(FlushOptions{Lock: &mu, Interval: time.Hour})
+	set := func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		testify_assert.NoError(t, db.Set([]byte(fmt.Sprintf("k%03d", i)), make([]byte, 50)))
+	}
+	i := 0
+	for ; db.wal.mem.size < db.MemtableSize; i++ {
+		set(i)
+	}
+	set(i)
+	i++
+	testify_assert.Zero(t, db.Stats().Checkpoints)
+	for ; db.Stats().Checkpoints == 0; i++ {
+		set(i)
+		testify_assert.Less(t, i, 100)
+	}
+	testify_assert.NoError(t, stop())
+
+	// merged by the goroutine
+	stop = db.StartFlush(FlushOptions{Lock: &mu, Interval: time.Millisecond})
+	for n := db.Stats().Checkpoints; ; i++ {
+		set(i)
+		mu.Lock()
+		merged := db.Stats().Checkpoints > n
+		mu.Unlock()
+		if merged {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	testify_assert.NoError(t, stop())
+	testify_assert.NoError(t, stop())
+	testify_assert.False(t, db.wal.background)
+	testify_assert.Len(t, walDump(t, db), i+1)
+	testify_assert.NoError(t, db.Verify())
+}
@@ -0,0 +1,134 @@
+package db
+
+import "sync"
+
+// the write transactions waiting for the writer goroutine
+const WRITER_QUEUE = 64
+
+// Writer is the single writer of a KV, which is not safe for concurrent
+// use: the write transactions submitted from any goroutine are queued
+// and run one at a time by its goroutine, each in its own commit.
+//
+// the reads don't wait for it, see View. it's the lock of the KV for the
+// other users, it can be given to DefragOptions.Lock.
+type Writer struct {
+	db    *KV
+	mu    sync.Mutex // held by a transaction, see Lock
+	queue chan writeRequest
+	// Submit holds it shared, Close exclusively to close the queue
+	closing sync.RWMutex
+	closed  bool
+	exited  chan struct{}
+}
+
+type writeRequest struct {
+	fn     func(tx *Tx) error
+	noSync bool
+	future *Future
+}
+
+// Future is the result of a submitted transaction.
+type Future struct {
+	done chan struct{}
+	err  error
+}
+
+// Done is closed once the transaction is committed or has failed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait returns the error of the transaction or of its commit.
+func (f *Future) Wait() error {
+	<-f.done
+	return f.err
+}
+
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// StartWriter starts the writer goroutine of the KV, until Close. the KV
+// must not be used directly after that.
+func (db *KV) StartWriter() *Writer {
+	w := &Writer{db: db, queue: make(chan writeRequest, WRITER_QUEUE), exited: make(chan struct{})}
+	go func() {
+		defer close(w.exited)
+		for req := range w.queue {
+			req.future.resolve(w.run(req))
+		}
+	}()
+	return w
+}
+
+func (w *Writer) run(req writeRequest) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	tx, err := w.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := req.fn(tx); err != nil {
+		return err
+	}
+	if req.noSync {
+		return tx.CommitNoSync()
+	}
+	return tx.Commit()
+}
+
+// Submit queues a transaction: fn makes its updates, it's committed
+// unless fn returns an error. it waits for room in the queue, not for
+// the commit.
+func (w *Writer) Submit(fn func(tx *Tx) error) *Future {
+	return w.submit(writeRequest{fn: fn})
+}
+
+// SubmitNoSync is Submit with Tx.CommitNoSync.
+func (w *Writer) SubmitNoSync(fn func(tx *Tx) error) *Future {
+	return w.submit(writeRequest{fn: fn, noSync: true})
+}
+
+func (w *Writer) submit(req writeRequest) *Future {
+	req.future = &Future{done: make(chan struct{})}
+	w.closing.RLock()
+	defer w.closing.RUnlock()
+	if w.closed {
+		req.future.resolve(ErrClosed)
+	} else {
+		w.queue <- req
+	}
+	return req.future
+}
+
+// Update submits a transaction and waits for its commit.
+func (w *Writer) Update(fn func(tx *Tx) error) error {
+	return w.Submit(fn).Wait()
+}
+
+// View calls fn with a read of the last commit, without waiting for the
+// transactions, see KV.BeginRead. the read is closed after that.
+func (w *Writer) View(fn func(r *ReadTx) error) error {
+	r := w.db.BeginRead()
+	defer r.Close()
+	return fn(r)
+}
+
+// Lock and Unlock make the Writer a sync.Locker for the other users of
+// the KV, like StartDefrag.
+func (w *Writer) Lock()   { w.mu.Lock() }
+func (w *Writer) Unlock() { w.mu.Unlock() }
+
+// Close runs the queued transactions and stops the goroutine, the
+// submissions after that fail with ErrClosed. the KV is not closed.
+func (w *Writer) Close() {
+	w.closing.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.closing.Unlock()
+	<-w.exited
+}
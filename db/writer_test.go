@@ -0,0 +1,64 @@
+package db
+
+import (
+	"encoding/binary"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	testify_assert "github.com/stretchr/testify/assert"
+)
+
+// the transactions of many goroutines are serialized, no increment is lost.
+func TestWriter(t *testing.T) {
+	db, err := Open(filepath.Join(t.TempDir(), "test.db"), WithNoSync())
+	testify_assert.NoError(t, err)
+	defer db.Close()
+	w := db.StartWriter()
+	incr := func(tx *Tx) error {
+		val, _, err := tx.Get([]byte("n"))
+		if err != nil {
+			return err
+		}
+		n := uint64(0)
+		if val != nil {
+			n = binary.LittleEndian.Uint64(val)
+		}
+		return tx.Set([]byte("n"), binary.LittleEndian.AppendUint64(nil, n+1))
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var futures []*Future
+			for i := 0; i < 50; i++ {
+				futures = append(futures, w.Submit(incr))
+				testify_assert.NoError(t, w.View(func(r *ReadTx) error {
+					_, _, err := r.Get([]byte("n"))
+					return err
+				}))
+			}
+			for _, f := range futures {
+				testify_assert.NoError(t, f.Wait())
+			}
+		}()
+	}
+	wg.Wait()
+
+	// a failed transaction is not committed
+	failed := errors.New("failed")
+	testify_assert.ErrorIs(t, w.Update(func(tx *Tx) error {
+		tx.Set([]byte("n"), nil)
+		return failed
+	}), failed)
+	f := w.SubmitNoSync(incr)
+	w.Close()
+	testify_assert.NoError(t, f.Wait())
+	testify_assert.ErrorIs(t, w.Update(incr), ErrClosed)
+
+	val, _, err := db.Get([]byte("n"))
+	testify_assert.NoError(t, err)
+	testify_assert.Equal(t, uint64(401), binary.LittleEndian.Uint64(val))
+}